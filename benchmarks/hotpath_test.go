@@ -0,0 +1,466 @@
+package benchmarks
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"ultraSQL/buffer"
+	"ultraSQL/kfile"
+	"ultraSQL/log"
+	"ultraSQL/transaction"
+)
+
+const (
+	blockSize = 4096
+	poolSize  = 64
+)
+
+func newFileMgr(b *testing.B, opts ...kfile.FileMgrOption) *kfile.FileMgr {
+	b.Helper()
+	fm, err := kfile.NewFileMgr(b.TempDir(), blockSize, opts...)
+	if err != nil {
+		b.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	b.Cleanup(func() { fm.Close() })
+	return fm
+}
+
+func appendBlocks(b *testing.B, fm *kfile.FileMgr, filename string, n int) {
+	b.Helper()
+	for i := 0; i < n; i++ {
+		if _, err := fm.Append(filename); err != nil {
+			b.Fatalf("Failed to append block: %v", err)
+		}
+	}
+}
+
+// record returns a log-record-sized payload, similar to a cell insert record.
+func record(i int) []byte {
+	return []byte(fmt.Sprintf("insert txnum=%08d blk=[data.db, %04d] key=customer:%08d value=%032d", i, i%512, i, i))
+}
+
+func BenchmarkPinHit(b *testing.B) {
+	fm := newFileMgr(b)
+	appendBlocks(b, fm, "data.db", poolSize/2)
+	bm := buffer.NewBufferMgr(fm, poolSize, buffer.InitClock(poolSize, fm))
+	blocks := make([]*kfile.BlockId, poolSize/2)
+	for i := range blocks {
+		blocks[i] = kfile.NewBlockId("data.db", int32(i))
+		buff, err := bm.Pin(blocks[i])
+		if err != nil {
+			b.Fatalf("Failed to warm pool: %v", err)
+		}
+		bm.Unpin(buff)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buff, err := bm.Pin(blocks[i%len(blocks)])
+		if err != nil {
+			b.Fatalf("Pin failed: %v", err)
+		}
+		bm.Unpin(buff)
+	}
+}
+
+func BenchmarkPinMiss(b *testing.B) {
+	const fileBlocks = 1024
+	fm := newFileMgr(b)
+	appendBlocks(b, fm, "data.db", fileBlocks)
+
+	// Each pass over the file uses a fresh pool, so every Pin reads from disk.
+	var bm *buffer.BufferMgr
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%fileBlocks == 0 {
+			b.StopTimer()
+			bm = buffer.NewBufferMgr(fm, fileBlocks, buffer.InitClock(fileBlocks, fm))
+			b.StartTimer()
+		}
+		buff, err := bm.Pin(kfile.NewBlockId("data.db", int32(i%fileBlocks)))
+		if err != nil {
+			b.Fatalf("Pin failed: %v", err)
+		}
+		bm.Unpin(buff)
+	}
+}
+
+func BenchmarkLogAppend(b *testing.B) {
+	fm := newFileMgr(b)
+	bm := buffer.NewBufferMgr(fm, poolSize, buffer.InitClock(poolSize, fm))
+	lm, err := log.NewLogMgr(fm, bm, "bench.log")
+	if err != nil {
+		b.Fatalf("Failed to create LogMgr: %v", err)
+	}
+	recs := make([][]byte, 256)
+	for i := range recs {
+		recs[i] = record(i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := lm.Append(recs[i%len(recs)]); err != nil {
+			b.Fatalf("Append failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkInsertCell(b *testing.B) {
+	keys := make([][]byte, 48)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("customer:%08d", (i*7919)%1000))
+	}
+	page := kfile.NewSlottedPage(blockSize)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Refill a fresh page once the current one has taken a page's worth.
+		if i%len(keys) == 0 {
+			b.StopTimer()
+			page = kfile.NewSlottedPage(blockSize)
+			b.StartTimer()
+		}
+		cell := kfile.NewKVCell(keys[i%len(keys)])
+		if err := cell.SetValue("customer_name=ada;account_status=active"); err != nil {
+			b.Fatalf("SetValue failed: %v", err)
+		}
+		if err := page.InsertCell(cell); err != nil {
+			b.Fatalf("InsertCell failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkFindCell(b *testing.B) {
+	page := kfile.NewSlottedPage(blockSize)
+	var keys [][]byte
+	for i := 0; ; i++ {
+		key := []byte(fmt.Sprintf("customer:%08d", i))
+		cell := kfile.NewKVCell(key)
+		if err := cell.SetValue("customer_name=ada;account_status=active"); err != nil {
+			b.Fatalf("SetValue failed: %v", err)
+		}
+		if !page.HasRoomFor(cell) {
+			break
+		}
+		if err := page.InsertCell(cell); err != nil {
+			b.Fatalf("InsertCell failed: %v", err)
+		}
+		keys = append(keys, key)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := page.FindCell(keys[(i*31)%len(keys)]); err != nil {
+			b.Fatalf("FindCell failed: %v", err)
+		}
+	}
+}
+
+// largeValuePage fills most of a page so the copy in GetBytes dominates.
+func largeValuePage(b *testing.B) *kfile.Page {
+	b.Helper()
+	page := kfile.NewPage(blockSize)
+	if err := page.SetBytes(0, make([]byte, blockSize-4)); err != nil {
+		b.Fatalf("SetBytes failed: %v", err)
+	}
+	return page
+}
+
+func BenchmarkGetBytes(b *testing.B) {
+	page := largeValuePage(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := page.GetBytes(0); err != nil {
+			b.Fatalf("GetBytes failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkGetBytesView(b *testing.B) {
+	page := largeValuePage(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := page.GetBytesView(0); err != nil {
+			b.Fatalf("GetBytesView failed: %v", err)
+		}
+	}
+}
+
+func newTxStack(b *testing.B) (*kfile.FileMgr, *log.LogMgr, *buffer.BufferMgr) {
+	b.Helper()
+	fm := newFileMgr(b)
+	bm := buffer.NewBufferMgr(fm, poolSize, buffer.InitLRU(poolSize, fm))
+	lm, err := log.NewLogMgr(fm, bm, "bench.log")
+	if err != nil {
+		b.Fatalf("Failed to create LogMgr: %v", err)
+	}
+	return fm, lm, bm
+}
+
+// BenchmarkSmallTransactions commits one single-insert transaction per
+// iteration, each flushing its pages and the log.
+func BenchmarkSmallTransactions(b *testing.B) {
+	fm, lm, bm := newTxStack(b)
+	txm := transaction.NewTxMgr(fm, lm, bm)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tx := txm.NewTransaction()
+		if _, err := tx.Insert("data.db", []byte(fmt.Sprintf("customer:%08d", i)), i, true); err != nil {
+			b.Fatalf("Insert failed: %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			b.Fatalf("Commit failed: %v", err)
+		}
+	}
+}
+
+// BenchmarkSmallTransactionsCombined runs the same transactions through a
+// write-combining Batch that flushes once per 32 commits.
+func BenchmarkSmallTransactionsCombined(b *testing.B) {
+	fm, lm, bm := newTxStack(b)
+	batch := transaction.NewBatch(transaction.NewTxMgr(fm, lm, bm), 32)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := batch.Run(func(tx *transaction.Mgr) error {
+			_, err := tx.Insert("data.db", []byte(fmt.Sprintf("customer:%08d", i)), i, true)
+			return err
+		})
+		if err != nil {
+			b.Fatalf("Run failed: %v", err)
+		}
+	}
+	if err := batch.Flush(); err != nil {
+		b.Fatalf("Flush failed: %v", err)
+	}
+}
+
+// BenchmarkTwoFileReadWrite has half the goroutines writing blocks of one
+// file while the other half read blocks of another, so it measures how much
+// work on one file holds up the other.
+func BenchmarkTwoFileReadWrite(b *testing.B) {
+	const fileBlocks = 64
+	fm := newFileMgr(b)
+	appendBlocks(b, fm, "users.dat", fileBlocks)
+	appendBlocks(b, fm, "orders.dat", fileBlocks)
+
+	var workers atomic.Int32
+	b.SetParallelism(2)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		writer := workers.Add(1)%2 == 0
+		page := kfile.NewSlottedPage(blockSize)
+		for i := 0; pb.Next(); i++ {
+			var err error
+			if writer {
+				err = fm.Write(kfile.NewBlockId("users.dat", int32(i%fileBlocks)), page)
+			} else {
+				err = fm.Read(kfile.NewBlockId("orders.dat", int32(i%fileBlocks)), page)
+			}
+			if err != nil {
+				b.Errorf("block I/O failed: %v", err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkCellBytes serializes a cell with a 16-byte key using fixed
+// 4-byte sizes and varint sizes, reporting the encoded size of each.
+func BenchmarkCellBytes(b *testing.B) {
+	for _, bc := range []struct {
+		name   string
+		varint bool
+	}{{"Fixed", false}, {"Varint", true}} {
+		b.Run(bc.name, func(b *testing.B) {
+			cell := kfile.NewKVCell([]byte("customer:0000042"))
+			if err := cell.SetValue("value 42"); err != nil {
+				b.Fatalf("SetValue failed: %v", err)
+			}
+			if bc.varint {
+				cell.UseVarintSizes()
+			}
+			var n int
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				n = len(cell.ToBytes())
+			}
+			b.ReportMetric(float64(n), "bytes/cell")
+		})
+	}
+}
+
+// BenchmarkWriteSyncPolicy bulk-writes blocks under each sync policy. The
+// dirty files are synced once at the end, inside the timed region, so each
+// mode pays for the durability it defers.
+func BenchmarkWriteSyncPolicy(b *testing.B) {
+	const fileBlocks = 64
+	for _, policy := range []kfile.SyncPolicy{kfile.SyncEveryWrite, kfile.SyncOnInterval, kfile.SyncOnClose} {
+		b.Run(policy.String(), func(b *testing.B) {
+			fm := newFileMgr(b, kfile.WithSyncPolicy(policy))
+			appendBlocks(b, fm, "bulk.dat", fileBlocks)
+			page := kfile.NewSlottedPage(blockSize)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := fm.Write(kfile.NewBlockId("bulk.dat", int32(i%fileBlocks)), page); err != nil {
+					b.Fatalf("Write failed: %v", err)
+				}
+			}
+			if err := fm.SyncAll(); err != nil {
+				b.Fatalf("SyncAll failed: %v", err)
+			}
+		})
+	}
+}
+
+// BenchmarkWriteBlocks flushes 64 adjacent dirty blocks either as 64 Writes,
+// each synced on its own, or as one WriteBlocks call with a single sync.
+func BenchmarkWriteBlocks(b *testing.B) {
+	const batchBlocks = 64
+	for _, batched := range []bool{false, true} {
+		name := "Individual"
+		if batched {
+			name = "Batched"
+		}
+		b.Run(name, func(b *testing.B) {
+			fm := newFileMgr(b)
+			appendBlocks(b, fm, "flush.dat", batchBlocks)
+			batch := make([]kfile.BlockWrite, batchBlocks)
+			for i := range batch {
+				batch[i] = kfile.BlockWrite{Blk: kfile.NewBlockId("flush.dat", int32(i)), Page: kfile.NewSlottedPage(blockSize)}
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if batched {
+					if err := fm.WriteBlocks(batch); err != nil {
+						b.Fatalf("WriteBlocks failed: %v", err)
+					}
+					continue
+				}
+				for _, w := range batch {
+					if err := fm.Write(w.Blk, w.Page); err != nil {
+						b.Fatalf("Write failed: %v", err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRead reads random blocks of a file that fits in the page cache,
+// through a read syscall per block or by copying from a memory mapping.
+func BenchmarkRead(b *testing.B) {
+	const fileBlocks = 256
+	for _, mode := range []struct {
+		name string
+		opts []kfile.FileMgrOption
+	}{
+		{"Syscall", nil},
+		{"Mmap", []kfile.FileMgrOption{kfile.EnableMmap()}},
+	} {
+		b.Run(mode.name, func(b *testing.B) {
+			fm := newFileMgr(b, mode.opts...)
+			appendBlocks(b, fm, "data.db", fileBlocks)
+			page := kfile.NewSlottedPage(blockSize)
+			blocks := make([]*kfile.BlockId, fileBlocks)
+			for i := range blocks {
+				blocks[i] = kfile.NewBlockId("data.db", int32(i*97%fileBlocks))
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := fm.Read(blocks[i%fileBlocks], page); err != nil {
+					b.Fatalf("Read failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkAppendN grows a file by 64 blocks either as 64 Appends, each
+// synced on its own, or as one AppendN call with a single sync.
+func BenchmarkAppendN(b *testing.B) {
+	const batchBlocks = 64
+	for _, batched := range []bool{false, true} {
+		name := "Loop"
+		if batched {
+			name = "Batched"
+		}
+		b.Run(name, func(b *testing.B) {
+			fm := newFileMgr(b)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				filename := fmt.Sprintf("bulk%d.dat", i%16)
+				if i%16 == 0 && i > 0 {
+					b.StopTimer()
+					for j := 0; j < 16; j++ {
+						if err := fm.Truncate(fmt.Sprintf("bulk%d.dat", j), 0); err != nil {
+							b.Fatalf("Truncate failed: %v", err)
+						}
+					}
+					b.StartTimer()
+				}
+				if batched {
+					if _, err := fm.AppendN(filename, batchBlocks); err != nil {
+						b.Fatalf("AppendN failed: %v", err)
+					}
+					continue
+				}
+				for j := 0; j < batchBlocks; j++ {
+					if _, err := fm.Append(filename); err != nil {
+						b.Fatalf("Append failed: %v", err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkBuildPage fills a page from key-sorted cells, as when building a
+// B-tree node, either one InsertCell at a time or with one BulkInsert.
+func BenchmarkBuildPage(b *testing.B) {
+	const pageCells = 72
+	cells := make([]*kfile.Cell, pageCells)
+	for i := range cells {
+		cells[i] = kfile.NewKVCell([]byte(fmt.Sprintf("customer:%08d", i)))
+		if err := cells[i].SetValue("account_status=active"); err != nil {
+			b.Fatalf("SetValue failed: %v", err)
+		}
+	}
+	for _, bulk := range []bool{false, true} {
+		name := "InsertCell"
+		if bulk {
+			name = "BulkInsert"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				page := kfile.NewSlottedPage(blockSize)
+				if bulk {
+					if err := page.BulkInsert(cells); err != nil {
+						b.Fatalf("BulkInsert failed: %v", err)
+					}
+					continue
+				}
+				for _, cell := range cells {
+					if err := page.InsertCell(cell); err != nil {
+						b.Fatalf("InsertCell failed: %v", err)
+					}
+				}
+			}
+		})
+	}
+}
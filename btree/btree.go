@@ -0,0 +1,435 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"ultraSQL/buffer"
+	"ultraSQL/kfile"
+)
+
+// BTree is a B+tree index over the blocks of one file, read and written
+// through a BufferMgr. Every node is a slotted page: leaves hold KV cells,
+// one per entry, and internal nodes hold key cells, one per child, each
+// naming the child block and a key no greater than any stored under it. A
+// search follows, in each internal node, the last cell whose key is at most
+// the one sought, or the first cell if there is none.
+//
+// The root always lives in block 0. A full node is split in two by bytes,
+// the upper half moving to a block taken with FileMgr.Append and its first
+// key being pushed up to the parent; a full root moves both halves to new
+// blocks and becomes their parent, so the tree grows at the top and every
+// leaf stays at the same depth. Delete removes entries from leaves without
+// merging nodes, whose space is reused by later inserts.
+//
+// Modified nodes stay in the buffer pool, which writes them back when it
+// evicts them; Flush writes them all.
+type BTree struct {
+	mu       sync.RWMutex
+	fm       *kfile.FileMgr
+	bm       *buffer.BufferMgr
+	filename string
+	maxEntry int            // largest cell, with its slot overhead, a node takes
+	dirty    map[int32]bool // blocks modified since the last Flush
+}
+
+// rootBlock is the block of the root node.
+const rootBlock = 0
+
+// slotOverhead is what a cell takes in a page on top of its own bytes: its
+// length prefix and its slot directory entry.
+const slotOverhead = 8
+
+// ErrEntryTooLarge is returned by Insert for a key and value that would
+// take more than a quarter of a node, which splitting could not make room
+// for.
+var ErrEntryTooLarge = errors.New("btree: entry too large for a node")
+
+// promotion is the key and block of the new right half of a split node,
+// for its parent to point to.
+type promotion struct {
+	key   []byte
+	block int32
+}
+
+// New opens the B-tree kept in filename, creating an empty one, a single
+// empty leaf, if the file has no blocks.
+func New(fm *kfile.FileMgr, bm *buffer.BufferMgr, filename string) (*BTree, error) {
+	if fm == nil || bm == nil {
+		return nil, fmt.Errorf("btree: file and buffer managers cannot be nil")
+	}
+	t := &BTree{
+		fm:       fm,
+		bm:       bm,
+		filename: filename,
+		maxEntry: (fm.BlockSize() - kfile.PageHeaderSize) / 4,
+		dirty:    make(map[int32]bool),
+	}
+	length, err := fm.Length(filename)
+	if err != nil {
+		return nil, fmt.Errorf("btree: failed to get length of %s: %w", filename, err)
+	}
+	if length == 0 {
+		if _, err := fm.Append(filename); err != nil {
+			return nil, fmt.Errorf("btree: failed to create root of %s: %w", filename, err)
+		}
+	}
+	return t, nil
+}
+
+// Search returns the value stored under key, or an error wrapping
+// kfile.ErrKeyNotFound if there is none.
+func (t *BTree) Search(key []byte) ([]byte, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	buff, err := t.findLeaf(key)
+	if err != nil {
+		return nil, err
+	}
+	defer t.bm.Unpin(buff)
+	cell, _, err := buff.Contents().FindCell(key)
+	if err != nil {
+		return nil, fmt.Errorf("btree: search for %q: %w", key, err)
+	}
+	return cellValue(cell)
+}
+
+// Insert stores value under key, replacing any value already there.
+func (t *BTree) Insert(key, value []byte) error {
+	if len(key) == 0 {
+		return kfile.ErrEmptyKey
+	}
+	cell := kfile.NewKVCell(key)
+	if err := cell.SetValue(value); err != nil {
+		return fmt.Errorf("btree: failed to set value for %q: %w", key, err)
+	}
+	// The key may also be pushed up into an internal node.
+	size := max(len(cell.ToBytes()), len(kfile.NewKeyCell(key, 0).ToBytes())) + slotOverhead
+	if size > t.maxEntry {
+		return fmt.Errorf("%w: %d bytes for key %q, at most %d", ErrEntryTooLarge, size, key, t.maxEntry)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, err := t.insert(rootBlock, cell)
+	return err
+}
+
+// Delete removes key and its value, or returns an error wrapping
+// kfile.ErrKeyNotFound if there is none.
+func (t *BTree) Delete(key []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	buff, err := t.findLeaf(key)
+	if err != nil {
+		return err
+	}
+	defer t.bm.Unpin(buff)
+	_, slot, err := buff.Contents().FindCell(key)
+	if err != nil {
+		return fmt.Errorf("btree: delete of %q: %w", key, err)
+	}
+	if err := buff.Contents().DeleteCell(slot); err != nil {
+		return fmt.Errorf("btree: delete of %q: %w", key, err)
+	}
+	t.markDirty(buff)
+	return nil
+}
+
+// ForEach calls fn with every key and value in key order, until fn returns
+// false.
+func (t *BTree) ForEach(fn func(key, value []byte) bool) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	_, err := t.forEach(rootBlock, fn)
+	return err
+}
+
+// Flush writes every node modified since the last Flush to disk.
+func (t *BTree) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, n := range slices.Sorted(func(yield func(int32) bool) {
+		for n := range t.dirty {
+			if !yield(n) {
+				return
+			}
+		}
+	}) {
+		buff, err := t.pin(n)
+		if err != nil {
+			return err
+		}
+		err = buff.Flush()
+		t.bm.Unpin(buff)
+		if err != nil {
+			return fmt.Errorf("btree: failed to flush block %d of %s: %w", n, t.filename, err)
+		}
+		delete(t.dirty, n)
+	}
+	return nil
+}
+
+// forEach visits the entries under block n in key order, reporting whether
+// fn asked to go on.
+func (t *BTree) forEach(n int32, fn func(key, value []byte) bool) (bool, error) {
+	buff, err := t.pin(n)
+	if err != nil {
+		return false, err
+	}
+	defer t.bm.Unpin(buff)
+	leaf := isLeaf(buff.Contents())
+	for it := buff.Contents().CellIterator(); it.HasNext(); {
+		cell, err := it.Next()
+		if err != nil {
+			return false, fmt.Errorf("btree: block %d of %s: %w", n, t.filename, err)
+		}
+		more := true
+		if leaf {
+			value, err := cellValue(cell)
+			if err != nil {
+				return false, err
+			}
+			more = fn(cell.GetKey(), value)
+		} else if more, err = t.forEach(int32(cell.GetPageId()), fn); err != nil {
+			return false, err
+		}
+		if !more {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// findLeaf returns the pinned leaf that holds key if any node does.
+func (t *BTree) findLeaf(key []byte) (*buffer.Buffer, error) {
+	n := int32(rootBlock)
+	for {
+		buff, err := t.pin(n)
+		if err != nil {
+			return nil, err
+		}
+		page := buff.Contents()
+		if isLeaf(page) {
+			return buff, nil
+		}
+		n, err = childFor(page, key)
+		t.bm.Unpin(buff)
+		if err != nil {
+			return nil, fmt.Errorf("btree: block %d of %s: %w", buff.Block().Number(), t.filename, err)
+		}
+	}
+}
+
+// insert adds cell to the subtree under block n, returning the new right
+// half if n had to be split.
+func (t *BTree) insert(n int32, cell *kfile.Cell) (*promotion, error) {
+	buff, err := t.pin(n)
+	if err != nil {
+		return nil, err
+	}
+	defer t.bm.Unpin(buff)
+	page := buff.Contents()
+	key := cell.GetKey()
+
+	if isLeaf(page) {
+		if _, slot, err := page.FindCell(key); err == nil {
+			if err := page.DeleteCell(slot); err != nil {
+				return nil, fmt.Errorf("btree: failed to replace %q: %w", key, err)
+			}
+			t.markDirty(buff)
+		}
+		err := page.InsertCell(cell)
+		if err == nil {
+			t.markDirty(buff)
+			return nil, nil
+		}
+		if !errors.Is(err, kfile.ErrPageFull) {
+			return nil, fmt.Errorf("btree: failed to insert %q: %w", key, err)
+		}
+		cells, err := page.ExportCells()
+		if err != nil {
+			return nil, fmt.Errorf("btree: block %d of %s: %w", n, t.filename, err)
+		}
+		return t.store(buff, insertSorted(cells, cell))
+	}
+
+	child, err := childFor(page, key)
+	if err != nil {
+		return nil, fmt.Errorf("btree: block %d of %s: %w", n, t.filename, err)
+	}
+	split, err := t.insert(child, cell)
+	if err != nil {
+		return nil, err
+	}
+	cells, err := page.ExportCells()
+	if err != nil {
+		return nil, fmt.Errorf("btree: block %d of %s: %w", n, t.filename, err)
+	}
+	// Every key under a child is at least the child's key, which a key
+	// below the first one must lower; a promoted key then always lies
+	// strictly between its neighbours.
+	lower := bytes.Compare(key, cells[0].GetKey()) < 0
+	if split == nil && !lower {
+		return nil, nil
+	}
+	if lower {
+		cells[0] = kfile.NewKeyCell(key, cells[0].GetPageId())
+	}
+	if split != nil {
+		cells = insertSorted(cells, kfile.NewKeyCell(split.key, uint64(split.block)))
+	}
+	return t.store(buff, cells)
+}
+
+// insertSorted adds cell to cells, which are in key order, in its place.
+func insertSorted(cells []*kfile.Cell, cell *kfile.Cell) []*kfile.Cell {
+	at, _ := slices.BinarySearchFunc(cells, cell.GetKey(), func(c *kfile.Cell, key []byte) int {
+		return bytes.Compare(c.GetKey(), key)
+	})
+	return slices.Insert(cells, at, cell)
+}
+
+// store replaces the node in buff with one holding cells, which are in key
+// order, splitting it in two if they do not fit in one block.
+func (t *BTree) store(buff *buffer.Buffer, cells []*kfile.Cell) (*promotion, error) {
+	page := buff.Contents()
+	if node, err := t.newNode(cells); err == nil {
+		copy(page.Contents(), node.Contents())
+		t.markDirty(buff)
+		return nil, nil
+	} else if !errors.Is(err, kfile.ErrPageFull) {
+		return nil, err
+	}
+
+	mid := splitPoint(cells)
+	left, err := t.newNode(cells[:mid])
+	if err != nil {
+		return nil, err
+	}
+	right, err := t.newNode(cells[mid:])
+	if err != nil {
+		return nil, err
+	}
+	rightBlk, err := t.appendNode(right)
+	if err != nil {
+		return nil, err
+	}
+
+	if buff.Block().Number() != rootBlock {
+		copy(page.Contents(), left.Contents())
+		t.markDirty(buff)
+		return &promotion{key: cells[mid].GetKey(), block: rightBlk}, nil
+	}
+	// The root stays in block 0: its halves move out and it becomes their
+	// parent.
+	leftBlk, err := t.appendNode(left)
+	if err != nil {
+		return nil, err
+	}
+	root, err := t.newNode([]*kfile.Cell{
+		kfile.NewKeyCell(cells[0].GetKey(), uint64(leftBlk)),
+		kfile.NewKeyCell(cells[mid].GetKey(), uint64(rightBlk)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	copy(page.Contents(), root.Contents())
+	t.markDirty(buff)
+	return nil, nil
+}
+
+// splitPoint returns where to split cells so that each half takes about
+// half of their bytes, leaving at least one cell on either side.
+func splitPoint(cells []*kfile.Cell) int {
+	total := 0
+	for _, c := range cells {
+		total += len(c.ToBytes()) + slotOverhead
+	}
+	acc := 0
+	for i, c := range cells {
+		acc += len(c.ToBytes()) + slotOverhead
+		if acc >= total/2 {
+			return min(max(i+1, 1), len(cells)-1)
+		}
+	}
+	return len(cells) - 1
+}
+
+// newNode returns a page holding cells, which are in key order.
+func (t *BTree) newNode(cells []*kfile.Cell) (*kfile.SlottedPage, error) {
+	page := kfile.NewSlottedPage(t.fm.BlockSize())
+	if err := page.BulkInsert(cells); err != nil {
+		return nil, fmt.Errorf("btree: failed to build node: %w", err)
+	}
+	return page, nil
+}
+
+// appendNode adds a block to the file holding page and returns its number.
+func (t *BTree) appendNode(page *kfile.SlottedPage) (int32, error) {
+	blk, err := t.fm.Append(t.filename)
+	if err != nil {
+		return 0, fmt.Errorf("btree: failed to allocate node in %s: %w", t.filename, err)
+	}
+	buff, err := t.pin(blk.Number())
+	if err != nil {
+		return 0, err
+	}
+	defer t.bm.Unpin(buff)
+	copy(buff.Contents().Contents(), page.Contents())
+	t.markDirty(buff)
+	return blk.Number(), nil
+}
+
+// pin pins block n of the tree's file.
+func (t *BTree) pin(n int32) (*buffer.Buffer, error) {
+	buff, err := t.bm.Pin(kfile.NewBlockId(t.filename, n))
+	if err != nil {
+		return nil, fmt.Errorf("btree: failed to pin block %d of %s: %w", n, t.filename, err)
+	}
+	return buff, nil
+}
+
+// markDirty records that the node in buff was modified.
+func (t *BTree) markDirty(buff *buffer.Buffer) {
+	buff.MarkModified(-1, -1)
+	t.dirty[buff.Block().Number()] = true
+}
+
+// isLeaf reports whether page is a leaf. Internal nodes are never empty,
+// since entries are only ever deleted from leaves.
+func isLeaf(page *kfile.SlottedPage) bool {
+	cell, err := page.GetCellBySlot(0)
+	return err != nil || cell.GetType() == kfile.CellTypeKV
+}
+
+// childFor returns the child of an internal node to follow for key.
+func childFor(page *kfile.SlottedPage, key []byte) (int32, error) {
+	slot := page.FindSlotPosition(key)
+	if cell, err := page.GetCellBySlot(slot); err != nil || !bytes.Equal(cell.GetKey(), key) {
+		slot = max(slot-1, 0)
+	}
+	cell, err := page.GetCellBySlot(slot)
+	if err != nil {
+		return 0, err
+	}
+	return int32(cell.GetPageId()), nil
+}
+
+// cellValue returns the value of a leaf cell.
+func cellValue(cell *kfile.Cell) ([]byte, error) {
+	v, err := cell.GetValue()
+	if err != nil {
+		return nil, fmt.Errorf("btree: bad value for %q: %w", cell.GetKey(), err)
+	}
+	value, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("btree: value for %q is %T, not []byte", cell.GetKey(), v)
+	}
+	return value, nil
+}
@@ -0,0 +1,231 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"ultraSQL/buffer"
+	"ultraSQL/kfile"
+)
+
+const testFile = "index.bt"
+
+func newTestTree(t *testing.T, dir string) (*BTree, *kfile.FileMgr) {
+	t.Helper()
+	fm, err := kfile.NewFileMgr(dir, 512)
+	require.NoError(t, err)
+	bm := buffer.NewBufferMgr(fm, 8, buffer.InitLRU(8, fm))
+	tree, err := New(fm, bm, testFile)
+	require.NoError(t, err)
+	return tree, fm
+}
+
+func testKey(i int) []byte   { return []byte(fmt.Sprintf("key-%05d", i)) }
+func testValue(i int) []byte { return []byte(fmt.Sprintf("value-%d", i)) }
+
+// checkStructure verifies that every key under a node lies within the
+// bounds its parent gives it and that every leaf is at the same depth.
+func checkStructure(t *testing.T, tree *BTree) (depth int) {
+	t.Helper()
+	leafDepth := -1
+	var walk func(n int32, low, high []byte, d int)
+	walk = func(n int32, low, high []byte, d int) {
+		buff, err := tree.pin(n)
+		require.NoError(t, err)
+		page := buff.Contents()
+		cells, err := page.ExportCells()
+		require.NoError(t, err)
+		leaf := isLeaf(page)
+		tree.bm.Unpin(buff)
+
+		for i, c := range cells {
+			if low != nil {
+				assert.GreaterOrEqual(t, bytes.Compare(c.GetKey(), low), 0, "block %d key %q below %q", n, c.GetKey(), low)
+			}
+			if high != nil {
+				assert.Less(t, bytes.Compare(c.GetKey(), high), 0, "block %d key %q not below %q", n, c.GetKey(), high)
+			}
+			if leaf {
+				assert.Equal(t, byte(kfile.CellTypeKV), c.GetType())
+				continue
+			}
+			require.Equal(t, byte(kfile.CellTypeKey), c.GetType())
+			childLow := c.GetKey()
+			if i == 0 {
+				childLow = low
+			}
+			childHigh := high
+			if i+1 < len(cells) {
+				childHigh = cells[i+1].GetKey()
+			}
+			walk(int32(c.GetPageId()), childLow, childHigh, d+1)
+		}
+		if leaf {
+			if leafDepth < 0 {
+				leafDepth = d
+			}
+			assert.Equal(t, leafDepth, d, "leaf %d at depth %d", n, d)
+		}
+	}
+	walk(rootBlock, nil, nil, 0)
+	return leafDepth
+}
+
+func TestBTree(t *testing.T) {
+	const n = 1000
+
+	t.Run("InsertAndSearch", func(t *testing.T) {
+		tree, fm := newTestTree(t, t.TempDir())
+		defer fm.Close()
+
+		for _, i := range rand.New(rand.NewSource(1)).Perm(n) {
+			require.NoError(t, tree.Insert(testKey(i), testValue(i)))
+		}
+		for i := 0; i < n; i++ {
+			v, err := tree.Search(testKey(i))
+			require.NoError(t, err, "key %d", i)
+			assert.Equal(t, testValue(i), v)
+		}
+		_, err := tree.Search([]byte("missing"))
+		assert.ErrorIs(t, err, kfile.ErrKeyNotFound)
+
+		length, err := fm.Length(testFile)
+		require.NoError(t, err)
+		assert.Greater(t, length, int32(1), "1000 entries should have split the root")
+		assert.GreaterOrEqual(t, checkStructure(t, tree), 2, "tree should have split internal nodes too")
+	})
+
+	t.Run("InOrder", func(t *testing.T) {
+		tree, fm := newTestTree(t, t.TempDir())
+		defer fm.Close()
+
+		for _, i := range rand.New(rand.NewSource(2)).Perm(n) {
+			require.NoError(t, tree.Insert(testKey(i), testValue(i)))
+		}
+		i := 0
+		require.NoError(t, tree.ForEach(func(key, value []byte) bool {
+			assert.Equal(t, testKey(i), key)
+			assert.Equal(t, testValue(i), value)
+			i++
+			return true
+		}))
+		assert.Equal(t, n, i)
+
+		seen := 0
+		require.NoError(t, tree.ForEach(func(key, value []byte) bool {
+			seen++
+			return seen < 10
+		}))
+		assert.Equal(t, 10, seen, "ForEach should stop when fn returns false")
+	})
+
+	t.Run("SequentialInserts", func(t *testing.T) {
+		tree, fm := newTestTree(t, t.TempDir())
+		defer fm.Close()
+
+		for i := n - 1; i >= 0; i-- {
+			require.NoError(t, tree.Insert(testKey(i), testValue(i)))
+		}
+		for i := 0; i < n; i++ {
+			v, err := tree.Search(testKey(i))
+			require.NoError(t, err, "key %d", i)
+			assert.Equal(t, testValue(i), v)
+		}
+		checkStructure(t, tree)
+	})
+
+	t.Run("Overwrite", func(t *testing.T) {
+		tree, fm := newTestTree(t, t.TempDir())
+		defer fm.Close()
+
+		for i := 0; i < n; i++ {
+			require.NoError(t, tree.Insert(testKey(i), testValue(i)))
+		}
+		for i := 0; i < n; i += 3 {
+			require.NoError(t, tree.Insert(testKey(i), testValue(-i)))
+		}
+		count := 0
+		require.NoError(t, tree.ForEach(func(key, value []byte) bool {
+			count++
+			return true
+		}))
+		assert.Equal(t, n, count, "overwriting should not add entries")
+		for i := 0; i < n; i++ {
+			want := testValue(i)
+			if i%3 == 0 {
+				want = testValue(-i)
+			}
+			v, err := tree.Search(testKey(i))
+			require.NoError(t, err)
+			assert.Equal(t, want, v)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		tree, fm := newTestTree(t, t.TempDir())
+		defer fm.Close()
+
+		for i := 0; i < n; i++ {
+			require.NoError(t, tree.Insert(testKey(i), testValue(i)))
+		}
+		for i := 0; i < n; i += 2 {
+			require.NoError(t, tree.Delete(testKey(i)))
+		}
+		assert.ErrorIs(t, tree.Delete(testKey(0)), kfile.ErrKeyNotFound)
+		for i := 0; i < n; i++ {
+			v, err := tree.Search(testKey(i))
+			if i%2 == 0 {
+				assert.ErrorIs(t, err, kfile.ErrKeyNotFound, "key %d", i)
+				continue
+			}
+			require.NoError(t, err, "key %d", i)
+			assert.Equal(t, testValue(i), v)
+		}
+		// The space freed is reused.
+		for i := 0; i < n; i += 2 {
+			require.NoError(t, tree.Insert(testKey(i), testValue(i)))
+		}
+		i := 0
+		require.NoError(t, tree.ForEach(func(key, value []byte) bool {
+			assert.Equal(t, testKey(i), key)
+			i++
+			return true
+		}))
+		assert.Equal(t, n, i)
+		checkStructure(t, tree)
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		dir := t.TempDir()
+		tree, fm := newTestTree(t, dir)
+		for i := 0; i < n; i++ {
+			require.NoError(t, tree.Insert(testKey(i), testValue(i)))
+		}
+		require.NoError(t, tree.Flush())
+		require.NoError(t, fm.Close())
+
+		tree, fm = newTestTree(t, dir)
+		defer fm.Close()
+		for i := 0; i < n; i++ {
+			v, err := tree.Search(testKey(i))
+			require.NoError(t, err, "key %d", i)
+			assert.Equal(t, testValue(i), v)
+		}
+	})
+
+	t.Run("InvalidEntries", func(t *testing.T) {
+		tree, fm := newTestTree(t, t.TempDir())
+		defer fm.Close()
+
+		assert.ErrorIs(t, tree.Insert(nil, []byte("v")), kfile.ErrEmptyKey)
+		err := tree.Insert([]byte("big"), bytes.Repeat([]byte("x"), 200))
+		assert.True(t, errors.Is(err, ErrEntryTooLarge), "got %v", err)
+		_, err = tree.Search([]byte("big"))
+		assert.ErrorIs(t, err, kfile.ErrKeyNotFound)
+	})
+}
@@ -0,0 +1,250 @@
+package buffer
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"ultraSQL/kfile"
+)
+
+// arcList identifies which of the four ARC lists an entry is on.
+type arcList int
+
+const (
+	arcT1 arcList = iota // resident, seen once recently
+	arcT2                // resident, seen at least twice
+	arcB1                // ghost of a block evicted from T1
+	arcB2                // ghost of a block evicted from T2
+)
+
+// arcEntry is an element of one of the ARC lists. Ghost entries keep only
+// the block; resident entries also hold its buffer.
+type arcEntry struct {
+	blk   kfile.BlockId
+	buff  *Buffer
+	where arcList
+}
+
+// ARC implements the Adaptive Replacement Cache policy. Resident blocks are
+// split between T1 (recency) and T2 (frequency), and the ghost lists B1 and
+// B2 remember recently evicted blocks of each. A miss that hits a ghost list
+// shifts the target size p of T1 towards the list that would have kept the
+// block, so a scan of blocks seen once cannot flush the frequently used
+// ones. Each list is ordered least recently used first.
+type ARC struct {
+	fm         kfile.BlockStore
+	capacity   int
+	p          int // target size of T1
+	lists      [4]*list.List
+	entries    map[kfile.BlockId]*list.Element
+	bufferPool map[kfile.BlockId]*Buffer // resident blocks only
+	mu         sync.Mutex
+}
+
+// InitARC creates a new ARC replacement policy with the given capacity.
+// Buffers read and write through fm, which is usually a *kfile.FileMgr.
+func InitARC(capacity int, fm kfile.BlockStore) *ARC {
+	a := &ARC{
+		fm:         fm,
+		capacity:   capacity,
+		entries:    make(map[kfile.BlockId]*list.Element),
+		bufferPool: make(map[kfile.BlockId]*Buffer),
+	}
+	for i := range a.lists {
+		a.lists[i] = list.New()
+	}
+	return a
+}
+
+// AllocateBufferForBlock implements the EvictionPolicy interface. A block
+// found on a ghost list adapts p before a victim is chosen and is brought
+// back into T2; any other new block enters T1.
+func (a *ARC) AllocateBufferForBlock(block kfile.BlockId) (*Buffer, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if buff := a.hitLocked(block); buff != nil {
+		return buff, nil
+	}
+
+	dest := arcT1
+	inB2 := false
+	if e, ok := a.entries[block]; ok {
+		ghost := e.Value.(*arcEntry)
+		b1, b2 := a.lists[arcB1].Len(), a.lists[arcB2].Len()
+		switch ghost.where {
+		case arcB1:
+			a.p = min(a.capacity, a.p+max(b2/b1, 1))
+		case arcB2:
+			inB2 = true
+			a.p = max(0, a.p-max(b1/b2, 1))
+		}
+		a.lists[ghost.where].Remove(e)
+		delete(a.entries, block)
+		dest = arcT2
+	} else {
+		a.trimGhostsLocked()
+	}
+
+	var buff *Buffer
+	if len(a.bufferPool) < a.capacity {
+		buff = NewBuffer(a.fm)
+	} else {
+		victim, err := a.replaceLocked(inB2)
+		if err != nil {
+			return nil, fmt.Errorf("failed to evict buffer: %w", err)
+		}
+		buff = victim
+	}
+
+	if err := buff.assignToBlock(&block); err != nil {
+		return nil, fmt.Errorf("failed to assign block to buffer: %w", err)
+	}
+
+	a.entries[block] = a.lists[dest].PushBack(&arcEntry{blk: block, buff: buff, where: dest})
+	a.bufferPool[block] = buff
+	buff.Pin()
+	return buff, nil
+}
+
+// Get implements the EvictionPolicy interface. A resident hit moves the
+// block to the most recently used end of T2.
+func (a *ARC) Get(block kfile.BlockId) (*Buffer, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if buff := a.hitLocked(block); buff != nil {
+		return buff, nil
+	}
+	return nil, fmt.Errorf("buffer for block %v does not exist", block)
+}
+
+// hitLocked pins and promotes block if it is resident, returning nil
+// otherwise. The caller must hold a.mu.
+func (a *ARC) hitLocked(block kfile.BlockId) *Buffer {
+	e, ok := a.entries[block]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*arcEntry)
+	if entry.where != arcT1 && entry.where != arcT2 {
+		return nil
+	}
+	a.lists[entry.where].Remove(e)
+	entry.where = arcT2
+	a.entries[block] = a.lists[arcT2].PushBack(entry)
+	entry.buff.Pin()
+	return entry.buff
+}
+
+// trimGhostsLocked makes room in the directory for a block seen for the
+// first time, following case IV of the ARC paper: the recency side
+// (T1 plus B1) may not exceed the capacity, nor may all four lists together
+// exceed twice the capacity.
+func (a *ARC) trimGhostsLocked() {
+	t1, b1 := a.lists[arcT1].Len(), a.lists[arcB1].Len()
+	total := t1 + b1 + a.lists[arcT2].Len() + a.lists[arcB2].Len()
+	switch {
+	case t1+b1 >= a.capacity && b1 > 0:
+		a.dropGhostLocked(arcB1)
+	case t1+b1 < a.capacity && total >= 2*a.capacity && a.lists[arcB2].Len() > 0:
+		a.dropGhostLocked(arcB2)
+	}
+}
+
+// dropGhostLocked forgets the least recently used entry of a ghost list.
+func (a *ARC) dropGhostLocked(which arcList) {
+	e := a.lists[which].Front()
+	delete(a.entries, e.Value.(*arcEntry).blk)
+	a.lists[which].Remove(e)
+}
+
+// replaceLocked is the ARC REPLACE procedure: it evicts the least recently
+// used unpinned buffer of T1 if T1 is above its target p (or at it, when
+// the miss hit B2), and of T2 otherwise, leaving a ghost of the block on B1
+// or B2. If every buffer on the preferred list is pinned the other list is
+// tried. The caller must hold a.mu.
+func (a *ARC) replaceLocked(inB2 bool) (*Buffer, error) {
+	t1 := a.lists[arcT1].Len()
+	order := []arcList{arcT2, arcT1}
+	if t1 > 0 && (t1 > a.p || (inB2 && t1 == a.p)) {
+		order = []arcList{arcT1, arcT2}
+	}
+	for _, from := range order {
+		for e := a.lists[from].Front(); e != nil; e = e.Next() {
+			entry := e.Value.(*arcEntry)
+			if entry.buff.Pinned() {
+				continue
+			}
+			a.lists[from].Remove(e)
+			delete(a.bufferPool, entry.blk)
+			buff := entry.buff
+			entry.buff = nil
+			entry.where = arcB1
+			if from == arcT2 {
+				entry.where = arcB2
+			}
+			a.entries[entry.blk] = a.lists[entry.where].PushBack(entry)
+			// Keep the ghost lists within the directory's bound.
+			if a.lists[arcB1].Len()+a.lists[arcB2].Len() > a.capacity {
+				if a.lists[arcB1].Len() > a.lists[arcB2].Len() {
+					a.dropGhostLocked(arcB1)
+				} else {
+					a.dropGhostLocked(arcB2)
+				}
+			}
+			return buff, nil
+		}
+	}
+	return nil, ErrNoUnpinnedBuffers
+}
+
+// Evict implements the EvictionPolicy interface.
+func (a *ARC) Evict() (*Buffer, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.replaceLocked(false)
+}
+
+// FlushAll implements the EvictionPolicy interface.
+func (a *ARC) FlushAll(txnum int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, buff := range a.bufferPool {
+		if buff.ModifyingTxID() == txnum {
+			_ = buff.Flush()
+		}
+	}
+}
+
+// EvictClean implements the EvictionPolicy interface. Victims are taken from
+// the least recently used end of T1, then of T2, and leave no ghost.
+func (a *ARC) EvictClean(target int) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	evicted := 0
+	for _, from := range []arcList{arcT1, arcT2} {
+		for e := a.lists[from].Front(); e != nil && len(a.bufferPool) > target; {
+			next := e.Next()
+			entry := e.Value.(*arcEntry)
+			if !entry.buff.Pinned() && !entry.buff.Dirty {
+				a.lists[from].Remove(e)
+				delete(a.entries, entry.blk)
+				delete(a.bufferPool, entry.blk)
+				evicted++
+			}
+			e = next
+		}
+	}
+	return evicted
+}
+
+// ResidentBlocks implements the EvictionPolicy interface.
+func (a *ARC) ResidentBlocks() []kfile.BlockId {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return sortedBlocks(a.bufferPool)
+}
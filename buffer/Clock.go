@@ -1,9 +1,8 @@
 package buffer
 
 import (
-	"errors"
 	"fmt"
-	"io"
+	"sort"
 	"sync"
 	"ultraSQL/kfile"
 )
@@ -11,7 +10,7 @@ import (
 // Clock implements the Clock (Second Chance) replacement algorithm.
 // It maintains a circular buffer of frames with a reference bit for each frame.
 type Clock struct {
-	fm         *kfile.FileMgr
+	fm         kfile.BlockStore
 	capacity   int
 	bufferPool map[kfile.BlockId]*Buffer // Maps BlockId to Buffer
 	frames     []*Buffer                 // Circular buffer of frames
@@ -20,7 +19,8 @@ type Clock struct {
 }
 
 // InitClock creates a new Clock replacement policy with the given capacity.
-func InitClock(capacity int, fm *kfile.FileMgr) *Clock {
+// Buffers read and write through fm, which is usually a *kfile.FileMgr.
+func InitClock(capacity int, fm kfile.BlockStore) *Clock {
 	return &Clock{
 		fm:         fm,
 		capacity:   capacity,
@@ -43,7 +43,7 @@ func (c *Clock) AllocateBufferForBlock(block kfile.BlockId) (*Buffer, error) {
 	}
 
 	// Find an empty frame or evict one
-	buff := NewBuffer(c.fm)
+	var buff *Buffer
 	var err error
 
 	// First, try to find an empty frame
@@ -65,9 +65,7 @@ func (c *Clock) AllocateBufferForBlock(block kfile.BlockId) (*Buffer, error) {
 
 	// Assign the new block to the buffer
 	if err := buff.assignToBlock(&block); err != nil {
-		if !errors.Is(err, io.EOF) {
-			return nil, fmt.Errorf("failed to assign block to buffer: %w", err)
-		}
+		return nil, fmt.Errorf("failed to assign block to buffer: %w", err)
 	}
 
 	buff.setReferenced(true) // Set reference bit for new buffer
@@ -153,3 +151,55 @@ func (c *Clock) FlushAll(txnum int64) {
 		}
 	}
 }
+
+// EvictClean implements the EvictionPolicy interface. It sweeps from the
+// clock hand as evictLocked does, giving referenced pages a second chance,
+// and leaves the hand past the last frame it looked at.
+func (c *Clock) EvictClean(target int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	evicted := 0
+	// Two turns of the hand: the first may only clear reference bits.
+	for steps := 2 * c.capacity; steps > 0 && len(c.bufferPool) > target; steps-- {
+		i := c.clockHand
+		c.clockHand = (c.clockHand + 1) % c.capacity
+		buff := c.frames[i]
+		if buff == nil || buff.Pinned() || buff.Dirty {
+			continue
+		}
+		if buff.referenced() {
+			buff.setReferenced(false)
+			continue
+		}
+		if block := buff.Block(); block != nil {
+			delete(c.bufferPool, *block)
+		}
+		c.frames[i] = nil
+		evicted++
+	}
+	return evicted
+}
+
+// ResidentBlocks implements the EvictionPolicy interface.
+func (c *Clock) ResidentBlocks() []kfile.BlockId {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return sortedBlocks(c.bufferPool)
+}
+
+// sortedBlocks returns the keys of pool ordered by file name and block number.
+func sortedBlocks(pool map[kfile.BlockId]*Buffer) []kfile.BlockId {
+	blocks := make([]kfile.BlockId, 0, len(pool))
+	for blk := range pool {
+		blocks = append(blocks, blk)
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		if blocks[i].FileName() != blocks[j].FileName() {
+			return blocks[i].FileName() < blocks[j].FileName()
+		}
+		return blocks[i].Number() < blocks[j].Number()
+	})
+	return blocks
+}
@@ -14,4 +14,11 @@ type EvictionPolicy interface {
 	Evict() (*Buffer, error)
 
 	FlushAll(txnum int64)
+
+	// ResidentBlocks lists the blocks currently held in the pool.
+	ResidentBlocks() []kfile.BlockId
+
+	// EvictClean drops clean, unpinned buffers until at most target blocks
+	// remain resident, and returns how many it dropped.
+	EvictClean(target int) int
 }
@@ -0,0 +1,180 @@
+package buffer
+
+import (
+	"fmt"
+	"sync"
+	"ultraSQL/kfile"
+)
+
+// LRU implements least-recently-used replacement. Resident buffers form a
+// doubly linked list through their prev and next fields, most recently used
+// at the head, so a hit moves its buffer to the front and eviction scans
+// from the tail in O(1) per step.
+type LRU struct {
+	fm         kfile.BlockStore
+	capacity   int
+	bufferPool map[kfile.BlockId]*Buffer // Maps BlockId to Buffer
+	head, tail *Buffer                   // Most and least recently used
+	mu         sync.Mutex                // Ensures thread safety
+}
+
+// InitLRU creates a new LRU replacement policy with the given capacity.
+// Buffers read and write through fm, which is usually a *kfile.FileMgr.
+func InitLRU(capacity int, fm kfile.BlockStore) *LRU {
+	return &LRU{
+		fm:         fm,
+		capacity:   capacity,
+		bufferPool: make(map[kfile.BlockId]*Buffer),
+	}
+}
+
+// AllocateBufferForBlock implements the EvictionPolicy interface. A new
+// buffer is created while the pool is below capacity; after that the least
+// recently used unpinned buffer is reassigned.
+func (l *LRU) AllocateBufferForBlock(block kfile.BlockId) (*Buffer, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if buff, exists := l.bufferPool[block]; exists {
+		l.moveToFront(buff)
+		buff.Pin()
+		return buff, nil
+	}
+
+	var buff *Buffer
+	if len(l.bufferPool) < l.capacity {
+		buff = NewBuffer(l.fm)
+	} else {
+		victim, err := l.evictLocked()
+		if err != nil {
+			return nil, fmt.Errorf("failed to evict buffer: %w", err)
+		}
+		buff = victim
+	}
+
+	if err := buff.assignToBlock(&block); err != nil {
+		return nil, fmt.Errorf("failed to assign block to buffer: %w", err)
+	}
+
+	l.pushFront(buff)
+	buff.Pin()
+	l.bufferPool[block] = buff
+	return buff, nil
+}
+
+// Get implements the EvictionPolicy interface, marking the buffer as the
+// most recently used.
+func (l *LRU) Get(block kfile.BlockId) (*Buffer, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if buff, exists := l.bufferPool[block]; exists {
+		l.moveToFront(buff)
+		buff.Pin()
+		return buff, nil
+	}
+	return nil, fmt.Errorf("buffer for block %v does not exist", block)
+}
+
+// evictLocked removes the least recently used unpinned buffer from the pool
+// and returns it. The caller must hold l.mu.
+func (l *LRU) evictLocked() (*Buffer, error) {
+	for buff := l.tail; buff != nil; buff = buff.prev {
+		if buff.Pinned() {
+			continue
+		}
+		l.remove(buff)
+		return buff, nil
+	}
+	return nil, ErrNoUnpinnedBuffers
+}
+
+// Evict implements the EvictionPolicy interface.
+func (l *LRU) Evict() (*Buffer, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.evictLocked()
+}
+
+// FlushAll implements the EvictionPolicy interface.
+func (l *LRU) FlushAll(txnum int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for buff := l.head; buff != nil; buff = buff.next {
+		if buff.ModifyingTxID() == txnum {
+			_ = buff.Flush()
+		}
+	}
+}
+
+// EvictClean implements the EvictionPolicy interface. Victims are taken
+// from the least recently used end.
+func (l *LRU) EvictClean(target int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	evicted := 0
+	for buff := l.tail; buff != nil && len(l.bufferPool) > target; {
+		prev := buff.prev
+		if !buff.Pinned() && !buff.Dirty {
+			l.remove(buff)
+			evicted++
+		}
+		buff = prev
+	}
+	return evicted
+}
+
+// ResidentBlocks implements the EvictionPolicy interface.
+func (l *LRU) ResidentBlocks() []kfile.BlockId {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return sortedBlocks(l.bufferPool)
+}
+
+// pushFront links buff in as the most recently used buffer.
+func (l *LRU) pushFront(buff *Buffer) {
+	buff.prev = nil
+	buff.next = l.head
+	if l.head != nil {
+		l.head.prev = buff
+	}
+	l.head = buff
+	if l.tail == nil {
+		l.tail = buff
+	}
+}
+
+// unlink detaches buff from the list.
+func (l *LRU) unlink(buff *Buffer) {
+	if buff.prev != nil {
+		buff.prev.next = buff.next
+	} else {
+		l.head = buff.next
+	}
+	if buff.next != nil {
+		buff.next.prev = buff.prev
+	} else {
+		l.tail = buff.prev
+	}
+	buff.prev, buff.next = nil, nil
+}
+
+// moveToFront marks a resident buffer as the most recently used.
+func (l *LRU) moveToFront(buff *Buffer) {
+	if l.head == buff {
+		return
+	}
+	l.unlink(buff)
+	l.pushFront(buff)
+}
+
+// remove drops buff from the list and the pool.
+func (l *LRU) remove(buff *Buffer) {
+	l.unlink(buff)
+	if block := buff.Block(); block != nil {
+		delete(l.bufferPool, *block)
+	}
+}
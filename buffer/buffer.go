@@ -7,13 +7,14 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 	"ultraSQL/kfile"
 )
 
 const PageSizeThreshold = 8 * 1024
 
 type Buffer struct {
-	fm             *kfile.FileMgr
+	fm             kfile.BlockStore
 	contents       *kfile.SlottedPage
 	blk            *kfile.BlockId
 	pins           int
@@ -23,11 +24,23 @@ type Buffer struct {
 	lastAccessTime uint64
 	prev, next     *Buffer
 	refBit         bool
-	mu             sync.Mutex
+	replaced       bool // the last assignToBlock evicted another block
+	// mu guards refBit, txnum and lsn, which the policy reads for buffers
+	// other goroutines are modifying.
+	mu sync.Mutex
+
+	// wal is set when the buffer is allocated through a BufferMgr, see
+	// BufferMgr.SetLogFlusher.
+	wal atomic.Pointer[logFlusher]
+
+	// latch guards the logical consistency of the page contents across
+	// multi-step modifications; it is independent of pins and of mu.
+	latch     sync.RWMutex
+	exclusive bool
 }
 
 // NewBuffer ...
-func NewBuffer(fm *kfile.FileMgr) *Buffer {
+func NewBuffer(fm kfile.BlockStore) *Buffer {
 	return &Buffer{
 		fm:       fm,
 		contents: kfile.NewSlottedPage(fm.BlockSize()),
@@ -40,6 +53,13 @@ func (b *Buffer) Contents() *kfile.SlottedPage {
 	return b.contents
 }
 
+// RawPage returns the page underlying Contents, for callers that use fixed
+// offsets rather than cells. Flush stamps a checksum into the slotted page
+// header, so fixed-offset data belongs at kfile.PageHeaderSize or beyond.
+func (b *Buffer) RawPage() *kfile.Page {
+	return b.contents.Page
+}
+
 func (b *Buffer) SetContents(sp *kfile.SlottedPage) {
 	b.contents = sp
 }
@@ -49,10 +69,12 @@ func (b *Buffer) Block() *kfile.BlockId {
 }
 
 func (b *Buffer) MarkModified(txnum int64, lsn int) {
+	b.mu.Lock()
 	b.txnum = txnum
 	if lsn > 0 {
 		b.lsn = lsn
 	}
+	b.mu.Unlock()
 	b.Dirty = true
 }
 
@@ -64,6 +86,32 @@ func (b *Buffer) Pin() {
 	b.pins++
 }
 
+// LatchShared acquires the buffer latch in shared mode. Readers hold it while
+// inspecting a page so that they never observe a half-applied update.
+func (b *Buffer) LatchShared() {
+	b.latch.RLock()
+}
+
+// LatchExclusive acquires the buffer latch in exclusive mode. Writers hold it
+// across every page modification that must appear atomic to latched readers.
+// Unlike a pin, the latch does not prevent eviction.
+func (b *Buffer) LatchExclusive() {
+	b.latch.Lock()
+	b.exclusive = true
+}
+
+// Unlatch releases the latch acquired by LatchShared or LatchExclusive.
+func (b *Buffer) Unlatch() {
+	// While an exclusive latch is held no shared holder can exist, so the
+	// flag unambiguously identifies which mode the caller holds.
+	if b.exclusive {
+		b.exclusive = false
+		b.latch.Unlock()
+		return
+	}
+	b.latch.RUnlock()
+}
+
 func (b *Buffer) Unpin() error {
 	if b.pins <= 0 {
 		return errors.New("buffer is not pinned")
@@ -75,11 +123,21 @@ func (b *Buffer) Unpin() error {
 func (b *Buffer) Flush() error {
 	// only flush if dirty and we have a valid block assigned
 	if b.Dirty && b.blk != nil {
+		// Write-ahead logging: the log records describing the page must be
+		// on disk before the page is.
+		if wal, lsn := b.wal.Load(), b.LSN(); wal != nil && lsn >= 0 {
+			if err := wal.flushTo(lsn); err != nil {
+				return fmt.Errorf("flush: log flush error: %w", err)
+			}
+		}
+		b.contents.UpdateChecksum()
 		if err := b.fm.Write(b.blk, b.contents); err != nil {
 			return fmt.Errorf("flush: write error: %w", err)
 		}
 		b.Dirty = false
+		b.mu.Lock()
 		b.txnum = -1
+		b.mu.Unlock()
 	}
 	return nil
 }
@@ -89,16 +147,30 @@ func (b *Buffer) assignToBlock(blk *kfile.BlockId) error {
 	if err := b.Flush(); err != nil {
 		return fmt.Errorf("assignToBlock: flush error: %w", err)
 	}
+	b.replaced = b.blk != nil
 	b.blk = blk
 	if err := b.fm.Read(blk, b.contents); err != nil {
-		return fmt.Errorf("assignToBlock: read error: %w", err)
+		if !errors.Is(err, kfile.ErrBlockOutOfRange) {
+			return fmt.Errorf("assignToBlock: read error: %w", err)
+		}
+		// A block past the end of its file has not been written yet; it
+		// starts as an empty page and reaches the file when flushed.
+		clear(b.contents.Contents())
 	}
+	if err := b.contents.VerifyChecksum(); err != nil {
+		return fmt.Errorf("assignToBlock: block %v: %w", blk, err)
+	}
+	// Pages carry their slot directory, so this only converts pages written
+	// before it was kept on the page. Blocks that do not hold a slotted page,
+	// such as ones written through the raw Page accessors, are still usable
+	// as plain pages.
+	_ = b.contents.RebuildSlots()
 	b.pins = 0
 	return nil
 }
 
 func (b *Buffer) FlushLSN(lsn int) error {
-	if lsn >= b.lsn {
+	if lsn >= b.LSN() {
 		return b.Flush()
 	}
 	return nil
@@ -106,6 +178,7 @@ func (b *Buffer) FlushLSN(lsn int) error {
 
 func (b *Buffer) LogFlush(blk *kfile.BlockId) error {
 	b.blk = blk
+	b.contents.UpdateChecksum()
 	if err := b.fm.Write(b.blk, b.contents); err != nil {
 		return fmt.Errorf("logFlush: write error: %w", err)
 	}
@@ -151,9 +224,19 @@ func (b *Buffer) decompressPage(page *kfile.Page) error {
 	return nil
 }
 func (b *Buffer) ModifyingTxID() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	return b.txnum
 }
 
+// LSN returns the LSN of the newest log record describing a change to the
+// buffer, or -1 if none has been recorded.
+func (b *Buffer) LSN() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.lsn
+}
+
 func (b *Buffer) referenced() bool {
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -3,9 +3,12 @@ package buffer
 import (
 	"errors"
 	"fmt"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 	"ultraSQL/kfile"
+	"ultraSQL/logging"
 )
 
 const MaxTime = 1000 * time.Millisecond
@@ -13,6 +16,9 @@ const MaxTime = 1000 * time.Millisecond
 // ErrNoUnpinnedBuffers is returned when no unpinned buffers are Available for eviction.
 var ErrNoUnpinnedBuffers = errors.New("no unpinned buffers Available for eviction")
 
+// ErrClosed is returned when pinning through a BufferMgr that has been closed.
+var ErrClosed = errors.New("buffer manager is closed")
+
 // BufferMgr manages a pool of buffers and applies an eviction policy.
 type BufferMgr struct {
 	mu           sync.RWMutex
@@ -20,13 +26,46 @@ type BufferMgr struct {
 	policy       EvictionPolicy
 	numAvailable int
 	availableCh  chan struct{}
+	pinTimeout   time.Duration // how long Pin waits for a free buffer
+
+	// now and after are time.Now and time.After, swapped out by tests that
+	// step through a Pin timeout without sleeping.
+	now   func() time.Time
+	after func(time.Duration) <-chan time.Time
 
 	// Access tracking fields (for LRU or similar).
 	accessCounter uint64
 
-	// Optional statistics.
-	hitCounter  int
-	missCounter int
+	// Optional statistics, see Stats.
+	hitCounter      int
+	missCounter     int
+	evictionCounter int
+
+	closed bool
+	logger *slog.Logger
+
+	// lowWatermark is the resident-page target while the host is under
+	// memory pressure; zero means no pressure.
+	lowWatermark int
+
+	compactions *kfile.CompactionMetrics
+	timestamps  map[string]func() time.Time // by file, see EnableCellTimestamps
+
+	wal logFlusher
+}
+
+// logFlusher makes the log durable through an LSN before a dirty page
+// reaches disk, see SetLogFlusher.
+type logFlusher struct {
+	fn atomic.Pointer[func(lsn int) error]
+}
+
+// flushTo calls the function set with SetLogFlusher, if any.
+func (f *logFlusher) flushTo(lsn int) error {
+	if fn := f.fn.Load(); fn != nil {
+		return (*fn)(lsn)
+	}
+	return nil
 }
 
 // NewBufferMgr creates a new BufferMgr with the specified number of buffers and eviction policy.
@@ -36,24 +75,127 @@ func NewBufferMgr(fm *kfile.FileMgr, numBuffs int, policy EvictionPolicy) *Buffe
 		fm:           fm,
 		numAvailable: numBuffs,
 		availableCh:  make(chan struct{}, numBuffs),
+		pinTimeout:   MaxTime,
+		now:          time.Now,
+		after:        time.After,
+		logger:       logging.Discard(),
+		compactions:  kfile.NewCompactionMetrics(),
+	}
+}
+
+// NewBufferMgrWithTimeout creates a BufferMgr whose Pin waits at most
+// timeout for a free buffer instead of MaxTime.
+func NewBufferMgrWithTimeout(fm *kfile.FileMgr, numBuffs int, policy EvictionPolicy, timeout time.Duration) *BufferMgr {
+	bm := NewBufferMgr(fm, numBuffs, policy)
+	bm.pinTimeout = timeout
+	return bm
+}
+
+// SetPinTimeout changes how long Pin waits for a free buffer; it applies to
+// pins that start after the call.
+func (bm *BufferMgr) SetPinTimeout(d time.Duration) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	bm.pinTimeout = d
+}
+
+// SetLogger routes the BufferMgr's diagnostics, and those of components
+// built on it such as log iterators and recovery, to l. A nil l silences
+// them, which is the default.
+func (bm *BufferMgr) SetLogger(l *slog.Logger) {
+	if l == nil {
+		l = logging.Discard()
+	}
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	bm.logger = l
+}
+
+// Logger returns the logger set with SetLogger.
+func (bm *BufferMgr) Logger() *slog.Logger {
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
+	return bm.logger
+}
+
+// SetLogFlusher makes every buffer pinned through bm call fn with the page's
+// LSN before writing a dirty page, whether on eviction or on an explicit
+// flush, so that no page reaches disk ahead of the log records describing
+// it. log.NewLogMgr sets it to the log's FlushLSN. fn runs while the
+// eviction policy's lock is held, so it must not pin or unpin buffers.
+func (bm *BufferMgr) SetLogFlusher(fn func(lsn int) error) {
+	if fn == nil {
+		bm.wal.fn.Store(nil)
+		return
 	}
+	bm.wal.fn.Store(&fn)
+}
+
+// EnableCellTimestamps makes the pages of filename pinned through bm record
+// created-at and modified-at times on the cells inserted and updated in
+// them, read from now, as kfile.SlottedPage.EnableTimestamps does. A nil now
+// uses time.Now. Pages already in the pool are stamped once they are read in
+// again, so enable it before filename is first used.
+func (bm *BufferMgr) EnableCellTimestamps(filename string, now func() time.Time) {
+	if now == nil {
+		now = time.Now
+	}
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	if bm.timestamps == nil {
+		bm.timestamps = make(map[string]func() time.Time)
+	}
+	bm.timestamps[filename] = now
+}
+
+// overflowReader returns the reader pages of filename follow overflow
+// chains with, pinning each overflow block through bm so that a chain
+// written by an uncommitted transaction reads back as the pool holds it.
+// Fragments in an overflow file are read as stored, so its pages get none.
+func (bm *BufferMgr) overflowReader(filename string) kfile.OverflowReader {
+	if kfile.IsOverflowFile(filename) {
+		return nil
+	}
+	file := kfile.OverflowFile(filename)
+	return func(n int32, use func(*kfile.SlottedPage) error) error {
+		buff, err := bm.Pin(kfile.NewBlockId(file, n))
+		if err != nil {
+			return err
+		}
+		defer bm.Unpin(buff)
+		return use(buff.Contents())
+	}
+}
+
+// CompactionMetrics returns per-file statistics for the compactions of
+// pages pinned through this BufferMgr.
+func (bm *BufferMgr) CompactionMetrics() *kfile.CompactionMetrics {
+	return bm.compactions
 }
 
 // Pin attempts to retrieve a buffer for the given block, possibly blocking until a buffer becomes Available.
-// If no buffers become Available within MaxTime, an error is returned.
+// If no buffers become Available within the pin timeout, MaxTime by default, an error is returned.
 func (bm *BufferMgr) Pin(blk *kfile.BlockId) (*Buffer, error) {
-	startTime := time.Now()
+	startTime := bm.now()
+	bm.mu.RLock()
+	timeout := bm.pinTimeout
+	bm.mu.RUnlock()
 
 	// Main loop: retry until success or timeout.
 	for {
 		bm.mu.Lock()
 
+		if bm.closed {
+			bm.mu.Unlock()
+			return nil, ErrClosed
+		}
+
 		buff, getErr := bm.Policy().Get(*blk)
 		switch {
 		case getErr != nil:
 			// Log the error from policy.Get but don’t necessarily return unless it's critical.
 			// The 'not found' scenario might not be an error per se; it could simply return (nil, nil).
-			fmt.Printf("debug: policy.Get returned an error: %v\n", getErr)
+			bm.logger.Debug("buffer pool miss", "block", blk.String(), "err", getErr)
 
 		case buff != nil:
 			// We found the buffer in the policy -> It's a "hit".
@@ -70,7 +212,14 @@ func (bm *BufferMgr) Pin(blk *kfile.BlockId) (*Buffer, error) {
 				bm.mu.Unlock()
 				return nil, fmt.Errorf("failed to allocate buffer: %w", allocErr)
 			}
+			bm.setupFrame(newBuff, blk)
+			if newBuff.replaced {
+				bm.evictionCounter++
+			}
 			bm.numAvailable--
+			if bm.lowWatermark > 0 {
+				bm.evictionCounter += bm.policy.EvictClean(bm.lowWatermark)
+			}
 			bm.mu.Unlock()
 			return newBuff, nil
 		}
@@ -78,10 +227,10 @@ func (bm *BufferMgr) Pin(blk *kfile.BlockId) (*Buffer, error) {
 		// If we reach here, it means buff == nil and bm.numAvailable == 0.
 
 		// Check if we’ve timed out.
-		remaining := MaxTime - time.Since(startTime)
+		remaining := timeout - bm.now().Sub(startTime)
 		if remaining <= 0 {
 			bm.mu.Unlock()
-			return nil, fmt.Errorf("no buffers Available after waiting %v", MaxTime)
+			return nil, fmt.Errorf("no buffers Available after waiting %v", timeout)
 		}
 
 		// Wait for a buffer to become free. Unlock while waiting.
@@ -89,21 +238,117 @@ func (bm *BufferMgr) Pin(blk *kfile.BlockId) (*Buffer, error) {
 		select {
 		case <-bm.availableCh:
 			// A buffer might have been freed; loop again.
-		case <-time.After(remaining):
-			return nil, fmt.Errorf("no buffers Available after waiting %v", MaxTime)
+		case <-bm.after(remaining):
+			return nil, fmt.Errorf("no buffers Available after waiting %v", timeout)
 		}
 	}
 }
 
+// Prefetch reads blks into the pool in the background so that a later Pin
+// of each is a hit. Blocks are loaded through the policy like a Pin miss but
+// left unpinned, so the policy may evict them again before they are used.
+// Blocks already resident are skipped, and so is every block met while no
+// buffer is available, since that would mean evicting a pinned one. The
+// returned channel receives the number of blocks read and is then closed.
+func (bm *BufferMgr) Prefetch(blks []*kfile.BlockId) <-chan int {
+	done := make(chan int, 1)
+	go func() {
+		defer close(done)
+		loaded := 0
+		for _, blk := range blks {
+			ok, err := bm.prefetch(blk)
+			if err != nil {
+				bm.Logger().Debug("prefetch failed", "block", blk.String(), "err", err)
+			}
+			if ok {
+				loaded++
+			}
+		}
+		done <- loaded
+	}()
+	return done
+}
+
+// prefetch loads one block for Prefetch, reporting whether it was read.
+func (bm *BufferMgr) prefetch(blk *kfile.BlockId) (bool, error) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	if bm.closed || bm.numAvailable == 0 {
+		return false, nil
+	}
+	if buff, err := bm.policy.Get(*blk); err == nil {
+		return false, buff.Unpin()
+	}
+	buff, err := bm.policy.AllocateBufferForBlock(*blk)
+	if err != nil {
+		return false, err
+	}
+	bm.setupFrame(buff, blk)
+	if buff.replaced {
+		bm.evictionCounter++
+	}
+	return true, buff.Unpin()
+}
+
+// setupFrame readies buff, just assigned to blk, for the file it now holds,
+// replacing whatever the frame was set up with for its previous block. The
+// caller must hold bm.mu.
+func (bm *BufferMgr) setupFrame(buff *Buffer, blk *kfile.BlockId) {
+	// Report compactions of the page against the file it now holds.
+	buff.Contents().OnCompact(bm.compactions.Observer(blk.FileName()))
+	buff.Contents().SetOverflowReader(bm.overflowReader(blk.FileName()))
+	if now := bm.timestamps[blk.FileName()]; now != nil {
+		buff.Contents().EnableTimestamps(now)
+	} else {
+		buff.Contents().DisableTimestamps()
+	}
+	buff.wal.Store(&bm.wal)
+}
+
+// BufferStats reports how well the buffer pool is serving pins.
+type BufferStats struct {
+	Hits      int     // pins of a resident block
+	Misses    int     // pins that had to read the block
+	Evictions int     // resident blocks dropped to make room or shed memory
+	HitRatio  float64 // Hits over Hits plus Misses, 0 before any pin
+}
+
+// Stats returns the pool's counters since creation or the last ResetStats.
+func (bm *BufferMgr) Stats() BufferStats {
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
+
+	stats := BufferStats{
+		Hits:      bm.hitCounter,
+		Misses:    bm.missCounter,
+		Evictions: bm.evictionCounter,
+	}
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
+
+// ResetStats zeroes the counters reported by Stats.
+func (bm *BufferMgr) ResetStats() {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	bm.hitCounter, bm.missCounter, bm.evictionCounter = 0, 0, 0
+}
+
 // Unpin decrements the pin count of the given buffer. If it becomes unpinned,
 // bm.numAvailable is incremented, and a signal is sent on bm.availableCh to notify waiters.
 func (bm *BufferMgr) Unpin(buff *Buffer) {
 	bm.mu.Lock()
 	defer bm.mu.Unlock()
 
+	if bm.closed {
+		return
+	}
 	if err := buff.Unpin(); err != nil {
 		// Log a warning rather than panicking.
-		fmt.Printf("warning: Unpin called on an unpinned buffer: %v\n", err)
+		bm.logger.Warn("unpin called on an unpinned buffer", "err", err)
 		return
 	}
 	if !buff.Pinned() {
@@ -115,6 +360,21 @@ func (bm *BufferMgr) Unpin(buff *Buffer) {
 	}
 }
 
+// Close marks the BufferMgr as closed so that further Pin calls fail with
+// ErrClosed, and wakes any goroutine waiting for a free buffer. It must be
+// called before the underlying FileMgr is closed. Calling Close twice is a no-op.
+func (bm *BufferMgr) Close() error {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	if bm.closed {
+		return nil
+	}
+	bm.closed = true
+	close(bm.availableCh)
+	return nil
+}
+
 // updateAccessTime sets a buffer’s lastAccessTime using a global counter,
 // which can be used by LRU or other replacement policies.
 func (bm *BufferMgr) updateAccessTime(buff *Buffer) {
@@ -129,6 +389,36 @@ func (bm *BufferMgr) Available() int {
 	return bm.numAvailable
 }
 
+// SetMemoryPressure responds to a host memory-pressure signal by evicting
+// clean, unpinned pages until at most low remain resident. Until
+// ReleaseMemoryPressure is called the pool keeps trimming itself back to low
+// after each miss; dirty and pinned pages are never dropped. It returns the
+// number of pages evicted.
+func (bm *BufferMgr) SetMemoryPressure(low int) int {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	if low < 1 {
+		low = 1
+	}
+	bm.lowWatermark = low
+	evicted := bm.policy.EvictClean(low)
+	bm.evictionCounter += evicted
+	return evicted
+}
+
+// ReleaseMemoryPressure lets the pool grow back toward its configured size.
+func (bm *BufferMgr) ReleaseMemoryPressure() {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	bm.lowWatermark = 0
+}
+
+// ResidentBlocks lists the blocks currently held in the buffer pool.
+func (bm *BufferMgr) ResidentBlocks() []kfile.BlockId {
+	return bm.policy.ResidentBlocks()
+}
+
 // Available returns the current count of Available (unpinned) buffers.
 func (bm *BufferMgr) Policy() EvictionPolicy {
 	return bm.policy
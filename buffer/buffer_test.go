@@ -1,9 +1,14 @@
 package buffer
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -194,6 +199,68 @@ func TestPinTimeout(t *testing.T) {
 	}
 }
 
+func TestConfigurablePinTimeout(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 400)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	const timeout = 50 * time.Millisecond
+	bufferMgr := NewBufferMgrWithTimeout(fm, 1, InitLRU(1, fm), timeout)
+	// Stop the clock and hand the test each wait Pin starts, so it decides
+	// when the wait ends.
+	start := time.Now()
+	bufferMgr.now = func() time.Time { return start }
+	waits := make(chan time.Duration)
+	expire := make(chan time.Time)
+	bufferMgr.after = func(d time.Duration) <-chan time.Time {
+		waits <- d
+		return expire
+	}
+
+	blk1, _ := fm.Append("timeout.db")
+	blk2, _ := fm.Append("timeout.db")
+	buff1, err := bufferMgr.Pin(blk1)
+	if err != nil {
+		t.Fatalf("Failed to pin block: %v", err)
+	}
+	pin := func() <-chan error {
+		errc := make(chan error, 1)
+		go func() {
+			_, err := bufferMgr.Pin(blk2)
+			errc <- err
+		}()
+		return errc
+	}
+
+	errc := pin()
+	if d := <-waits; d != timeout {
+		t.Errorf("Expected Pin to wait %v, waited %v", timeout, d)
+	}
+	expire <- start
+	if err := <-errc; err == nil {
+		t.Fatal("Expected Pin to time out with the only buffer pinned")
+	}
+
+	bufferMgr.SetPinTimeout(10 * time.Millisecond)
+	errc = pin()
+	if d := <-waits; d != 10*time.Millisecond {
+		t.Errorf("Expected the shorter timeout to apply, waited %v", d)
+	}
+	expire <- start
+	if err := <-errc; err == nil {
+		t.Fatal("Expected Pin to time out after SetPinTimeout")
+	}
+
+	// A buffer freed during the wait ends it before the timeout.
+	errc = pin()
+	<-waits
+	bufferMgr.Unpin(buff1)
+	if err := <-errc; err != nil {
+		t.Errorf("Expected Pin to take the freed buffer, got %v", err)
+	}
+}
+
 // TestFlushAll tests flushing buffers for a specific transaction.
 func TestFlushAll(t *testing.T) {
 	// Setup
@@ -427,3 +494,984 @@ func TestDeterministicBufferOverflow(t *testing.T) {
 
 	bufferMgr.Unpin(firstBuffers[0])
 }
+
+func TestBufferMgrClose(t *testing.T) {
+	tempDir := t.TempDir()
+	fm, err := kfile.NewFileMgr(tempDir, 400)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	policy := InitClock(3, fm)
+	bufferMgr := NewBufferMgr(fm, 3, policy)
+
+	blk, err := fm.Append("close_test.db")
+	if err != nil {
+		t.Fatalf("Failed to append block: %v", err)
+	}
+	buff, err := bufferMgr.Pin(blk)
+	if err != nil {
+		t.Fatalf("Failed to pin block: %v", err)
+	}
+
+	// Race a flush of a dirty buffer against closing the managers: the flush
+	// must either complete or report ErrClosed, never panic.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 50; i++ {
+			buff.MarkModified(1, i)
+			if err := buff.Flush(); err != nil {
+				if !errors.Is(err, kfile.ErrClosed) {
+					t.Errorf("Expected flush to succeed or return ErrClosed, got %v", err)
+				}
+				return
+			}
+		}
+	}()
+	if err := bufferMgr.Close(); err != nil {
+		t.Errorf("BufferMgr Close failed: %v", err)
+	}
+	if err := fm.Close(); err != nil {
+		t.Errorf("FileMgr Close failed: %v", err)
+	}
+	wg.Wait()
+
+	if err := bufferMgr.Close(); err != nil {
+		t.Errorf("Expected double Close to return nil, got %v", err)
+	}
+	if _, err := bufferMgr.Pin(blk); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Pin after Close, got %v", err)
+	}
+}
+
+func TestBufferLatch(t *testing.T) {
+	tempDir := t.TempDir()
+	fm, err := kfile.NewFileMgr(tempDir, 400)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	buff := NewBuffer(fm)
+	page := buff.Contents()
+
+	const firstField, secondField = 100, 200
+	const updates = 500
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				buff.LatchShared()
+				a, errA := page.GetInt(firstField)
+				b, errB := page.GetInt(secondField)
+				buff.Unlatch()
+				if errA != nil || errB != nil {
+					t.Errorf("GetInt failed: %v, %v", errA, errB)
+					return
+				}
+				if a != b {
+					t.Errorf("Observed partial update: fields %d and %d", a, b)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 1; i <= updates; i++ {
+		buff.LatchExclusive()
+		if err := page.SetInt(firstField, i); err != nil {
+			t.Errorf("SetInt failed: %v", err)
+		}
+		if err := page.SetInt(secondField, i); err != nil {
+			t.Errorf("SetInt failed: %v", err)
+		}
+		buff.Unlatch()
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestScanRingLeavesPoolIntact(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 400)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	policy := InitClock(3, fm)
+	bufferMgr := NewBufferMgr(fm, 3, policy)
+
+	const scanBlocks = 20
+	for i := 0; i < scanBlocks; i++ {
+		blk, err := fm.Append("scan.db")
+		if err != nil {
+			t.Fatalf("Failed to append block: %v", err)
+		}
+		p := kfile.NewSlottedPage(fm.BlockSize())
+		p.SetInt(100, i)
+		if err := fm.Write(blk, p); err != nil {
+			t.Fatalf("Failed to write block: %v", err)
+		}
+	}
+
+	// Warm the pool with two hot pages, one of them dirty.
+	for _, n := range []int32{0, 1} {
+		hot, err := fm.Append("hot.db")
+		if err != nil {
+			t.Fatalf("Failed to append block: %v", err)
+		}
+		if hot.Number() != n {
+			t.Fatalf("Expected hot block %d, got %d", n, hot.Number())
+		}
+		buff, err := bufferMgr.Pin(hot)
+		if err != nil {
+			t.Fatalf("Failed to pin hot block: %v", err)
+		}
+		bufferMgr.Unpin(buff)
+	}
+	dirty, err := bufferMgr.Pin(kfile.NewBlockId("scan.db", 5))
+	if err != nil {
+		t.Fatalf("Failed to pin block: %v", err)
+	}
+	dirty.Contents().SetInt(100, 500)
+	dirty.MarkModified(1, -1)
+	bufferMgr.Unpin(dirty)
+	before := bufferMgr.ResidentBlocks()
+
+	ring, err := bufferMgr.NewScanRing(2)
+	if err != nil {
+		t.Fatalf("Failed to create scan ring: %v", err)
+	}
+	for i := 0; i < scanBlocks; i++ {
+		buff, err := ring.Read(kfile.NewBlockId("scan.db", int32(i)))
+		if err != nil {
+			t.Fatalf("Scan read of block %d failed: %v", i, err)
+		}
+		want := i
+		if i == 5 {
+			want = 500 // the unflushed pool copy wins
+		}
+		if got, _ := buff.Contents().GetInt(100); got != want {
+			t.Errorf("Block %d: expected %d, got %d", i, want, got)
+		}
+	}
+	ring.Close()
+
+	after := bufferMgr.ResidentBlocks()
+	if fmt.Sprint(before) != fmt.Sprint(after) {
+		t.Errorf("Expected resident blocks %v to be unchanged, got %v", before, after)
+	}
+}
+
+func TestCompactedPageIsFlushed(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 400)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	bufferMgr := NewBufferMgr(fm, 3, InitClock(3, fm))
+
+	blk, err := fm.Append("compact.db")
+	if err != nil {
+		t.Fatalf("Failed to append block: %v", err)
+	}
+	buff, err := bufferMgr.Pin(blk)
+	if err != nil {
+		t.Fatalf("Failed to pin block: %v", err)
+	}
+	page := buff.Contents()
+	for _, k := range []string{"a", "b", "c"} {
+		cell := kfile.NewKVCell([]byte(k))
+		cell.SetValue(strings.Repeat(k, 40))
+		if err := page.InsertCell(cell); err != nil {
+			t.Fatalf("InsertCell failed: %v", err)
+		}
+	}
+	if err := page.DeleteCell(0); err != nil {
+		t.Fatalf("DeleteCell failed: %v", err)
+	}
+
+	held := page.Contents()
+	if err := page.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	buff.MarkModified(1, -1)
+	if err := buff.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	onDisk := kfile.NewSlottedPage(fm.BlockSize())
+	if err := fm.Read(blk, onDisk); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(onDisk.Contents(), page.Contents()) {
+		t.Errorf("Expected the compacted page to reach disk")
+	}
+	if !bytes.Equal(held, page.Contents()) {
+		t.Errorf("Expected a previously obtained Contents slice to see the compaction")
+	}
+}
+
+func TestCompactionMetrics(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 400)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	bufferMgr := NewBufferMgr(fm, 3, InitClock(3, fm))
+
+	blk, err := fm.Append("vacuum.db")
+	if err != nil {
+		t.Fatalf("Failed to append block: %v", err)
+	}
+	buff, err := bufferMgr.Pin(blk)
+	if err != nil {
+		t.Fatalf("Failed to pin block: %v", err)
+	}
+	page := buff.Contents()
+	sizes := make(map[string]int)
+	for i, k := range []string{"a", "b", "c", "d"} {
+		cell := kfile.NewKVCell([]byte(k))
+		cell.SetValue(strings.Repeat(k, 10*(i+1)))
+		sizes[k] = len(cell.ToBytes()) + 4 // plus the length prefix
+		if err := page.InsertCell(cell); err != nil {
+			t.Fatalf("InsertCell failed: %v", err)
+		}
+	}
+	// Delete "b" and then "d" (slot 2 once "b" is gone).
+	for _, slot := range []int{1, 2} {
+		if err := page.DeleteCell(slot); err != nil {
+			t.Fatalf("DeleteCell failed: %v", err)
+		}
+	}
+	if err := page.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+
+	got := bufferMgr.CompactionMetrics().Totals("vacuum.db")
+	want := kfile.CompactionTotals{
+		Compactions:    1,
+		CellsRetained:  2,
+		CellsDropped:   2,
+		BytesReclaimed: sizes["b"] + sizes["d"],
+	}
+	if got != want {
+		t.Errorf("Expected totals %+v, got %+v", want, got)
+	}
+	if files := bufferMgr.CompactionMetrics().Files(); fmt.Sprint(files) != "[vacuum.db]" {
+		t.Errorf("Expected metrics for vacuum.db only, got %v", files)
+	}
+}
+
+func TestMemoryPressureEvictsCleanPages(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 400)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	bufferMgr := NewBufferMgr(fm, 8, InitClock(8, fm))
+
+	var buffs []*Buffer
+	for i := 0; i < 6; i++ {
+		blk, err := fm.Append("pressure.db")
+		if err != nil {
+			t.Fatalf("Failed to append block: %v", err)
+		}
+		buff, err := bufferMgr.Pin(blk)
+		if err != nil {
+			t.Fatalf("Failed to pin block: %v", err)
+		}
+		buffs = append(buffs, buff)
+	}
+	// Blocks 0 and 1 are dirty, block 2 stays pinned, 3-5 are clean.
+	buffs[0].MarkModified(1, -1)
+	buffs[1].MarkModified(1, -1)
+	for i, buff := range buffs {
+		if i != 2 {
+			bufferMgr.Unpin(buff)
+		}
+	}
+
+	if evicted := bufferMgr.SetMemoryPressure(2); evicted != 3 {
+		t.Errorf("Expected the 3 clean pages to be evicted, got %d", evicted)
+	}
+	want := fmt.Sprint([]kfile.BlockId{
+		*kfile.NewBlockId("pressure.db", 0),
+		*kfile.NewBlockId("pressure.db", 1),
+		*kfile.NewBlockId("pressure.db", 2),
+	})
+	if got := fmt.Sprint(bufferMgr.ResidentBlocks()); got != want {
+		t.Errorf("Expected dirty and pinned pages %s to stay resident, got %s", want, got)
+	}
+
+	// While under pressure the pool trims itself back after each miss.
+	buff, err := bufferMgr.Pin(kfile.NewBlockId("pressure.db", 4))
+	if err != nil {
+		t.Fatalf("Failed to pin block: %v", err)
+	}
+	bufferMgr.Unpin(buff)
+	if _, err := bufferMgr.Pin(kfile.NewBlockId("pressure.db", 5)); err != nil {
+		t.Fatalf("Failed to pin block: %v", err)
+	}
+	if n := len(bufferMgr.ResidentBlocks()); n != 4 {
+		t.Errorf("Expected 4 resident pages under pressure, got %d", n)
+	}
+
+	// Once pressure eases the pool grows again.
+	bufferMgr.ReleaseMemoryPressure()
+	buff, err = bufferMgr.Pin(kfile.NewBlockId("pressure.db", 3))
+	if err != nil {
+		t.Fatalf("Failed to pin block: %v", err)
+	}
+	bufferMgr.Unpin(buff)
+	if n := len(bufferMgr.ResidentBlocks()); n != 5 {
+		t.Errorf("Expected the pool to grow back to 5 resident pages, got %d", n)
+	}
+}
+
+func TestClockEvictCleanFollowsTheHand(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 400)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	policy := InitClock(3, fm)
+
+	for i := int32(0); i < 3; i++ {
+		buff, err := policy.AllocateBufferForBlock(*kfile.NewBlockId("clock.db", i))
+		if err != nil {
+			t.Fatalf("Failed to allocate buffer: %v", err)
+		}
+		buff.Unpin()
+	}
+	// Every page is referenced, so the first turn only clears the bits.
+	if evicted := policy.EvictClean(2); evicted != 1 {
+		t.Fatalf("Expected 1 page to be evicted, got %d", evicted)
+	}
+	// Block 1 is referenced again and so outlives block 2, though it sits
+	// first in block order.
+	buff, err := policy.Get(*kfile.NewBlockId("clock.db", 1))
+	if err != nil {
+		t.Fatalf("Failed to get buffer: %v", err)
+	}
+	buff.Unpin()
+	if evicted := policy.EvictClean(1); evicted != 1 {
+		t.Fatalf("Expected 1 page to be evicted, got %d", evicted)
+	}
+	want := fmt.Sprint([]kfile.BlockId{*kfile.NewBlockId("clock.db", 1)})
+	if got := fmt.Sprint(policy.ResidentBlocks()); got != want {
+		t.Errorf("Expected %s to stay resident, got %s", want, got)
+	}
+
+	// A full pool evicts rather than growing past its capacity.
+	for i := int32(3); i < 6; i++ {
+		buff, err := policy.AllocateBufferForBlock(*kfile.NewBlockId("clock.db", i))
+		if err != nil {
+			t.Fatalf("Failed to allocate buffer: %v", err)
+		}
+		buff.Unpin()
+	}
+	if n := len(policy.ResidentBlocks()); n != 3 {
+		t.Errorf("Expected 3 resident pages, got %d", n)
+	}
+}
+
+func TestEnableCellTimestamps(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 400)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	bufferMgr := NewBufferMgr(fm, 1, InitLRU(1, fm))
+	stamped := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	bufferMgr.EnableCellTimestamps("stamped.db", func() time.Time { return stamped })
+
+	// One frame serves both files in turn, read in by a pin or a prefetch.
+	steps := []struct {
+		file     string
+		prefetch bool
+	}{
+		{"stamped.db", false},
+		{"plain.db", false},
+		{"stamped.db", true},
+		{"plain.db", true},
+		{"stamped.db", false},
+	}
+	for _, step := range steps {
+		file := step.file
+		blk, err := fm.Append(file)
+		if err != nil {
+			t.Fatalf("Failed to append block: %v", err)
+		}
+		if step.prefetch {
+			if n := <-bufferMgr.Prefetch([]*kfile.BlockId{blk}); n != 1 {
+				t.Fatalf("%s: expected the block to be prefetched, got %d", file, n)
+			}
+		}
+		buff, err := bufferMgr.Pin(blk)
+		if err != nil {
+			t.Fatalf("Failed to pin block: %v", err)
+		}
+		if err := buff.Contents().InsertCell(kfile.NewKVCell([]byte("key"))); err != nil {
+			t.Fatalf("InsertCell failed: %v", err)
+		}
+		cell, _, err := buff.Contents().FindCell([]byte("key"))
+		if err != nil {
+			t.Fatalf("FindCell failed: %v", err)
+		}
+		if want := file == "stamped.db"; cell.HasTimestamps() != want {
+			t.Errorf("%s: expected timestamps %v, got %v", file, want, cell.HasTimestamps())
+		} else if want && !cell.CreatedAt().Equal(stamped) {
+			t.Errorf("%s: expected the cell stamped %v, got %v", file, stamped, cell.CreatedAt())
+		}
+		bufferMgr.Unpin(buff)
+	}
+}
+
+// captureHandler records every log record it receives.
+type captureHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *captureHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *captureHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r)
+	return nil
+}
+
+func (h *captureHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *captureHandler) WithGroup(string) slog.Handler      { return h }
+
+func TestBufferMgrLogging(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 400)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	bufferMgr := NewBufferMgr(fm, 3, InitClock(3, fm))
+	handler := &captureHandler{}
+	bufferMgr.SetLogger(slog.New(handler))
+
+	buff, err := bufferMgr.Pin(kfile.NewBlockId("logging.db", 0))
+	if err != nil {
+		t.Fatalf("Failed to pin block: %v", err)
+	}
+	bufferMgr.Unpin(buff)
+	bufferMgr.Unpin(buff)
+
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if len(handler.records) != 2 {
+		t.Fatalf("Expected 2 log records, got %d", len(handler.records))
+	}
+	miss, unpin := handler.records[0], handler.records[1]
+	if miss.Level != slog.LevelDebug || miss.Message != "buffer pool miss" {
+		t.Errorf("Expected a debug record for the pool miss, got %s %q", miss.Level, miss.Message)
+	}
+	if unpin.Level != slog.LevelWarn || unpin.Message != "unpin called on an unpinned buffer" {
+		t.Errorf("Expected a warning for the second unpin, got %s %q", unpin.Level, unpin.Message)
+	}
+}
+
+func TestPrefetchLogsWhileLoggerChanges(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 400)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	bufferMgr := NewBufferMgr(fm, 3, InitLRU(3, fm))
+	handler := &captureHandler{}
+	bufferMgr.SetLogger(slog.New(handler))
+
+	// Blocks with negative numbers cannot be read, so each is logged.
+	var bad []*kfile.BlockId
+	for i := 0; i < 200; i++ {
+		bad = append(bad, &kfile.BlockId{Filename: "prefetch.db", Blknum: -1})
+	}
+	done := bufferMgr.Prefetch(bad)
+	// Swapping the logger during the prefetch must not race with it.
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				bufferMgr.SetLogger(slog.New(handler))
+			}
+		}()
+	}
+	wg.Wait()
+	if n := <-done; n != 0 {
+		t.Errorf("Expected nothing prefetched, got %d", n)
+	}
+
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if len(handler.records) != len(bad) {
+		t.Fatalf("Expected %d failed prefetches logged, got %d", len(bad), len(handler.records))
+	}
+	for _, r := range handler.records {
+		if r.Message != "prefetch failed" {
+			t.Errorf("Unexpected log record %q", r.Message)
+		}
+	}
+}
+
+func TestPrefetchedPageReadsOverflow(t *testing.T) {
+	const blocksize = 400
+	fm, err := kfile.NewFileMgr(t.TempDir(), blocksize)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+
+	// Store a value twice the page size, spilled into the overflow file.
+	big := bytes.Repeat([]byte("0123456789abcdef"), 2*blocksize/16)
+	cell := kfile.NewKVCell([]byte("row"))
+	if err := cell.SetValue(big); err != nil {
+		t.Fatalf("SetValue failed: %v", err)
+	}
+	page := kfile.NewSlottedPage(blocksize)
+	spill, err := page.SpillCell(cell, 0)
+	if err != nil {
+		t.Fatalf("SpillCell failed: %v", err)
+	}
+	ovf, err := fm.AppendN(kfile.OverflowFile("spill.db"), len(spill.Fragments))
+	if err != nil {
+		t.Fatalf("AppendN failed: %v", err)
+	}
+	blks := make([]int32, len(ovf))
+	for i, blk := range ovf {
+		blks[i] = blk.Number()
+	}
+	spill.Chain(blks)
+	for i, frag := range spill.Fragments {
+		p := kfile.NewSlottedPage(blocksize)
+		if err := p.RestoreCell(frag); err != nil {
+			t.Fatalf("RestoreCell failed: %v", err)
+		}
+		if err := fm.Write(ovf[i], p); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := page.RestoreCell(spill.Inline); err != nil {
+		t.Fatalf("RestoreCell failed: %v", err)
+	}
+	home := kfile.NewBlockId("spill.db", 0)
+	if err := fm.Write(home, page); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	bufferMgr := NewBufferMgr(fm, 2, InitLRU(2, fm))
+	if n := <-bufferMgr.Prefetch([]*kfile.BlockId{home}); n != 1 {
+		t.Fatalf("Expected the block to be prefetched, got %d", n)
+	}
+	buff, err := bufferMgr.Pin(home)
+	if err != nil {
+		t.Fatalf("Failed to pin block: %v", err)
+	}
+	defer bufferMgr.Unpin(buff)
+	if bufferMgr.Stats().Hits != 1 {
+		t.Fatalf("Expected the pin to hit the prefetched page")
+	}
+	got, _, err := buff.Contents().FindCell([]byte("row"))
+	if err != nil {
+		t.Fatalf("FindCell failed: %v", err)
+	}
+	if v, err := got.GetValue(); err != nil || !bytes.Equal(v.([]byte), big) {
+		t.Errorf("Expected the prefetched page to read the value back whole (err %v)", err)
+	}
+}
+
+func TestSetContentsRebuildsSlots(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 400)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	bufferMgr := NewBufferMgr(fm, 3, InitClock(3, fm))
+	buff, err := bufferMgr.Pin(kfile.NewBlockId("contents.db", 0))
+	if err != nil {
+		t.Fatalf("Failed to pin block: %v", err)
+	}
+	defer bufferMgr.Unpin(buff)
+
+	insert := func(p *kfile.SlottedPage, keys ...string) {
+		for _, k := range keys {
+			cell := kfile.NewKVCell([]byte(k))
+			cell.SetValue("value " + k)
+			if err := p.InsertCell(cell); err != nil {
+				t.Fatalf("InsertCell failed: %v", err)
+			}
+		}
+	}
+	insert(buff.Contents(), "a", "b", "c")
+
+	other := kfile.NewSlottedPage(400)
+	insert(other, "z", "x", "y")
+	_, slot, _ := other.FindCell([]byte("y"))
+	if err := other.DeleteCell(slot); err != nil {
+		t.Fatalf("DeleteCell failed: %v", err)
+	}
+	data := bytes.Clone(other.Contents())
+
+	if err := buff.Contents().SetContents(data); err != nil {
+		t.Fatalf("SetContents failed: %v", err)
+	}
+	for _, k := range []string{"x", "z"} {
+		cell, _, err := buff.Contents().FindCell([]byte(k))
+		if err != nil {
+			t.Fatalf("FindCell(%s) failed after SetContents: %v", k, err)
+		}
+		if got, _ := cell.GetValue(); got != "value "+k {
+			t.Errorf("Key %s: expected %q, got %q", k, "value "+k, got)
+		}
+	}
+	for _, k := range []string{"a", "y"} {
+		if _, _, err := buff.Contents().FindCell([]byte(k)); !errors.Is(err, kfile.ErrKeyNotFound) {
+			t.Errorf("Expected key %s to be gone, got %v", k, err)
+		}
+	}
+
+	// Malformed bytes are rejected and leave the current contents in place.
+	bad := bytes.Clone(data)
+	bad[0], bad[1], bad[2], bad[3] = 0, 0, 2, 0 // page size 512
+	if err := buff.Contents().SetContents(bad); err == nil {
+		t.Errorf("Expected SetContents to reject a malformed page")
+	}
+	if _, _, err := buff.Contents().FindCell([]byte("x")); err != nil {
+		t.Errorf("Rejected SetContents disturbed the page: %v", err)
+	}
+}
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 400)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	policy := InitLRU(3, fm)
+	bufferMgr := NewBufferMgr(fm, 3, policy)
+
+	var blocks []*kfile.BlockId
+	for i := 0; i < 4; i++ {
+		blk, err := fm.Append("lru.db")
+		if err != nil {
+			t.Fatalf("Failed to append block: %v", err)
+		}
+		blocks = append(blocks, blk)
+	}
+	buffs := make([]*Buffer, 3)
+	for i := range buffs {
+		if buffs[i], err = bufferMgr.Pin(blocks[i]); err != nil {
+			t.Fatalf("Failed to pin block %d: %v", i, err)
+		}
+	}
+	// Touch block 0 so block 1 becomes the least recently used, then keep
+	// block 2 pinned so only blocks 0 and 1 are candidates.
+	if _, err := bufferMgr.Pin(blocks[0]); err != nil {
+		t.Fatalf("Failed to re-pin block 0: %v", err)
+	}
+	bufferMgr.Unpin(buffs[0])
+	bufferMgr.Unpin(buffs[0])
+	bufferMgr.Unpin(buffs[1])
+
+	if _, err := bufferMgr.Pin(blocks[3]); err != nil {
+		t.Fatalf("Failed to pin block 3: %v", err)
+	}
+	var resident []int32
+	for _, blk := range policy.ResidentBlocks() {
+		resident = append(resident, blk.Number())
+	}
+	if got := fmt.Sprint(resident); got != "[0 2 3]" {
+		t.Errorf("Expected block 1 to be evicted, resident blocks are %s", got)
+	}
+
+	// With blocks 2 and 3 pinned, block 0 is the only remaining victim.
+	victim, err := policy.Evict()
+	if err != nil {
+		t.Fatalf("Evict failed: %v", err)
+	}
+	if victim.Block().Number() != 0 {
+		t.Errorf("Expected block 0 to be evicted, got %v", victim.Block())
+	}
+	if _, err := policy.Evict(); !errors.Is(err, ErrNoUnpinnedBuffers) {
+		t.Errorf("Expected ErrNoUnpinnedBuffers with every buffer pinned, got %v", err)
+	}
+}
+
+func TestARCBeatsLRUOnScans(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 400)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+
+	// A hot set of six blocks, read twice per round, is interleaved with a
+	// scan of twelve blocks that are never read again. The scan is longer
+	// than the cache, so LRU loses the hot set every round while ARC keeps
+	// it in T2 and lets the scan churn through T1.
+	const capacity, hot, scan, rounds = 8, 6, 12, 10
+	var trace []kfile.BlockId
+	next := int32(hot)
+	for r := 0; r < rounds; r++ {
+		for pass := 0; pass < 2; pass++ {
+			for i := int32(0); i < hot; i++ {
+				trace = append(trace, *kfile.NewBlockId("arc.db", i))
+			}
+		}
+		for i := 0; i < scan; i++ {
+			trace = append(trace, *kfile.NewBlockId("arc.db", next))
+			next++
+		}
+	}
+	for i := int32(0); i < next; i++ {
+		if _, err := fm.Append("arc.db"); err != nil {
+			t.Fatalf("Failed to append block: %v", err)
+		}
+	}
+
+	hitRatio := func(policy EvictionPolicy) float64 {
+		hits := 0
+		for _, blk := range trace {
+			buff, err := policy.Get(blk)
+			if err == nil {
+				hits++
+			} else if buff, err = policy.AllocateBufferForBlock(blk); err != nil {
+				t.Fatalf("Failed to allocate buffer for %v: %v", blk, err)
+			}
+			if err := buff.Unpin(); err != nil {
+				t.Fatalf("Failed to unpin %v: %v", blk, err)
+			}
+		}
+		return float64(hits) / float64(len(trace))
+	}
+
+	lru := hitRatio(InitLRU(capacity, fm))
+	arc := hitRatio(InitARC(capacity, fm))
+	if arc <= lru {
+		t.Errorf("Expected ARC hit ratio above LRU, got ARC %.2f and LRU %.2f", arc, lru)
+	}
+	t.Logf("hit ratio: ARC %.2f, LRU %.2f", arc, lru)
+}
+
+func TestPrefetchMakesNextPinAHit(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 400)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	bufferMgr := NewBufferMgr(fm, 3, InitLRU(3, fm))
+
+	var blocks []*kfile.BlockId
+	for i := 0; i < 5; i++ {
+		blk, err := fm.Append("scan.db")
+		if err != nil {
+			t.Fatalf("Failed to append block: %v", err)
+		}
+		blocks = append(blocks, blk)
+	}
+
+	if n := <-bufferMgr.Prefetch(blocks[:2]); n != 2 {
+		t.Fatalf("Expected 2 blocks prefetched, got %d", n)
+	}
+	if avail := bufferMgr.Available(); avail != 3 {
+		t.Errorf("Expected prefetched blocks to stay unpinned, %d of 3 buffers available", avail)
+	}
+	for i, blk := range blocks[:2] {
+		hits, misses := bufferMgr.hitCounter, bufferMgr.missCounter
+		buff, err := bufferMgr.Pin(blk)
+		if err != nil {
+			t.Fatalf("Failed to pin block %d: %v", i, err)
+		}
+		if bufferMgr.hitCounter != hits+1 || bufferMgr.missCounter != misses {
+			t.Errorf("Expected pinning prefetched block %d to be a hit", i)
+		}
+		if buff.Block().Number() != blk.Number() {
+			t.Errorf("Pinned buffer holds %v, want %v", buff.Block(), blk)
+		}
+	}
+
+	// With every buffer pinned, prefetching skips the block rather than
+	// evicting a pinned one.
+	if _, err := bufferMgr.Pin(blocks[2]); err != nil {
+		t.Fatalf("Failed to pin block 2: %v", err)
+	}
+	if n := <-bufferMgr.Prefetch(blocks[3:]); n != 0 {
+		t.Errorf("Expected nothing prefetched with no buffer available, got %d", n)
+	}
+	var resident []int32
+	for _, blk := range bufferMgr.ResidentBlocks() {
+		resident = append(resident, blk.Number())
+	}
+	if got := fmt.Sprint(resident); got != "[0 1 2]" {
+		t.Errorf("Expected the pinned blocks to stay resident, got %s", got)
+	}
+}
+
+func TestBufferStats(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 400)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	bufferMgr := NewBufferMgr(fm, 1, InitLRU(1, fm))
+
+	blk0, err := fm.Append("stats.db")
+	if err != nil {
+		t.Fatalf("Failed to append block: %v", err)
+	}
+	blk1, err := fm.Append("stats.db")
+	if err != nil {
+		t.Fatalf("Failed to append block: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		buff, err := bufferMgr.Pin(blk0)
+		if err != nil {
+			t.Fatalf("Failed to pin block: %v", err)
+		}
+		bufferMgr.Unpin(buff)
+	}
+	if got, want := bufferMgr.Stats(), (BufferStats{Hits: 1, Misses: 1, HitRatio: 0.5}); got != want {
+		t.Errorf("Expected %+v after pinning one block twice, got %+v", want, got)
+	}
+
+	// The pool holds one block, so pinning another evicts the first.
+	if _, err := bufferMgr.Pin(blk1); err != nil {
+		t.Fatalf("Failed to pin block: %v", err)
+	}
+	if got := bufferMgr.Stats(); got.Misses != 2 || got.Evictions != 1 {
+		t.Errorf("Expected 2 misses and 1 eviction, got %+v", got)
+	}
+
+	bufferMgr.ResetStats()
+	if got := bufferMgr.Stats(); got != (BufferStats{}) {
+		t.Errorf("Expected zeroed stats after ResetStats, got %+v", got)
+	}
+}
+
+func TestRawPage(t *testing.T) {
+	dir := t.TempDir()
+	const blockSize = 400
+	fm, err := kfile.NewFileMgr(dir, blockSize)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	bufferMgr := NewBufferMgr(fm, 1, InitLRU(1, fm))
+
+	fm.Append("raw.db")
+	blk, err := fm.Append("raw.db")
+	if err != nil {
+		t.Fatalf("Failed to append block: %v", err)
+	}
+	buff, err := bufferMgr.Pin(blk)
+	if err != nil {
+		t.Fatalf("Failed to pin block: %v", err)
+	}
+	const offset = 100
+	if err := buff.RawPage().SetInt(offset, 0x01020304); err != nil {
+		t.Fatalf("SetInt failed: %v", err)
+	}
+	buff.MarkModified(1, 0)
+	if err := buff.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	bufferMgr.Unpin(buff)
+
+	data, err := os.ReadFile(filepath.Join(dir, "raw.db"))
+	if err != nil {
+		t.Fatalf("Failed to read data file: %v", err)
+	}
+	at := int(blk.Number())*blockSize + offset
+	if got := data[at : at+4]; !bytes.Equal(got, []byte{1, 2, 3, 4}) {
+		t.Errorf("Expected the integer at byte %d on disk, got %v", at, got)
+	}
+	if v, err := buff.RawPage().GetInt(offset); err != nil || v != 0x01020304 {
+		t.Errorf("Expected GetInt to read back 0x01020304, got %#x (%v)", v, err)
+	}
+}
+
+func TestPinPastEndOfFile(t *testing.T) {
+	const blockSize = 400
+	for _, tc := range []struct {
+		name   string
+		policy func(fm *kfile.FileMgr) EvictionPolicy
+	}{
+		{"Clock", func(fm *kfile.FileMgr) EvictionPolicy { return InitClock(1, fm) }},
+		{"LRU", func(fm *kfile.FileMgr) EvictionPolicy { return InitLRU(1, fm) }},
+		{"ARC", func(fm *kfile.FileMgr) EvictionPolicy { return InitARC(1, fm) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fm, err := kfile.NewFileMgr(t.TempDir(), blockSize)
+			if err != nil {
+				t.Fatalf("Failed to create FileMgr: %v", err)
+			}
+			defer fm.Close()
+			bm := NewBufferMgr(fm, 1, tc.policy(fm))
+
+			// Fill the only frame with a written block first, so that a
+			// stale page would show.
+			blk, err := fm.Append("data.db")
+			if err != nil {
+				t.Fatalf("Append failed: %v", err)
+			}
+			page := kfile.NewSlottedPage(blockSize)
+			if err := page.SetInt(100, 1234); err != nil {
+				t.Fatalf("SetInt failed: %v", err)
+			}
+			if err := fm.Write(blk, page); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			buff, err := bm.Pin(blk)
+			if err != nil {
+				t.Fatalf("Pin failed: %v", err)
+			}
+			bm.Unpin(buff)
+
+			// A block past the end pins as an empty page and reaches the
+			// file when flushed.
+			next := kfile.NewBlockId("data.db", 3)
+			buff, err = bm.Pin(next)
+			if err != nil {
+				t.Fatalf("Pin of a block past the end failed: %v", err)
+			}
+			if v, err := buff.Contents().GetInt(100); err != nil || v != 0 {
+				t.Errorf("Expected a block past the end to pin as an empty page, read %d (%v)", v, err)
+			}
+			if n := len(buff.Contents().GetAllSlots()); n != 0 {
+				t.Errorf("Expected a block past the end to pin with no cells, got %d", n)
+			}
+			if err := buff.Contents().SetInt(100, 4321); err != nil {
+				t.Fatalf("SetInt failed: %v", err)
+			}
+			buff.MarkModified(1, 0)
+			if err := buff.Flush(); err != nil {
+				t.Fatalf("Flush failed: %v", err)
+			}
+			bm.Unpin(buff)
+			if n, _ := fm.Length("data.db"); n != 4 {
+				t.Errorf("Expected the flush to extend the file to 4 blocks, got %d", n)
+			}
+			if err := fm.Read(next, page); err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+			if v, err := page.GetInt(100); err != nil || v != 4321 {
+				t.Errorf("Expected block 3 to hold 4321, got %d (%v)", v, err)
+			}
+		})
+	}
+}
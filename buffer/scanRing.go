@@ -0,0 +1,75 @@
+package buffer
+
+import (
+	"fmt"
+	"ultraSQL/kfile"
+)
+
+// ScanRing serves the blocks of a large sequential scan from a small ring of
+// private buffers instead of the main pool, so that the scan does not evict
+// the pool's hot pages. A block that is already resident in the pool is read
+// from there, so the scan still sees unflushed changes.
+//
+// A buffer returned by Read stays valid until the ring wraps around to its
+// slot again, i.e. for the next size-1 calls to Read.
+type ScanRing struct {
+	bm     *BufferMgr
+	frames []*Buffer
+	pooled []*Buffer // pool buffers pinned on behalf of each slot
+	next   int
+}
+
+// NewScanRing creates a ring of size private buffers reading through bm.
+func (bm *BufferMgr) NewScanRing(size int) (*ScanRing, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("scan ring size must be positive, got %d", size)
+	}
+	r := &ScanRing{
+		bm:     bm,
+		frames: make([]*Buffer, size),
+		pooled: make([]*Buffer, size),
+	}
+	for i := range r.frames {
+		r.frames[i] = NewBuffer(bm.fm)
+	}
+	return r, nil
+}
+
+// Read returns a buffer holding blk, reusing the oldest slot of the ring.
+func (r *ScanRing) Read(blk *kfile.BlockId) (*Buffer, error) {
+	slot := r.next
+	r.next = (r.next + 1) % len(r.frames)
+	r.releaseSlot(slot)
+
+	r.bm.mu.Lock()
+	if r.bm.closed {
+		r.bm.mu.Unlock()
+		return nil, ErrClosed
+	}
+	buff, err := r.bm.policy.Get(*blk)
+	r.bm.mu.Unlock()
+	if err == nil && buff != nil {
+		r.pooled[slot] = buff
+		return buff, nil
+	}
+
+	frame := r.frames[slot]
+	if err := frame.assignToBlock(blk); err != nil {
+		return nil, fmt.Errorf("scan ring failed to read block %v: %w", blk, err)
+	}
+	return frame, nil
+}
+
+// Close releases any pool buffers the ring still holds.
+func (r *ScanRing) Close() {
+	for slot := range r.pooled {
+		r.releaseSlot(slot)
+	}
+}
+
+func (r *ScanRing) releaseSlot(slot int) {
+	if buff := r.pooled[slot]; buff != nil {
+		r.bm.Unpin(buff)
+		r.pooled[slot] = nil
+	}
+}
@@ -3,34 +3,57 @@ package concurrency
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 	"ultraSQL/kfile"
 )
 
+// nextOwner hands out the ids that identify each Mgr's key-range locks.
+var nextOwner atomic.Uint64
+
 type Mgr struct {
+	id    uint64
 	lTble *LockTable
 	locks map[kfile.BlockId]string
 	mu    sync.RWMutex // Protect shared map access
 }
 
 func NewConcurrencyMgr() *Mgr {
+	return NewConcurrencyMgrWithTable(NewLockTable())
+}
+
+// NewConcurrencyMgrWithTable returns a Mgr that takes its locks in lt, so
+// that it conflicts with every other Mgr sharing the same table.
+func NewConcurrencyMgrWithTable(lt *LockTable) *Mgr {
 	return &Mgr{
-		lTble: NewLockTable(),
+		id:    nextOwner.Add(1),
+		lTble: lt,
 		locks: make(map[kfile.BlockId]string),
 	}
 }
 
+// Owner returns the id under which the Mgr's locks are held in its lock
+// table, as passed to a LockTable wait hook.
+func (cM *Mgr) Owner() uint64 {
+	return cM.id
+}
+
 func (cM *Mgr) SLock(blk kfile.BlockId) error {
+	return cM.SLockTimeout(blk, MaxWaitTime)
+}
+
+// SLockTimeout is SLock waiting at most d for a conflicting lock to be
+// released; after that it fails with ErrLockTimeout.
+func (cM *Mgr) SLockTimeout(blk kfile.BlockId, d time.Duration) error {
 	cM.mu.Lock()
 	defer cM.mu.Unlock()
 
 	// If we already have any lock (S or X), no need to acquire again
-	if locks, exists := cM.locks[blk]; exists {
-		if locks != "S" {
-			return fmt.Errorf("failed to acquire lock %v: already have a shared lock", blk)
-		}
+	if _, exists := cM.locks[blk]; exists {
+		return nil
 	}
 
-	err := cM.lTble.SLock(blk)
+	err := cM.lTble.SLockTimeout(cM.id, blk, d)
 	if err != nil {
 		return fmt.Errorf("failed to acquire shared lock: %w", err)
 	}
@@ -40,26 +63,36 @@ func (cM *Mgr) SLock(blk kfile.BlockId) error {
 }
 
 func (cM *Mgr) XLock(blk kfile.BlockId) error {
+	return cM.XLockTimeout(blk, MaxWaitTime)
+}
+
+// XLockTimeout is XLock waiting at most d in total, for the shared lock and
+// its upgrade together; after that it fails with ErrLockTimeout.
+func (cM *Mgr) XLockTimeout(blk kfile.BlockId, d time.Duration) error {
 	cM.mu.Lock()
 	defer cM.mu.Unlock()
 
 	// If we already have an X lock, no need to acquire again
 	if cM.hasXLock(blk) {
-		return fmt.Errorf("failed to acquire lock %v: already have an exclusive lock", blk)
+		return nil
 	}
 
+	deadline := time.Now().Add(d)
 	// Following the two-phase locking protocol:
 	// 1. First acquire S lock if we don't have any lock
 	if _, exists := cM.locks[blk]; !exists {
-		err := cM.lTble.SLock(blk)
+		err := cM.lTble.SLockTimeout(cM.id, blk, d)
 		if err != nil {
 			return fmt.Errorf("failed to acquire initial shared lock: %w", err)
 		}
 		cM.locks[blk] = "S"
 	}
 
-	// 2. Then upgrade to X lock
-	err := cM.lTble.XLock(blk)
+	// 2. Then upgrade to X lock. If another holder of the S lock is already
+	// upgrading this fails with ErrUpgradeConflict, and if waiting would
+	// deadlock with ErrDeadlock; either way the caller should release its
+	// locks rather than retry.
+	err := cM.lTble.UpgradeTimeout(cM.id, blk, time.Until(deadline))
 	if err != nil {
 		return fmt.Errorf("failed to upgrade to exclusive lock: %w", err)
 	}
@@ -74,13 +107,14 @@ func (cM *Mgr) Release() error {
 
 	var errs []error
 	for blk := range cM.locks {
-		if err := cM.lTble.Unlock(blk); err != nil {
+		if err := cM.lTble.Unlock(cM.id, blk); err != nil {
 			errs = append(errs, fmt.Errorf("failed to release lock for block %v: %w", blk, err))
 		}
 	}
 
 	// Clear the locks map regardless of errors
 	cM.locks = make(map[kfile.BlockId]string)
+	cM.lTble.UnlockRanges(cM.id)
 
 	if len(errs) > 0 {
 		return fmt.Errorf("errors during release: %v", errs)
@@ -88,6 +122,59 @@ func (cM *Mgr) Release() error {
 	return nil
 }
 
+// ReleaseLock releases the lock held on blk alone, keeping every other
+// lock, for read locks that need not last until commit. Releasing an
+// exclusive lock early breaks two-phase locking, so it is meant for shared
+// locks.
+func (cM *Mgr) ReleaseLock(blk kfile.BlockId) error {
+	cM.mu.Lock()
+	defer cM.mu.Unlock()
+
+	if _, exists := cM.locks[blk]; !exists {
+		return fmt.Errorf("no lock held on block %v", blk)
+	}
+	if err := cM.lTble.Unlock(cM.id, blk); err != nil {
+		return fmt.Errorf("failed to release lock for block %v: %w", blk, err)
+	}
+	delete(cM.locks, blk)
+	return nil
+}
+
+// RangeSLock locks the keys of filename in [lo, hi), and the gaps between
+// them, against inserts by other transactions until Release. A scan that
+// takes it before reading sees the same keys if it runs again, which
+// block-level locks alone cannot promise once new blocks are appended. A
+// nil hi locks every key from lo on. It waits for inserts already made into
+// the range by other transactions to be released.
+func (cM *Mgr) RangeSLock(filename string, lo, hi []byte) error {
+	return cM.RangeSLockTimeout(filename, lo, hi, MaxWaitTime)
+}
+
+// RangeSLockTimeout is RangeSLock waiting at most d for conflicting inserts
+// to be released; after that it fails with ErrLockTimeout.
+func (cM *Mgr) RangeSLockTimeout(filename string, lo, hi []byte, d time.Duration) error {
+	if err := cM.lTble.LockRangeTimeout(cM.id, filename, lo, hi, false, d); err != nil {
+		return fmt.Errorf("failed to acquire range lock: %w", err)
+	}
+	return nil
+}
+
+// KeyXLock locks key in filename for an insert until Release, waiting while
+// another transaction holds a range lock covering it.
+func (cM *Mgr) KeyXLock(filename string, key []byte) error {
+	return cM.KeyXLockTimeout(filename, key, MaxWaitTime)
+}
+
+// KeyXLockTimeout is KeyXLock waiting at most d for covering range locks to
+// be released; after that it fails with ErrLockTimeout.
+func (cM *Mgr) KeyXLockTimeout(filename string, key []byte, d time.Duration) error {
+	lo, hi := keyRange(key)
+	if err := cM.lTble.LockRangeTimeout(cM.id, filename, lo, hi, true, d); err != nil {
+		return fmt.Errorf("failed to acquire key lock: %w", err)
+	}
+	return nil
+}
+
 func (cM *Mgr) hasXLock(blk kfile.BlockId) bool {
 	// Note: Caller must hold mutex
 	lockType, ok := cM.locks[blk]
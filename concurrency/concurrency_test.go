@@ -1,6 +1,7 @@
 package concurrency
 
 import (
+	"errors"
 	"sync"
 	"testing"
 	"time"
@@ -83,7 +84,7 @@ func TestLockTableDirect(t *testing.T) {
 	blk := kfile.NewBlockId("testfile", 1)
 
 	// Acquire shared lock
-	if err := lt.SLock(*blk); err != nil {
+	if err := lt.SLock(1, *blk); err != nil {
 		t.Fatalf("Failed to acquire shared lock: %v", err)
 	}
 	lockType, count := lt.GetLockInfo(*blk)
@@ -92,7 +93,7 @@ func TestLockTableDirect(t *testing.T) {
 	}
 
 	// Acquire exclusive lock (upgrade)
-	if err := lt.XLock(*blk); err != nil {
+	if err := lt.XLock(1, *blk); err != nil {
 		t.Fatalf("Failed to upgrade to exclusive lock: %v", err)
 	}
 	lockType, count = lt.GetLockInfo(*blk)
@@ -101,7 +102,7 @@ func TestLockTableDirect(t *testing.T) {
 	}
 
 	// Unlock
-	if err := lt.Unlock(*blk); err != nil {
+	if err := lt.Unlock(1, *blk); err != nil {
 		t.Fatalf("Failed to Unlock: %v", err)
 	}
 	lockType, count = lt.GetLockInfo(*blk)
@@ -109,3 +110,344 @@ func TestLockTableDirect(t *testing.T) {
 		t.Errorf("Expected no lock after Unlock, got type=%s count=%d", lockType, count)
 	}
 }
+
+func TestConflictingUpgradeFails(t *testing.T) {
+	lt := NewLockTable()
+	txA, txB := NewConcurrencyMgrWithTable(lt), NewConcurrencyMgrWithTable(lt)
+	blk := kfile.NewBlockId("testfile", 7)
+
+	if err := txA.SLock(*blk); err != nil {
+		t.Fatalf("txA failed to SLock: %v", err)
+	}
+	if err := txB.SLock(*blk); err != nil {
+		t.Fatalf("txB failed to SLock: %v", err)
+	}
+
+	upgraded := make(chan error, 1)
+	go func() { upgraded <- txA.XLock(*blk) }()
+
+	// Wait for txA's upgrade to be pending before txB tries its own.
+	deadline := time.Now().Add(time.Second)
+	for {
+		lt.mu.RLock()
+		pending := lt.upgrading[*blk]
+		lt.mu.RUnlock()
+		if pending {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("txA's upgrade never became pending")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	if err := txB.XLock(*blk); !errors.Is(err, ErrUpgradeConflict) {
+		t.Fatalf("Expected txB's upgrade to fail with ErrUpgradeConflict, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the conflict to be reported at once, took %v", elapsed)
+	}
+
+	// Once txB gives up its locks, txA's upgrade completes.
+	if err := txB.Release(); err != nil {
+		t.Fatalf("txB failed to release: %v", err)
+	}
+	select {
+	case err := <-upgraded:
+		if err != nil {
+			t.Fatalf("txA's upgrade failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("txA's upgrade did not complete after txB released")
+	}
+	if lockType, _ := lt.GetLockInfo(*blk); lockType != "exclusive" {
+		t.Errorf("Expected txA to hold an exclusive lock, got %s", lockType)
+	}
+	if err := txA.Release(); err != nil {
+		t.Fatalf("txA failed to release: %v", err)
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	lt := NewLockTable()
+	txA, txB := NewConcurrencyMgrWithTable(lt), NewConcurrencyMgrWithTable(lt)
+	blk := kfile.NewBlockId("testfile", 8)
+
+	if err := txA.XLock(*blk); err != nil {
+		t.Fatalf("txA failed to XLock: %v", err)
+	}
+
+	start := time.Now()
+	err := txB.SLockTimeout(*blk, 100*time.Millisecond)
+	elapsed := time.Since(start)
+	if !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("Expected ErrLockTimeout, got %v", err)
+	}
+	if elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Expected the request to give up after about 100ms, took %v", elapsed)
+	}
+
+	// The timed-out request left nothing behind: once txA releases, txB's
+	// next request is granted at once.
+	if err := txA.Release(); err != nil {
+		t.Fatalf("txA failed to release: %v", err)
+	}
+	if err := txB.XLockTimeout(*blk, 100*time.Millisecond); err != nil {
+		t.Fatalf("txB failed to XLock after release: %v", err)
+	}
+	if err := txB.Release(); err != nil {
+		t.Fatalf("txB failed to release: %v", err)
+	}
+}
+
+func TestReleaseLock(t *testing.T) {
+	lt := NewLockTable()
+	txA, txB := NewConcurrencyMgrWithTable(lt), NewConcurrencyMgrWithTable(lt)
+	blk1 := kfile.NewBlockId("testfile", 1)
+	blk2 := kfile.NewBlockId("testfile", 2)
+
+	if err := txA.SLock(*blk1); err != nil {
+		t.Fatalf("Failed to SLock blk1: %v", err)
+	}
+	if err := txA.SLock(*blk2); err != nil {
+		t.Fatalf("Failed to SLock blk2: %v", err)
+	}
+	if err := txA.ReleaseLock(*blk1); err != nil {
+		t.Fatalf("ReleaseLock failed: %v", err)
+	}
+
+	if _, held := txA.GetLockType(*blk1); held {
+		t.Error("Expected blk1 to be released")
+	}
+	if lockType, held := txA.GetLockType(*blk2); !held || lockType != "S" {
+		t.Errorf("Expected blk2 to stay S-locked, got %q (held %v)", lockType, held)
+	}
+
+	// Another transaction can now write blk1 but not blk2.
+	if err := txB.XLockTimeout(*blk1, 100*time.Millisecond); err != nil {
+		t.Errorf("Expected txB to XLock the released block, got %v", err)
+	}
+	if err := txB.XLockTimeout(*blk2, 100*time.Millisecond); !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("Expected txB's XLock on blk2 to time out, got %v", err)
+	}
+
+	if err := txA.ReleaseLock(*blk1); err == nil {
+		t.Error("Expected an error releasing a lock not held")
+	}
+	if err := txA.Release(); err != nil {
+		t.Fatalf("txA failed to release: %v", err)
+	}
+	if err := txB.Release(); err != nil {
+		t.Fatalf("txB failed to release: %v", err)
+	}
+}
+
+func TestRangeLockBlocksPhantomInsert(t *testing.T) {
+	lt := NewLockTable()
+	tx1, tx2 := NewConcurrencyMgrWithTable(lt), NewConcurrencyMgrWithTable(lt)
+
+	// tx1 scans keys b through d; tx2 then inserts c, which falls in a gap
+	// of that range.
+	if err := tx1.RangeSLock("accounts", []byte("b"), []byte("d")); err != nil {
+		t.Fatalf("tx1 failed to lock range: %v", err)
+	}
+
+	// Keys outside the scanned range are not held up.
+	if err := tx2.KeyXLock("accounts", []byte("d")); err != nil {
+		t.Fatalf("tx2 failed to lock key d outside the range: %v", err)
+	}
+	if err := tx2.KeyXLock("other", []byte("c")); err != nil {
+		t.Fatalf("tx2 failed to lock key c of another file: %v", err)
+	}
+
+	inserted := make(chan error, 1)
+	go func() { inserted <- tx2.KeyXLock("accounts", []byte("c")) }()
+
+	select {
+	case err := <-inserted:
+		t.Fatalf("Expected tx2's insert into the scanned range to block, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// A second scan of the range by tx1 is still allowed while tx2 waits.
+	if err := tx1.RangeSLock("accounts", []byte("a"), []byte("c")); err != nil {
+		t.Fatalf("tx1 failed to lock an overlapping range: %v", err)
+	}
+
+	// Committing tx1 releases its range locks and lets the insert through.
+	if err := tx1.Release(); err != nil {
+		t.Fatalf("tx1 failed to release: %v", err)
+	}
+	select {
+	case err := <-inserted:
+		if err != nil {
+			t.Fatalf("tx2's insert failed after tx1 committed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("tx2's insert did not proceed after tx1 committed")
+	}
+
+	// Until tx2 commits, a new scan over its insert waits in turn.
+	scanned := make(chan error, 1)
+	go func() { scanned <- tx1.RangeSLock("accounts", []byte("a"), nil) }()
+	select {
+	case err := <-scanned:
+		t.Fatalf("Expected a scan over tx2's insert to block, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := tx2.Release(); err != nil {
+		t.Fatalf("tx2 failed to release: %v", err)
+	}
+	if err := <-scanned; err != nil {
+		t.Fatalf("Scan failed after tx2 committed: %v", err)
+	}
+	if err := tx1.Release(); err != nil {
+		t.Fatalf("tx1 failed to release: %v", err)
+	}
+}
+
+func TestRangeLocksAreHeldOnce(t *testing.T) {
+	lt := NewLockTable()
+	tx1, tx2 := NewConcurrencyMgrWithTable(lt), NewConcurrencyMgrWithTable(lt)
+
+	for i := 0; i < 3; i++ {
+		if err := tx1.KeyXLock("accounts", []byte("c")); err != nil {
+			t.Fatalf("tx1 failed to lock key c: %v", err)
+		}
+		if err := tx1.RangeSLock("accounts", []byte("b"), []byte("d")); err != nil {
+			t.Fatalf("tx1 failed to lock range: %v", err)
+		}
+	}
+	if len(lt.ranges) != 2 {
+		t.Errorf("Expected repeated locks to be held once, got %d ranges", len(lt.ranges))
+	}
+
+	// A wider scan replaces the shared ranges it covers but not the key
+	// lock, which it does not grant.
+	if err := tx1.RangeSLock("accounts", []byte("a"), nil); err != nil {
+		t.Fatalf("tx1 failed to lock the open range: %v", err)
+	}
+	if err := tx1.RangeSLock("accounts", []byte("x"), []byte("y")); err != nil {
+		t.Fatalf("tx1 failed to lock a covered range: %v", err)
+	}
+	if len(lt.ranges) != 2 {
+		t.Errorf("Expected the open range to absorb the others, got %d ranges", len(lt.ranges))
+	}
+
+	// Another owner's request waits only as long as it asks to.
+	start := time.Now()
+	err := tx2.KeyXLockTimeout("accounts", []byte("m"), 50*time.Millisecond)
+	if !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("Expected ErrLockTimeout, got %v", err)
+	}
+	if waited := time.Since(start); waited > MaxWaitTime/2 {
+		t.Errorf("Expected the key lock to give up after its own timeout, waited %v", waited)
+	}
+	if err := tx2.RangeSLockTimeout("accounts", []byte("b"), []byte("d"), 50*time.Millisecond); !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("Expected a scan over tx1's insert to time out, got %v", err)
+	}
+	if err := tx1.Release(); err != nil {
+		t.Fatalf("tx1 failed to release: %v", err)
+	}
+	if len(lt.ranges) != 0 {
+		t.Errorf("Expected Release to drop every range, got %d", len(lt.ranges))
+	}
+}
+
+func TestDeadlockDetected(t *testing.T) {
+	lt := NewLockTable()
+	tx1, tx2 := NewConcurrencyMgrWithTable(lt), NewConcurrencyMgrWithTable(lt)
+	a, b := kfile.NewBlockId("testfile", 1), kfile.NewBlockId("testfile", 2)
+
+	if err := tx1.XLock(*a); err != nil {
+		t.Fatalf("tx1 failed to XLock a: %v", err)
+	}
+	if err := tx2.XLock(*b); err != nil {
+		t.Fatalf("tx2 failed to XLock b: %v", err)
+	}
+
+	// Each goroutine now wants the block the other holds.
+	errs := make(chan error, 2)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for _, req := range []struct {
+		tx  *Mgr
+		blk *kfile.BlockId
+	}{{tx1, b}, {tx2, a}} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := req.tx.XLock(*req.blk)
+			if err != nil {
+				// The victim gives up its locks so the other can proceed.
+				req.tx.Release()
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the deadlock to be reported at once, took %v", elapsed)
+	}
+
+	var deadlocks, granted int
+	for err := range errs {
+		switch {
+		case err == nil:
+			granted++
+		case errors.Is(err, ErrDeadlock):
+			deadlocks++
+		default:
+			t.Errorf("Unexpected lock error: %v", err)
+		}
+	}
+	if deadlocks != 1 || granted != 1 {
+		t.Errorf("Expected one deadlock and one grant, got %d and %d", deadlocks, granted)
+	}
+	tx1.Release()
+	tx2.Release()
+	if lockType, _ := lt.GetLockInfo(*a); lockType != "none" {
+		t.Errorf("Expected a to be unlocked, got %s", lockType)
+	}
+}
+
+func TestRangeDeadlockDetected(t *testing.T) {
+	lt := NewLockTable()
+	tx1, tx2 := NewConcurrencyMgrWithTable(lt), NewConcurrencyMgrWithTable(lt)
+	blk := kfile.NewBlockId("testfile", 3)
+
+	// tx1 scans a range and tx2 locks a block tx1 then waits for, while
+	// tx2 tries to insert into tx1's range.
+	if err := tx1.RangeSLock("accounts", []byte("a"), []byte("m")); err != nil {
+		t.Fatalf("tx1 failed to lock range: %v", err)
+	}
+	if err := tx2.XLock(*blk); err != nil {
+		t.Fatalf("tx2 failed to XLock: %v", err)
+	}
+	waiting := make(chan error, 1)
+	go func() { waiting <- tx1.SLock(*blk) }()
+	deadline := time.Now().Add(time.Second)
+	for {
+		lt.mu.RLock()
+		_, blocked := lt.waiting[tx1.id]
+		lt.mu.RUnlock()
+		if blocked {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("tx1's lock request never blocked")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := tx2.KeyXLock("accounts", []byte("c")); !errors.Is(err, ErrDeadlock) {
+		t.Fatalf("Expected tx2's insert to fail with ErrDeadlock, got %v", err)
+	}
+	tx2.Release()
+	if err := <-waiting; err != nil {
+		t.Fatalf("tx1's lock failed after tx2 released: %v", err)
+	}
+	tx1.Release()
+}
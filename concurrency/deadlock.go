@@ -0,0 +1,88 @@
+package concurrency
+
+import (
+	"errors"
+	"fmt"
+	"ultraSQL/kfile"
+)
+
+// ErrDeadlock is returned by a lock request that would wait for an owner
+// which is itself waiting, directly or through other owners, for the
+// requester. Waiting could only end in MaxWaitTime timeouts, so the
+// requester must give up its locks (typically by aborting) instead.
+var ErrDeadlock = errors.New("deadlock detected")
+
+// awaitBlock waits on lT.cond for the holders of blk to change, recording
+// that owner waits for them meanwhile. It fails at once with ErrDeadlock if
+// waiting would close a cycle in the wait-for graph. The caller must hold
+// lT.mu.
+func (lT *LockTable) awaitBlock(owner uint64, blk kfile.BlockId) error {
+	lT.waiting[owner] = blk
+	defer delete(lT.waiting, owner)
+	if lT.detectCycle(owner) {
+		return fmt.Errorf("lock on block %v: %w", blk, ErrDeadlock)
+	}
+	if lT.waitHook != nil {
+		lT.waitHook(owner)
+	}
+	lT.cond.Wait()
+	return nil
+}
+
+// awaitRange is awaitBlock for a key-range lock request.
+func (lT *LockTable) awaitRange(req keyRangeLock) error {
+	lT.waitingRange[req.owner] = req
+	defer delete(lT.waitingRange, req.owner)
+	if lT.detectCycle(req.owner) {
+		return fmt.Errorf("key-range lock on %s [%q, %q): %w", req.filename, req.lo, req.hi, ErrDeadlock)
+	}
+	if lT.waitHook != nil {
+		lT.waitHook(req.owner)
+	}
+	lT.cond.Wait()
+	return nil
+}
+
+// blockers returns the owners that owner is waiting for: the other holders
+// of the block it waits to lock, or the holders of range locks conflicting
+// with the range it waits to lock. The caller must hold lT.mu.
+func (lT *LockTable) blockers(owner uint64) []uint64 {
+	var out []uint64
+	if blk, ok := lT.waiting[owner]; ok {
+		for _, h := range lT.holders[blk] {
+			if h != owner {
+				out = append(out, h)
+			}
+		}
+	}
+	if req, ok := lT.waitingRange[owner]; ok {
+		for _, held := range lT.ranges {
+			if req.conflicts(held) {
+				out = append(out, held.owner)
+			}
+		}
+	}
+	return out
+}
+
+// detectCycle reports whether the wait-for graph, in which each waiting
+// owner points at its blockers, leads from start back to start. Edges are
+// derived from the current holders rather than stored, so they are never
+// stale. The caller must hold lT.mu.
+func (lT *LockTable) detectCycle(start uint64) bool {
+	visited := make(map[uint64]bool)
+	stack := lT.blockers(start)
+	for len(stack) > 0 {
+		o := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if o == start {
+			return true
+		}
+		if visited[o] {
+			continue
+		}
+		visited[o] = true
+		stack = append(stack, lT.blockers(o)...)
+	}
+	return false
+}
@@ -1,7 +1,9 @@
 package concurrency
 
 import (
+	"errors"
 	"fmt"
+	"slices"
 	"sync"
 	"time"
 	"ultraSQL/kfile"
@@ -9,59 +11,191 @@ import (
 
 const MaxWaitTime = 10 * time.Second
 
+// ErrUpgradeConflict is returned by Upgrade when another holder of a shared
+// lock on the same block is already waiting to upgrade. Each would wait for
+// the other to release its shared lock, so the later one must give up its
+// locks (typically by aborting) for the earlier one to proceed.
+var ErrUpgradeConflict = errors.New("conflicting lock upgrade")
+
+// ErrLockTimeout is returned by a lock request still blocked when its wait
+// time, MaxWaitTime unless the caller chose another, runs out.
+var ErrLockTimeout = errors.New("lock wait timed out")
+
+// LockTable grants shared and exclusive block locks, and key-range locks,
+// to owners. An owner identifies one transaction; concurrency.Mgr uses its
+// own id, so every lock a Mgr takes in the table is attributed to it.
 type LockTable struct {
-	locks map[kfile.BlockId]int // positive: number of shared locks, negative: exclusive lock
-	mu    sync.RWMutex
-	cond  *sync.Cond
+	locks     map[kfile.BlockId]int // positive: number of shared locks, negative: exclusive lock
+	holders   map[kfile.BlockId][]uint64
+	upgrading map[kfile.BlockId]bool
+	ranges    []keyRangeLock // key-range locks, see LockRange
+	// The lock each blocked owner is waiting for, see detectCycle.
+	waiting      map[uint64]kfile.BlockId
+	waitingRange map[uint64]keyRangeLock
+	waitHook     func(owner uint64) // see SetWaitHook
+	mu           sync.RWMutex
+	cond         *sync.Cond
 }
 
 func NewLockTable() *LockTable {
 	lt := &LockTable{
-		locks: make(map[kfile.BlockId]int),
+		locks:        make(map[kfile.BlockId]int),
+		holders:      make(map[kfile.BlockId][]uint64),
+		upgrading:    make(map[kfile.BlockId]bool),
+		waiting:      make(map[uint64]kfile.BlockId),
+		waitingRange: make(map[uint64]keyRangeLock),
 	}
 	lt.cond = sync.NewCond(&lt.mu)
 	return lt
 }
 
-func (lT *LockTable) SLock(blk kfile.BlockId) error {
+// SLock takes a shared lock on blk for owner, waiting while another owner
+// holds or is about to be granted an exclusive one. It fails with
+// ErrDeadlock instead of waiting when that owner is itself waiting, directly
+// or not, for owner, and with ErrLockTimeout after MaxWaitTime.
+func (lT *LockTable) SLock(owner uint64, blk kfile.BlockId) error {
+	return lT.SLockTimeout(owner, blk, MaxWaitTime)
+}
+
+// SLockTimeout is SLock waiting at most d.
+func (lT *LockTable) SLockTimeout(owner uint64, blk kfile.BlockId, d time.Duration) error {
 	lT.mu.Lock()
 	defer lT.mu.Unlock()
 
-	deadline := time.Now().Add(MaxWaitTime)
+	deadline := time.Now().Add(d)
+	var wake wakeTimer
+	defer wake.stop()
 
-	// Wait while there's an exclusive lock on the block
-	for lT.hasXLock(blk) {
-		if time.Now().After(deadline) {
-			return fmt.Errorf("shared lock acquisition timed out for block %v", blk)
+	// Wait while there's an exclusive lock on the block, or one is about to
+	// be granted to an upgrading holder, which new readers must not starve.
+	for lT.hasXLock(blk) || lT.upgrading[blk] {
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("shared lock on block %v: %w after %v", blk, ErrLockTimeout, d)
+		}
+		wake.arm(lT, deadline)
+		if err := lT.awaitBlock(owner, blk); err != nil {
+			return err
 		}
-		lT.cond.Wait()
 	}
 
 	// Increment the number of shared locks (or initialize to 1)
 	val := lT.getLockVal(blk)
 	lT.locks[blk] = val + 1
+	lT.holders[blk] = append(lT.holders[blk], owner)
 	return nil
 }
 
-func (lT *LockTable) XLock(blk kfile.BlockId) error {
+// XLock takes an exclusive lock on blk for owner, waiting while any other
+// owner holds a lock on it. A shared lock owner already holds is absorbed.
+// Like SLock, it fails with ErrDeadlock rather than wait in a cycle, and
+// with ErrLockTimeout after MaxWaitTime.
+func (lT *LockTable) XLock(owner uint64, blk kfile.BlockId) error {
+	return lT.XLockTimeout(owner, blk, MaxWaitTime)
+}
+
+// XLockTimeout is XLock waiting at most d.
+func (lT *LockTable) XLockTimeout(owner uint64, blk kfile.BlockId, d time.Duration) error {
 	lT.mu.Lock()
 	defer lT.mu.Unlock()
 
-	deadline := time.Now().Add(MaxWaitTime)
+	deadline := time.Now().Add(d)
+	var wake wakeTimer
+	defer wake.stop()
 
 	// Wait while there are other locks (shared or exclusive)
-	for lT.hasOtherLocks(blk) {
-		if time.Now().After(deadline) {
-			return fmt.Errorf("exclusive lock acquisition timed out for block %v", blk)
+	for lT.hasOtherLocks(owner, blk) {
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("exclusive lock on block %v: %w after %v", blk, ErrLockTimeout, d)
+		}
+		wake.arm(lT, deadline)
+		if err := lT.awaitBlock(owner, blk); err != nil {
+			return err
 		}
-		lT.cond.Wait()
 	}
 
 	// Set to -1 to indicate exclusive lock
 	lT.locks[blk] = -1
+	lT.holders[blk] = []uint64{owner}
+	return nil
+}
+
+// Upgrade turns a shared lock owner holds on blk into an exclusive one,
+// waiting for the other shared holders to release theirs. If another holder
+// is already waiting to upgrade, it fails at once with ErrUpgradeConflict
+// instead of deadlocking; the caller keeps its shared lock. It likewise
+// fails with ErrDeadlock if a holder it would wait for is waiting for owner,
+// and with ErrLockTimeout after MaxWaitTime.
+func (lT *LockTable) Upgrade(owner uint64, blk kfile.BlockId) error {
+	return lT.UpgradeTimeout(owner, blk, MaxWaitTime)
+}
+
+// UpgradeTimeout is Upgrade waiting at most d.
+func (lT *LockTable) UpgradeTimeout(owner uint64, blk kfile.BlockId, d time.Duration) error {
+	lT.mu.Lock()
+	defer lT.mu.Unlock()
+
+	if lT.getLockVal(blk) <= 0 || !slices.Contains(lT.holders[blk], owner) {
+		return fmt.Errorf("cannot upgrade block %v without a shared lock", blk)
+	}
+	if lT.upgrading[blk] {
+		return fmt.Errorf("upgrade of block %v: %w", blk, ErrUpgradeConflict)
+	}
+	lT.upgrading[blk] = true
+	defer delete(lT.upgrading, blk)
+
+	deadline := time.Now().Add(d)
+	var wake wakeTimer
+	defer wake.stop()
+	for lT.getLockVal(blk) > 1 {
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("lock upgrade of block %v: %w after %v", blk, ErrLockTimeout, d)
+		}
+		wake.arm(lT, deadline)
+		if err := lT.awaitBlock(owner, blk); err != nil {
+			return err
+		}
+	}
+	lT.locks[blk] = -1
 	return nil
 }
 
+// SetWaitHook makes the table call fn with the owner of every lock request
+// about to wait for a conflicting lock, so that a caller can tell a blocked
+// request from a slow one. fn runs with the table locked and must not take
+// locks in it; nil removes the hook.
+func (lT *LockTable) SetWaitHook(fn func(owner uint64)) {
+	lT.mu.Lock()
+	defer lT.mu.Unlock()
+	lT.waitHook = fn
+}
+
+// wakeTimer wakes every waiter on a LockTable's cond at a deadline, so that
+// a request still blocked then sees its time is up even if no lock was
+// released. A request starts it before its first wait only, so one granted
+// at once never pays for a timer.
+type wakeTimer struct {
+	t *time.Timer
+}
+
+// arm starts the timer for deadline unless it is already running.
+func (w *wakeTimer) arm(lT *LockTable, deadline time.Time) {
+	if w.t != nil {
+		return
+	}
+	w.t = time.AfterFunc(time.Until(deadline), func() {
+		lT.mu.Lock()
+		defer lT.mu.Unlock()
+		lT.cond.Broadcast()
+	})
+}
+
+// stop cancels the wake-up, if arm started one.
+func (w *wakeTimer) stop() {
+	if w.t != nil {
+		w.t.Stop()
+	}
+}
+
 func (lT *LockTable) hasXLock(blk kfile.BlockId) bool {
 	return lT.getLockVal(blk) < 0
 }
@@ -74,28 +208,38 @@ func (lT *LockTable) getLockVal(blk kfile.BlockId) int {
 	return val
 }
 
-func (lT *LockTable) hasOtherLocks(blk kfile.BlockId) bool {
-	val := lT.getLockVal(blk)
-	return val != 0 && val != 1 // Allow upgrade from single shared lock
+// hasOtherLocks reports whether an owner other than owner holds a lock on
+// blk.
+func (lT *LockTable) hasOtherLocks(owner uint64, blk kfile.BlockId) bool {
+	return slices.ContainsFunc(lT.holders[blk], func(h uint64) bool { return h != owner })
 }
 
-func (lT *LockTable) Unlock(blk kfile.BlockId) error {
+// Unlock releases one lock owner holds on blk.
+func (lT *LockTable) Unlock(owner uint64, blk kfile.BlockId) error {
 	lT.mu.Lock()
 	defer lT.mu.Unlock()
 
-	val := lT.getLockVal(blk)
-	if val == 0 {
-		return fmt.Errorf("attempting to Unlock block %v which is not locked", blk)
+	i := slices.Index(lT.holders[blk], owner)
+	if i < 0 {
+		return fmt.Errorf("attempting to Unlock block %v which is not locked by owner %d", blk, owner)
+	}
+	if held := slices.Delete(lT.holders[blk], i, i+1); len(held) > 0 {
+		lT.holders[blk] = held
+	} else {
+		delete(lT.holders, blk)
 	}
 
+	val := lT.getLockVal(blk)
 	if val > 1 {
 		// Decrement shared lock count
 		lT.locks[blk] = val - 1
 	} else {
 		// Remove last shared lock or exclusive lock
 		delete(lT.locks, blk)
-		lT.cond.Broadcast() // Wake up waiting goroutines
 	}
+	// Wake up waiting goroutines, including an upgrader waiting for the
+	// shared count to drop to its own lock.
+	lT.cond.Broadcast()
 	return nil
 }
 
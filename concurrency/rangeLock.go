@@ -0,0 +1,143 @@
+package concurrency
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// keyRangeLock is a lock on the keys of a file from lo up to but excluding
+// hi; a nil hi means the range is unbounded above. Shared range locks are
+// taken by scans and cover the gaps between existing keys as well as the
+// keys themselves, so a phantom cannot be inserted into a scanned range.
+// Exclusive ones are taken by inserts and cover a single key.
+type keyRangeLock struct {
+	owner     uint64
+	filename  string
+	lo, hi    []byte
+	exclusive bool
+}
+
+// overlaps reports whether two ranges of the same file share a key.
+func (r keyRangeLock) overlaps(o keyRangeLock) bool {
+	if r.filename != o.filename {
+		return false
+	}
+	if r.hi != nil && bytes.Compare(o.lo, r.hi) >= 0 {
+		return false
+	}
+	if o.hi != nil && bytes.Compare(r.lo, o.hi) >= 0 {
+		return false
+	}
+	return true
+}
+
+// conflicts reports whether r must wait for o: they belong to different
+// owners, overlap, and at least one is exclusive.
+func (r keyRangeLock) conflicts(o keyRangeLock) bool {
+	return r.owner != o.owner && (r.exclusive || o.exclusive) && r.overlaps(o)
+}
+
+// covers reports whether r already grants everything o asks for: it has the
+// same owner and file, spans o's keys, and is exclusive if o is.
+func (r keyRangeLock) covers(o keyRangeLock) bool {
+	if r.owner != o.owner || r.filename != o.filename || (o.exclusive && !r.exclusive) {
+		return false
+	}
+	if bytes.Compare(r.lo, o.lo) > 0 {
+		return false
+	}
+	return r.hi == nil || (o.hi != nil && bytes.Compare(o.hi, r.hi) <= 0)
+}
+
+// keyRange returns the range holding just key.
+func keyRange(key []byte) (lo, hi []byte) {
+	lo = append([]byte(nil), key...)
+	hi = append(append([]byte(nil), key...), 0)
+	return lo, hi
+}
+
+// LockRange takes a key-range lock for owner on the keys of filename in
+// [lo, hi), waiting while another owner holds a conflicting one. A nil hi
+// leaves the range unbounded above. Shared range locks are compatible with
+// each other; an exclusive one conflicts with any overlapping lock of
+// another owner. A range owner already holds is not taken again, and one
+// that covers ranges owner holds replaces them. Like SLock, it fails with
+// ErrDeadlock rather than wait in a cycle, and with ErrLockTimeout after
+// MaxWaitTime.
+func (lT *LockTable) LockRange(owner uint64, filename string, lo, hi []byte, exclusive bool) error {
+	return lT.LockRangeTimeout(owner, filename, lo, hi, exclusive, MaxWaitTime)
+}
+
+// LockRangeTimeout is LockRange waiting at most d.
+func (lT *LockTable) LockRangeTimeout(owner uint64, filename string, lo, hi []byte, exclusive bool, d time.Duration) error {
+	if hi != nil && bytes.Compare(lo, hi) >= 0 {
+		return fmt.Errorf("empty key range [%q, %q) in %s", lo, hi, filename)
+	}
+	req := keyRangeLock{
+		owner:     owner,
+		filename:  filename,
+		lo:        append([]byte(nil), lo...),
+		exclusive: exclusive,
+	}
+	if hi != nil {
+		req.hi = append([]byte(nil), hi...)
+	}
+
+	lT.mu.Lock()
+	defer lT.mu.Unlock()
+
+	for _, held := range lT.ranges {
+		if held.covers(req) {
+			return nil
+		}
+	}
+	deadline := time.Now().Add(d)
+	var wake wakeTimer
+	defer wake.stop()
+	for lT.rangeConflict(req) {
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("key-range lock on %s [%q, %q): %w after %v", filename, lo, hi, ErrLockTimeout, d)
+		}
+		wake.arm(lT, deadline)
+		if err := lT.awaitRange(req); err != nil {
+			return err
+		}
+	}
+	kept := lT.ranges[:0]
+	for _, held := range lT.ranges {
+		if !req.covers(held) {
+			kept = append(kept, held)
+		}
+	}
+	clear(lT.ranges[len(kept):])
+	lT.ranges = append(kept, req)
+	return nil
+}
+
+// rangeConflict reports whether any held range lock conflicts with req.
+// The caller must hold lT.mu.
+func (lT *LockTable) rangeConflict(req keyRangeLock) bool {
+	for _, held := range lT.ranges {
+		if req.conflicts(held) {
+			return true
+		}
+	}
+	return false
+}
+
+// UnlockRanges releases every key-range lock held by owner.
+func (lT *LockTable) UnlockRanges(owner uint64) {
+	lT.mu.Lock()
+	defer lT.mu.Unlock()
+
+	kept := lT.ranges[:0]
+	for _, held := range lT.ranges {
+		if held.owner != owner {
+			kept = append(kept, held)
+		}
+	}
+	clear(lT.ranges[len(kept):])
+	lT.ranges = kept
+	lT.cond.Broadcast()
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 	"sync"
 	"time"
 )
@@ -62,8 +63,34 @@ func (p *Page) SetInt(offset int, val int) error {
 	return nil
 }
 
+// GetInt64 reads an 8-byte big-endian integer from the given offset.
+func (p *Page) GetInt64(offset int) (int64, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if offset < 0 || offset+8 > len(p.data) {
+		return 0, fmt.Errorf("%s: getting int64", ErrOutOfBounds)
+	}
+	return int64(binary.BigEndian.Uint64(p.data[offset:])), nil
+}
+
+// SetInt64 writes an 8-byte big-endian integer at the given offset.
+func (p *Page) SetInt64(offset int, val int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if offset < 0 || offset+8 > len(p.data) {
+		return fmt.Errorf("%s: setting int64", ErrOutOfBounds)
+	}
+	binary.BigEndian.PutUint64(p.data[offset:], uint64(val))
+	p.setIsDirty(true)
+	return nil
+}
+
 // GetBytes reads a length-prefixed byte slice from the given offset.
-// The length prefix is a 4-byte big-endian integer.
+// The length prefix is a 4-byte big-endian integer. A zero prefix yields an
+// empty, non-nil slice; an offset with no room for a prefix, as on an empty
+// page, is ErrOutOfBounds rather than an empty result.
 func (p *Page) GetBytes(offset int) ([]byte, error) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
@@ -88,6 +115,28 @@ func (p *Page) GetBytesWithLen(offset int) ([]byte, error) {
 	return p.GetBytes(offset)
 }
 
+// GetBytesView reads a length-prefixed byte slice from the given offset
+// without copying it. The returned slice aliases the page's data: callers
+// must treat it as read-only, and it is only valid until the page is next
+// modified or its buffer is reassigned to another block. Use GetBytes unless
+// the copy shows up in a profile.
+func (p *Page) GetBytesView(offset int) ([]byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if offset < 0 || offset+4 > len(p.data) {
+		return nil, fmt.Errorf("%s: getting bytes", ErrOutOfBounds)
+	}
+
+	length := int(binary.BigEndian.Uint32(p.data[offset : offset+4]))
+	if offset+4+length > len(p.data) {
+		return nil, fmt.Errorf("%s: invalid length", ErrOutOfBounds)
+	}
+
+	// Cap the slice so an append by the caller cannot write into the page.
+	return p.data[offset+4 : offset+4+length : offset+4+length], nil
+}
+
 // SetBytes writes a length-prefixed byte slice at the given offset.
 func (p *Page) SetBytes(offset int, val []byte) error {
 	p.mu.Lock()
@@ -196,6 +245,30 @@ func (p *Page) GetDate(offset int) (time.Time, error) {
 	return time.Unix(int64(timestamp), 0), nil
 }
 
+// SetFloat64 writes val as its 8-byte big-endian IEEE-754 bit pattern at the given offset.
+func (p *Page) SetFloat64(offset int, val float64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if offset < 0 || offset+8 > len(p.data) {
+		return fmt.Errorf("%s: setting float64", ErrOutOfBounds)
+	}
+	binary.BigEndian.PutUint64(p.data[offset:], math.Float64bits(val))
+	p.setIsDirty(true)
+	return nil
+}
+
+// GetFloat64 reads an 8-byte big-endian IEEE-754 value from the given offset.
+func (p *Page) GetFloat64(offset int) (float64, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if offset < 0 || offset+8 > len(p.data) {
+		return 0, fmt.Errorf("%s: getting float64", ErrOutOfBounds)
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(p.data[offset:])), nil
+}
+
 // setIsDirty sets the dirty flag.
 // It uses a write lock internally if not already held.
 func (p *Page) setIsDirty(dirt bool) {
@@ -231,16 +304,16 @@ func (p *Page) Size() int {
 	return len(p.data)
 }
 
-// Available returns the number of unused bytes on the page.
-// Note: GetUsedSpace() should be implemented per page type.
+// Available returns the number of unused bytes on the page. A plain Page
+// has no layout to account for, so it reports its whole size; SlottedPage
+// overrides both Available and GetUsedSpace.
 func (p *Page) Available() int {
 	return p.Size() - p.GetUsedSpace()
 }
 
-// GetUsedSpace returns the amount of space currently used in the page.
-// TODO: Implement this based on page type (e.g. slotted pages include header, slots, cells).
+// GetUsedSpace returns the amount of space currently used in the page,
+// which for a plain Page is always zero.
 func (p *Page) GetUsedSpace() int {
-	// Placeholder implementation.
 	return 0
 }
 
@@ -0,0 +1,240 @@
+package kfile
+
+import (
+	"fmt"
+	"slices"
+)
+
+// AllocationStrategy decides where Allocate places a new block of a file:
+// in one of the file's free blocks, or at its end.
+type AllocationStrategy interface {
+	// Choose returns the index in free of the block to reuse, or -1 to
+	// append. hint is the block number the caller would like the new block
+	// to be close to; strategies that ignore locality ignore it too.
+	Choose(free []int32, hint int32) int
+}
+
+// AppendStrategy always grows the file, leaving freed blocks unused. It
+// keeps files physically ordered by allocation and is the default.
+type AppendStrategy struct{}
+
+func (AppendStrategy) Choose([]int32, int32) int { return -1 }
+
+// FreeListFirst reuses the block freed longest ago, appending only when no
+// block is free. It keeps delete-heavy files from growing.
+type FreeListFirst struct{}
+
+func (FreeListFirst) Choose(free []int32, _ int32) int {
+	if len(free) == 0 {
+		return -1
+	}
+	return 0
+}
+
+// BestFit reuses the free block closest to the hint, preferring the lower
+// block number on a tie, so related blocks stay near each other on disk.
+type BestFit struct{}
+
+func (BestFit) Choose(free []int32, hint int32) int {
+	best := -1
+	for i, blk := range free {
+		if best < 0 {
+			best = i
+			continue
+		}
+		d, bestD := distance(blk, hint), distance(free[best], hint)
+		if d < bestD || (d == bestD && blk < free[best]) {
+			best = i
+		}
+	}
+	return best
+}
+
+func distance(a, b int32) int64 {
+	d := int64(a) - int64(b)
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// SetAllocationStrategy selects how Allocate places new blocks of filename.
+// A nil strategy restores the default, AppendStrategy.
+func (fm *FileMgr) SetAllocationStrategy(filename string, s AllocationStrategy) {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	if fm.strategies == nil {
+		fm.strategies = make(map[string]AllocationStrategy)
+	}
+	if s == nil {
+		delete(fm.strategies, filename)
+		return
+	}
+	fm.strategies[filename] = s
+}
+
+// FreeBlock records that blk no longer holds live data, making it available
+// to Append and Allocate. The block is zeroed first, so its old contents are
+// never read again, and the free list is kept with the metadata, so it
+// survives a restart.
+func (fm *FileMgr) FreeBlock(blk *BlockId) error {
+	if fm.readOnly {
+		return ErrReadOnly
+	}
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+	fl := fm.fileLock(blk.FileName())
+	fl.Lock()
+	defer fl.Unlock()
+
+	if fm.closed {
+		return ErrClosed
+	}
+	length, err := fm.LengthLocked(blk.FileName())
+	if err != nil {
+		return fmt.Errorf("failed to determine length for file %s: %w", blk.FileName(), err)
+	}
+	if blk.Number() < 0 || blk.Number() >= length {
+		return fmt.Errorf("%s: block %v is beyond the end of the file", ErrOutOfBounds, blk)
+	}
+	fm.freeMu.Lock()
+	isFree := slices.Contains(fm.freeBlocks[blk.FileName()], blk.Number())
+	fm.freeMu.Unlock()
+	if isFree {
+		return fmt.Errorf("block %v is already free", blk)
+	}
+	if err := fm.clearBlockLocked(blk, fm.ioBuffer(fm.blocksize)); err != nil {
+		return fmt.Errorf("failed to clear freed block %v: %w", blk, err)
+	}
+	fm.freeMu.Lock()
+	if fm.freeBlocks == nil {
+		fm.freeBlocks = make(map[string][]int32)
+	}
+	free := append(fm.freeBlocks[blk.FileName()], blk.Number())
+	fm.freeBlocks[blk.FileName()] = free
+	free = slices.Clone(free)
+	fm.freeMu.Unlock()
+	return fm.setFreeBlocksMeta(blk.FileName(), free)
+}
+
+// clearBlockLocked overwrites blk with data and syncs it as the sync policy
+// says. The caller must hold the file's lock.
+func (fm *FileMgr) clearBlockLocked(blk *BlockId, data []byte) error {
+	f, err := fm.getFile(blk.FileName())
+	if err != nil {
+		return err
+	}
+	offset, err := fm.blockOffset(blk.Number())
+	if err != nil {
+		return err
+	}
+	if _, err := fm.fileWriteAt(f, data, offset); err != nil {
+		return err
+	}
+	return fm.syncWrittenLocked(blk.FileName(), f)
+}
+
+// FreeBlocks returns the free blocks of filename in the order they were freed.
+func (fm *FileMgr) FreeBlocks(filename string) []int32 {
+	fm.freeMu.Lock()
+	defer fm.freeMu.Unlock()
+	return slices.Clone(fm.freeBlocks[filename])
+}
+
+// Allocate returns an empty block of filename chosen by the file's
+// allocation strategy, either reusing a free block or appending a new one.
+// hint is passed on to the strategy. Unlike Append, Allocate under the
+// default AppendStrategy grows the file even when blocks are free.
+func (fm *FileMgr) Allocate(filename string, hint int32) (*BlockId, error) {
+	if fm.readOnly {
+		return nil, ErrReadOnly
+	}
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+	fl := fm.fileLock(filename)
+	fl.Lock()
+	defer fl.Unlock()
+
+	if fm.closed {
+		return nil, ErrClosed
+	}
+	strategy := fm.strategies[filename]
+	if strategy == nil {
+		strategy = AppendStrategy{}
+	}
+	free := fm.FreeBlocks(filename)
+	i := strategy.Choose(free, hint)
+	if i < 0 || i >= len(free) {
+		first, err := fm.appendLocked(filename, 1)
+		if err != nil {
+			return nil, err
+		}
+		return NewBlockId(filename, first), nil
+	}
+	return fm.reuseFreeBlockLocked(filename, i)
+}
+
+// reuseFreeBlockLocked takes the block at index i of the free list of
+// filename off the list and returns it, holding what Append would have
+// written to a new block. The caller must hold the file's lock.
+func (fm *FileMgr) reuseFreeBlockLocked(filename string, i int) (*BlockId, error) {
+	fm.freeMu.Lock()
+	blk := NewBlockId(filename, fm.freeBlocks[filename][i])
+	fm.freeMu.Unlock()
+	// FreeBlock zeroed the block, but it may have been written since.
+	if err := fm.clearBlockLocked(blk, fm.emptyBlocks(1)); err != nil {
+		return nil, fmt.Errorf("failed to clear reused block %v: %w", blk, err)
+	}
+	fm.freeMu.Lock()
+	free := slices.Delete(fm.freeBlocks[filename], i, i+1)
+	fm.freeBlocks[filename] = free
+	free = slices.Clone(free)
+	fm.freeMu.Unlock()
+	if err := fm.setFreeBlocksMeta(filename, free); err != nil {
+		return nil, err
+	}
+	return blk, nil
+}
+
+// trimFreeBlocks drops the blocks of filename from end on from its free
+// list, once the file no longer has them. The caller must hold the file's
+// lock.
+func (fm *FileMgr) trimFreeBlocks(filename string, end int32) error {
+	fm.freeMu.Lock()
+	free := fm.freeBlocks[filename]
+	kept := slices.DeleteFunc(slices.Clone(free), func(n int32) bool { return n >= end })
+	if len(kept) == len(free) {
+		fm.freeMu.Unlock()
+		return nil
+	}
+	if len(kept) == 0 {
+		delete(fm.freeBlocks, filename)
+	} else {
+		fm.freeBlocks[filename] = kept
+	}
+	fm.freeMu.Unlock()
+	return fm.setFreeBlocksMeta(filename, kept)
+}
+
+// renameFreeBlocks moves the free list of oldName, if any, to newName. The
+// caller must hold the locks of both files.
+func (fm *FileMgr) renameFreeBlocks(oldName, newName string) error {
+	fm.freeMu.Lock()
+	free, ok := fm.freeBlocks[oldName]
+	if ok {
+		delete(fm.freeBlocks, oldName)
+		fm.freeBlocks[newName] = free
+	}
+	fm.freeMu.Unlock()
+	if !ok {
+		return nil
+	}
+	return fm.updateMetadata(func(md *FileMetadata) bool {
+		delete(md.FreeBlocks, oldName)
+		if md.FreeBlocks == nil {
+			md.FreeBlocks = make(map[string][]int32)
+		}
+		md.FreeBlocks[newName] = slices.Clone(free)
+		return true
+	})
+}
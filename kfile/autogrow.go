@@ -0,0 +1,49 @@
+package kfile
+
+import "fmt"
+
+// WithAutoGrow makes Write grow a file to the block it writes first, as
+// EnsureFileSize does, when the block lies past the end of the file.
+// Writing block 10 of a 3-block file then leaves 11 blocks, with blocks 3
+// to 9 reading as zeros, rather than relying on the write alone to extend
+// the file. The growth is held to the file's size limit like any other.
+func WithAutoGrow() FileMgrOption {
+	return func(fm *FileMgr) {
+		fm.autoGrow = true
+	}
+}
+
+// EnsureFileSize grows the file of blk, if it is shorter, to requiredBlocks
+// blocks, which read as zeros until written. It fails with a
+// *SizeLimitError if they would not fit in the file's size limit.
+func (fm *FileMgr) EnsureFileSize(blk *BlockId, requiredBlocks int32) error {
+	if fm.readOnly {
+		return ErrReadOnly
+	}
+	if blk.FileName() == "" {
+		return fmt.Errorf("invalid filename")
+	}
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+	fl := fm.fileLock(blk.FileName())
+	fl.Lock()
+	defer fl.Unlock()
+
+	if fm.closed {
+		return ErrClosed
+	}
+	return fm.ensureFileSizeLocked(blk.FileName(), requiredBlocks)
+}
+
+// ensureFileSizeLocked grows filename to requiredBlocks blocks if it is
+// shorter. The caller must hold the file's lock.
+func (fm *FileMgr) ensureFileSizeLocked(filename string, requiredBlocks int32) error {
+	currentBlocks, err := fm.LengthLocked(filename)
+	if err != nil {
+		return fmt.Errorf("failed to determine length for file %s: %w", filename, err)
+	}
+	if currentBlocks >= requiredBlocks {
+		return nil
+	}
+	return fm.performPreallocation(filename, int64(requiredBlocks)*int64(fm.blocksize))
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 	"time"
 )
 
@@ -15,8 +16,19 @@ const (
 	CellTypeKV  = 2 // Leaf node cell (key + value)
 
 	// Flag bits (upper nibble)
-	FlagDeleted  = 1 << 4 // Mark cell as deleted
-	FlagOverflow = 1 << 5 // Record doesn’t fit in page
+	FlagDeleted = 1 << 4 // Mark cell as deleted
+	// FlagOverflow marks a KV cell holding only the start of its value; the
+	// rest is in a chain of overflow blocks, the first of which follows the
+	// value as an 8-byte block number, see SpillCell.
+	FlagOverflow = 1 << 5
+	// FlagTimestamps marks a cell that carries created-at and modified-at
+	// times, stored as two 8-byte Unix nanosecond values ahead of the key.
+	FlagTimestamps = 1 << 6
+	// FlagVarint marks a cell whose key and value sizes are stored as
+	// unsigned varints rather than fixed 4-byte integers.
+	FlagVarint = 1 << 7
+
+	timestampsSize = 16
 )
 
 // Data types for values.
@@ -26,6 +38,10 @@ const (
 	BoolType    = 3
 	DateType    = 4
 	BytesType   = 5
+	FloatType   = 6
+	// Int64Type holds ints that IntegerType's 4-byte encoding would
+	// truncate, including negative values.
+	Int64Type = 7
 )
 
 type Cell struct {
@@ -43,6 +59,10 @@ type Cell struct {
 	keyType   byte
 	valueType byte
 	offset    int
+
+	// Only meaningful when FlagTimestamps is set.
+	createdAt  time.Time
+	modifiedAt time.Time
 }
 
 func NewKeyCell(key []byte, childPageId uint64) *Cell {
@@ -71,11 +91,19 @@ func (c *Cell) SetValue(val any) error {
 
 	switch v := val.(type) {
 	case int:
-		c.valueType = IntegerType
-		buf := make([]byte, 4)
-		binary.BigEndian.PutUint32(buf, uint32(v))
-		c.value = buf
-		c.valueSize = 4
+		if v == int(uint32(v)) {
+			c.valueType = IntegerType
+			buf := make([]byte, 4)
+			binary.BigEndian.PutUint32(buf, uint32(v))
+			c.value = buf
+			c.valueSize = 4
+		} else {
+			c.valueType = Int64Type
+			buf := make([]byte, 8)
+			binary.BigEndian.PutUint64(buf, uint64(v))
+			c.value = buf
+			c.valueSize = 8
+		}
 
 	case string:
 		c.valueType = StringType
@@ -103,6 +131,13 @@ func (c *Cell) SetValue(val any) error {
 		c.value = v
 		c.valueSize = len(v)
 
+	case float64:
+		c.valueType = FloatType
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, math.Float64bits(v))
+		c.value = buf
+		c.valueSize = 8
+
 	default:
 		return fmt.Errorf("unsupported value type: %T", val)
 	}
@@ -120,6 +155,11 @@ func (c *Cell) GetValue() (any, error) {
 			return nil, fmt.Errorf("invalid data for integer")
 		}
 		return int(binary.BigEndian.Uint32(c.value)), nil
+	case Int64Type:
+		if len(c.value) < 8 {
+			return nil, fmt.Errorf("invalid data for int64")
+		}
+		return int(int64(binary.BigEndian.Uint64(c.value))), nil
 	case StringType:
 		return string(c.value), nil
 	case BoolType:
@@ -135,26 +175,62 @@ func (c *Cell) GetValue() (any, error) {
 		return time.Unix(int64(timestamp), 0), nil
 	case BytesType:
 		return c.value, nil
+	case FloatType:
+		if len(c.value) < 8 {
+			return nil, fmt.Errorf("invalid data for float")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(c.value)), nil
 	default:
 		return nil, fmt.Errorf("unknown value type: %d", c.valueType)
 	}
 }
 
 func (c *Cell) Size() int {
-	// 1 byte for header, 4 bytes each for keySize and (if KV) valueSize.
-	size := 1 + 4
-	if c.cellType == CellTypeKV {
-		size += 4 + 1 // additional 4 for valueSize and 1 for valueType
-	}
+	size := c.keyOffset()
 	size += c.keySize
 	if c.cellType == CellTypeKV {
 		size += c.valueSize
+		if c.HasOverflow() {
+			size += 8 // for the first overflow block
+		}
 	} else {
 		size += 8 // for pageId in key-only cells
 	}
 	return size
 }
 
+// keyOffset returns the offset of the key within the serialized cell.
+func (c *Cell) keyOffset() int {
+	// 1 byte for header, then keySize and (if KV) valueSize.
+	offset := 1 + c.sizeFieldLen(c.keySize)
+	if c.cellType == CellTypeKV {
+		offset += c.sizeFieldLen(c.valueSize) + 1 // and 1 for valueType
+	}
+	if c.HasTimestamps() {
+		offset += timestampsSize
+	}
+	return offset
+}
+
+// sizeFieldLen returns how many bytes the size n takes in the serialized cell.
+func (c *Cell) sizeFieldLen(n int) int {
+	if c.HasVarintSizes() {
+		return len(binary.AppendUvarint(nil, uint64(n)))
+	}
+	return 4
+}
+
+// UseVarintSizes stores the cell's key and value sizes as unsigned varints,
+// which takes one byte each instead of four for sizes under 128.
+func (c *Cell) UseVarintSizes() {
+	c.flags |= FlagVarint
+}
+
+// HasVarintSizes reports whether the cell's sizes are stored as varints.
+func (c *Cell) HasVarintSizes() bool {
+	return (c.flags & FlagVarint) != 0
+}
+
 func (c *Cell) FitsInPage(remainingSpace int) bool {
 	return c.Size() <= remainingSpace
 }
@@ -167,10 +243,52 @@ func (c *Cell) IsDeleted() bool {
 	return (c.flags & FlagDeleted) != 0
 }
 
+// HasOverflow reports whether part of the cell's value is kept in overflow
+// blocks.
+func (c *Cell) HasOverflow() bool {
+	return (c.flags & FlagOverflow) != 0
+}
+
 func (c *Cell) GetKey() []byte {
 	return c.key
 }
 
+// GetType returns the cell's type, CellTypeKey or CellTypeKV.
+func (c *Cell) GetType() byte {
+	return c.cellType
+}
+
+// GetPageId returns the child page a key cell points to, or for an
+// overflowing KV cell its first overflow block.
+func (c *Cell) GetPageId() uint64 {
+	return c.pageId
+}
+
+// HasTimestamps reports whether the cell carries created-at and modified-at
+// times.
+func (c *Cell) HasTimestamps() bool {
+	return (c.flags & FlagTimestamps) != 0
+}
+
+// CreatedAt returns when the cell was first inserted, or the zero time if it
+// carries no timestamps.
+func (c *Cell) CreatedAt() time.Time {
+	return c.createdAt
+}
+
+// ModifiedAt returns when the cell was last inserted or updated, or the zero
+// time if it carries no timestamps.
+func (c *Cell) ModifiedAt() time.Time {
+	return c.modifiedAt
+}
+
+// setTimestamps stamps the cell and sets FlagTimestamps.
+func (c *Cell) setTimestamps(created, modified time.Time) {
+	c.flags |= FlagTimestamps
+	c.createdAt = created
+	c.modifiedAt = modified
+}
+
 func (c *Cell) ToBytes() []byte {
 	buf := new(bytes.Buffer)
 
@@ -181,13 +299,13 @@ func (c *Cell) ToBytes() []byte {
 	}
 
 	// Write key size.
-	if err := binary.Write(buf, binary.BigEndian, uint32(c.keySize)); err != nil {
+	if err := c.writeSize(buf, c.keySize); err != nil {
 		return nil
 	}
 
 	if c.cellType == CellTypeKV {
 		// Write value size and value type.
-		if err := binary.Write(buf, binary.BigEndian, uint32(c.valueSize)); err != nil {
+		if err := c.writeSize(buf, c.valueSize); err != nil {
 			return nil
 		}
 		if err := buf.WriteByte(c.valueType); err != nil {
@@ -195,16 +313,31 @@ func (c *Cell) ToBytes() []byte {
 		}
 	}
 
+	if c.HasTimestamps() {
+		if err := binary.Write(buf, binary.BigEndian, c.createdAt.UnixNano()); err != nil {
+			return nil
+		}
+		if err := binary.Write(buf, binary.BigEndian, c.modifiedAt.UnixNano()); err != nil {
+			return nil
+		}
+	}
+
 	// Write key.
 	if _, err := buf.Write(c.key); err != nil {
 		return nil
 	}
 
-	// Write value or pageId.
+	// Write value or pageId; an overflowing value is followed by its first
+	// overflow block.
 	if c.cellType == CellTypeKV {
 		if _, err := buf.Write(c.value); err != nil {
 			return nil
 		}
+		if c.HasOverflow() {
+			if err := binary.Write(buf, binary.BigEndian, c.pageId); err != nil {
+				return nil
+			}
+		}
 	} else {
 		if err := binary.Write(buf, binary.BigEndian, c.pageId); err != nil {
 			return nil
@@ -214,6 +347,34 @@ func (c *Cell) ToBytes() []byte {
 	return buf.Bytes()
 }
 
+// writeSize writes a key or value size in the cell's size encoding.
+func (c *Cell) writeSize(buf *bytes.Buffer, n int) error {
+	if c.HasVarintSizes() {
+		_, err := buf.Write(binary.AppendUvarint(nil, uint64(n)))
+		return err
+	}
+	return binary.Write(buf, binary.BigEndian, uint32(n))
+}
+
+// readSize reads a size written by writeSize.
+func (c *Cell) readSize(buf *bytes.Buffer) (int, error) {
+	if c.HasVarintSizes() {
+		n, err := binary.ReadUvarint(buf)
+		if err != nil {
+			return 0, err
+		}
+		if n > math.MaxUint32 {
+			return 0, fmt.Errorf("size %d out of range", n)
+		}
+		return int(n), nil
+	}
+	var n uint32
+	if err := binary.Read(buf, binary.BigEndian, &n); err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
 // CellFromBytes deserializes a cell from the given byte slice.
 func CellFromBytes(data []byte) (*Cell, error) {
 	buf := bytes.NewBuffer(data)
@@ -228,20 +389,16 @@ func CellFromBytes(data []byte) (*Cell, error) {
 	cell.cellType = headerByte & 0x0F
 	cell.flags = headerByte & 0xF0
 
-	// Read key size.
-	var keySize uint32
-	if err := binary.Read(buf, binary.BigEndian, &keySize); err != nil {
+	// Read key size, fixed or varint according to FlagVarint.
+	if cell.keySize, err = cell.readSize(buf); err != nil {
 		return nil, fmt.Errorf("failed to read key size: %w", err)
 	}
-	cell.keySize = int(keySize)
 
 	if cell.cellType == CellTypeKV {
 		// For KV cells, read value size and value type.
-		var valueSize uint32
-		if err := binary.Read(buf, binary.BigEndian, &valueSize); err != nil {
+		if cell.valueSize, err = cell.readSize(buf); err != nil {
 			return nil, fmt.Errorf("failed to read value size: %w", err)
 		}
-		cell.valueSize = int(valueSize)
 
 		valueType, err := buf.ReadByte()
 		if err != nil {
@@ -250,6 +407,18 @@ func CellFromBytes(data []byte) (*Cell, error) {
 		cell.valueType = valueType
 	}
 
+	if cell.HasTimestamps() {
+		var created, modified int64
+		if err := binary.Read(buf, binary.BigEndian, &created); err != nil {
+			return nil, fmt.Errorf("failed to read created-at: %w", err)
+		}
+		if err := binary.Read(buf, binary.BigEndian, &modified); err != nil {
+			return nil, fmt.Errorf("failed to read modified-at: %w", err)
+		}
+		cell.createdAt = time.Unix(0, created)
+		cell.modifiedAt = time.Unix(0, modified)
+	}
+
 	// Read key.
 	cell.key = make([]byte, cell.keySize)
 	if n, err := buf.Read(cell.key); err != nil || n != cell.keySize {
@@ -262,6 +431,11 @@ func CellFromBytes(data []byte) (*Cell, error) {
 		if n, err := buf.Read(cell.value); err != nil || n != cell.valueSize {
 			return nil, fmt.Errorf("failed to read value: %w", err)
 		}
+		if cell.HasOverflow() {
+			if err := binary.Read(buf, binary.BigEndian, &cell.pageId); err != nil {
+				return nil, fmt.Errorf("failed to read overflow block: %w", err)
+			}
+		}
 	} else {
 		if err := binary.Read(buf, binary.BigEndian, &cell.pageId); err != nil {
 			return nil, fmt.Errorf("failed to read pageId: %w", err)
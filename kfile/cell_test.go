@@ -2,7 +2,13 @@ package kfile
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"math"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 )
@@ -163,12 +169,12 @@ func TestCell_Serialization(t *testing.T) {
 func TestSlottedPage_Basic(t *testing.T) {
 	page := NewSlottedPage(DefaultPageSize)
 
-	if page.freeSpace != DefaultPageSize {
-		t.Errorf("Expected free space %d, got %d", DefaultPageSize, page.freeSpace)
+	if page.GetFreeSpace() != DefaultPageSize {
+		t.Errorf("Expected free space %d, got %d", DefaultPageSize, page.GetFreeSpace())
 	}
 
-	if len(page.slots) != 0 {
-		t.Errorf("Expected empty slots, got %d slots", len(page.slots))
+	if len(page.GetAllSlots()) != 0 {
+		t.Errorf("Expected empty slots, got %d slots", len(page.GetAllSlots()))
 	}
 }
 
@@ -189,13 +195,16 @@ func TestSlottedPage_InsertCell(t *testing.T) {
 		}
 
 		// Verify cell count
-		if page.cellCount != i+1 {
-			t.Errorf("Expected cell count %d, got %d", i+1, page.cellCount)
+		if page.numSlots() != i+1 {
+			t.Errorf("Expected cell count %d, got %d", i+1, page.numSlots())
 		}
 
-		// Verify slot array order
-		if len(page.slots) != i+1 {
-			t.Errorf("Expected slot count %d, got %d", i+1, len(page.slots))
+		// Verify slot directory size
+		if len(page.GetAllSlots()) != i+1 {
+			t.Errorf("Expected slot count %d, got %d", i+1, len(page.GetAllSlots()))
+		}
+		if page.headerSize() != PageHeaderSize+(i+1)*slotEntrySize {
+			t.Errorf("Expected the header to grow with the directory, got %d bytes", page.headerSize())
 		}
 	}
 
@@ -239,9 +248,8 @@ func TestSlottedPage_DeleteAndCompact(t *testing.T) {
 	}
 
 	// Store initial state
-	originalFreeSpace := page.freeSpace
-	originalSlots := make([]int, len(page.slots))
-	copy(originalSlots, page.slots)
+	originalFreeSpace := page.GetFreeSpace()
+	originalSlots := page.GetAllSlots()
 
 	// Delete middle cell (key2)
 	err := page.DeleteCell(2)
@@ -250,23 +258,24 @@ func TestSlottedPage_DeleteAndCompact(t *testing.T) {
 	}
 
 	// Verify cell count and slots decreased
-	if page.cellCount != 4 {
-		t.Errorf("Expected cell count 4, got %d", page.cellCount)
+	if page.numSlots() != 4 {
+		t.Errorf("Expected cell count 4, got %d", page.numSlots())
 	}
-	if len(page.slots) != 4 {
-		t.Errorf("Expected 4 slots after deletion, got %d", len(page.slots))
+	slots := page.GetAllSlots()
+	if len(slots) != 4 {
+		t.Fatalf("Expected 4 slots after deletion, got %d", len(slots))
 	}
 
 	// Verify slot array was adjusted correctly
 	// First two slots should remain the same
 	for i := 0; i < 2; i++ {
-		if page.slots[i] != originalSlots[i] {
+		if slots[i] != originalSlots[i] {
 			t.Errorf("Slot %d changed unexpectedly after deletion", i)
 		}
 	}
 	// Last two slots should now contain what were originally slots 3 and 4
 	for i := 2; i < 4; i++ {
-		if page.slots[i] != originalSlots[i+1] {
+		if slots[i] != originalSlots[i+1] {
 			t.Errorf("Slot %d not properly shifted after deletion", i)
 		}
 	}
@@ -283,7 +292,7 @@ func TestSlottedPage_DeleteAndCompact(t *testing.T) {
 		t.Fatalf("Failed to compact page: %v", err)
 	}
 
-	if page.freeSpace <= originalFreeSpace {
+	if page.GetFreeSpace() <= originalFreeSpace {
 		t.Error("Compaction did not reclaim space")
 	}
 }
@@ -324,3 +333,1200 @@ func TestSlottedPage_SpaceManagement(t *testing.T) {
 		t.Error("Expected error when inserting into full page")
 	}
 }
+
+func TestSlottedPage_Available(t *testing.T) {
+	page := NewSlottedPage(400)
+	if got, want := page.Available(), 400-PageHeaderSize; got != want {
+		t.Fatalf("Expected %d bytes available on an empty page, got %d", want, got)
+	}
+
+	sizes := make([]int, 3)
+	for i := range sizes {
+		cell := NewKVCell([]byte(fmt.Sprintf("key%d", i)))
+		cell.SetValue(strings.Repeat("v", 10*(i+1)))
+		before := page.Available()
+		if err := page.InsertCell(cell); err != nil {
+			t.Fatalf("InsertCell failed: %v", err)
+		}
+		sizes[i] = len(cell.ToBytes()) + slotPointerSize + slotEntrySize
+		if got := page.Available(); got != before-sizes[i] {
+			t.Errorf("Expected Available to drop by %d to %d, got %d", sizes[i], before-sizes[i], got)
+		}
+	}
+	if got := page.Available(); got != page.gap() {
+		t.Errorf("Expected Available %d to match the gap below the free space pointer, got %d", page.gap(), got)
+	}
+
+	_, slot, err := page.FindCell([]byte("key1"))
+	if err != nil {
+		t.Fatalf("FindCell failed: %v", err)
+	}
+	before := page.Available()
+	if err := page.DeleteCell(slot); err != nil {
+		t.Fatalf("DeleteCell failed: %v", err)
+	}
+	if got := page.Available(); got != before+sizes[1] {
+		t.Errorf("Expected Available to grow by %d after a delete, got %d", sizes[1], got-before)
+	}
+	if err := page.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if got := page.Available(); got != before+sizes[1] || got != page.gap() {
+		t.Errorf("Expected %d bytes available after compaction, got %d", before+sizes[1], got)
+	}
+}
+
+func TestSlottedPage_ApplyDelta(t *testing.T) {
+	page := NewSlottedPage(400)
+	for _, k := range []string{"a", "b"} {
+		cell := NewKVCell([]byte(k))
+		cell.SetValue("hello world")
+		if err := page.InsertCell(cell); err != nil {
+			t.Fatalf("InsertCell failed: %v", err)
+		}
+	}
+	_, slot, err := page.FindCell([]byte("b"))
+	if err != nil {
+		t.Fatalf("FindCell failed: %v", err)
+	}
+
+	if err := page.ApplyDelta(slot, 6, []byte("there")); err != nil {
+		t.Fatalf("ApplyDelta failed: %v", err)
+	}
+	for k, want := range map[string]string{"a": "hello world", "b": "hello there"} {
+		cell, _, err := page.FindCell([]byte(k))
+		if err != nil {
+			t.Fatalf("FindCell(%s) failed: %v", k, err)
+		}
+		if got, _ := cell.GetValue(); got != want {
+			t.Errorf("Cell %s: expected %q, got %q", k, want, got)
+		}
+	}
+
+	for _, tc := range []struct {
+		offset int
+		delta  string
+	}{
+		{-1, "x"},
+		{7, "there"},
+		{11, "x"},
+	} {
+		if err := page.ApplyDelta(slot, tc.offset, []byte(tc.delta)); err == nil {
+			t.Errorf("Expected out-of-range delta %q at %d to fail", tc.delta, tc.offset)
+		}
+	}
+	if cell, _, _ := page.FindCell([]byte("b")); cell != nil {
+		if got, _ := cell.GetValue(); got != "hello there" {
+			t.Errorf("Rejected deltas modified the cell: %q", got)
+		}
+	}
+}
+
+func TestSlottedPage_ModifiedSince(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := start
+	page := NewSlottedPage(400)
+	page.EnableTimestamps(func() time.Time { return clock })
+
+	for i, k := range []string{"a", "b", "c"} {
+		clock = start.Add(time.Duration(i) * time.Minute)
+		cell := NewKVCell([]byte(k))
+		cell.SetValue(k)
+		if err := page.InsertCell(cell); err != nil {
+			t.Fatalf("InsertCell failed: %v", err)
+		}
+	}
+	clock = start.Add(10 * time.Minute)
+	if err := page.UpdateCell([]byte("a"), "a2"); err != nil {
+		t.Fatalf("UpdateCell failed: %v", err)
+	}
+
+	cell, _, err := page.FindCell([]byte("a"))
+	if err != nil {
+		t.Fatalf("FindCell failed: %v", err)
+	}
+	if !cell.CreatedAt().Equal(start) || !cell.ModifiedAt().Equal(clock) {
+		t.Errorf("Expected a created %v, modified %v; got %v, %v",
+			start, clock, cell.CreatedAt(), cell.ModifiedAt())
+	}
+	if got, _ := cell.GetValue(); got != "a2" {
+		t.Errorf("Expected updated value a2, got %v", got)
+	}
+
+	keys := func(cells []*Cell) string {
+		var out []string
+		for _, c := range cells {
+			out = append(out, string(c.GetKey()))
+		}
+		return fmt.Sprint(out)
+	}
+	for _, tc := range []struct {
+		since time.Time
+		want  string
+	}{
+		{start, "[a b c]"},
+		{start.Add(time.Minute), "[a b c]"},
+		{start.Add(90 * time.Second), "[a c]"},
+		{start.Add(10 * time.Minute), "[a]"},
+		{start.Add(time.Hour), "[]"},
+	} {
+		if got := keys(page.ModifiedSince(tc.since)); got != tc.want {
+			t.Errorf("ModifiedSince(%v): expected %s, got %s", tc.since, tc.want, got)
+		}
+	}
+
+	// Timestamps survive compaction and leave ApplyDelta addressing the value.
+	_, slot, _ := page.FindCell([]byte("b"))
+	if err := page.DeleteCell(slot); err != nil {
+		t.Fatalf("DeleteCell failed: %v", err)
+	}
+	if err := page.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if got := keys(page.ModifiedSince(start.Add(90 * time.Second))); got != "[a c]" {
+		t.Errorf("Expected [a c] after compaction, got %s", got)
+	}
+	_, slot, _ = page.FindCell([]byte("c"))
+	if err := page.ApplyDelta(slot, 0, []byte("z")); err != nil {
+		t.Fatalf("ApplyDelta failed: %v", err)
+	}
+	if cell, _, _ := page.FindCell([]byte("c")); cell != nil {
+		if got, _ := cell.GetValue(); got != "z" {
+			t.Errorf("Expected delta to rewrite the value, got %v", got)
+		}
+	}
+
+	// Pages without timestamps enabled stamp nothing.
+	plain := NewSlottedPage(400)
+	plainCell := NewKVCell([]byte("x"))
+	plainCell.SetValue("x")
+	if err := plain.InsertCell(plainCell); err != nil {
+		t.Fatalf("InsertCell failed: %v", err)
+	}
+	if got := plain.ModifiedSince(time.Time{}); len(got) != 0 {
+		t.Errorf("Expected no timestamped cells, got %d", len(got))
+	}
+}
+
+func TestSlottedPage_Checksum(t *testing.T) {
+	fm, err := NewFileMgr(t.TempDir(), 400)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+
+	page := NewSlottedPage(400)
+	for _, k := range []string{"a", "b", "c"} {
+		cell := NewKVCell([]byte(k))
+		cell.SetValue("value " + k)
+		if err := page.InsertCell(cell); err != nil {
+			t.Fatalf("InsertCell failed: %v", err)
+		}
+	}
+	if err := page.VerifyChecksum(); err != nil {
+		t.Errorf("Expected a never-checksummed page to pass, got %v", err)
+	}
+
+	clean, tampered := NewBlockId("checksum.db", 0), NewBlockId("checksum.db", 1)
+	page.UpdateChecksum()
+	if err := fm.Write(clean, page); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	// Flip a byte of the last cell after the checksum was taken.
+	page.data[len(page.data)-1] ^= 0xFF
+	if err := fm.Write(tampered, page); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	reloaded := NewSlottedPage(400)
+	if err := fm.Read(clean, reloaded); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if err := reloaded.VerifyChecksum(); err != nil {
+		t.Errorf("Expected the clean page to verify, got %v", err)
+	}
+	if err := fm.Read(tampered, reloaded); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if err := reloaded.VerifyChecksum(); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected ErrChecksumMismatch for the tampered page, got %v", err)
+	}
+}
+
+func TestFileMgrChecksumVerification(t *testing.T) {
+	dir := t.TempDir()
+	plain, err := NewFileMgr(dir, 400)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer plain.Close()
+	verifying, err := NewFileMgr(dir, 400, WithChecksumVerification())
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer verifying.Close()
+
+	page := NewSlottedPage(400)
+	cell := NewKVCell([]byte("k"))
+	cell.SetValue("value")
+	if err := page.InsertCell(cell); err != nil {
+		t.Fatalf("InsertCell failed: %v", err)
+	}
+	unchecked, legacy := NewBlockId("verify.db", 0), NewBlockId("verify.db", 1)
+	clean, tampered := NewBlockId("verify.db", 2), NewBlockId("verify.db", 3)
+	if err := plain.Write(unchecked, page); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	// A page checksummed with IEEE CRC32, before CRC32C was used.
+	binary.BigEndian.PutUint32(page.data[pageFlagsOffset:], pageFlagChecksummed)
+	binary.BigEndian.PutUint32(page.data[checksumOffset:], page.checksumLocked(crc32.IEEETable))
+	if err := plain.Write(legacy, page); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	page.UpdateChecksum()
+	if err := plain.Write(clean, page); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	page.data[len(page.data)-1] ^= 0xFF
+	if err := plain.Write(tampered, page); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	reloaded := NewSlottedPage(400)
+	for _, blk := range []*BlockId{unchecked, legacy, clean} {
+		if err := verifying.Read(blk, reloaded); err != nil {
+			t.Errorf("Expected %v to load with verification, got %v", blk, err)
+		}
+	}
+	if err := verifying.Read(tampered, reloaded); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected ErrChecksumMismatch for the tampered page, got %v", err)
+	}
+	if err := plain.Read(tampered, reloaded); err != nil {
+		t.Errorf("Expected reads without verification to ignore checksums, got %v", err)
+	}
+}
+
+func TestSlottedPage_EmptyKeysAndValues(t *testing.T) {
+	page := NewSlottedPage(400)
+
+	// Empty keys are rejected and leave the page untouched.
+	cell := NewKVCell([]byte{})
+	cell.SetValue("orphan")
+	if err := page.InsertCell(cell); !errors.Is(err, ErrEmptyKey) {
+		t.Errorf("Expected ErrEmptyKey, got %v", err)
+	}
+	if page.numSlots() != 0 || page.GetFreeSpace() != 400 {
+		t.Errorf("Rejected insert modified the page: %d cells, free space %d", page.numSlots(), page.GetFreeSpace())
+	}
+	if _, _, err := page.FindCell(nil); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound for an empty key, got %v", err)
+	}
+
+	// Empty values are stored and read back as empty, not nil or an error.
+	for key, val := range map[string]any{"str": "", "raw": []byte{}} {
+		cell := NewKVCell([]byte(key))
+		if err := cell.SetValue(val); err != nil {
+			t.Fatalf("SetValue failed: %v", err)
+		}
+		if err := page.InsertCell(cell); err != nil {
+			t.Fatalf("InsertCell of empty %s value failed: %v", key, err)
+		}
+	}
+	strCell, _, err := page.FindCell([]byte("str"))
+	if err != nil {
+		t.Fatalf("FindCell failed: %v", err)
+	}
+	if got, err := strCell.GetValue(); err != nil || got != "" {
+		t.Errorf("Expected empty string, got %q, %v", got, err)
+	}
+	rawCell, _, err := page.FindCell([]byte("raw"))
+	if err != nil {
+		t.Fatalf("FindCell failed: %v", err)
+	}
+	if got, err := rawCell.GetValue(); err != nil || got == nil || len(got.([]byte)) != 0 {
+		t.Errorf("Expected empty non-nil byte slice, got %#v, %v", got, err)
+	}
+}
+
+func TestSlottedPage_RebuildSlots(t *testing.T) {
+	fm, err := NewFileMgr(t.TempDir(), 400)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+
+	page := NewSlottedPage(400)
+	keys := []string{"m", "c", "x", "a", "q"}
+	for _, k := range keys {
+		cell := NewKVCell([]byte(k))
+		cell.SetValue("value " + k)
+		if err := page.InsertCell(cell); err != nil {
+			t.Fatalf("InsertCell failed: %v", err)
+		}
+	}
+	_, slot, _ := page.FindCell([]byte("q"))
+	if err := page.DeleteCell(slot); err != nil {
+		t.Fatalf("DeleteCell failed: %v", err)
+	}
+	blk := NewBlockId("rebuild.db", 0)
+	if err := fm.Write(blk, page); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	reloaded := NewSlottedPage(400)
+	if err := fm.Read(blk, reloaded); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	// The slot directory is read along with the cells, so rebuilding the
+	// page changes nothing.
+	before := bytes.Clone(reloaded.Contents())
+	if err := reloaded.RebuildSlots(); err != nil {
+		t.Fatalf("RebuildSlots failed: %v", err)
+	}
+	for _, k := range []string{"a", "c", "m", "x"} {
+		cell, _, err := reloaded.FindCell([]byte(k))
+		if err != nil {
+			t.Errorf("FindCell(%s) failed after rebuild: %v", k, err)
+			continue
+		}
+		if got, _ := cell.GetValue(); got != "value "+k {
+			t.Errorf("Key %s: expected %q, got %q", k, "value "+k, got)
+		}
+	}
+	if _, _, err := reloaded.FindCell([]byte("q")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected deleted key q to stay deleted, got %v", err)
+	}
+	if reloaded.numSlots() != page.numSlots() || reloaded.GetFreeSpace() != page.GetFreeSpace() {
+		t.Errorf("Expected %d cells and free space %d, got %d and %d",
+			page.numSlots(), page.GetFreeSpace(), reloaded.numSlots(), reloaded.GetFreeSpace())
+	}
+	if !bytes.Equal(before, reloaded.Contents()) {
+		t.Error("Expected RebuildSlots to leave a current page unchanged")
+	}
+}
+
+func TestSlottedPage_SortedGuard(t *testing.T) {
+	page := NewSlottedPage(400)
+	keys := []string{"a", "b", "c", "d", "e"}
+	for _, k := range keys {
+		cell := NewKVCell([]byte(k))
+		cell.SetValue(k)
+		if err := page.InsertCell(cell); err != nil {
+			t.Fatalf("InsertCell failed: %v", err)
+		}
+	}
+	if !page.IsSorted() {
+		t.Fatalf("Expected a freshly built page to be sorted")
+	}
+
+	slots := page.GetAllSlots()
+	page.SetInt(PageHeaderSize, slots[3])
+	page.SetInt(PageHeaderSize+3*slotEntrySize, slots[0])
+	if page.IsSorted() {
+		t.Errorf("Expected IsSorted to detect the swapped slots")
+	}
+
+	// Run with -tags slotdebug to check the debug guard too.
+	if debugAssertSorted {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected FindCell to trip the debug guard on unsorted slots")
+				}
+			}()
+			page.FindCell([]byte("c"))
+		}()
+	}
+
+	if err := page.RewriteSorted(); err != nil {
+		t.Fatalf("RewriteSorted failed: %v", err)
+	}
+	if !page.IsSorted() {
+		t.Errorf("Expected RewriteSorted to restore key order")
+	}
+	for _, k := range keys {
+		cell, _, err := page.FindCell([]byte(k))
+		if err != nil {
+			t.Errorf("FindCell(%s) failed after RewriteSorted: %v", k, err)
+		} else if got, _ := cell.GetValue(); got != k {
+			t.Errorf("Key %s: expected value %q, got %q", k, k, got)
+		}
+	}
+}
+
+func TestCell_FloatValue(t *testing.T) {
+	for _, want := range floatCases {
+		cell := NewKVCell([]byte("float"))
+		if err := cell.SetValue(want); err != nil {
+			t.Fatalf("SetValue(%v) failed: %v", want, err)
+		}
+		decoded, err := CellFromBytes(cell.ToBytes())
+		if err != nil {
+			t.Fatalf("CellFromBytes failed: %v", err)
+		}
+		got, err := decoded.GetValue()
+		if err != nil {
+			t.Fatalf("GetValue failed: %v", err)
+		}
+		f, ok := got.(float64)
+		if !ok {
+			t.Fatalf("Expected a float64, got %T", got)
+		}
+		if math.Float64bits(f) != math.Float64bits(want) {
+			t.Errorf("Expected bits %016x (%v), got %016x (%v)",
+				math.Float64bits(want), want, math.Float64bits(f), f)
+		}
+	}
+}
+
+func TestCell_Int64Value(t *testing.T) {
+	for _, want := range intCases {
+		cell := NewKVCell([]byte("int"))
+		if err := cell.SetValue(int(want)); err != nil {
+			t.Fatalf("SetValue(%d) failed: %v", want, err)
+		}
+		wantType := byte(IntegerType)
+		if want < 0 || want > math.MaxUint32 {
+			wantType = Int64Type
+		}
+		if cell.valueType != wantType {
+			t.Errorf("SetValue(%d): expected type %d, got %d", want, wantType, cell.valueType)
+		}
+		decoded, err := CellFromBytes(cell.ToBytes())
+		if err != nil {
+			t.Fatalf("CellFromBytes failed: %v", err)
+		}
+		got, err := decoded.GetValue()
+		if err != nil {
+			t.Fatalf("GetValue failed: %v", err)
+		}
+		if got != int(want) {
+			t.Errorf("Expected %d, got %v", want, got)
+		}
+	}
+}
+
+func TestCell_VarintSizes(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), 16)
+	for _, value := range []string{"short", strings.Repeat("v", 300)} {
+		legacy := NewKVCell(key)
+		legacy.SetValue(value)
+		compact := NewKVCell(key)
+		compact.SetValue(value)
+		compact.UseVarintSizes()
+
+		legacyBytes, compactBytes := legacy.ToBytes(), compact.ToBytes()
+		if len(compactBytes) != compact.Size() {
+			t.Errorf("Size() = %d but ToBytes produced %d bytes", compact.Size(), len(compactBytes))
+		}
+		// A 16-byte key saves 3 bytes, and so does a value under 128 bytes.
+		saved := 3
+		if len(value) < 128 {
+			saved += 3
+		} else {
+			saved += 2
+		}
+		if got := len(legacyBytes) - len(compactBytes); got != saved {
+			t.Errorf("value of %d bytes: expected varints to save %d bytes, saved %d", len(value), saved, got)
+		}
+
+		for _, data := range [][]byte{legacyBytes, compactBytes} {
+			decoded, err := CellFromBytes(data)
+			if err != nil {
+				t.Fatalf("CellFromBytes failed: %v", err)
+			}
+			got, err := decoded.GetValue()
+			if err != nil {
+				t.Fatalf("GetValue failed: %v", err)
+			}
+			if !bytes.Equal(decoded.GetKey(), key) || got != value {
+				t.Errorf("Round trip gave key %q value %q", decoded.GetKey(), got)
+			}
+			if want := len(data) == len(compactBytes); decoded.HasVarintSizes() != want {
+				t.Errorf("Expected HasVarintSizes %v after decoding", want)
+			}
+		}
+	}
+}
+
+func TestSlottedPage_ExportImportCells(t *testing.T) {
+	src := NewSlottedPage(4096)
+	want := make(map[string]string)
+	for i := 0; i < 60; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		val := fmt.Sprintf("value %d %s", i, bytes.Repeat([]byte("x"), i%20))
+		cell := NewKVCell([]byte(key))
+		cell.SetValue(val)
+		if err := src.InsertCell(cell); err != nil {
+			t.Fatalf("InsertCell failed: %v", err)
+		}
+		want[key] = val
+	}
+	for i := 0; i < 60; i += 7 {
+		key := fmt.Sprintf("key%03d", i)
+		_, slot, _ := src.FindCell([]byte(key))
+		if err := src.DeleteCell(slot); err != nil {
+			t.Fatalf("DeleteCell failed: %v", err)
+		}
+		delete(want, key)
+	}
+
+	cells, err := src.ExportCells()
+	if err != nil {
+		t.Fatalf("ExportCells failed: %v", err)
+	}
+	dst := NewSlottedPage(8192)
+	if err := dst.ImportCells(cells); err != nil {
+		t.Fatalf("ImportCells failed: %v", err)
+	}
+	// The export must not alias the source page.
+	for i := range src.data {
+		src.data[i] = 0
+	}
+
+	if len(dst.GetAllSlots()) != len(want) {
+		t.Errorf("Expected %d cells, got %d", len(want), len(dst.GetAllSlots()))
+	}
+	for key, val := range want {
+		cell, _, err := dst.FindCell([]byte(key))
+		if err != nil {
+			t.Errorf("FindCell(%s) failed: %v", key, err)
+			continue
+		}
+		if got, _ := cell.GetValue(); got != val {
+			t.Errorf("Key %s: expected %q, got %q", key, val, got)
+		}
+	}
+
+	// A page too small for the export is left empty.
+	small := NewSlottedPage(512)
+	if err := small.ImportCells(cells); !errors.Is(err, ErrPageFull) {
+		t.Errorf("Expected ErrPageFull, got %v", err)
+	}
+	if n := len(small.GetAllSlots()); n != 0 {
+		t.Errorf("Expected a failed import to insert nothing, got %d cells", n)
+	}
+
+	// A cell that cannot be decoded fails the export instead of going
+	// missing from it.
+	binary.BigEndian.PutUint32(dst.data[dst.slot(3):], uint32(len(dst.data)))
+	if _, err := dst.ExportCells(); err == nil {
+		t.Errorf("Expected ExportCells to fail on a damaged cell")
+	}
+}
+
+func TestSlottedPage_SearchAfterRawRead(t *testing.T) {
+	fm, err := NewFileMgr(t.TempDir(), 400)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+
+	page := NewSlottedPage(400)
+	for _, k := range []string{"m", "c", "x", "a"} {
+		cell := NewKVCell([]byte(k))
+		cell.SetValue("value " + k)
+		if err := page.InsertCell(cell); err != nil {
+			t.Fatalf("InsertCell failed: %v", err)
+		}
+	}
+	blk := NewBlockId("layout.db", 0)
+	if err := fm.Write(blk, page); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// A page filled straight from disk is searchable and editable at once.
+	reloaded := NewSlottedPage(400)
+	if err := fm.Read(blk, reloaded); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	for i, k := range []string{"a", "c", "m", "x"} {
+		cell, slot, err := reloaded.FindCell([]byte(k))
+		if err != nil {
+			t.Fatalf("FindCell(%s) failed: %v", k, err)
+		}
+		if got, _ := cell.GetValue(); got != "value "+k || slot != i {
+			t.Errorf("Key %s: expected %q in slot %d, got %q in slot %d", k, "value "+k, i, got, slot)
+		}
+	}
+	cell := NewKVCell([]byte("f"))
+	cell.SetValue("value f")
+	if err := reloaded.InsertCell(cell); err != nil {
+		t.Fatalf("InsertCell into the reloaded page failed: %v", err)
+	}
+	if _, slot, err := reloaded.FindCell([]byte("f")); err != nil || slot != 2 {
+		t.Errorf("Expected f in slot 2, got slot %d (%v)", slot, err)
+	}
+
+	// So is an appended block that was never written.
+	appended, err := fm.Append("layout.db")
+	if err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	blank := NewSlottedPage(400)
+	if err := fm.Read(appended, blank); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if _, _, err := blank.FindCell([]byte("a")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound on a blank page, got %v", err)
+	}
+	if err := blank.InsertCell(cell); err != nil {
+		t.Fatalf("InsertCell into a blank page failed: %v", err)
+	}
+	if _, _, err := blank.FindCell([]byte("f")); err != nil {
+		t.Errorf("FindCell on the formerly blank page failed: %v", err)
+	}
+}
+
+func TestSlottedPage_ConvertsPagesWithoutDirectory(t *testing.T) {
+	// Lay out a page as written before the slot directory was kept on it:
+	// cells packed down from the end in insertion order, a deleted one
+	// among them, and a header recording no directory.
+	const size = 400
+	data := make([]byte, size)
+	freeSpace := size
+	for _, k := range []string{"m", "c", "q", "a"} {
+		cell := NewKVCell([]byte(k))
+		cell.SetValue("value " + k)
+		if k == "q" {
+			cell.MarkDeleted()
+		}
+		b := cell.ToBytes()
+		freeSpace -= len(b) + slotPointerSize
+		binary.BigEndian.PutUint32(data[freeSpace:], uint32(len(b)))
+		copy(data[freeSpace+slotPointerSize:], b)
+	}
+	binary.BigEndian.PutUint32(data[pageSizeOffset:], size)
+	binary.BigEndian.PutUint32(data[headerSizeOffset:], PageHeaderSize)
+	binary.BigEndian.PutUint32(data[cellCountOffset:], 3)
+	binary.BigEndian.PutUint32(data[freeSpaceOffset:], uint32(freeSpace))
+
+	page := NewSlottedPage(size)
+	copy(page.Contents(), data)
+	if err := page.RebuildSlots(); err != nil {
+		t.Fatalf("RebuildSlots failed: %v", err)
+	}
+	if page.headerSize() != PageHeaderSize+3*slotEntrySize {
+		t.Errorf("Expected a directory of 3 entries, got a header of %d bytes", page.headerSize())
+	}
+	for i, k := range []string{"a", "c", "m"} {
+		cell, slot, err := page.FindCell([]byte(k))
+		if err != nil {
+			t.Fatalf("FindCell(%s) failed after conversion: %v", k, err)
+		}
+		if got, _ := cell.GetValue(); got != "value "+k || slot != i {
+			t.Errorf("Key %s: expected %q in slot %d, got %q in slot %d", k, "value "+k, i, got, slot)
+		}
+	}
+	if _, _, err := page.FindCell([]byte("q")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected deleted key q to stay deleted, got %v", err)
+	}
+
+	// SetContents converts the same way.
+	fresh := NewSlottedPage(size)
+	if err := fresh.SetContents(data); err != nil {
+		t.Fatalf("SetContents failed: %v", err)
+	}
+	if _, _, err := fresh.FindCell([]byte("m")); err != nil {
+		t.Errorf("FindCell after SetContents failed: %v", err)
+	}
+}
+
+func TestSlottedPage_OverflowCells(t *testing.T) {
+	const blocksize = 400
+	fm, err := NewFileMgr(t.TempDir(), blocksize)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+
+	page := NewSlottedPage(blocksize)
+	small := NewKVCell([]byte("a"))
+	if err := small.SetValue("inline"); err != nil {
+		t.Fatalf("SetValue failed: %v", err)
+	}
+	if err := page.InsertCell(small); err != nil {
+		t.Fatalf("InsertCell failed: %v", err)
+	}
+
+	// A value twice the page size spills into a chain of blocks.
+	big := bytes.Repeat([]byte("0123456789abcdef"), 2*blocksize/16)
+	cell := NewKVCell([]byte("b"))
+	if err := cell.SetValue(big); err != nil {
+		t.Fatalf("SetValue failed: %v", err)
+	}
+	if err := page.InsertCell(cell); !errors.Is(err, ErrPageFull) {
+		t.Fatalf("Expected InsertCell of the big cell to fail with ErrPageFull, got %v", err)
+	}
+	spill, err := page.SpillCell(cell, 0)
+	if err != nil {
+		t.Fatalf("SpillCell failed: %v", err)
+	}
+	if len(spill.Fragments) < 2 {
+		t.Fatalf("Expected the value to need at least 2 overflow blocks, got %d", len(spill.Fragments))
+	}
+	capped, err := page.SpillCell(cell, 200)
+	if err != nil {
+		t.Fatalf("SpillCell with a limit failed: %v", err)
+	}
+	for i, piece := range append([]*Cell{capped.Inline}, capped.Fragments...) {
+		if n := len(piece.ToBytes()); n > 200 {
+			t.Errorf("Expected piece %d within the limit of 200 bytes, got %d", i, n)
+		}
+	}
+	file := OverflowFile("tree.db")
+	ovf, err := fm.AppendN(file, len(spill.Fragments))
+	if err != nil {
+		t.Fatalf("AppendN failed: %v", err)
+	}
+	blks := make([]int32, len(ovf))
+	for i, blk := range ovf {
+		blks[i] = blk.Number()
+	}
+	spill.Chain(blks)
+	for i, frag := range spill.Fragments {
+		p := NewSlottedPage(blocksize)
+		if err := p.RestoreCell(frag); err != nil {
+			t.Fatalf("RestoreCell of fragment %d failed: %v", i, err)
+		}
+		if err := fm.Write(ovf[i], p); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := page.RestoreCell(spill.Inline); err != nil {
+		t.Fatalf("RestoreCell of the inline part failed: %v", err)
+	}
+
+	// Without a reader the cell reads back as stored.
+	stored, slot, err := page.FindCell([]byte("b"))
+	if err != nil {
+		t.Fatalf("FindCell failed: %v", err)
+	}
+	if !stored.HasOverflow() || len(stored.value) >= len(big) {
+		t.Errorf("Expected the stored cell to hold part of the value and overflow")
+	}
+
+	page.SetOverflowReader(func(blk int32, use func(*SlottedPage) error) error {
+		p := NewSlottedPage(blocksize)
+		if err := fm.Read(NewBlockId(file, blk), p); err != nil {
+			return err
+		}
+		return use(p)
+	})
+	full, _, err := page.FindCell([]byte("b"))
+	if err != nil {
+		t.Fatalf("FindCell failed: %v", err)
+	}
+	if v, err := full.GetValue(); err != nil || !bytes.Equal(v.([]byte), big) {
+		t.Errorf("Expected the value to be reassembled intact (%v)", err)
+	}
+	if full.HasOverflow() {
+		t.Errorf("Expected the reassembled cell not to overflow")
+	}
+	cells, err := page.ScanRange(nil, nil, true, true)
+	if err != nil || len(cells) != 2 {
+		t.Fatalf("Expected ScanRange to return both cells, got %d (%v)", len(cells), err)
+	}
+	if v, _ := cells[0].GetValue(); v != "inline" {
+		t.Errorf("Expected the small cell to read back as inline, got %v", v)
+	}
+	if v, _ := cells[1].GetValue(); !bytes.Equal(v.([]byte), big) {
+		t.Errorf("Expected ScanRange to reassemble the value")
+	}
+	if c, err := page.StoredCellBySlot(slot); err != nil || !c.HasOverflow() {
+		t.Errorf("Expected StoredCellBySlot to return the cell as stored (%v)", err)
+	}
+
+	// Freeing the chain hands every overflow block back.
+	if err := fm.FreeOverflow("tree.db", stored); err != nil {
+		t.Fatalf("FreeOverflow failed: %v", err)
+	}
+	if free := fm.FreeBlocks(file); len(free) != len(blks) {
+		t.Errorf("Expected %d free overflow blocks, got %v", len(blks), free)
+	}
+}
+
+func TestSlottedPage_CompactKeyCells(t *testing.T) {
+	page := NewSlottedPage(DefaultPageSize)
+	var stats []CompactionStats
+	page.OnCompact(func(s CompactionStats) { stats = append(stats, s) })
+
+	// Interleave internal-node cells, whose child pointers must survive,
+	// with leaf cells.
+	for i := 0; i < 8; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		var cell *Cell
+		if i%2 == 0 {
+			cell = NewKeyCell(key, uint64(1000+i))
+		} else {
+			cell = NewKVCell(key)
+			if err := cell.SetValue(fmt.Sprintf("value%d", i)); err != nil {
+				t.Fatalf("SetValue failed: %v", err)
+			}
+		}
+		if err := page.InsertCell(cell); err != nil {
+			t.Fatalf("Failed to insert cell %d: %v", i, err)
+		}
+	}
+	for _, key := range []string{"key6", "key3", "key0"} {
+		_, slot, err := page.FindCell([]byte(key))
+		if err != nil {
+			t.Fatalf("FindCell(%s) failed: %v", key, err)
+		}
+		if err := page.DeleteCell(slot); err != nil {
+			t.Fatalf("DeleteCell(%s) failed: %v", key, err)
+		}
+	}
+
+	before := page.GetFreeSpace()
+	if err := page.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if !page.IsSorted() {
+		t.Errorf("Expected the slots to stay in key order")
+	}
+	want := []string{"key1", "key2", "key4", "key5", "key7"}
+	if page.numSlots() != len(want) {
+		t.Fatalf("Expected %d cells after compaction, got %d", len(want), page.numSlots())
+	}
+	for slot, key := range want {
+		cell, err := page.GetCellBySlot(slot)
+		if err != nil {
+			t.Fatalf("GetCellBySlot(%d) failed: %v", slot, err)
+		}
+		if string(cell.GetKey()) != key {
+			t.Errorf("Slot %d: expected %s, got %s", slot, key, cell.GetKey())
+		}
+		i := int(key[len(key)-1] - '0')
+		if i%2 == 0 {
+			if cell.cellType != CellTypeKey || cell.pageId != uint64(1000+i) {
+				t.Errorf("Expected %s to keep child page %d, got type %d page %d", key, 1000+i, cell.cellType, cell.pageId)
+			}
+		} else if v, err := cell.GetValue(); err != nil || v != fmt.Sprintf("value%d", i) {
+			t.Errorf("Expected %s to keep value%d, got %v (%v)", key, i, v, err)
+		}
+	}
+
+	// The free space pointer sits right below the packed cells, and the
+	// reported reclaim is exactly how far it moved.
+	if got, packed := page.GetFreeSpace(), page.Size()-page.cellsTotalSize(); got != packed {
+		t.Errorf("Expected the free space pointer at %d after packing, got %d", packed, got)
+	}
+	if len(stats) != 1 {
+		t.Fatalf("Expected one compaction to be reported, got %d", len(stats))
+	}
+	if s := stats[0]; s.CellsRetained != 5 || s.CellsDropped != 3 || s.BytesReclaimed != page.GetFreeSpace()-before {
+		t.Errorf("Unexpected compaction stats %+v, free space moved by %d", s, page.GetFreeSpace()-before)
+	}
+}
+
+func TestSlottedPage_BulkInsert(t *testing.T) {
+	stamp := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	newCells := func(from, to int) []*Cell {
+		var cells []*Cell
+		for i := from; i < to; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			if i%3 == 0 {
+				cells = append(cells, NewKeyCell(key, uint64(i)))
+				continue
+			}
+			cell := NewKVCell(key)
+			if err := cell.SetValue(fmt.Sprintf("value%d", i)); err != nil {
+				t.Fatalf("SetValue failed: %v", err)
+			}
+			cells = append(cells, cell)
+		}
+		return cells
+	}
+
+	// Two batches, the second after the first, against one InsertCell per
+	// cell: the slot arrays and the bytes must match.
+	bulk := NewSlottedPage(1024)
+	bulk.EnableTimestamps(func() time.Time { return stamp })
+	one := NewSlottedPage(1024)
+	one.EnableTimestamps(func() time.Time { return stamp })
+	if err := bulk.BulkInsert(newCells(0, 10)); err != nil {
+		t.Fatalf("BulkInsert failed: %v", err)
+	}
+	if err := bulk.BulkInsert(newCells(10, 20)); err != nil {
+		t.Fatalf("BulkInsert failed: %v", err)
+	}
+	for _, cell := range newCells(0, 20) {
+		if err := one.InsertCell(cell); err != nil {
+			t.Fatalf("InsertCell failed: %v", err)
+		}
+	}
+	if !slices.Equal(bulk.GetAllSlots(), one.GetAllSlots()) {
+		t.Errorf("Slot arrays differ:\n bulk %v\n one  %v", bulk.GetAllSlots(), one.GetAllSlots())
+	}
+	if !bytes.Equal(bulk.Contents(), one.Contents()) {
+		t.Errorf("Expected BulkInsert to lay the page out as InsertCell does")
+	}
+	if cell, _, err := bulk.FindCell([]byte("key013")); err != nil {
+		t.Errorf("FindCell(key013) failed: %v", err)
+	} else if !cell.CreatedAt().Equal(stamp) {
+		t.Errorf("Expected key013 to be stamped %v, got %v", stamp, cell.CreatedAt())
+	}
+
+	// Rejected batches leave the page alone.
+	before := slices.Clone(bulk.Contents())
+	unsorted := append(newCells(30, 32), newCells(25, 26)...)
+	if err := bulk.BulkInsert(unsorted); !errors.Is(err, ErrNotSorted) {
+		t.Errorf("Expected ErrNotSorted for out-of-order cells, got %v", err)
+	}
+	if err := bulk.BulkInsert(newCells(5, 6)); !errors.Is(err, ErrNotSorted) {
+		t.Errorf("Expected ErrNotSorted for a key before the page's last, got %v", err)
+	}
+	if err := bulk.BulkInsert(newCells(20, 80)); !errors.Is(err, ErrPageFull) {
+		t.Errorf("Expected ErrPageFull for cells that do not fit, got %v", err)
+	}
+	if !bytes.Equal(bulk.Contents(), before) {
+		t.Errorf("Expected a rejected BulkInsert to leave the page unchanged")
+	}
+}
+
+func TestSlottedPage_UpdateCellBySlot(t *testing.T) {
+	page := NewSlottedPage(400)
+	for _, k := range []string{"a", "b", "c"} {
+		cell := NewKVCell([]byte(k))
+		if err := cell.SetValue("value-" + k); err != nil {
+			t.Fatalf("SetValue failed: %v", err)
+		}
+		if err := page.InsertCell(cell); err != nil {
+			t.Fatalf("InsertCell failed: %v", err)
+		}
+	}
+	find := func(key string) any {
+		t.Helper()
+		cell, _, err := page.FindCell([]byte(key))
+		if err != nil {
+			t.Fatalf("FindCell(%s) failed: %v", key, err)
+		}
+		v, err := cell.GetValue()
+		if err != nil {
+			t.Fatalf("GetValue failed: %v", err)
+		}
+		return v
+	}
+
+	// A smaller value is written over the old cell: same offset, same free
+	// space, and the cells after it still scan.
+	_, slot, err := page.FindCell([]byte("b"))
+	if err != nil {
+		t.Fatalf("FindCell failed: %v", err)
+	}
+	slots, free := page.GetAllSlots(), page.GetFreeSpace()
+	if err := page.UpdateCellBySlot(slot, "b2"); err != nil {
+		t.Fatalf("UpdateCellBySlot with a smaller value failed: %v", err)
+	}
+	if v := find("b"); v != "b2" {
+		t.Errorf("Expected b2 after the smaller update, got %v", v)
+	}
+	if !slices.Equal(page.GetAllSlots(), slots) || page.GetFreeSpace() != free {
+		t.Errorf("Expected the smaller update to stay in place")
+	}
+	if n := page.storedCellCount(); n != 3 {
+		t.Errorf("Expected the cell region to still hold 3 cells, got %d", n)
+	}
+
+	// A larger value moves the cell, and the slots stay in key order.
+	larger := strings.Repeat("B", 64)
+	if err := page.UpdateCellBySlot(slot, larger); err != nil {
+		t.Fatalf("UpdateCellBySlot with a larger value failed: %v", err)
+	}
+	if v := find("b"); v != larger {
+		t.Errorf("Expected the larger value, got %v", v)
+	}
+	if page.GetAllSlots()[slot] == slots[slot] {
+		t.Errorf("Expected the larger update to move the cell")
+	}
+	if !page.IsSorted() {
+		t.Errorf("Expected the slots to stay in key order")
+	}
+	for _, k := range []string{"a", "c"} {
+		if v := find(k); v != "value-"+k {
+			t.Errorf("Expected %s to keep value-%s, got %v", k, k, v)
+		}
+	}
+
+	// A value too large for the page leaves the cell as it was.
+	if err := page.UpdateCellBySlot(slot, strings.Repeat("x", 500)); !errors.Is(err, ErrPageFull) {
+		t.Errorf("Expected ErrPageFull for an oversized value, got %v", err)
+	}
+	if v := find("b"); v != larger {
+		t.Errorf("Expected a failed update to keep the old value, got %v", v)
+	}
+	if err := page.UpdateCellBySlot(3, "x"); err == nil {
+		t.Errorf("Expected an error for an invalid slot")
+	}
+
+	// The update keeps the cell's size encoding, and a key cell has no
+	// value to update.
+	varint := NewKVCell([]byte("d"))
+	varint.UseVarintSizes()
+	if err := varint.SetValue("value-d"); err != nil {
+		t.Fatalf("SetValue failed: %v", err)
+	}
+	if err := page.InsertCell(varint); err != nil {
+		t.Fatalf("InsertCell failed: %v", err)
+	}
+	_, slot, _ = page.FindCell([]byte("d"))
+	if err := page.UpdateCellBySlot(slot, "d2"); err != nil {
+		t.Fatalf("UpdateCellBySlot of a varint cell failed: %v", err)
+	}
+	if cell, _ := page.GetCellBySlot(slot); !cell.HasVarintSizes() {
+		t.Errorf("Expected the updated cell to keep its varint sizes")
+	}
+	if err := page.InsertCell(NewKeyCell([]byte("e"), 7)); err != nil {
+		t.Fatalf("InsertCell failed: %v", err)
+	}
+	_, slot, _ = page.FindCell([]byte("e"))
+	if err := page.UpdateCellBySlot(slot, "x"); err == nil {
+		t.Errorf("Expected updating a key cell to fail")
+	}
+	if cell, _ := page.GetCellBySlot(slot); cell.GetType() != CellTypeKey || cell.GetPageId() != 7 {
+		t.Errorf("Expected the key cell to be left alone, got type %d page %d", cell.GetType(), cell.GetPageId())
+	}
+}
+
+func TestSlottedPage_Scan(t *testing.T) {
+	page := NewSlottedPage(DefaultPageSize)
+	for i := 0; i < 10; i++ {
+		cell := NewKVCell([]byte(fmt.Sprintf("key%d", i)))
+		if err := cell.SetValue(i); err != nil {
+			t.Fatalf("SetValue failed: %v", err)
+		}
+		if err := page.InsertCell(cell); err != nil {
+			t.Fatalf("InsertCell failed: %v", err)
+		}
+	}
+	_, slot, err := page.FindCell([]byte("key5"))
+	if err != nil {
+		t.Fatalf("FindCell failed: %v", err)
+	}
+	if err := page.DeleteCell(slot); err != nil {
+		t.Fatalf("DeleteCell failed: %v", err)
+	}
+
+	keys := func(cells []*Cell) string {
+		var out []string
+		for _, c := range cells {
+			out = append(out, string(c.GetKey()))
+		}
+		return strings.Join(out, " ")
+	}
+	b := func(s string) []byte {
+		if s == "" {
+			return nil
+		}
+		return []byte(s)
+	}
+	for _, tc := range []struct {
+		name                    string
+		low, high               string
+		includeLow, includeHigh bool
+		want                    string
+	}{
+		{"closed", "key2", "key4", true, true, "key2 key3 key4"},
+		{"half-open above", "key2", "key4", true, false, "key2 key3"},
+		{"half-open below", "key2", "key4", false, true, "key3 key4"},
+		{"open", "key2", "key4", false, false, "key3"},
+		{"skips deleted", "key4", "key6", true, true, "key4 key6"},
+		{"bounds between keys", "key2a", "key4a", true, true, "key3 key4"},
+		{"no low bound", "", "key1", true, true, "key0 key1"},
+		{"no high bound", "key8", "", true, true, "key8 key9"},
+		{"all cells", "", "", true, true, "key0 key1 key2 key3 key4 key6 key7 key8 key9"},
+		{"bounds around all", "a", "z", false, false, "key0 key1 key2 key3 key4 key6 key7 key8 key9"},
+		{"empty between keys", "key3a", "key3b", true, true, ""},
+		{"empty deleted key", "key5", "key5", true, true, ""},
+		{"empty single key excluded", "key3", "key3", true, false, ""},
+		{"empty inverted", "key7", "key2", true, true, ""},
+		{"empty above", "zz", "", true, true, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cells, err := page.ScanRange(b(tc.low), b(tc.high), tc.includeLow, tc.includeHigh)
+			if err != nil {
+				t.Fatalf("ScanRange failed: %v", err)
+			}
+			if got := keys(cells); got != tc.want {
+				t.Errorf("Expected [%s], got [%s]", tc.want, got)
+			}
+		})
+	}
+
+	cells, err := page.Scan([]byte("key8"), []byte("key9"))
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if got := keys(cells); got != "key8 key9" {
+		t.Errorf("Expected Scan to include both bounds, got [%s]", got)
+	}
+	if v, err := cells[0].GetValue(); err != nil || v != 8 {
+		t.Errorf("Expected key8 to hold 8, got %v (%v)", v, err)
+	}
+	if cells, err := NewSlottedPage(400).Scan(nil, nil); err != nil || len(cells) != 0 {
+		t.Errorf("Expected an empty page to scan to nothing, got %d cells (%v)", len(cells), err)
+	}
+}
+
+func TestSlottedPage_CellIterator(t *testing.T) {
+	page := NewSlottedPage(DefaultPageSize)
+	if page.CellIterator().HasNext() {
+		t.Errorf("Expected an empty page to have no cells")
+	}
+	for _, k := range []string{"e", "a", "c", "b", "d"} {
+		cell := NewKVCell([]byte(k))
+		if err := cell.SetValue("value-" + k); err != nil {
+			t.Fatalf("SetValue failed: %v", err)
+		}
+		if err := page.InsertCell(cell); err != nil {
+			t.Fatalf("InsertCell failed: %v", err)
+		}
+	}
+	_, slot, err := page.FindCell([]byte("c"))
+	if err != nil {
+		t.Fatalf("FindCell failed: %v", err)
+	}
+	if err := page.DeleteCell(slot); err != nil {
+		t.Fatalf("DeleteCell failed: %v", err)
+	}
+
+	collect := func() []string {
+		t.Helper()
+		var keys []string
+		for it := page.CellIterator(); it.HasNext(); {
+			cell, err := it.Next()
+			if err != nil {
+				t.Fatalf("Next failed: %v", err)
+			}
+			if v, err := cell.GetValue(); err != nil || v != "value-"+string(cell.GetKey()) {
+				t.Errorf("Unexpected value %v (%v) for %s", v, err, cell.GetKey())
+			}
+			keys = append(keys, string(cell.GetKey()))
+		}
+		return keys
+	}
+	if got := collect(); !slices.Equal(got, []string{"a", "b", "d", "e"}) {
+		t.Errorf("Expected the live cells a b d e, got %v", got)
+	}
+
+	// A cell still in the directory but flagged deleted, as the cell region
+	// of an old page may hold, is stepped over too.
+	offset := page.slot(1)
+	page.mu.Lock()
+	page.data[offset+slotPointerSize] |= FlagDeleted
+	page.mu.Unlock()
+	if got := collect(); !slices.Equal(got, []string{"a", "d", "e"}) {
+		t.Errorf("Expected the flagged cell b to be skipped, got %v", got)
+	}
+
+	it := page.CellIterator()
+	for it.HasNext() {
+		if _, err := it.Next(); err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+	}
+	if _, err := it.Next(); err == nil {
+		t.Errorf("Expected Next past the last cell to fail")
+	}
+}
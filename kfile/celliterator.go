@@ -0,0 +1,57 @@
+package kfile
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errNoMoreCells is returned by CellIterator.Next past the last cell.
+var errNoMoreCells = errors.New("no more cells")
+
+// CellIterator walks the live cells of a slotted page in key order. It
+// keeps only the index of the next slot, so it sees the page as it is at
+// each call; a cell inserted or deleted behind it shifts what it yields
+// next. It satisfies utils.Iterator[*Cell].
+type CellIterator struct {
+	sp   *SlottedPage
+	slot int
+}
+
+// CellIterator returns an iterator over the page's live cells, in key order.
+func (sp *SlottedPage) CellIterator() *CellIterator {
+	return &CellIterator{sp: sp}
+}
+
+// HasNext reports whether another live cell remains, stepping over any
+// cell marked deleted without decoding it.
+func (it *CellIterator) HasNext() bool {
+	for count := it.sp.numSlots(); it.slot < count; it.slot++ {
+		if !it.sp.cellDeleted(it.sp.slot(it.slot)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns the next live cell, decoded afresh from the page.
+func (it *CellIterator) Next() (*Cell, error) {
+	if !it.HasNext() {
+		return nil, errNoMoreCells
+	}
+	cell, err := it.sp.GetCellBySlot(it.slot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cell at slot %d: %w", it.slot, err)
+	}
+	it.slot++
+	return cell, nil
+}
+
+// cellDeleted reports whether the cell at offset carries FlagDeleted. A cell
+// whose header lies outside the page is reported as live, for GetCell to
+// fail on.
+func (sp *SlottedPage) cellDeleted(offset int) bool {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	header := offset + slotPointerSize
+	return header >= 0 && header < len(sp.data) && sp.data[header]&FlagDeleted != 0
+}
@@ -0,0 +1,108 @@
+package kfile
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+)
+
+// CompactionStats describes a single SlottedPage.Compact.
+type CompactionStats struct {
+	CellsRetained  int // live cells copied into the compacted page
+	CellsDropped   int // deleted or superseded cells discarded
+	BytesReclaimed int // growth of the free region, length prefixes included
+}
+
+// CompactionTotals accumulates CompactionStats for one file.
+type CompactionTotals struct {
+	Compactions    int
+	CellsRetained  int
+	CellsDropped   int
+	BytesReclaimed int
+}
+
+// CompactionMetrics aggregates compaction statistics per file, to help
+// decide when a file is worth vacuuming. It is safe for concurrent use.
+type CompactionMetrics struct {
+	mu        sync.Mutex
+	totals    map[string]*CompactionTotals
+	observers map[string]func(CompactionStats)
+}
+
+// NewCompactionMetrics returns an empty CompactionMetrics.
+func NewCompactionMetrics() *CompactionMetrics {
+	return &CompactionMetrics{
+		totals:    make(map[string]*CompactionTotals),
+		observers: make(map[string]func(CompactionStats)),
+	}
+}
+
+// Observer returns a hook for SlottedPage.OnCompact that adds each
+// compaction to filename's totals.
+func (m *CompactionMetrics) Observer(filename string) func(CompactionStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if fn, ok := m.observers[filename]; ok {
+		return fn
+	}
+	fn := func(s CompactionStats) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		t, ok := m.totals[filename]
+		if !ok {
+			t = &CompactionTotals{}
+			m.totals[filename] = t
+		}
+		t.Compactions++
+		t.CellsRetained += s.CellsRetained
+		t.CellsDropped += s.CellsDropped
+		t.BytesReclaimed += s.BytesReclaimed
+	}
+	m.observers[filename] = fn
+	return fn
+}
+
+// Totals returns the accumulated statistics for filename.
+func (m *CompactionMetrics) Totals(filename string) CompactionTotals {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.totals[filename]; ok {
+		return *t
+	}
+	return CompactionTotals{}
+}
+
+// Files returns the names of files that have seen a compaction, sorted.
+func (m *CompactionMetrics) Files() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	files := make([]string, 0, len(m.totals))
+	for f := range m.totals {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// OnCompact registers fn to receive the statistics of every later Compact
+// of this page. A nil fn removes the hook.
+func (sp *SlottedPage) OnCompact(fn func(CompactionStats)) {
+	sp.onCompact = fn
+}
+
+// storedCellCount counts every cell in the data region, live or dead, by
+// walking the length prefixes up from the free space pointer.
+func (sp *SlottedPage) storedCellCount() int {
+	freeSpace := sp.GetFreeSpace()
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	n := 0
+	for offset := freeSpace; offset+slotPointerSize <= len(sp.data); n++ {
+		size := int(binary.BigEndian.Uint32(sp.data[offset:]))
+		if size <= 0 {
+			break
+		}
+		offset += slotPointerSize + size
+	}
+	return n
+}
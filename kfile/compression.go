@@ -0,0 +1,129 @@
+package kfile
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// CompressionDictFile is the reserved file in the database directory holding
+// the shared compression dictionary.
+const CompressionDictFile = "compression.dict"
+
+// maxDictSize is the largest useful preset dictionary: DEFLATE only looks
+// back 32KB.
+const maxDictSize = 32 * 1024
+
+// CompressionDict is a preset dictionary shared by all pages, so that pages
+// compress against patterns common across pages (such as repeated schema
+// strings) rather than only against their own contents. A nil dictionary
+// compresses each page on its own.
+type CompressionDict struct {
+	data []byte
+}
+
+// NewCompressionDict wraps a fixed dictionary.
+func NewCompressionDict(data []byte) *CompressionDict {
+	if len(data) > maxDictSize {
+		data = data[len(data)-maxDictSize:]
+	}
+	return &CompressionDict{data: append([]byte(nil), data...)}
+}
+
+// TrainCompressionDict builds a dictionary of at most maxSize bytes from
+// sample pages. Runs of zero bytes (unused page space) are dropped and
+// repeated content is kept once; later samples end up closest to the end of
+// the dictionary, where DEFLATE references are cheapest.
+func TrainCompressionDict(samples [][]byte, maxSize int) *CompressionDict {
+	if maxSize <= 0 || maxSize > maxDictSize {
+		maxSize = maxDictSize
+	}
+	var dict []byte
+	for _, sample := range samples {
+		for _, chunk := range bytes.FieldsFunc(sample, func(r rune) bool { return r == 0 }) {
+			if len(chunk) < 4 || bytes.Contains(dict, chunk) {
+				continue
+			}
+			dict = append(dict, chunk...)
+		}
+	}
+	if len(dict) > maxSize {
+		dict = dict[len(dict)-maxSize:]
+	}
+	return NewCompressionDict(dict)
+}
+
+// Bytes returns the dictionary contents.
+func (d *CompressionDict) Bytes() []byte {
+	if d == nil {
+		return nil
+	}
+	return d.data
+}
+
+// Compress deflates data against the dictionary.
+func (d *CompressionDict) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriterDict(&buf, flate.BestCompression, d.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create compressor: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to compress: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish compression: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress inflates data produced by Compress with the same dictionary.
+func (d *CompressionDict) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReaderDict(bytes.NewReader(data), d.Bytes())
+	defer r.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress: %w", err)
+	}
+	return out, nil
+}
+
+// SaveCompressionDict stores d in the database's reserved dictionary file,
+// replacing any previous one atomically.
+func (fm *FileMgr) SaveCompressionDict(d *CompressionDict) error {
+	if fm.readOnly {
+		return ErrReadOnly
+	}
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+
+	if fm.closed {
+		return ErrClosed
+	}
+	if err := fm.replaceFile(filepath.Join(fm.dbDirectory, CompressionDictFile), d.Bytes()); err != nil {
+		return fmt.Errorf("failed to save compression dictionary: %w", err)
+	}
+	return nil
+}
+
+// LoadCompressionDict reads the database's compression dictionary. It
+// returns nil, meaning no shared dictionary, if none has been saved.
+func (fm *FileMgr) LoadCompressionDict() (*CompressionDict, error) {
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+
+	if fm.closed {
+		return nil, ErrClosed
+	}
+	data, err := os.ReadFile(filepath.Join(fm.dbDirectory, CompressionDictFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compression dictionary: %w", err)
+	}
+	return NewCompressionDict(data), nil
+}
@@ -0,0 +1,96 @@
+package kfile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// CopyFile copies srcFilename to dstFilename, which is a file name in the
+// source's directory or an absolute path, and syncs the copy. It holds the
+// source's lock for the duration, so the copy holds every write completed
+// before the call and none made during it; batched writes not yet synced
+// are included, since they are read back through the same open file. Only
+// whole blocks are copied, along with the superblock of a file that has
+// one. An existing destination is never overwritten.
+func (fm *FileMgr) CopyFile(srcFilename, dstFilename string) error {
+	if fm.readOnly {
+		return ErrReadOnly
+	}
+	if dstFilename == "" || dstFilename == srcFilename {
+		return fmt.Errorf("invalid copy destination %q for %s", dstFilename, srcFilename)
+	}
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+
+	// A destination in the data directory is locked too, so that no other
+	// operation opens it while the copy is created. Lock in a fixed order,
+	// as RenameFile does.
+	src := fm.fileLock(srcFilename)
+	if filepath.IsAbs(dstFilename) {
+		src.RLock()
+		defer src.RUnlock()
+	} else {
+		dst := fm.fileLock(dstFilename)
+		if dstFilename < srcFilename {
+			dst.Lock()
+			defer dst.Unlock()
+			src.RLock()
+			defer src.RUnlock()
+		} else {
+			src.RLock()
+			defer src.RUnlock()
+			dst.Lock()
+			defer dst.Unlock()
+		}
+	}
+
+	if fm.closed {
+		return ErrClosed
+	}
+	fm.openFilesLock.Lock()
+	srcPath := fm.pathLocked(srcFilename)
+	fm.openFilesLock.Unlock()
+	if _, err := os.Stat(srcPath); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", srcFilename, err)
+	}
+	dstPath := dstFilename
+	if !filepath.IsAbs(dstPath) {
+		dstPath = filepath.Join(filepath.Dir(srcPath), dstFilename)
+	}
+
+	length, err := fm.LengthLocked(srcFilename)
+	if err != nil {
+		return fmt.Errorf("failed to determine length for file %s: %w", srcFilename, err)
+	}
+	f, err := fm.getFile(srcFilename)
+	if err != nil {
+		return fmt.Errorf("failed to get file %s: %w", srcFilename, err)
+	}
+	out, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create copy of %s: %w", srcFilename, err)
+	}
+	size := int64(fm.headerSize) + int64(length)*int64(fm.blocksize)
+	if length == 0 {
+		size = 0
+	}
+	if _, err := io.Copy(out, io.NewSectionReader(fileReaderAt{fm, f}, 0, size)); err != nil {
+		out.Close()
+		os.Remove(dstPath)
+		return fmt.Errorf("failed to copy %s to %s: %w", srcFilename, dstPath, err)
+	}
+	if err := fm.syncFile(out); err != nil {
+		out.Close()
+		os.Remove(dstPath)
+		return fmt.Errorf("failed to sync copy of %s: %w", srcFilename, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to close copy of %s: %w", srcFilename, err)
+	}
+	if !filepath.IsAbs(dstFilename) {
+		fm.setFileMeta(dstFilename, length)
+	}
+	return nil
+}
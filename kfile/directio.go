@@ -0,0 +1,141 @@
+package kfile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"unsafe"
+)
+
+// WithDirectIO opens data files for direct I/O where the platform and file
+// system support it (O_DIRECT on Linux), so that block reads and writes
+// bypass the OS page cache and benchmarks measure the buffer pool alone.
+// Block I/O then goes through buffers aligned as the file system requires,
+// pages being copied in and out of them. Log files keep using the page
+// cache. NewFileMgr probes the data directory and quietly falls back to
+// ordinary I/O when direct I/O is unavailable, the block size is not a
+// multiple of the required alignment, or the FileMgr is read-only; DirectIO
+// reports which way it went.
+func WithDirectIO() FileMgrOption {
+	return func(fm *FileMgr) {
+		fm.directIO = true
+	}
+}
+
+// DirectIO reports whether data files are opened for direct I/O, that is
+// whether WithDirectIO was given and is supported here.
+func (fm *FileMgr) DirectIO() bool {
+	return fm.directIO
+}
+
+// setupDirectIO turns direct I/O off unless the data directory supports it
+// at an alignment the block size and any superblock satisfy.
+func (fm *FileMgr) setupDirectIO() {
+	if !fm.directIO {
+		return
+	}
+	fm.directIO = false
+	if fm.readOnly {
+		return
+	}
+	align, ok := probeDirectIO(fm.dbDirectory)
+	// Blocks must also start on aligned offsets past any superblock.
+	if !ok || fm.blocksize%align != 0 || fm.headerSize%align != 0 {
+		return
+	}
+	fm.directIO = true
+	fm.dioAlign = align
+	fm.dioPool.New = func() any {
+		b := alignedBuffer(fm.blocksize, align)
+		return &b
+	}
+}
+
+// ioBuffer returns an n-byte buffer suitable for block I/O, aligned if data
+// files use direct I/O.
+func (fm *FileMgr) ioBuffer(n int) []byte {
+	if !fm.directIO {
+		return make([]byte, n)
+	}
+	return alignedBuffer(n, fm.dioAlign)
+}
+
+// alignedBuffer returns an n-byte buffer whose address is a multiple of
+// align, which must be a power of two. The Go heap does not move objects,
+// so the alignment holds for the life of the buffer.
+func alignedBuffer(n, align int) []byte {
+	buf := make([]byte, n+align)
+	shift := 0
+	if r := int(uintptr(unsafe.Pointer(unsafe.SliceData(buf))) & uintptr(align-1)); r != 0 {
+		shift = align - r
+	}
+	return buf[shift : shift+n : shift+n]
+}
+
+// directAligned reports whether reading or writing b at off in a direct I/O
+// file needs no bounce buffer.
+func (fm *FileMgr) directAligned(b []byte, off int64) bool {
+	a := fm.dioAlign
+	return off%int64(a) == 0 && len(b)%a == 0 &&
+		uintptr(unsafe.Pointer(unsafe.SliceData(b)))%uintptr(a) == 0
+}
+
+// bounceBuffer returns an aligned n-byte buffer, from the pool when n is a
+// block, and the function that gives it back.
+func (fm *FileMgr) bounceBuffer(n int) ([]byte, func()) {
+	if n != fm.blocksize {
+		return alignedBuffer(n, fm.dioAlign), func() {}
+	}
+	bp := fm.dioPool.Get().(*[]byte)
+	return *bp, func() { fm.dioPool.Put(bp) }
+}
+
+// fileReadAt is f.ReadAt for a data file. Under direct I/O, a read of b that
+// is not aligned goes through an aligned buffer covering it.
+func (fm *FileMgr) fileReadAt(f *os.File, b []byte, off int64) (int, error) {
+	if !fm.directIO || fm.directAligned(b, off) {
+		return f.ReadAt(b, off)
+	}
+	a := int64(fm.dioAlign)
+	start := off &^ (a - 1)
+	end := (off + int64(len(b)) + a - 1) &^ (a - 1)
+	buf, release := fm.bounceBuffer(int(end - start))
+	defer release()
+	n, err := f.ReadAt(buf, start)
+	n = min(max(n-int(off-start), 0), len(b))
+	copy(b, buf[off-start:int(off-start)+n])
+	if n == len(b) {
+		// The aligned read may run past the end of the file even though b
+		// was filled.
+		err = nil
+	} else if err == nil {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// fileWriteAt is f.WriteAt for a data file. Under direct I/O, b must start
+// and end on aligned offsets, as every block write does, and is copied into
+// an aligned buffer if it does not itself sit at an aligned address.
+func (fm *FileMgr) fileWriteAt(f *os.File, b []byte, off int64) (int, error) {
+	if !fm.directIO || fm.directAligned(b, off) {
+		return f.WriteAt(b, off)
+	}
+	if off%int64(fm.dioAlign) != 0 || len(b)%fm.dioAlign != 0 {
+		return 0, fmt.Errorf("unaligned direct write of %d bytes at offset %d", len(b), off)
+	}
+	buf, release := fm.bounceBuffer(len(b))
+	defer release()
+	copy(buf, b)
+	return f.WriteAt(buf, off)
+}
+
+// fileReaderAt reads a data file through fileReadAt.
+type fileReaderAt struct {
+	fm *FileMgr
+	f  *os.File
+}
+
+func (r fileReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	return r.fm.fileReadAt(r.f, b, off)
+}
@@ -0,0 +1,51 @@
+//go:build linux
+
+package kfile
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// directIOFlag is the open flag that requests direct I/O.
+const directIOFlag = unix.O_DIRECT
+
+// defaultDirectIOAlign is assumed when the kernel does not report the
+// alignment direct I/O needs, as kernels before 6.1 do not.
+const defaultDirectIOAlign = 4096
+
+// probeDirectIO reports whether files in dir can be opened for direct I/O,
+// and the alignment of memory, offsets and lengths it then requires. It
+// creates, writes and removes a temporary file; one left by a crash is
+// removed with the other temporary files on the next open.
+func probeDirectIO(dir string) (int, bool) {
+	tmp, err := os.CreateTemp(dir, ".directio-*.tmp")
+	if err != nil {
+		return 0, false
+	}
+	name := tmp.Name()
+	tmp.Close()
+	defer os.Remove(name)
+
+	f, err := os.OpenFile(name, os.O_RDWR|directIOFlag, 0644)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	align := defaultDirectIOAlign
+	var stx unix.Statx_t
+	if err := unix.Statx(int(f.Fd()), "", unix.AT_EMPTY_PATH, unix.STATX_DIOALIGN, &stx); err == nil &&
+		stx.Mask&unix.STATX_DIOALIGN != 0 {
+		if stx.Dio_offset_align == 0 {
+			// The file system does not support direct I/O on this file.
+			return 0, false
+		}
+		align = int(max(stx.Dio_mem_align, stx.Dio_offset_align))
+	}
+	if _, err := f.WriteAt(alignedBuffer(align, align), 0); err != nil {
+		return 0, false
+	}
+	return align, true
+}
@@ -0,0 +1,150 @@
+//go:build linux
+
+package kfile
+
+import (
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestDirectIO(t *testing.T) {
+	const blocksize = 4096
+	for _, tc := range []struct {
+		name string
+		open func(dir string, opts ...FileMgrOption) (*FileMgr, error)
+	}{
+		{"NewFileMgr", func(dir string, opts ...FileMgrOption) (*FileMgr, error) {
+			return NewFileMgr(dir, blocksize, opts...)
+		}},
+		{"OpenDatabase", func(dir string, opts ...FileMgrOption) (*FileMgr, error) {
+			return OpenDatabase(dir, blocksize, opts...)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fm, err := tc.open(dir, WithDirectIO())
+			if err != nil {
+				t.Fatalf("Failed to open with direct I/O: %v", err)
+			}
+			defer fm.Close()
+			if !fm.DirectIO() {
+				t.Skip("direct I/O is not supported by the file system of the test directory")
+			}
+
+			for i := 0; i < 4; i++ {
+				if _, err := fm.Append("direct.db"); err != nil {
+					t.Fatalf("Append failed: %v", err)
+				}
+			}
+			f, err := fm.getFile("direct.db")
+			if err != nil {
+				t.Fatalf("getFile failed: %v", err)
+			}
+			if flags, err := unix.FcntlInt(f.Fd(), unix.F_GETFL, 0); err != nil {
+				t.Fatalf("F_GETFL failed: %v", err)
+			} else if flags&unix.O_DIRECT == 0 {
+				t.Errorf("Expected direct.db to be open with O_DIRECT, flags %#x", flags)
+			}
+
+			// Pages are ordinary, unaligned slices; Write, WriteBlocks and
+			// Read must still get them on and off the disk.
+			page := NewSlottedPage(blocksize)
+			if err := page.SetInt(100, 1000); err != nil {
+				t.Fatalf("SetInt failed: %v", err)
+			}
+			if err := fm.Write(NewBlockId("direct.db", 0), page); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			var batch []BlockWrite
+			for i := int32(1); i < 4; i++ {
+				p := NewSlottedPage(blocksize)
+				if err := p.SetInt(100, 1000+int(i)); err != nil {
+					t.Fatalf("SetInt failed: %v", err)
+				}
+				batch = append(batch, BlockWrite{Blk: NewBlockId("direct.db", i), Page: p})
+			}
+			if err := fm.WriteBlocks(batch); err != nil {
+				t.Fatalf("WriteBlocks failed: %v", err)
+			}
+			got := NewSlottedPage(blocksize)
+			if err := fm.Read(NewBlockId("direct.db", 0), got); err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+			if v, err := got.GetInt(100); err != nil || v != 1000 {
+				t.Errorf("Expected block 0 to hold 1000, got %d (%v)", v, err)
+			}
+			pages, err := fm.ReadBlocks("direct.db", 0, 4)
+			if err != nil || len(pages) != 4 {
+				t.Fatalf("ReadBlocks returned %d pages (%v)", len(pages), err)
+			}
+			for i, p := range pages {
+				if v, err := p.GetInt(100); err != nil || v != 1000+i {
+					t.Errorf("Expected block %d to hold %d, got %d (%v)", i, 1000+i, v, err)
+				}
+			}
+			if err := fm.CopyFile("direct.db", "copy.db"); err != nil {
+				t.Fatalf("CopyFile failed: %v", err)
+			}
+
+			// A renamed file is reopened for direct I/O too.
+			renamed := NewBlockId("direct.db", 0)
+			if err := fm.RenameFile(renamed, "renamed.db"); err != nil {
+				t.Fatalf("RenameFile failed: %v", err)
+			}
+			if f, err = fm.getFile("renamed.db"); err != nil {
+				t.Fatalf("getFile failed: %v", err)
+			}
+			if flags, err := unix.FcntlInt(f.Fd(), unix.F_GETFL, 0); err != nil {
+				t.Fatalf("F_GETFL failed: %v", err)
+			} else if flags&unix.O_DIRECT == 0 {
+				t.Errorf("Expected renamed.db to be open with O_DIRECT, flags %#x", flags)
+			}
+			if err := fm.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			// The files read back the same through the page cache.
+			plain, err := tc.open(dir)
+			if err != nil {
+				t.Fatalf("Failed to reopen: %v", err)
+			}
+			defer plain.Close()
+			for _, name := range []string{"renamed.db", "copy.db"} {
+				for i := int32(0); i < 4; i++ {
+					if err := plain.Read(NewBlockId(name, i), got); err != nil {
+						t.Fatalf("Read of %s block %d failed: %v", name, i, err)
+					}
+					if v, err := got.GetInt(100); err != nil || v != 1000+int(i) {
+						t.Errorf("Expected %s block %d to hold %d, got %d (%v)", name, i, 1000+i, v, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDirectIOFallback(t *testing.T) {
+	// 400-byte blocks cannot be aligned for direct I/O, so the FileMgr says
+	// so and uses ordinary I/O.
+	dir := t.TempDir()
+	fm, err := NewFileMgr(dir, 400, WithDirectIO())
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	if fm.DirectIO() {
+		t.Fatalf("Expected direct I/O to be off for 400-byte blocks")
+	}
+	blk, err := fm.Append("plain.db")
+	if err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if err := fm.Read(blk, NewSlottedPage(400)); err != nil {
+		t.Errorf("Read failed: %v", err)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, ".directio-*")); len(matches) != 0 {
+		t.Errorf("Expected the probe file to be removed, found %v", matches)
+	}
+}
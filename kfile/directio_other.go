@@ -0,0 +1,12 @@
+//go:build !linux
+
+package kfile
+
+// directIOFlag is zero where direct I/O is not supported.
+const directIOFlag = 0
+
+// probeDirectIO reports that direct I/O is unavailable, so WithDirectIO
+// falls back to ordinary I/O.
+func probeDirectIO(dir string) (int, bool) {
+	return 0, false
+}
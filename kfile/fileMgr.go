@@ -1,6 +1,7 @@
 package kfile
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -9,28 +10,108 @@ import (
 	"time"
 )
 
+// BlockStore is the block I/O surface the buffer layer depends on. FileMgr
+// implements it directly; other storage engines (such as shadow paging) can
+// implement it to decide where a logical block physically lives. Read fails
+// with ErrBlockOutOfRange for a block the store does not hold yet, which the
+// buffer layer takes for a new, empty block.
+type BlockStore interface {
+	Read(blk *BlockId, p *SlottedPage) error
+	Write(blk *BlockId, p *SlottedPage) error
+	BlockSize() int
+}
+
 type FileMgr struct {
 	dbDirectory   string
 	blocksize     int
 	isNew         bool
 	openFiles     map[string]*os.File
 	openFilesLock sync.Mutex
+	maxOpenFiles  int               // cap on openFiles, see WithMaxOpenFiles
+	lastUsed      map[string]uint64 // useClock at each open file's last use
+	useClock      uint64
+	// mutex is held shared by every per-file operation and exclusively by
+	// Close and the allocation and dictionary bookkeeping; fileLocks then
+	// serialises operations on one file without blocking the others.
 	mutex         sync.RWMutex
+	fileLocksMu   sync.Mutex
+	fileLocks     map[string]*sync.RWMutex
 	blocksRead    int
 	blocksWritten int
-	readLog       []ReadWriteLogEntry
-	writeLog      []ReadWriteLogEntry
+	readLog       logRing
+	writeLog      logRing
+	logCapacity   int
+	statsMu       sync.Mutex // guards the counters, logs and metadata
 	metaData      FileMetadata
+	metaMu        sync.Mutex // serialises saves of MetadataFile
+	metaPending   bool       // changed since the last save, see flushMetadata
+	fileStats     fileStatsTable
+	latency       ioLatency
+	useMmap       bool              // see EnableMmap
+	mmapMu        sync.Mutex        // guards mmaps
+	mmaps         map[string][]byte // read-only mapping of each file read so far
+	directIO      bool              // see WithDirectIO
+	dioAlign      int               // alignment direct I/O requires
+	dioPool       sync.Pool         // aligned block buffers for direct I/O
+	closed        bool
+	headerSize    int                // bytes reserved for the superblock before block 0
+	dbID          DatabaseID         // identity stamped into superblocks
+	freeMu        sync.Mutex         // guards freeBlocks
+	freeBlocks    map[string][]int32 // free list of each file, see FreeBlock
+	strategies    map[string]AllocationStrategy
+	logDirectory  string          // where log files live; empty means dbDirectory
+	logFiles      map[string]bool // files named by SetLogFile
+	atomicWrites  bool            // stage writes in DoubleWriteFile first
+	checksums     bool            // stamp checksums on write, verify on read
+	readOnly      bool            // see WithReadOnly
+	autoGrow      bool            // see WithAutoGrow
+	dwFile        *os.File        // open double-write area, if any
+	dwMu          sync.Mutex      // one staged write at a time, across files
+	// Checks made on open, see WithBlockSizeOverride and
+	// WithStartupValidation.
+	ignoreBlockSize    bool
+	validateOnOpen     bool
+	strictValidation   bool
+	validationProblems []FileProblem
+	// writer replaces File.WriteAt for block writes when set; tests use it
+	// to interrupt the write path.
+	writer func(f *os.File, b []byte, off int64) (int, error)
+	// syncer replaces File.Sync when set; tests use it to count syncs.
+	syncer func(f *os.File) error
+
+	// Sync batching, see WithSyncPolicy.
+	syncPolicy   SyncPolicy
+	syncInterval time.Duration
+	dirtyMu      sync.Mutex          // guards dirty and flushErr
+	dirty        map[string]*os.File // written but not yet synced
+	flushErr     error               // first error met by the flusher
+	stopFlush    chan struct{}
+	flushDone    chan struct{}
+	stopOnce     sync.Once
+
+	// Write-behind queues, see WithWriteBehind.
+	wbWorkers int
+	wbDepth   int
+	wbQueues  []chan asyncWrite // one per worker
+	wbMu      sync.RWMutex      // guards wbClosed against sends on closed queues
+	wbClosed  bool
+	wbDone    sync.WaitGroup
+	wbErrMu   sync.Mutex       // guards wbErrs
+	wbErrs    map[string]error // first failed write per file since its Flush
 }
 
-// FileMetadata contains metadata for the database files.
+// FileMetadata contains metadata for the database files. All but
+// LastAccessed is kept in MetadataFile and survives a restart.
 type FileMetadata struct {
 	CreatedAt    time.Time
 	ModifiedAt   time.Time
 	SizeLimit    int64
+	BlockSize    int // block size the directory was created with
 	FileSize     int64
 	BlockCount   int
 	LastAccessed time.Time
+	Files        map[string]FileEntry // per-file entries, by file name
+	FreeBlocks   map[string][]int32   // free lists, see FreeBlock
 }
 
 // ReadWriteLogEntry logs a read or write operation.
@@ -38,24 +119,121 @@ type ReadWriteLogEntry struct {
 	Timestamp   time.Time
 	BlockId     *BlockId
 	BytesAmount int
+	Elapsed     time.Duration // time taken by the I/O, see LatencyStats
 }
 
-const (
-	maxLogEntries = 1000
-)
+// defaultLogCapacity is how many entries the read and write logs each keep
+// unless WithLogCapacity says otherwise.
+const defaultLogCapacity = 1000
+
+// logRing keeps the most recent entries of a read or write log in a
+// fixed-size ring. It is guarded by FileMgr.statsMu.
+type logRing struct {
+	entries []ReadWriteLogEntry
+	start   int // index of the oldest entry
+	n       int // number of entries held
+}
+
+func newLogRing(capacity int) logRing {
+	return logRing{entries: make([]ReadWriteLogEntry, max(capacity, 0))}
+}
+
+// add records e, overwriting the oldest entry once the ring is full.
+func (r *logRing) add(e ReadWriteLogEntry) {
+	if len(r.entries) == 0 {
+		return
+	}
+	if r.n < len(r.entries) {
+		r.entries[(r.start+r.n)%len(r.entries)] = e
+		r.n++
+		return
+	}
+	r.entries[r.start] = e
+	r.start = (r.start + 1) % len(r.entries)
+}
+
+// snapshot returns a copy of the entries, oldest first.
+func (r *logRing) snapshot() []ReadWriteLogEntry {
+	out := make([]ReadWriteLogEntry, r.n)
+	for i := range out {
+		out[i] = r.entries[(r.start+i)%len(r.entries)]
+	}
+	return out
+}
+
+// reset empties the ring, keeping its capacity.
+func (r *logRing) reset() {
+	clear(r.entries)
+	r.start, r.n = 0, 0
+}
+
+// ErrClosed is returned by any FileMgr operation attempted after Close.
+var ErrClosed = errors.New("file manager is closed")
+
+// ErrInvalidBlock is returned for a block whose number is negative or whose
+// offset lies past the file size limit.
+var ErrInvalidBlock = errors.New("invalid block number")
+
+// ErrBlockOutOfRange is returned by Read for a block at or past the file's
+// Length, including any block of an empty file.
+var ErrBlockOutOfRange = errors.New("block out of range")
+
+// ChecksumError reports a block whose on-disk contents do not match the
+// checksum stored in its page header. It unwraps to ErrChecksumMismatch.
+type ChecksumError struct {
+	Blk BlockId
+	Err error
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("block %v: %v", &e.Blk, e.Err)
+}
+
+func (e *ChecksumError) Unwrap() error {
+	return e.Err
+}
+
+// verifyBlock checks the checksum of p, just read from blk.
+func verifyBlock(blk *BlockId, p *SlottedPage) error {
+	if err := p.VerifyChecksum(); err != nil {
+		return &ChecksumError{Blk: *blk, Err: err}
+	}
+	return nil
+}
 
-var seekErrFormat = "failed to seek to offset %d in file %s: %w"
+// ErrFileMgrClosed is the package-qualified name for ErrClosed, for callers
+// that check closed errors from several managers side by side.
+var ErrFileMgrClosed = ErrClosed
 
-func NewFileMgr(dbDirectory string, blocksize int) (*FileMgr, error) {
+// NewFileMgr opens dbDirectory, creating it if needed, and removes leftover
+// temporary files. With WithAtomicWrites it also repairs any block write
+// that was interrupted by a crash. WithReadOnly skips all of this. With
+// WithStartupValidation it finally checks every data file.
+func NewFileMgr(dbDirectory string, blocksize int, opts ...FileMgrOption) (*FileMgr, error) {
 	fm := &FileMgr{
 		dbDirectory: dbDirectory,
 		blocksize:   blocksize,
 		openFiles:   make(map[string]*os.File),
+		logFiles:    make(map[string]bool),
+		logCapacity: defaultLogCapacity,
+	}
+	for _, opt := range opts {
+		opt(fm)
+	}
+	fm.readLog = newLogRing(fm.logCapacity)
+	fm.writeLog = newLogRing(fm.logCapacity)
+	if fm.logDirectory != "" && !fm.readOnly {
+		if err := os.MkdirAll(fm.logDirectory, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create log directory %s: %w", fm.logDirectory, err)
+		}
 	}
 
 	// Ensure the directory exists.
 	info, err := os.Stat(dbDirectory)
 	if os.IsNotExist(err) {
+		if fm.readOnly {
+			return nil, fmt.Errorf("cannot open missing directory %s read-only: %w", dbDirectory, err)
+		}
 		fm.isNew = true
 		if err = os.MkdirAll(dbDirectory, 0755); err != nil {
 			return nil, fmt.Errorf("failed to create directory %s: %w", dbDirectory, err)
@@ -68,23 +246,67 @@ func NewFileMgr(dbDirectory string, blocksize int) (*FileMgr, error) {
 		return nil, fmt.Errorf("path %s is not a directory", dbDirectory)
 	}
 
-	// Remove any leftover temporary files.
-	files, err := os.ReadDir(dbDirectory)
+	// Check the block size first: repairing a double write with the wrong
+	// one would corrupt the block it restores.
+	md, err := fm.readMetadata()
+	if err != nil {
+		return nil, err
+	}
+	if !fm.readOnly {
+		if err := fm.cleanDirectory(); err != nil {
+			return nil, err
+		}
+	}
+
+	fm.setupDirectIO()
+
+	if fm.batchingSyncs() && !fm.readOnly {
+		fm.dirty = make(map[string]*os.File)
+		if fm.syncPolicy == SyncOnInterval {
+			fm.startFlusher()
+		}
+	}
+
+	if err := fm.loadMetadata(md); err != nil {
+		fm.stopFlusher()
+		return nil, err
+	}
+	fm.startWriteBehind()
+
+	if fm.validateOnOpen {
+		problems, err := fm.validateDirectory()
+		if err == nil && fm.strictValidation && len(problems) > 0 {
+			err = &ValidationError{Problems: problems}
+		}
+		if err != nil {
+			fm.Close()
+			return nil, err
+		}
+		fm.validationProblems = problems
+	}
+	return fm, nil
+}
+
+// cleanDirectory removes leftover temporary files and, with atomic writes,
+// repairs any block write that was interrupted by a crash.
+func (fm *FileMgr) cleanDirectory() error {
+	files, err := os.ReadDir(fm.dbDirectory)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list directory %s: %w", dbDirectory, err)
+		return fmt.Errorf("failed to list directory %s: %w", fm.dbDirectory, err)
 	}
 	for _, file := range files {
 		if !file.IsDir() && filepath.Ext(file.Name()) == ".tmp" {
-			tempPath := filepath.Join(dbDirectory, file.Name())
+			tempPath := filepath.Join(fm.dbDirectory, file.Name())
 			if err := os.Remove(tempPath); err != nil {
-				return nil, fmt.Errorf("failed to remove temporary file %s: %w", tempPath, err)
+				return fmt.Errorf("failed to remove temporary file %s: %w", tempPath, err)
 			}
 		}
 	}
 
-	metadata := NewMetaData(time.Now())
-	fm.metaData = metadata
-	return fm, nil
+	if fm.atomicWrites {
+		return fm.repairDoubleWrite()
+	}
+	return nil
 }
 
 // addMetaData updates the metadata.
@@ -93,9 +315,12 @@ func (fm *FileMgr) addMetaData(metaData FileMetadata) {
 		CreatedAt:    metaData.CreatedAt,
 		ModifiedAt:   metaData.ModifiedAt,
 		SizeLimit:    metaData.SizeLimit,
+		BlockSize:    metaData.BlockSize,
 		FileSize:     metaData.FileSize,
 		BlockCount:   metaData.BlockCount,
 		LastAccessed: metaData.LastAccessed,
+		Files:        metaData.Files,
+		FreeBlocks:   metaData.FreeBlocks,
 	}
 }
 
@@ -106,8 +331,12 @@ func NewMetaData(createdAt time.Time) FileMetadata {
 	}
 }
 
-// PreallocateFile reserves space in the file corresponding to blk.
+// PreallocateFile reserves space in the file corresponding to blk. Growing
+// the file past its size limit fails with a *SizeLimitError.
 func (fm *FileMgr) PreallocateFile(blk *BlockId, size int64) error {
+	if fm.readOnly {
+		return ErrReadOnly
+	}
 	if err := fm.validatePreallocationParams(blk, size); err != nil {
 		return err
 	}
@@ -117,6 +346,11 @@ func (fm *FileMgr) PreallocateFile(blk *BlockId, size int64) error {
 		return err
 	}
 
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+	fl := fm.fileLock(filename)
+	fl.Lock()
+	defer fl.Unlock()
 	return fm.performPreallocation(filename, size)
 }
 
@@ -157,16 +391,22 @@ func (fm *FileMgr) performPreallocation(filename string, size int64) error {
 	if stat.Mode()&0200 == 0 {
 		return fmt.Errorf("file is not writable")
 	}
+	size += int64(fm.headerSize)
 	if stat.Size() >= size {
 		return nil
 	}
+	if err := fm.checkSizeLimit(filename, size); err != nil {
+		return err
+	}
 
 	if err := f.Truncate(size); err != nil {
 		return fmt.Errorf("failed to preallocate sparse file: %w", err)
 	}
+	fm.outgrowMmapLocked(filename, size)
 	if err := f.Sync(); err != nil {
 		return fmt.Errorf("failed to sync preallocated file: %w", err)
 	}
+	fm.setFileMeta(filename, int32((size-int64(fm.headerSize))/int64(fm.blocksize)))
 	return nil
 }
 
@@ -176,131 +416,305 @@ func (fm *FileMgr) getFile(filename string) (*os.File, error) {
 	fm.openFilesLock.Lock()
 	defer fm.openFilesLock.Unlock()
 
+	// Refuse to reopen handles once closed; O_CREATE would otherwise
+	// silently resurrect the manager (and possibly deleted files).
+	if fm.closed {
+		return nil, ErrClosed
+	}
 	if f, exists := fm.openFiles[filename]; exists {
+		fm.touchFileLocked(filename)
 		return f, nil
 	}
-	filePath := filepath.Join(fm.dbDirectory, filename)
-	f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
+	filePath := fm.pathLocked(filename)
+	f, err := os.OpenFile(filePath, fm.openFlagLocked(filename), 0644)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file %s: %w", filePath, err)
 	}
-	fm.openFiles[filename] = f
+	if fm.headerSize > 0 {
+		if err := fm.checkSuperblock(f, filename); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	fm.cacheFileLocked(filename, f)
 	return f, nil
 }
 
-// Read reads a block from disk into the given slotted page.
+// openFlagLocked returns the flags filename is opened with: read-write, or
+// read-only for a read-only FileMgr, and direct I/O for data files under
+// WithDirectIO. The caller must hold openFilesLock.
+func (fm *FileMgr) openFlagLocked(filename string) int {
+	flag := os.O_RDWR | os.O_CREATE
+	if fm.readOnly {
+		flag = os.O_RDONLY
+	}
+	if fm.directIO && !fm.logFiles[filename] {
+		flag |= directIOFlag
+	}
+	return flag
+}
+
+// WithLogDirectory keeps log files in dir rather than the data directory,
+// so the log can sit on a separate device. A file counts as a log file once
+// SetLogFile names it; NewLogMgr does so for its own file.
+func WithLogDirectory(dir string) FileMgrOption {
+	return func(fm *FileMgr) {
+		fm.logDirectory = dir
+	}
+}
+
+// WithChecksumVerification makes the FileMgr own page checksums: Write,
+// WriteBlocks and Append stamp a CRC32C into each page header, and Read and
+// ReadBlocks fail with a *ChecksumError when a block no longer matches it.
+// Pages that were never checksummed still load. Every block must then hold
+// a slotted page, since the checksum lives in bytes of its header.
+func WithChecksumVerification() FileMgrOption {
+	return func(fm *FileMgr) {
+		fm.checksums = true
+	}
+}
+
+// WithLogCapacity sets how many entries ReadLog and WriteLog each keep; the
+// oldest entries are dropped beyond that. Zero disables both logs.
+func WithLogCapacity(n int) FileMgrOption {
+	return func(fm *FileMgr) {
+		fm.logCapacity = n
+	}
+}
+
+// SetLogFile marks filename as a write-ahead log. Writes to it are synced
+// before they return whatever the sync policy, since a commit is durable
+// only once its log record is, and with WithLogDirectory the file lives in
+// the log directory. There it must be called before the file is first
+// opened, and fails otherwise, since the open handle would still point at
+// the data directory.
+func (fm *FileMgr) SetLogFile(filename string) error {
+	fm.openFilesLock.Lock()
+	defer fm.openFilesLock.Unlock()
+
+	if fm.logFiles[filename] {
+		return nil
+	}
+	if _, open := fm.openFiles[filename]; open && fm.logDirectory != "" {
+		return fmt.Errorf("cannot move open file %s to the log directory", filename)
+	}
+	fm.logFiles[filename] = true
+	return nil
+}
+
+// isLogFile reports whether SetLogFile marked filename.
+func (fm *FileMgr) isLogFile(filename string) bool {
+	fm.openFilesLock.Lock()
+	defer fm.openFilesLock.Unlock()
+	return fm.logFiles[filename]
+}
+
+// pathLocked returns the on-disk path of filename; the caller must hold
+// fm.openFilesLock.
+func (fm *FileMgr) pathLocked(filename string) string {
+	if fm.logFiles[filename] && fm.logDirectory != "" {
+		return filepath.Join(fm.logDirectory, filename)
+	}
+	return filepath.Join(fm.dbDirectory, filename)
+}
+
+// fileLock returns the lock serialising operations on filename, creating it
+// on first use.
+func (fm *FileMgr) fileLock(filename string) *sync.RWMutex {
+	fm.fileLocksMu.Lock()
+	defer fm.fileLocksMu.Unlock()
+	if fm.fileLocks == nil {
+		fm.fileLocks = make(map[string]*sync.RWMutex)
+	}
+	l, ok := fm.fileLocks[filename]
+	if !ok {
+		l = &sync.RWMutex{}
+		fm.fileLocks[filename] = l
+	}
+	return l
+}
+
+// Read reads a block from disk into the given slotted page, from the
+// file's memory mapping under EnableMmap. Any block within the file's
+// Length can be read, and one PreallocateFile reserved but nothing has
+// written yet reads as zeros, as does any part of a block the file system
+// returns short. A block at or past Length, such as block 0 of an empty
+// file or an incomplete block at the end, fails with ErrBlockOutOfRange.
 func (fm *FileMgr) Read(blk *BlockId, p *SlottedPage) error {
 	fm.mutex.RLock()
 	defer fm.mutex.RUnlock()
+	fl := fm.fileLock(blk.FileName())
+	fl.RLock()
+	defer fl.RUnlock()
 
+	if fm.closed {
+		return ErrClosed
+	}
 	f, err := fm.getFile(blk.FileName())
 	if err != nil {
 		return fmt.Errorf("failed to get file for block %v: %w", blk, err)
 	}
 
-	offset := int64(blk.Number() * int32(fm.blocksize))
-	if _, err = f.Seek(offset, io.SeekStart); err != nil {
-		return fmt.Errorf(seekErrFormat, offset, blk.FileName(), err)
-	}
-	bytesRead, err := f.Read(p.Contents())
+	// ReadAt carries its own offset, so concurrent readers of one file do
+	// not race on a shared seek position.
+	offset, err := fm.blockOffset(blk.Number())
 	if err != nil {
 		return fmt.Errorf("failed to read block %v: %w", blk, err)
 	}
+	start := time.Now()
+	var bytesRead int
+	if m := fm.mappedBlock(blk.FileName(), f, offset); m != nil {
+		bytesRead = copy(p.Contents(), m)
+	} else {
+		bytesRead, err = fm.fileReadAt(f, p.Contents(), offset)
+	}
+	elapsed := time.Since(start)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to read block %v: %w", blk, err)
+	}
 	if bytesRead != fm.blocksize {
-		return fmt.Errorf("incomplete read: expected %d bytes, got %d", fm.blocksize, bytesRead)
+		// The file ends inside or before the block. Only then is its length
+		// worth a stat: a block within it reads as zeros past the short
+		// read, and any other is out of range.
+		length, err := fm.LengthLocked(blk.FileName())
+		if err != nil {
+			return fmt.Errorf("failed to determine length for file %s: %w", blk.FileName(), err)
+		}
+		if blk.Number() >= length {
+			return fmt.Errorf("%w: block %v of a file of %d blocks", ErrBlockOutOfRange, blk, length)
+		}
+		clear(p.Contents()[bytesRead:])
+	}
+	if fm.checksums {
+		if err := verifyBlock(blk, p); err != nil {
+			return err
+		}
 	}
 
+	fm.fileStats.counters(blk.FileName()).read.Add(1)
+	fm.latency.read.observe(elapsed)
+	fm.statsMu.Lock()
+	defer fm.statsMu.Unlock()
 	fm.blocksRead++
 	fm.addToReadLog(ReadWriteLogEntry{
 		Timestamp:   time.Now(),
 		BlockId:     blk,
 		BytesAmount: bytesRead,
+		Elapsed:     elapsed,
 	})
 	return nil
 }
 
-// Write writes the contents of a slotted page to disk.
+// Write writes the contents of a slotted page to disk, first stamping its
+// checksum under WithChecksumVerification. Under WithAutoGrow, a block past
+// the end of the file first has the file grown to reach it.
 func (fm *FileMgr) Write(blk *BlockId, p *SlottedPage) error {
-	fm.mutex.Lock()
-	defer fm.mutex.Unlock()
+	if fm.readOnly {
+		return ErrReadOnly
+	}
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+	fl := fm.fileLock(blk.FileName())
+	fl.Lock()
+	defer fl.Unlock()
 
+	if fm.closed {
+		return ErrClosed
+	}
 	f, err := fm.getFile(blk.FileName())
 	if err != nil {
 		return fmt.Errorf("failed to get file for block %v: %w", blk, err)
 	}
 
-	offset := int64(blk.Number() * int32(fm.blocksize))
-	if _, err = f.Seek(offset, io.SeekStart); err != nil {
-		return fmt.Errorf(seekErrFormat, offset, blk.FileName(), err)
-	}
-	bytesWritten, err := f.Write(p.Contents())
+	offset, err := fm.blockOffset(blk.Number())
 	if err != nil {
 		return fmt.Errorf("failed to write block %v: %w", blk, err)
 	}
-	if bytesWritten != fm.blocksize {
-		return fmt.Errorf("incomplete write: expected %d bytes, wrote %d", fm.blocksize, bytesWritten)
+	if err := fm.checkWriteLimitLocked(blk.FileName(), blk.Number()); err != nil {
+		return fmt.Errorf("failed to write block %v: %w", blk, err)
+	}
+	if fm.autoGrow {
+		if err := fm.ensureFileSizeLocked(blk.FileName(), blk.Number()+1); err != nil {
+			return fmt.Errorf("failed to grow file for block %v: %w", blk, err)
+		}
+	}
+	if fm.checksums {
+		p.UpdateChecksum()
+	}
+	start := time.Now()
+	bytesWritten, err := fm.writeBlockLocked(f, blk.FileName(), offset, p.Contents())
+	if err != nil {
+		return fmt.Errorf("failed to write block %v: %w", blk, err)
 	}
-	if err = f.Sync(); err != nil {
-		return fmt.Errorf("failed to sync file %s: %w", blk.FileName(), err)
+	elapsed := time.Since(start)
+	fm.latency.write.observe(elapsed)
+	fm.outgrowMmapLocked(blk.FileName(), offset+int64(bytesWritten))
+	if err := fm.growFileMetaLocked(blk.FileName(), blk.Number()+1); err != nil {
+		return err
 	}
 
+	fm.fileStats.counters(blk.FileName()).written.Add(1)
+	fm.statsMu.Lock()
+	defer fm.statsMu.Unlock()
 	fm.blocksWritten++
 	fm.addToWriteLog(ReadWriteLogEntry{
 		Timestamp:   time.Now(),
 		BlockId:     blk,
 		BytesAmount: bytesWritten,
+		Elapsed:     elapsed,
 	})
 	return nil
 }
 
-// Append adds an empty block to the file and returns its BlockId.
+// Append returns an empty block of the file: the block freed longest ago,
+// if FreeBlock left any, or else a new block added to the end. Under
+// WithChecksumVerification the block holds an empty, checksummed slotted
+// page rather than zeros. If a new block would take the file past its size
+// limit, Append fails with a *SizeLimitError and the file is unchanged.
 func (fm *FileMgr) Append(filename string) (*BlockId, error) {
-	fm.mutex.Lock()
-	defer fm.mutex.Unlock()
-
-	newBlkNum, err := fm.LengthLocked(filename)
-	if err != nil {
-		return nil, fmt.Errorf("failed to determine length for file %s: %w", filename, err)
+	if fm.readOnly {
+		return nil, ErrReadOnly
 	}
-	blk := NewBlockId(filename, newBlkNum)
-	emptyBlock := make([]byte, fm.blocksize)
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+	fl := fm.fileLock(filename)
+	fl.Lock()
+	defer fl.Unlock()
 
-	f, err := fm.getFile(filename)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get file for append: %w", err)
+	if fm.closed {
+		return nil, ErrClosed
 	}
-	offset := int64(newBlkNum * int32(fm.blocksize))
-	if _, err = f.Seek(offset, io.SeekStart); err != nil {
-		return nil, fmt.Errorf("failed to seek to offset %d in file %s: %w", offset, filename, err)
+	if len(fm.FreeBlocks(filename)) > 0 {
+		return fm.reuseFreeBlockLocked(filename, 0)
 	}
-	bytesWritten, err := f.Write(emptyBlock)
+	first, err := fm.appendLocked(filename, 1)
 	if err != nil {
-		return nil, fmt.Errorf("failed to write new block %v: %w", blk, err)
-	}
-	if bytesWritten != fm.blocksize {
-		return nil, fmt.Errorf("incomplete write: expected %d bytes, wrote %d", fm.blocksize, bytesWritten)
-	}
-	if err = f.Sync(); err != nil {
-		return nil, fmt.Errorf("failed to sync file %s: %w", filename, err)
+		return nil, err
 	}
-	return blk, nil
+	return NewBlockId(filename, first), nil
 }
 
 // Length returns the number of blocks in the file.
 func (fm *FileMgr) Length(filename string) (int32, error) {
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+	fl := fm.fileLock(filename)
+	fl.RLock()
+	defer fl.RUnlock()
 	return fm.LengthLocked(filename)
 }
 
 // NewLength is a helper that returns the length or 0 on error.
 func (fm *FileMgr) NewLength(filename string) int32 {
-	n, err := fm.LengthLocked(filename)
+	n, err := fm.Length(filename)
 	if err != nil {
 		return 0
 	}
 	return n
 }
 
-// LengthLocked returns the number of blocks in the file; the caller must hold fm.mutex.
+// LengthLocked returns the number of blocks in the file; the caller must hold
+// the file's lock or fm.mutex exclusively.
 func (fm *FileMgr) LengthLocked(filename string) (int32, error) {
 	f, err := fm.getFile(filename)
 	if err != nil {
@@ -310,10 +724,24 @@ func (fm *FileMgr) LengthLocked(filename string) (int32, error) {
 	if err != nil {
 		return 0, fmt.Errorf("failed to stat file %s: %w", filename, err)
 	}
-	numBlocks := int32(stat.Size() / int64(fm.blocksize))
+	if stat.Size() < int64(fm.headerSize) {
+		return 0, nil
+	}
+	numBlocks := int32((stat.Size() - int64(fm.headerSize)) / int64(fm.blocksize))
 	return numBlocks, nil
 }
 
+// blockOffset returns the file offset of block blkNum, past any superblock.
+// The arithmetic is done in int64, where the largest block number times any
+// block size still fits, so the offset never wraps; negative block numbers
+// are rejected.
+func (fm *FileMgr) blockOffset(blkNum int32) (int64, error) {
+	if blkNum < 0 {
+		return 0, fmt.Errorf("%w: %d is negative", ErrInvalidBlock, blkNum)
+	}
+	return int64(fm.headerSize) + int64(blkNum)*int64(fm.blocksize), nil
+}
+
 // IsNew returns whether the FileMgr was created with a new directory.
 func (fm *FileMgr) IsNew() bool {
 	return fm.isNew
@@ -324,14 +752,36 @@ func (fm *FileMgr) BlockSize() int {
 	return fm.blocksize
 }
 
-// Close closes all open files.
+// Close closes all open files, first finishing any writes queued by
+// WriteAsync. After Close every operation that touches the disk returns
+// ErrClosed; calling Close again is a no-op.
 func (fm *FileMgr) Close() error {
+	fm.stopWriteBehind()
+	fm.stopFlusher()
 	fm.mutex.Lock()
 	defer fm.mutex.Unlock()
 
-	var firstErr error
+	if fm.closed {
+		return nil
+	}
+	// Sync batched writes before their handles go away.
+	firstErr := fm.syncDirty()
 	fm.openFilesLock.Lock()
 	defer fm.openFilesLock.Unlock()
+	fm.closed = true
+	if fm.dwFile != nil {
+		if err := fm.dwFile.Close(); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to close double-write area: %w", err)
+			}
+		}
+		fm.dwFile = nil
+	}
+	fm.mmapMu.Lock()
+	for filename := range fm.mmaps {
+		fm.unmapLocked(filename)
+	}
+	fm.mmapMu.Unlock()
 	for filename, f := range fm.openFiles {
 		if err := f.Close(); err != nil && firstErr == nil {
 			firstErr = fmt.Errorf("failed to close file %s: %w", filename, err)
@@ -343,65 +793,94 @@ func (fm *FileMgr) Close() error {
 
 // BlocksRead returns the total number of blocks read.
 func (fm *FileMgr) BlocksRead() int {
+	fm.statsMu.Lock()
+	defer fm.statsMu.Unlock()
 	return fm.blocksRead
 }
 
 // BlocksWritten returns the total number of blocks written.
 func (fm *FileMgr) BlocksWritten() int {
+	fm.statsMu.Lock()
+	defer fm.statsMu.Unlock()
 	return fm.blocksWritten
 }
 
-// addToReadLog adds an entry to the read log.
+// ResetStats zeroes the block counters, per-file ones included, and clears
+// the read and write logs and latency histograms, returning the global
+// counts they held so callers can sample deltas without losing operations
+// that land between a read and a reset.
+func (fm *FileMgr) ResetStats() (blocksRead, blocksWritten int) {
+	fm.statsMu.Lock()
+	defer fm.statsMu.Unlock()
+	blocksRead, blocksWritten = fm.blocksRead, fm.blocksWritten
+	fm.blocksRead, fm.blocksWritten = 0, 0
+	fm.readLog.reset()
+	fm.writeLog.reset()
+	fm.latency.reset()
+	fm.fileStats.mu.Lock()
+	fm.fileStats.files = nil
+	fm.fileStats.mu.Unlock()
+	return blocksRead, blocksWritten
+}
+
+// addToReadLog adds an entry to the read log; the caller must hold fm.statsMu.
 func (fm *FileMgr) addToReadLog(entry ReadWriteLogEntry) {
-	if len(fm.readLog) >= maxLogEntries {
-		fm.readLog = fm.readLog[1:]
-	}
-	fm.readLog = append(fm.readLog, entry)
+	fm.readLog.add(entry)
 }
 
-// addToWriteLog adds an entry to the write log.
+// addToWriteLog adds an entry to the write log; the caller must hold fm.statsMu.
 func (fm *FileMgr) addToWriteLog(entry ReadWriteLogEntry) {
-	if len(fm.writeLog) >= maxLogEntries {
-		fm.writeLog = fm.writeLog[1:]
-	}
-	fm.writeLog = append(fm.writeLog, entry)
+	fm.writeLog.add(entry)
 }
 
-// ReadLog returns the current read log.
+// ReadLog returns a copy of the most recent reads, oldest first.
 func (fm *FileMgr) ReadLog() []ReadWriteLogEntry {
-	return fm.readLog
+	fm.statsMu.Lock()
+	defer fm.statsMu.Unlock()
+	return fm.readLog.snapshot()
 }
 
-// WriteLog returns the current write log.
+// WriteLog returns a copy of the most recent writes, oldest first.
 func (fm *FileMgr) WriteLog() []ReadWriteLogEntry {
-	return fm.writeLog
-}
-
-// ensureFileSize ensures the file has at least the required number of blocks.
-func (fm *FileMgr) ensureFileSize(blk *BlockId, requiredBlocks int32) error {
-	currentBlocks, err := fm.Length(blk.FileName())
-	if err != nil {
-		return err
-	}
-	if currentBlocks < requiredBlocks {
-		size := int64(requiredBlocks * int32(fm.blocksize))
-		return fm.PreallocateFile(blk, size)
-	}
-	return nil
+	fm.statsMu.Lock()
+	defer fm.statsMu.Unlock()
+	return fm.writeLog.snapshot()
 }
 
 // RenameFile renames the file corresponding to blk to newFileName.
 func (fm *FileMgr) RenameFile(blk *BlockId, newFileName string) error {
-	fm.mutex.Lock()
-	defer fm.mutex.Unlock()
+	if fm.readOnly {
+		return ErrReadOnly
+	}
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
 
+	if fm.closed {
+		return ErrClosed
+	}
 	if newFileName == "" {
 		return fmt.Errorf("invalid new filename: %s", newFileName)
 	}
 
 	oldFileName := blk.FileName()
+	if oldFileName == newFileName {
+		return fmt.Errorf("target file already exists: %s", newFileName)
+	}
+	// Lock both names in a fixed order so concurrent renames cannot deadlock.
+	first, second := fm.fileLock(oldFileName), fm.fileLock(newFileName)
+	if newFileName < oldFileName {
+		first, second = second, first
+	}
+	first.Lock()
+	defer first.Unlock()
+	second.Lock()
+	defer second.Unlock()
+	if err := fm.syncDirtyFileLocked(oldFileName); err != nil {
+		return err
+	}
 
 	// Close the old file if it is open.
+	fm.dropMmapLocked(oldFileName)
 	fm.openFilesLock.Lock()
 	if f, exists := fm.openFiles[oldFileName]; exists {
 		if err := f.Close(); err != nil {
@@ -409,12 +888,14 @@ func (fm *FileMgr) RenameFile(blk *BlockId, newFileName string) error {
 			return fmt.Errorf("failed to close file before rename: %w", err)
 		}
 		delete(fm.openFiles, oldFileName)
+		delete(fm.lastUsed, oldFileName)
 	}
+	// A renamed log file stays in the log directory.
+	oldPath := fm.pathLocked(oldFileName)
+	newPath := filepath.Join(filepath.Dir(oldPath), newFileName)
+	flag := fm.openFlagLocked(oldFileName)
 	fm.openFilesLock.Unlock()
 
-	oldPath := filepath.Join(fm.dbDirectory, oldFileName)
-	newPath := filepath.Join(fm.dbDirectory, newFileName)
-
 	if _, err := os.Stat(newPath); err == nil {
 		return fmt.Errorf("target file already exists: %s", newFileName)
 	}
@@ -423,20 +904,33 @@ func (fm *FileMgr) RenameFile(blk *BlockId, newFileName string) error {
 		return fmt.Errorf("failed to rename file from %s to %s: %w", oldFileName, newFileName, err)
 	}
 
-	newFile, err := os.OpenFile(newPath, os.O_RDWR, 0644)
+	newFile, err := os.OpenFile(newPath, flag, 0644)
 	if err != nil {
 		return fmt.Errorf("failed to reopen renamed file: %w", err)
 	}
 
+	fm.renameFileMeta(oldFileName, newFileName)
+	if err := fm.renameFreeBlocks(oldFileName, newFileName); err != nil {
+		newFile.Close()
+		return err
+	}
+	fm.fileStats.rename(oldFileName, newFileName)
+
 	// Update metadata and cache.
 	blk.SetFileName(newFileName)
+	fm.statsMu.Lock()
 	metadata := fm.metaData
 	metadata.ModifiedAt = time.Now()
 	metadata.LastAccessed = time.Now()
 	fm.addMetaData(metadata)
+	fm.statsMu.Unlock()
 
 	fm.openFilesLock.Lock()
-	fm.openFiles[newFileName] = newFile
+	fm.cacheFileLocked(newFileName, newFile)
+	if fm.logFiles[oldFileName] {
+		delete(fm.logFiles, oldFileName)
+		fm.logFiles[newFileName] = true
+	}
 	fm.openFilesLock.Unlock()
 
 	return nil
@@ -444,9 +938,24 @@ func (fm *FileMgr) RenameFile(blk *BlockId, newFileName string) error {
 
 // DeleteFile closes and removes the specified file.
 func (fm *FileMgr) DeleteFile(filename string) error {
-	fm.mutex.Lock()
-	defer fm.mutex.Unlock()
+	if fm.readOnly {
+		return ErrReadOnly
+	}
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+	fl := fm.fileLock(filename)
+	fl.Lock()
+	defer fl.Unlock()
+
+	if fm.closed {
+		return ErrClosed
+	}
+	// Pending syncs of a file about to be removed are moot.
+	fm.dirtyMu.Lock()
+	delete(fm.dirty, filename)
+	fm.dirtyMu.Unlock()
 
+	fm.dropMmapLocked(filename)
 	fm.openFilesLock.Lock()
 	if f, exists := fm.openFiles[filename]; exists {
 		if err := f.Close(); err != nil {
@@ -454,37 +963,25 @@ func (fm *FileMgr) DeleteFile(filename string) error {
 			return fmt.Errorf("failed to close file before deletion: %w", err)
 		}
 		delete(fm.openFiles, filename)
+		delete(fm.lastUsed, filename)
 	}
+	path := fm.pathLocked(filename)
 	fm.openFilesLock.Unlock()
 
-	path := filepath.Join(fm.dbDirectory, filename)
 	if err := os.Remove(path); err != nil {
 		return fmt.Errorf("failed to delete file %s: %w", filename, err)
 	}
-	return nil
-}
-
-// checkSizeLimit verifies that adding additionalBytes will not exceed the size limit.
-func (fm *FileMgr) checkSizeLimit(filename string, additionalBytes int64) error {
-	if fm.metaData.SizeLimit <= 0 {
-		return nil
-	}
-	f, err := fm.getFile(filename)
-	if err != nil {
-		return err
-	}
-	stat, err := f.Stat()
-	if err != nil {
-		return err
-	}
-	if stat.Size()+additionalBytes > fm.metaData.SizeLimit {
-		return fmt.Errorf("operation would exceed size limit of %d bytes", fm.metaData.SizeLimit)
-	}
-	return nil
+	fm.forgetFileMeta(filename)
+	return fm.trimFreeBlocks(filename, 0)
 }
 
 // ValidateFile checks that the file size is a multiple of blocksize and that permissions are sufficient.
 func (fm *FileMgr) ValidateFile(filename string) error {
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+	fl := fm.fileLock(filename)
+	fl.RLock()
+	defer fl.RUnlock()
 	f, err := fm.getFile(filename)
 	if err != nil {
 		return err
@@ -493,7 +990,7 @@ func (fm *FileMgr) ValidateFile(filename string) error {
 	if err != nil {
 		return err
 	}
-	if stat.Size()%int64(fm.blocksize) != 0 {
+	if (stat.Size()-int64(fm.headerSize))%int64(fm.blocksize) != 0 {
 		return fmt.Errorf("file size %d is not a multiple of blocksize %d", stat.Size(), fm.blocksize)
 	}
 	if stat.Mode().Perm()&0600 != 0600 {
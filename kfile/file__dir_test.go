@@ -2,10 +2,16 @@ package kfile
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -173,6 +179,8 @@ func BenchmarkBlockId(b *testing.B) {
 
 func TestFileMgr(t *testing.T) {
 	tempDir := filepath.Join(os.TempDir(), "simpledb_test_"+time.Now().Format("20060102150405"))
+	// The later subtests recreate the directory with another block size.
+	t.Cleanup(func() { os.RemoveAll(tempDir) })
 
 	t.Run("Basic FileMgr operations", func(t *testing.T) {
 		// Setup
@@ -555,7 +563,83 @@ func TestPage_GetDate_InvalidOffset(t *testing.T) {
 	}
 }
 
-// Test GetBytes method
+// floatCases covers the IEEE-754 values whose bit patterns are easiest to lose.
+var floatCases = []float64{
+	0,
+	math.Copysign(0, -1),
+	3.14159,
+	-2.5e10,
+	math.MaxFloat64,
+	math.NaN(),
+	math.Inf(1),
+	math.Inf(-1),
+	math.SmallestNonzeroFloat64,              // smallest subnormal
+	math.Float64frombits(0x000FFFFFFFFFFFFF), // largest subnormal
+}
+
+func TestPage_SetFloat64AndGetFloat64(t *testing.T) {
+	page := NewPage(128)
+	for _, want := range floatCases {
+		if err := page.SetFloat64(16, want); err != nil {
+			t.Fatalf("SetFloat64(%v) failed: %v", want, err)
+		}
+		got, err := page.GetFloat64(16)
+		if err != nil {
+			t.Fatalf("GetFloat64 failed: %v", err)
+		}
+		if math.Float64bits(got) != math.Float64bits(want) {
+			t.Errorf("Expected bits %016x (%v), got %016x (%v)",
+				math.Float64bits(want), want, math.Float64bits(got), got)
+		}
+	}
+
+	for _, offset := range []int{-1, 124} {
+		if err := page.SetFloat64(offset, 1); err == nil {
+			t.Errorf("Expected out-of-bounds SetFloat64 at %d to fail", offset)
+		}
+		if _, err := page.GetFloat64(offset); err == nil {
+			t.Errorf("Expected out-of-bounds GetFloat64 at %d to fail", offset)
+		}
+	}
+}
+
+// intCases covers integers on both sides of the 4-byte encoding's range.
+var intCases = []int64{
+	0,
+	42,
+	math.MaxUint32,
+	math.MaxUint32 + 1,
+	-1,
+	math.MinInt32,
+	math.MaxInt64,
+	math.MinInt64,
+}
+
+func TestPage_SetInt64AndGetInt64(t *testing.T) {
+	page := NewPage(128)
+	for _, want := range intCases {
+		if err := page.SetInt64(16, want); err != nil {
+			t.Fatalf("SetInt64(%d) failed: %v", want, err)
+		}
+		got, err := page.GetInt64(16)
+		if err != nil {
+			t.Fatalf("GetInt64 failed: %v", err)
+		}
+		if got != want {
+			t.Errorf("Expected %d, got %d", want, got)
+		}
+	}
+
+	for _, offset := range []int{-1, 124} {
+		if err := page.SetInt64(offset, 1); err == nil {
+			t.Errorf("Expected out-of-bounds SetInt64 at %d to fail", offset)
+		}
+		if _, err := page.GetInt64(offset); err == nil {
+			t.Errorf("Expected out-of-bounds GetInt64 at %d to fail", offset)
+		}
+	}
+}
+
 func TestGetBytes(t *testing.T) {
 	testCases := []struct {
 		name           string
@@ -585,6 +669,8 @@ func TestGetBytes(t *testing.T) {
 		//	expectedResult: nil,
 		//	expectedError:  fmt.Errorf("%s: getting bytes", ErrOutOfBounds),
 		//},
+		// An empty value is stored behind a zero length prefix, so it reads
+		// back as empty; TestGetBytesEmptyPages covers missing prefixes.
 		{
 			name:           "Empty slice retrieval",
 			initialData:    []byte{},
@@ -639,6 +725,86 @@ func TestGetBytes(t *testing.T) {
 	}
 }
 
+func TestGetBytesEmptyPages(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		data    []byte
+		offset  int
+		want    []byte
+		wantErr string
+	}{
+		{"empty page", []byte{}, 0, nil, ErrOutOfBounds + ": getting bytes"},
+		{"nil page", nil, 0, nil, ErrOutOfBounds + ": getting bytes"},
+		{"too short for a prefix", []byte{0, 0, 0}, 0, nil, ErrOutOfBounds + ": getting bytes"},
+		{"prefix past the end", []byte{0, 0, 0, 0}, 1, nil, ErrOutOfBounds + ": getting bytes"},
+		{"length past the end", []byte{0, 0, 0, 2, 7}, 0, nil, ErrOutOfBounds + ": invalid length"},
+		{"zero length prefix", []byte{0, 0, 0, 0}, 0, []byte{}, ""},
+		{"valid value", []byte{0, 0, 0, 2, 7, 8}, 0, []byte{7, 8}, ""},
+	} {
+		p := NewPageFromBytes(tc.data)
+		for name, get := range map[string]func(int) ([]byte, error){
+			"GetBytes":     p.GetBytes,
+			"GetBytesView": p.GetBytesView,
+		} {
+			got, err := get(tc.offset)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Errorf("%s, %s: expected error %q, got %v, %v", tc.name, name, tc.wantErr, got, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s, %s: unexpected error %v", tc.name, name, err)
+				continue
+			}
+			if got == nil || !bytes.Equal(got, tc.want) {
+				t.Errorf("%s, %s: expected %#v, got %#v", tc.name, name, tc.want, got)
+			}
+		}
+	}
+}
+
+func TestGetBytesView(t *testing.T) {
+	p := NewPage(64)
+	if err := p.SetBytes(8, []byte("hello")); err != nil {
+		t.Fatalf("SetBytes failed: %v", err)
+	}
+
+	view, err := p.GetBytesView(8)
+	if err != nil {
+		t.Fatalf("GetBytesView failed: %v", err)
+	}
+	copied, err := p.GetBytes(8)
+	if err != nil {
+		t.Fatalf("GetBytes failed: %v", err)
+	}
+	if string(view) != "hello" || string(copied) != "hello" {
+		t.Fatalf("Expected both reads to return %q, got %q and %q", "hello", view, copied)
+	}
+
+	// The view aliases the page, so later writes show through it while the
+	// copy keeps the value it was read with.
+	if err := p.SetBytes(8, []byte("world")); err != nil {
+		t.Fatalf("SetBytes failed: %v", err)
+	}
+	if string(view) != "world" {
+		t.Errorf("Expected the view to see the overwrite, got %q", view)
+	}
+	if string(copied) != "hello" {
+		t.Errorf("Expected the copy to be unaffected, got %q", copied)
+	}
+
+	// Appending to the view must not spill into the rest of the page.
+	_ = append(view, '!')
+	if n, err := p.GetInt(8 + 4 + len(view)); err != nil || n != 0 {
+		t.Errorf("Expected append to leave the page untouched, got %d, %v", n, err)
+	}
+
+	if _, err := p.GetBytesView(62); err == nil {
+		t.Errorf("Expected an out-of-bounds error")
+	}
+}
+
 // Test SetBytes method
 func TestSetBytes(t *testing.T) {
 	testCases := []struct {
@@ -673,14 +839,15 @@ func TestSetBytes(t *testing.T) {
 			expectedResult: nil,
 			expectedError:  fmt.Errorf("%s: setting bytes", ErrOutOfBounds),
 		},
-		//{
-		//	name:           "Empty slice setting",
-		//	initialData:    []byte{},
-		//	offset:         0,
-		//	valueToSet:     []byte{},
-		//	expectedResult: []byte{},
-		//	expectedError:  nil,
-		//},
+		{
+			// Even an empty value needs room for its length prefix.
+			name:           "Empty slice setting",
+			initialData:    []byte{},
+			offset:         0,
+			valueToSet:     []byte{},
+			expectedResult: nil,
+			expectedError:  fmt.Errorf("%s: setting bytes", ErrOutOfBounds),
+		},
 	}
 
 	for _, tc := range testCases {
@@ -803,6 +970,213 @@ func TestPreallocateFile(t *testing.T) {
 	}
 }
 
+func TestAutoGrow(t *testing.T) {
+	const blocksize = 400
+	fm, err := NewFileMgr(t.TempDir(), blocksize, WithAutoGrow(), WithChecksumVerification())
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := fm.Append("grow.db"); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	page := NewSlottedPage(blocksize)
+	if err := page.SetInt(100, 4242); err != nil {
+		t.Fatalf("SetInt failed: %v", err)
+	}
+	if err := fm.Write(NewBlockId("grow.db", 10), page); err != nil {
+		t.Fatalf("Write past the end failed: %v", err)
+	}
+	if n, err := fm.Length("grow.db"); err != nil || n != 11 {
+		t.Fatalf("Expected 11 blocks after writing block 10, got %d (%v)", n, err)
+	}
+	if md := fm.Metadata(); md.Files["grow.db"].BlockCount != 11 {
+		t.Errorf("Expected the metadata to record 11 blocks, got %d", md.Files["grow.db"].BlockCount)
+	}
+
+	// The blocks in between read back as empty pages, even with checksums
+	// verified, and the written block holds its value.
+	got := NewSlottedPage(blocksize)
+	zeros := make([]byte, blocksize)
+	for i := int32(3); i < 10; i++ {
+		if err := fm.Read(NewBlockId("grow.db", i), got); err != nil {
+			t.Fatalf("Read of block %d failed: %v", i, err)
+		}
+		if !bytes.Equal(got.Contents(), zeros) {
+			t.Errorf("Expected block %d to be zeros", i)
+		}
+		if n := len(got.GetAllSlots()); n != 0 {
+			t.Errorf("Expected block %d to read as an empty page, got %d cells", i, n)
+		}
+	}
+	if err := fm.Read(NewBlockId("grow.db", 10), got); err != nil {
+		t.Fatalf("Read of block 10 failed: %v", err)
+	}
+	if v, err := got.GetInt(100); err != nil || v != 4242 {
+		t.Errorf("Expected block 10 to hold 4242, got %d (%v)", v, err)
+	}
+
+	// Writing within the file does not grow it.
+	if err := fm.Write(NewBlockId("grow.db", 5), page); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if n, _ := fm.Length("grow.db"); n != 11 {
+		t.Errorf("Expected a write within the file to keep 11 blocks, got %d", n)
+	}
+
+	// Growth is held to the size limit, and a refused write leaves the file
+	// as it was.
+	if err := fm.SetSizeLimit(20 * blocksize); err != nil {
+		t.Fatalf("SetSizeLimit failed: %v", err)
+	}
+	if err := fm.Write(NewBlockId("grow.db", 25), page); !errors.Is(err, ErrSizeLimitExceeded) {
+		t.Errorf("Expected ErrSizeLimitExceeded writing past the limit, got %v", err)
+	}
+	if n, _ := fm.Length("grow.db"); n != 11 {
+		t.Errorf("Expected a refused write to keep 11 blocks, got %d", n)
+	}
+	if err := fm.EnsureFileSize(NewBlockId("grow.db", 0), 21); !errors.Is(err, ErrSizeLimitExceeded) {
+		t.Errorf("Expected ErrSizeLimitExceeded from EnsureFileSize, got %v", err)
+	}
+	if err := fm.EnsureFileSize(NewBlockId("grow.db", 0), 20); err != nil {
+		t.Errorf("EnsureFileSize up to the limit failed: %v", err)
+	}
+	if n, _ := fm.Length("grow.db"); n != 20 {
+		t.Errorf("Expected 20 blocks after EnsureFileSize, got %d", n)
+	}
+	if err := fm.EnsureFileSize(NewBlockId("grow.db", 0), 4); err != nil {
+		t.Errorf("EnsureFileSize of a shorter size failed: %v", err)
+	}
+	if n, _ := fm.Length("grow.db"); n != 20 {
+		t.Errorf("Expected EnsureFileSize never to shrink the file, got %d blocks", n)
+	}
+}
+
+func TestReadOutOfRange(t *testing.T) {
+	const blocksize = 400
+	for _, tc := range []struct {
+		name string
+		opts []FileMgrOption
+	}{
+		{"Syscall", nil},
+		{"Mmap", []FileMgrOption{EnableMmap()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fm, err := NewFileMgr(dir, blocksize, tc.opts...)
+			if err != nil {
+				t.Fatalf("Failed to create FileMgr: %v", err)
+			}
+			defer fm.Close()
+			page := NewSlottedPage(blocksize)
+
+			// Block 0 of an empty file is past its end.
+			if err := fm.Read(NewBlockId("empty.db", 0), page); !errors.Is(err, ErrBlockOutOfRange) {
+				t.Errorf("Expected ErrBlockOutOfRange for block 0 of an empty file, got %v", err)
+			}
+
+			// A file of two blocks and half of a third: the half block is
+			// not within Length, nor is anything after it.
+			for i := 0; i < 2; i++ {
+				blk, err := fm.Append("tail.db")
+				if err != nil {
+					t.Fatalf("Append failed: %v", err)
+				}
+				p := NewSlottedPage(blocksize)
+				if err := p.SetInt(100, 500+i); err != nil {
+					t.Fatalf("SetInt failed: %v", err)
+				}
+				if err := fm.Write(blk, p); err != nil {
+					t.Fatalf("Write failed: %v", err)
+				}
+			}
+			f, err := os.OpenFile(filepath.Join(dir, "tail.db"), os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatalf("Failed to open tail.db: %v", err)
+			}
+			if _, err := f.Write(bytes.Repeat([]byte{0xee}, blocksize/2)); err != nil {
+				t.Fatalf("Failed to write the partial block: %v", err)
+			}
+			f.Close()
+			if n, _ := fm.Length("tail.db"); n != 2 {
+				t.Fatalf("Expected a length of 2 blocks, got %d", n)
+			}
+			for i := int32(0); i < 2; i++ {
+				if err := fm.Read(NewBlockId("tail.db", i), page); err != nil {
+					t.Fatalf("Read of block %d failed: %v", i, err)
+				}
+				if v, err := page.GetInt(100); err != nil || v != 500+int(i) {
+					t.Errorf("Expected block %d to hold %d, got %d (%v)", i, 500+i, v, err)
+				}
+			}
+			for _, n := range []int32{2, 3, 10} {
+				err := fm.Read(NewBlockId("tail.db", n), page)
+				if !errors.Is(err, ErrBlockOutOfRange) {
+					t.Errorf("Expected ErrBlockOutOfRange for block %d, got %v", n, err)
+				}
+			}
+		})
+	}
+}
+
+func TestPreallocateSparseFile(t *testing.T) {
+	const blocksize = 4096
+	fm, err := NewFileMgr(t.TempDir(), blocksize)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+
+	if err := fm.PreallocateFile(NewBlockId("sparse.db", 0), 100*blocksize); err != nil {
+		t.Fatalf("PreallocateFile failed: %v", err)
+	}
+	if n, err := fm.Length("sparse.db"); err != nil || n != 100 {
+		t.Fatalf("Expected 100 blocks, got %d (%v)", n, err)
+	}
+	allocated, err := fm.AllocatedSize("sparse.db")
+	if err != nil {
+		t.Fatalf("AllocatedSize failed: %v", err)
+	}
+	if allocated >= 100*blocksize {
+		t.Errorf("Expected a sparse file, got %d bytes allocated", allocated)
+	}
+
+	// A block never written reads as a zeroed page.
+	page := NewSlottedPage(blocksize)
+	copy(page.Contents(), bytes.Repeat([]byte{0xff}, blocksize))
+	if err := fm.Read(NewBlockId("sparse.db", 50), page); err != nil {
+		t.Fatalf("Read of an unwritten block failed: %v", err)
+	}
+	if !bytes.Equal(page.Contents(), make([]byte, blocksize)) {
+		t.Errorf("Expected block 50 to read as zeros")
+	}
+
+	// Writing the block allocates storage for it.
+	if err := fm.Write(NewBlockId("sparse.db", 50), NewSlottedPage(blocksize)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if grown, err := fm.AllocatedSize("sparse.db"); err != nil || grown <= allocated {
+		t.Errorf("Expected allocation to grow past %d bytes, got %d (%v)", allocated, grown, err)
+	}
+
+	// Asking about a missing file does not create it.
+	if _, err := fm.AllocatedSize("missing.db"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected os.ErrNotExist for a missing file, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(fm.dbDirectory, "missing.db")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected AllocatedSize to leave missing.db uncreated, got %v", err)
+	}
+	if err := fm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, err := fm.AllocatedSize("sparse.db"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed after Close, got %v", err)
+	}
+}
+
 func TestPreallocateFileNonAlignedSize(t *testing.T) {
 	tempDir := filepath.Join(os.TempDir(), "simpledb_test_"+time.Now().Format("20060102150405"))
 	fm, err := NewFileMgr(tempDir, 512)
@@ -907,3 +1281,2455 @@ func TestPreallocateFileErrors(t *testing.T) {
 		t.Error("Expected error for readonly directory, got nil")
 	}
 }
+
+func TestFileMgrClose(t *testing.T) {
+	tempDir := t.TempDir()
+	fm, err := NewFileMgr(tempDir, 512)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	filename := "closed.db"
+	blk, err := fm.Append(filename)
+	if err != nil {
+		t.Fatalf("Failed to append block: %v", err)
+	}
+
+	if err := fm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := fm.Close(); err != nil {
+		t.Errorf("Expected double Close to return nil, got %v", err)
+	}
+
+	p := NewSlottedPage(fm.BlockSize())
+	ops := map[string]func() error{
+		"Read":  func() error { return fm.Read(blk, p) },
+		"Write": func() error { return fm.Write(blk, p) },
+		"Append": func() error {
+			_, err := fm.Append(filename)
+			return err
+		},
+		"Length": func() error {
+			_, err := fm.Length(filename)
+			return err
+		},
+		"PreallocateFile": func() error { return fm.PreallocateFile(blk, 1024) },
+		"RenameFile":      func() error { return fm.RenameFile(blk, "renamed.db") },
+		"DeleteFile":      func() error { return fm.DeleteFile(filename) },
+		"ValidateFile":    func() error { return fm.ValidateFile(filename) },
+		"SaveCompressionDict": func() error {
+			return fm.SaveCompressionDict(NewCompressionDict([]byte("dict")))
+		},
+		"LoadCompressionDict": func() error {
+			_, err := fm.LoadCompressionDict()
+			return err
+		},
+	}
+	for name, op := range ops {
+		t.Run(name, func(t *testing.T) {
+			if err := op(); !errors.Is(err, ErrFileMgrClosed) {
+				t.Errorf("Expected ErrFileMgrClosed after Close, got %v", err)
+			}
+		})
+	}
+
+	// The file must not have been recreated or renamed behind our back.
+	if _, err := os.Stat(filepath.Join(tempDir, CompressionDictFile)); !os.IsNotExist(err) {
+		t.Errorf("Expected no dictionary to be written after Close, stat returned %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "renamed.db")); !os.IsNotExist(err) {
+		t.Errorf("Expected renamed.db not to exist, stat returned %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, filename)); err != nil {
+		t.Errorf("Expected %s to survive operations after Close: %v", filename, err)
+	}
+}
+
+func TestOpenDatabaseRejectsMixedFiles(t *testing.T) {
+	const blockSize = 400
+	dirA, dirB := t.TempDir(), t.TempDir()
+	for _, dir := range []string{dirA, dirB} {
+		fm, err := OpenDatabase(dir, blockSize)
+		if err != nil {
+			t.Fatalf("OpenDatabase(%s) failed: %v", dir, err)
+		}
+		for _, name := range []string{"data.db", "log.db"} {
+			blk, err := fm.Append(name)
+			if err != nil {
+				t.Fatalf("Append to %s failed: %v", name, err)
+			}
+			p := NewSlottedPage(blockSize)
+			p.SetInt(100, 42)
+			if err := fm.Write(blk, p); err != nil {
+				t.Fatalf("Write to %s failed: %v", name, err)
+			}
+		}
+		fm.Close()
+	}
+
+	// Reopening an untouched database works.
+	fm, err := OpenDatabase(dirA, blockSize)
+	if err != nil {
+		t.Fatalf("Reopen of consistent database failed: %v", err)
+	}
+	if n, _ := fm.Length("data.db"); n != 1 {
+		t.Errorf("Expected 1 block in data.db, got %d", n)
+	}
+	fm.Close()
+
+	// Copy A's data file next to B's log.
+	data, err := os.ReadFile(filepath.Join(dirA, "data.db"))
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dirB, "data.db"), data, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	_, err = OpenDatabase(dirB, blockSize)
+	if !errors.Is(err, ErrDatabaseIdentityMismatch) {
+		t.Fatalf("Expected ErrDatabaseIdentityMismatch, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "data.db") {
+		t.Errorf("Expected error to name data.db, got %v", err)
+	}
+
+	if err := ForceAdopt(dirB, blockSize, "log.db"); err != nil {
+		t.Fatalf("ForceAdopt failed: %v", err)
+	}
+	fm, err = OpenDatabase(dirB, blockSize)
+	if err != nil {
+		t.Fatalf("OpenDatabase after adopt failed: %v", err)
+	}
+	defer fm.Close()
+	p := NewSlottedPage(blockSize)
+	if err := fm.Read(NewBlockId("data.db", 0), p); err != nil {
+		t.Fatalf("Read after adopt failed: %v", err)
+	}
+	if v, _ := p.GetInt(100); v != 42 {
+		t.Errorf("Expected adopted data to be intact, got %d", v)
+	}
+}
+
+func TestCompressionDictImprovesRatio(t *testing.T) {
+	fm, err := NewFileMgr(t.TempDir(), 4096)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+
+	// Pages of small records that share their schema strings.
+	page := func(n int) []byte {
+		p := NewSlottedPage(fm.BlockSize())
+		for i := 0; i < 3; i++ {
+			cell := NewKVCell([]byte(fmt.Sprintf("customer:%05d", n*10+i)))
+			cell.SetValue(fmt.Sprintf("customer_name=%d;customer_address=%d Main Street;account_status=active", n*7+i, n+i))
+			if err := p.InsertCell(cell); err != nil {
+				t.Fatalf("InsertCell failed: %v", err)
+			}
+		}
+		return append([]byte(nil), p.Contents()...)
+	}
+	var samples, pages [][]byte
+	for n := 0; n < 5; n++ {
+		samples = append(samples, page(n))
+	}
+	for n := 100; n < 120; n++ {
+		pages = append(pages, page(n))
+	}
+
+	if err := fm.SaveCompressionDict(TrainCompressionDict(samples, 0)); err != nil {
+		t.Fatalf("SaveCompressionDict failed: %v", err)
+	}
+	dict, err := fm.LoadCompressionDict()
+	if err != nil || dict == nil {
+		t.Fatalf("LoadCompressionDict failed: %v", err)
+	}
+
+	var plain, shared int
+	for _, p := range pages {
+		without, err := (*CompressionDict)(nil).Compress(p)
+		if err != nil {
+			t.Fatalf("Compress without dictionary failed: %v", err)
+		}
+		with, err := dict.Compress(p)
+		if err != nil {
+			t.Fatalf("Compress with dictionary failed: %v", err)
+		}
+		plain += len(without)
+		shared += len(with)
+
+		restored, err := dict.Decompress(with)
+		if err != nil {
+			t.Fatalf("Decompress failed: %v", err)
+		}
+		if !bytes.Equal(restored, p) {
+			t.Fatalf("Round trip through the dictionary changed the page")
+		}
+	}
+	if shared >= plain {
+		t.Errorf("Expected the shared dictionary to improve compression, got %d bytes with and %d without", shared, plain)
+	}
+	t.Logf("compressed %d pages: %d bytes without dictionary, %d with", len(pages), plain, shared)
+}
+
+func TestAllocationStrategies(t *testing.T) {
+	free := []int32{9, 2, 6}
+	for _, tc := range []struct {
+		name     string
+		strategy AllocationStrategy
+		hint     int32
+		want     int
+	}{
+		{"append ignores free blocks", AppendStrategy{}, 5, -1},
+		{"free list takes the oldest", FreeListFirst{}, 5, 0},
+		{"best fit takes the closest", BestFit{}, 8, 0},
+		{"best fit breaks ties low", BestFit{}, 4, 1},
+		{"best fit below all free", BestFit{}, 0, 1},
+	} {
+		if got := tc.strategy.Choose(free, tc.hint); got != tc.want {
+			t.Errorf("%s: expected index %d, got %d", tc.name, tc.want, got)
+		}
+	}
+	for _, s := range []AllocationStrategy{FreeListFirst{}, BestFit{}} {
+		if got := s.Choose(nil, 3); got != -1 {
+			t.Errorf("%T with no free blocks: expected -1, got %d", s, got)
+		}
+	}
+
+	fm, err := NewFileMgr(t.TempDir(), 400)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	for _, filename := range []string{"append.db", "first.db", "best.db"} {
+		for i := 0; i < 10; i++ {
+			if _, err := fm.Append(filename); err != nil {
+				t.Fatalf("Append failed: %v", err)
+			}
+		}
+		for _, n := range free {
+			if err := fm.FreeBlock(NewBlockId(filename, n)); err != nil {
+				t.Fatalf("FreeBlock failed: %v", err)
+			}
+		}
+	}
+	if err := fm.FreeBlock(NewBlockId("best.db", 2)); err == nil {
+		t.Errorf("Expected freeing a free block to fail")
+	}
+	if err := fm.FreeBlock(NewBlockId("best.db", 10)); err == nil {
+		t.Errorf("Expected freeing a block past the end to fail")
+	}
+	fm.SetAllocationStrategy("first.db", FreeListFirst{})
+	fm.SetAllocationStrategy("best.db", BestFit{})
+
+	for filename, want := range map[string]int32{"append.db": 10, "first.db": 9, "best.db": 6} {
+		blk, err := fm.Allocate(filename, 7)
+		if err != nil {
+			t.Fatalf("Allocate(%s) failed: %v", filename, err)
+		}
+		if blk.Number() != want {
+			t.Errorf("Allocate(%s): expected block %d, got %d", filename, want, blk.Number())
+		}
+	}
+	if got := fmt.Sprint(fm.FreeBlocks("best.db")); got != "[9 2]" {
+		t.Errorf("Expected the reused block to leave the free list, got %s", got)
+	}
+	if got := fmt.Sprint(fm.FreeBlocks("append.db")); got != "[9 2 6]" {
+		t.Errorf("Expected append to leave the free list alone, got %s", got)
+	}
+}
+
+func TestFreeBlockReuse(t *testing.T) {
+	const blocksize = 400
+	dir := t.TempDir()
+	fm, err := NewFileMgr(dir, blocksize)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		blk, err := fm.Append("tree.db")
+		if err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+		page := NewSlottedPage(blocksize)
+		if err := page.SetInt(100, 700+i); err != nil {
+			t.Fatalf("SetInt failed: %v", err)
+		}
+		if err := fm.Write(blk, page); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	// A freed block no longer serves its old contents.
+	middle := NewBlockId("tree.db", 2)
+	if err := fm.FreeBlock(middle); err != nil {
+		t.Fatalf("FreeBlock failed: %v", err)
+	}
+	page := NewSlottedPage(blocksize)
+	if err := fm.Read(middle, page); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(page.Contents(), make([]byte, blocksize)) {
+		t.Errorf("Expected the freed block to be zeroed")
+	}
+	if err := fm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// The free list survives a restart and Append reuses it before the file
+	// grows.
+	fm, err = NewFileMgr(dir, blocksize)
+	if err != nil {
+		t.Fatalf("Failed to reopen FileMgr: %v", err)
+	}
+	defer fm.Close()
+	if got := fmt.Sprint(fm.FreeBlocks("tree.db")); got != "[2]" {
+		t.Fatalf("Expected the free list [2] after reopening, got %s", got)
+	}
+	blk, err := fm.Append("tree.db")
+	if err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if blk.Number() != 2 {
+		t.Errorf("Expected the freed block 2 to be reused, got %d", blk.Number())
+	}
+	if n, err := fm.Length("tree.db"); err != nil || n != 5 {
+		t.Errorf("Expected the file to stay at 5 blocks, got %d (%v)", n, err)
+	}
+	if free := fm.FreeBlocks("tree.db"); len(free) != 0 {
+		t.Errorf("Expected the free list to be empty, got %v", free)
+	}
+	if free := fm.Metadata().FreeBlocks["tree.db"]; len(free) != 0 {
+		t.Errorf("Expected the saved free list to be empty, got %v", free)
+	}
+	if err := fm.Read(NewBlockId("tree.db", 3), page); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if v, err := page.GetInt(100); err != nil || v != 703 {
+		t.Errorf("Expected block 3 to keep 703, got %d (%v)", v, err)
+	}
+}
+
+func TestFreeBlocksFollowTheFile(t *testing.T) {
+	const blocksize = 400
+	dir := t.TempDir()
+	fm, err := NewFileMgr(dir, blocksize)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	for _, filename := range []string{"a.db", "b.db"} {
+		if _, err := fm.AppendN(filename, 6); err != nil {
+			t.Fatalf("AppendN failed: %v", err)
+		}
+		for _, n := range []int32{1, 4, 5} {
+			if err := fm.FreeBlock(NewBlockId(filename, n)); err != nil {
+				t.Fatalf("FreeBlock failed: %v", err)
+			}
+		}
+	}
+	saved := func(filename string) string {
+		return fmt.Sprint(fm.Metadata().FreeBlocks[filename])
+	}
+
+	// Blocks cut off by Truncate are no longer free to reuse.
+	if err := fm.Truncate("a.db", 4); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if got := fmt.Sprint(fm.FreeBlocks("a.db")); got != "[1]" || saved("a.db") != "[1]" {
+		t.Errorf("Expected the free list [1] after truncating, got %s (saved %s)", got, saved("a.db"))
+	}
+
+	// The free list moves with a renamed file.
+	if err := fm.RenameFile(NewBlockId("a.db", 0), "c.db"); err != nil {
+		t.Fatalf("RenameFile failed: %v", err)
+	}
+	if got := fm.FreeBlocks("a.db"); len(got) != 0 || saved("a.db") != "[]" {
+		t.Errorf("Expected no free list under the old name, got %v (saved %s)", got, saved("a.db"))
+	}
+	if got := fmt.Sprint(fm.FreeBlocks("c.db")); got != "[1]" || saved("c.db") != "[1]" {
+		t.Errorf("Expected the free list [1] under the new name, got %s (saved %s)", got, saved("c.db"))
+	}
+
+	// A deleted file leaves nothing behind for a new file of its name.
+	if err := fm.DeleteFile("b.db"); err != nil {
+		t.Fatalf("DeleteFile failed: %v", err)
+	}
+	if got := fm.FreeBlocks("b.db"); len(got) != 0 || saved("b.db") != "[]" {
+		t.Errorf("Expected no free list after deleting, got %v (saved %s)", got, saved("b.db"))
+	}
+	blk, err := fm.Append("b.db")
+	if err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if blk.Number() != 0 {
+		t.Errorf("Expected the new b.db to start at block 0, got %d", blk.Number())
+	}
+}
+
+func TestAtomicWritesSurviveTornWrites(t *testing.T) {
+	const blocksize = 400
+	for _, tc := range []struct {
+		name     string
+		tearDW   bool // tear the double-write staging instead of the block
+		wantByte byte
+	}{
+		{"torn in place write is redone", false, 'n'},
+		{"torn staging keeps old block", true, 'o'},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fm, err := NewFileMgr(dir, blocksize, WithAtomicWrites())
+			if err != nil {
+				t.Fatalf("Failed to create FileMgr: %v", err)
+			}
+			blk := NewBlockId("atomic.db", 0)
+			page := NewSlottedPage(blocksize)
+			copy(page.Contents(), bytes.Repeat([]byte{'o'}, blocksize))
+			if err := fm.Write(blk, page); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+
+			// Crash halfway through the chosen write.
+			fm.writer = func(f *os.File, b []byte, off int64) (int, error) {
+				if (filepath.Base(f.Name()) == DoubleWriteFile) != tc.tearDW {
+					return f.WriteAt(b, off)
+				}
+				n, err := f.WriteAt(b[:len(b)/2], off)
+				if err != nil {
+					return n, err
+				}
+				return n, errors.New("simulated crash")
+			}
+			copy(page.Contents(), bytes.Repeat([]byte{'n'}, blocksize))
+			if err := fm.Write(blk, page); err == nil {
+				t.Fatalf("Expected the interrupted write to fail")
+			}
+			fm.Close()
+
+			fm, err = NewFileMgr(dir, blocksize, WithAtomicWrites())
+			if err != nil {
+				t.Fatalf("Failed to reopen FileMgr: %v", err)
+			}
+			defer fm.Close()
+			got := NewSlottedPage(blocksize)
+			if err := fm.Read(blk, got); err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+			if want := bytes.Repeat([]byte{tc.wantByte}, blocksize); !bytes.Equal(got.Contents(), want) {
+				t.Errorf("Expected block to be entirely %q after repair, got %q...", tc.wantByte, got.Contents()[:16])
+			}
+			if info, err := os.Stat(filepath.Join(dir, DoubleWriteFile)); err != nil || info.Size() != 0 {
+				t.Errorf("Expected an empty double-write area after repair, got %v, %v", info, err)
+			}
+		})
+	}
+}
+
+func TestBlockSizeMismatchKeepsPendingDoubleWrite(t *testing.T) {
+	const blocksize = 400
+	dir := t.TempDir()
+	fm, err := NewFileMgr(dir, blocksize, WithAtomicWrites())
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	blk := NewBlockId("atomic.db", 0)
+	page := NewSlottedPage(blocksize)
+	copy(page.Contents(), bytes.Repeat([]byte{'o'}, blocksize))
+	if err := fm.Write(blk, page); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	// Crash with the new block staged but torn in place.
+	fm.writer = func(f *os.File, b []byte, off int64) (int, error) {
+		if filepath.Base(f.Name()) == DoubleWriteFile {
+			return f.WriteAt(b, off)
+		}
+		n, err := f.WriteAt(b[:len(b)/2], off)
+		if err != nil {
+			return n, err
+		}
+		return n, errors.New("simulated crash")
+	}
+	copy(page.Contents(), bytes.Repeat([]byte{'n'}, blocksize))
+	if err := fm.Write(blk, page); err == nil {
+		t.Fatalf("Expected the interrupted write to fail")
+	}
+	fm.Close()
+
+	// A wrong block size is refused before the pending write is touched.
+	if _, err := NewFileMgr(dir, 2*blocksize, WithAtomicWrites()); !errors.Is(err, ErrBlockSizeMismatch) {
+		t.Fatalf("Expected ErrBlockSizeMismatch, got %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, DoubleWriteFile)); err != nil || info.Size() == 0 {
+		t.Fatalf("Expected the double-write record to survive the refused open, got %v, %v", info, err)
+	}
+
+	fm, err = NewFileMgr(dir, blocksize, WithAtomicWrites())
+	if err != nil {
+		t.Fatalf("Failed to reopen FileMgr: %v", err)
+	}
+	defer fm.Close()
+	got := NewSlottedPage(blocksize)
+	if err := fm.Read(blk, got); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if want := bytes.Repeat([]byte{'n'}, blocksize); !bytes.Equal(got.Contents(), want) {
+		t.Errorf("Expected the staged block to be restored, got %q...", got.Contents()[:16])
+	}
+}
+
+func TestConcurrentReadsOfOneFile(t *testing.T) {
+	const (
+		blocksize = 400
+		blocks    = 16
+		readers   = 32
+		rounds    = 50
+	)
+	fm, err := NewFileMgr(t.TempDir(), blocksize)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	for i := 0; i < blocks; i++ {
+		page := NewSlottedPage(blocksize)
+		copy(page.Contents(), bytes.Repeat([]byte{byte(i + 1)}, blocksize))
+		if err := fm.Write(NewBlockId("shared.db", int32(i)), page); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, readers)
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			page := NewSlottedPage(blocksize)
+			for i := 0; i < rounds; i++ {
+				n := (r + i) % blocks
+				if err := fm.Read(NewBlockId("shared.db", int32(n)), page); err != nil {
+					errs <- err
+					return
+				}
+				if want := bytes.Repeat([]byte{byte(n + 1)}, blocksize); !bytes.Equal(page.Contents(), want) {
+					errs <- fmt.Errorf("block %d read back mixed data %v...", n, page.Contents()[:8])
+					return
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if got := fm.BlocksRead(); got != readers*rounds {
+		t.Errorf("Expected %d blocks read, got %d", readers*rounds, got)
+	}
+	if got := len(fm.ReadLog()); got != defaultLogCapacity {
+		t.Errorf("Expected a full read log of %d entries, got %d", defaultLogCapacity, got)
+	}
+}
+
+func TestFileMgrStatsUnderConcurrency(t *testing.T) {
+	const (
+		blocksize = 400
+		workers   = 8
+		rounds    = 40
+	)
+	fm, err := NewFileMgr(t.TempDir(), blocksize)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	for _, filename := range []string{"read.db", "write.db"} {
+		for i := 0; i < workers; i++ {
+			if _, err := fm.Append(filename); err != nil {
+				t.Fatalf("Append failed: %v", err)
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			page := NewSlottedPage(blocksize)
+			for i := 0; i < rounds; i++ {
+				if err := fm.Read(NewBlockId("read.db", int32(w)), page); err != nil {
+					t.Errorf("Read failed: %v", err)
+					return
+				}
+				_ = fm.BlocksRead()
+			}
+		}(w)
+		go func(w int) {
+			defer wg.Done()
+			page := NewSlottedPage(blocksize)
+			for i := 0; i < rounds; i++ {
+				if err := fm.Write(NewBlockId("write.db", int32(w)), page); err != nil {
+					t.Errorf("Write failed: %v", err)
+					return
+				}
+				_ = fm.BlocksWritten()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if got := fm.BlocksRead(); got != workers*rounds {
+		t.Errorf("Expected %d blocks read, got %d", workers*rounds, got)
+	}
+	if got := fm.BlocksWritten(); got != workers*rounds {
+		t.Errorf("Expected %d blocks written, got %d", workers*rounds, got)
+	}
+	read, written := fm.ResetStats()
+	if read != workers*rounds || written != workers*rounds {
+		t.Errorf("ResetStats returned %d, %d; expected %d each", read, written, workers*rounds)
+	}
+	if fm.BlocksRead() != 0 || fm.BlocksWritten() != 0 || len(fm.ReadLog()) != 0 || len(fm.WriteLog()) != 0 {
+		t.Errorf("Expected ResetStats to clear the counters and logs")
+	}
+}
+
+func TestSyncIntervalBatchesFsyncs(t *testing.T) {
+	const (
+		blocksize = 400
+		writes    = 200
+		interval  = 20 * time.Millisecond
+	)
+	var (
+		mu       sync.Mutex
+		syncs    int
+		lastSync time.Time
+	)
+	countSyncs := func(fm *FileMgr) {
+		fm.syncer = func(f *os.File) error {
+			// The metadata saves that follow the syncs are not counted, as
+			// the flusher may still be making one when the test looks.
+			if filepath.Base(f.Name()) != "batched.db" {
+				return f.Sync()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			syncs++
+			lastSync = time.Now()
+			return f.Sync()
+		}
+	}
+	fm, err := NewFileMgr(t.TempDir(), blocksize, WithSyncInterval(interval), countSyncs)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+
+	page := NewSlottedPage(blocksize)
+	for i := 0; i < writes; i++ {
+		if err := fm.Write(NewBlockId("batched.db", int32(i%20)), page); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	lastWrite := time.Now()
+
+	// The flusher must pick up the last write within a few intervals.
+	deadline := time.Now().Add(10 * interval)
+	for {
+		fm.dirtyMu.Lock()
+		pending := len(fm.dirty)
+		fm.dirtyMu.Unlock()
+		if pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Dirty files were not synced within %v", 10*interval)
+		}
+		time.Sleep(interval / 4)
+	}
+	mu.Lock()
+	n, synced := syncs, lastSync
+	mu.Unlock()
+	if n == 0 || n > writes/10 {
+		t.Errorf("Expected a handful of batched syncs for %d writes, got %d", writes, n)
+	}
+	if synced.Before(lastWrite) {
+		t.Errorf("Expected a sync after the last write")
+	}
+
+	// An explicit Sync makes a new write durable at once.
+	if err := fm.Write(NewBlockId("batched.db", 0), page); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := fm.SyncAll(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	mu.Lock()
+	if syncs != n+1 {
+		t.Errorf("Expected Sync to sync the dirty file once, got %d syncs", syncs-n)
+	}
+	mu.Unlock()
+}
+
+func TestSyncPolicyExplicitSync(t *testing.T) {
+	const blocksize = 400
+	dir := t.TempDir()
+	var (
+		mu     sync.Mutex
+		synced []string
+	)
+	recordSyncs := func(fm *FileMgr) {
+		fm.syncer = func(f *os.File) error {
+			mu.Lock()
+			defer mu.Unlock()
+			synced = append(synced, filepath.Base(f.Name()))
+			return f.Sync()
+		}
+	}
+	syncedFiles := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return fmt.Sprint(synced)
+	}
+	fm, err := NewFileMgr(dir, blocksize, WithSyncPolicy(SyncOnClose), recordSyncs)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+
+	page := NewSlottedPage(blocksize)
+	if err := page.SetInt(100, 4242); err != nil {
+		t.Fatalf("SetInt failed: %v", err)
+	}
+	if err := fm.Write(NewBlockId("accounts.db", 0), page); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := fm.Append("orders.db"); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if got := syncedFiles(); got != "[]" {
+		t.Fatalf("Expected no syncs before an explicit Sync, got %s", got)
+	}
+
+	// Sync makes just the named file durable, and only once.
+	if err := fm.Sync("accounts.db"); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if err := fm.Sync("accounts.db"); err != nil {
+		t.Fatalf("Second Sync failed: %v", err)
+	}
+	if got := syncedFiles(); got != "[accounts.db]" {
+		t.Errorf("Expected Sync to sync accounts.db once, got %s", got)
+	}
+
+	other, err := NewFileMgr(dir, blocksize)
+	if err != nil {
+		t.Fatalf("Failed to open second FileMgr: %v", err)
+	}
+	defer other.Close()
+	read := NewSlottedPage(blocksize)
+	if err := other.Read(NewBlockId("accounts.db", 0), read); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if v, err := read.GetInt(100); err != nil || v != 4242 {
+		t.Errorf("Expected the synced block to hold 4242, got %d (%v)", v, err)
+	}
+
+	// Close syncs what is still dirty.
+	if err := fm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if got := syncedFiles(); got != "[accounts.db orders.db .meta.tmp "+filepath.Base(dir)+"]" {
+		t.Errorf("Expected Close to sync orders.db and the metadata, got %s", got)
+	}
+	if err := fm.Sync("accounts.db"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Sync after Close, got %v", err)
+	}
+}
+
+func TestReadWriteLogRing(t *testing.T) {
+	const (
+		blocksize = 400
+		capacity  = 16
+		workers   = 6
+		rounds    = 30
+	)
+	fm, err := NewFileMgr(t.TempDir(), blocksize, WithLogCapacity(capacity))
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	if _, err := fm.Append("ring.db"); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+
+	var readers sync.WaitGroup
+	stop := make(chan struct{})
+	// Readers of the logs run alongside the I/O that appends to them.
+	for i := 0; i < 2; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for _, log := range [][]ReadWriteLogEntry{fm.ReadLog(), fm.WriteLog()} {
+					if len(log) > capacity {
+						t.Errorf("Log grew to %d entries, capacity %d", len(log), capacity)
+						return
+					}
+					for _, e := range log {
+						if e.BlockId == nil {
+							t.Errorf("Observed a partially written log entry")
+							return
+						}
+					}
+				}
+			}
+		}()
+	}
+	var writers sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			page := NewSlottedPage(blocksize)
+			blk := NewBlockId("ring.db", 0)
+			for i := 0; i < rounds; i++ {
+				if err := fm.Write(blk, page); err != nil {
+					t.Errorf("Write failed: %v", err)
+					return
+				}
+				if err := fm.Read(blk, page); err != nil {
+					t.Errorf("Read failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	writers.Wait()
+	close(stop)
+	readers.Wait()
+
+	readLog, writeLog := fm.ReadLog(), fm.WriteLog()
+	if len(readLog) != capacity || len(writeLog) != capacity {
+		t.Fatalf("Expected full logs of %d entries, got %d and %d", capacity, len(readLog), len(writeLog))
+	}
+	for i := 1; i < capacity; i++ {
+		if readLog[i].Timestamp.Before(readLog[i-1].Timestamp) {
+			t.Errorf("Expected the read log oldest first, entry %d precedes %d", i, i-1)
+		}
+	}
+	// The copies are the caller's to keep.
+	readLog[0].BytesAmount = -1
+	if fm.ReadLog()[0].BytesAmount == -1 {
+		t.Errorf("Expected ReadLog to return a copy")
+	}
+}
+
+func TestAppendN(t *testing.T) {
+	const blocksize = 400
+	for _, tc := range []struct {
+		name string
+		opts []FileMgrOption
+	}{
+		{"Plain", nil},
+		{"Checksums", []FileMgrOption{WithChecksumVerification()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fm, err := NewFileMgr(t.TempDir(), blocksize, tc.opts...)
+			if err != nil {
+				t.Fatalf("Failed to create FileMgr: %v", err)
+			}
+			defer fm.Close()
+
+			// Both files start with a block, so the batch does not begin at 0.
+			for _, name := range []string{"loop.db", "bulk.db"} {
+				if _, err := fm.Append(name); err != nil {
+					t.Fatalf("Append failed: %v", err)
+				}
+			}
+			for i := 0; i < 7; i++ {
+				if _, err := fm.Append("loop.db"); err != nil {
+					t.Fatalf("Append failed: %v", err)
+				}
+			}
+			blks, err := fm.AppendN("bulk.db", 7)
+			if err != nil {
+				t.Fatalf("AppendN failed: %v", err)
+			}
+			if len(blks) != 7 {
+				t.Fatalf("Expected 7 BlockIds, got %d", len(blks))
+			}
+			for i, blk := range blks {
+				if blk.FileName() != "bulk.db" || blk.Number() != int32(i+1) {
+					t.Errorf("Expected BlockId %d to be [bulk.db, %d], got %v", i, i+1, blk)
+				}
+			}
+
+			loopLen, _ := fm.Length("loop.db")
+			bulkLen, _ := fm.Length("bulk.db")
+			if loopLen != 8 || bulkLen != loopLen {
+				t.Fatalf("Expected both files to have 8 blocks, got %d and %d", loopLen, bulkLen)
+			}
+			want, got := NewSlottedPage(blocksize), NewSlottedPage(blocksize)
+			for i := int32(0); i < loopLen; i++ {
+				if err := fm.Read(NewBlockId("loop.db", i), want); err != nil {
+					t.Fatalf("Read of loop.db block %d failed: %v", i, err)
+				}
+				if err := fm.Read(NewBlockId("bulk.db", i), got); err != nil {
+					t.Fatalf("Read of bulk.db block %d failed: %v", i, err)
+				}
+				if !bytes.Equal(want.Contents(), got.Contents()) {
+					t.Errorf("Block %d differs between Append and AppendN", i)
+				}
+			}
+			if stats := fm.StatsFor("bulk.db"); stats.BlocksAppended != 8 {
+				t.Errorf("Expected 8 blocks appended to bulk.db, got %d", stats.BlocksAppended)
+			}
+
+			if blks, err := fm.AppendN("bulk.db", 0); err != nil || len(blks) != 0 {
+				t.Errorf("Expected AppendN of 0 blocks to do nothing, got %v (%v)", blks, err)
+			}
+			if _, err := fm.AppendN("bulk.db", -1); !errors.Is(err, ErrInvalidBlock) {
+				t.Errorf("Expected ErrInvalidBlock for a negative count, got %v", err)
+			}
+		})
+	}
+
+	t.Run("SizeLimit", func(t *testing.T) {
+		fm, err := NewFileMgr(t.TempDir(), blocksize)
+		if err != nil {
+			t.Fatalf("Failed to create FileMgr: %v", err)
+		}
+		defer fm.Close()
+		if err := fm.SetSizeLimit(4 * blocksize); err != nil {
+			t.Fatalf("SetSizeLimit failed: %v", err)
+		}
+		if _, err := fm.AppendN("small.db", 5); !errors.Is(err, ErrSizeLimitExceeded) {
+			t.Errorf("Expected ErrSizeLimitExceeded, got %v", err)
+		}
+		if n, _ := fm.Length("small.db"); n != 0 {
+			t.Errorf("Expected the file to be unchanged, got %d blocks", n)
+		}
+		if _, err := fm.AppendN("small.db", 4); err != nil {
+			t.Errorf("AppendN up to the limit failed: %v", err)
+		}
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		fm, err := NewFileMgr(t.TempDir(), blocksize)
+		if err != nil {
+			t.Fatalf("Failed to create FileMgr: %v", err)
+		}
+		defer fm.Close()
+		const workers, rounds, batch = 4, 10, 3
+		var mu sync.Mutex
+		seen := make(map[int32]bool)
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for r := 0; r < rounds; r++ {
+					var blks []*BlockId
+					if w%2 == 0 {
+						blk, err := fm.Append("shared.db")
+						if err != nil {
+							t.Errorf("Append failed: %v", err)
+							return
+						}
+						blks = []*BlockId{blk}
+					} else {
+						var err error
+						if blks, err = fm.AppendN("shared.db", batch); err != nil {
+							t.Errorf("AppendN failed: %v", err)
+							return
+						}
+						for i := 1; i < len(blks); i++ {
+							if blks[i].Number() != blks[i-1].Number()+1 {
+								t.Errorf("AppendN returned non-adjacent blocks %v", blks)
+							}
+						}
+					}
+					mu.Lock()
+					for _, blk := range blks {
+						if seen[blk.Number()] {
+							t.Errorf("Block %d was handed out twice", blk.Number())
+						}
+						seen[blk.Number()] = true
+					}
+					mu.Unlock()
+				}
+			}(w)
+		}
+		wg.Wait()
+		want := int32(workers / 2 * rounds * (1 + batch))
+		if n, _ := fm.Length("shared.db"); n != want || len(seen) != int(want) {
+			t.Errorf("Expected %d distinct blocks, file has %d and %d were handed out", want, n, len(seen))
+		}
+	})
+}
+
+func TestWriteBehind(t *testing.T) {
+	const blocksize = 400
+	valueOf := func(b []byte) int {
+		p := NewSlottedPage(blocksize)
+		copy(p.Contents(), b)
+		v, _ := p.GetInt(100)
+		return v
+	}
+	pageWith := func(v int) *SlottedPage {
+		p := NewSlottedPage(blocksize)
+		if err := p.SetInt(100, v); err != nil {
+			t.Fatalf("SetInt failed: %v", err)
+		}
+		return p
+	}
+
+	t.Run("Ordering", func(t *testing.T) {
+		fm, err := NewFileMgr(t.TempDir(), blocksize, WithWriteBehind(4, 8))
+		if err != nil {
+			t.Fatalf("Failed to create FileMgr: %v", err)
+		}
+		defer fm.Close()
+		if _, err := fm.AppendN("data.db", 8); err != nil {
+			t.Fatalf("AppendN failed: %v", err)
+		}
+		var mu sync.Mutex
+		seen := make(map[int64][]int)
+		fm.writer = func(f *os.File, b []byte, off int64) (int, error) {
+			mu.Lock()
+			seen[off] = append(seen[off], valueOf(b))
+			mu.Unlock()
+			return f.WriteAt(b, off)
+		}
+
+		// Writes to every block interleave; the page is reused at once,
+		// which the copy made by WriteAsync allows.
+		page := NewSlottedPage(blocksize)
+		var results []<-chan error
+		for v := 1; v <= 40; v++ {
+			for n := int32(0); n < 8; n++ {
+				if err := page.SetInt(100, v*10+int(n)); err != nil {
+					t.Fatalf("SetInt failed: %v", err)
+				}
+				results = append(results, fm.WriteAsync(NewBlockId("data.db", n), page))
+			}
+		}
+		if err := fm.Flush("data.db"); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+		for i, done := range results {
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Errorf("Write %d failed: %v", i, err)
+				}
+			default:
+				t.Fatalf("Expected write %d to be done after Flush", i)
+			}
+		}
+		for n := int32(0); n < 8; n++ {
+			offset, _ := fm.blockOffset(n)
+			values := seen[offset]
+			if len(values) != 40 {
+				t.Fatalf("Expected 40 writes to block %d, got %d", n, len(values))
+			}
+			for i, v := range values {
+				if v != (i+1)*10+int(n) {
+					t.Fatalf("Block %d: write %d carried %d, out of submission order", n, i, v)
+				}
+			}
+			if err := fm.Read(NewBlockId("data.db", n), page); err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+			if v, _ := page.GetInt(100); v != 400+int(n) {
+				t.Errorf("Expected block %d to hold the last write, %d, got %d", n, 400+n, v)
+			}
+		}
+	})
+
+	t.Run("DrainOnClose", func(t *testing.T) {
+		dir := t.TempDir()
+		fm, err := NewFileMgr(dir, blocksize, WithWriteBehind(2, 64))
+		if err != nil {
+			t.Fatalf("Failed to create FileMgr: %v", err)
+		}
+		if _, err := fm.AppendN("data.db", 32); err != nil {
+			t.Fatalf("AppendN failed: %v", err)
+		}
+		fm.writer = func(f *os.File, b []byte, off int64) (int, error) {
+			time.Sleep(time.Millisecond)
+			return f.WriteAt(b, off)
+		}
+		var results []<-chan error
+		for n := int32(0); n < 32; n++ {
+			results = append(results, fm.WriteAsync(NewBlockId("data.db", n), pageWith(1000+int(n))))
+		}
+		if err := fm.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		for i, done := range results {
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Errorf("Write %d failed: %v", i, err)
+				}
+			default:
+				t.Fatalf("Expected write %d to be done after Close", i)
+			}
+		}
+		if err := <-fm.WriteAsync(NewBlockId("data.db", 0), pageWith(1)); !errors.Is(err, ErrClosed) {
+			t.Errorf("Expected ErrClosed from WriteAsync after Close, got %v", err)
+		}
+		if err := fm.Flush("data.db"); !errors.Is(err, ErrClosed) {
+			t.Errorf("Expected ErrClosed from Flush after Close, got %v", err)
+		}
+
+		reopened, err := NewFileMgr(dir, blocksize)
+		if err != nil {
+			t.Fatalf("Failed to reopen: %v", err)
+		}
+		defer reopened.Close()
+		page := NewSlottedPage(blocksize)
+		for n := int32(0); n < 32; n++ {
+			if err := reopened.Read(NewBlockId("data.db", n), page); err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+			if v, _ := page.GetInt(100); v != 1000+int(n) {
+				t.Errorf("Expected block %d to hold %d, got %d", n, 1000+n, v)
+			}
+		}
+	})
+
+	t.Run("FlushReportsErrors", func(t *testing.T) {
+		fm, err := NewFileMgr(t.TempDir(), blocksize, WithWriteBehind(0, 0))
+		if err != nil {
+			t.Fatalf("Failed to create FileMgr: %v", err)
+		}
+		defer fm.Close()
+		if _, err := fm.AppendN("data.db", 2); err != nil {
+			t.Fatalf("AppendN failed: %v", err)
+		}
+		errDisk := errors.New("disk on fire")
+		bad, _ := fm.blockOffset(1)
+		fm.writer = func(f *os.File, b []byte, off int64) (int, error) {
+			if off == bad {
+				return 0, errDisk
+			}
+			return f.WriteAt(b, off)
+		}
+		fm.WriteAsync(NewBlockId("data.db", 0), pageWith(1))
+		done := fm.WriteAsync(NewBlockId("data.db", 1), pageWith(2))
+		if err := fm.Flush("data.db"); !errors.Is(err, errDisk) {
+			t.Errorf("Expected Flush to report the failed write, got %v", err)
+		}
+		if err := <-done; !errors.Is(err, errDisk) {
+			t.Errorf("Expected the write's channel to report its failure, got %v", err)
+		}
+		if err := fm.Flush("data.db"); err != nil {
+			t.Errorf("Expected the error to be reported once, got %v", err)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		fm, err := NewFileMgr(t.TempDir(), blocksize)
+		if err != nil {
+			t.Fatalf("Failed to create FileMgr: %v", err)
+		}
+		defer fm.Close()
+		blk, err := fm.Append("data.db")
+		if err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+		done := fm.WriteAsync(blk, pageWith(77))
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("WriteAsync failed: %v", err)
+			}
+		default:
+			t.Fatalf("Expected WriteAsync without write-behind to write at once")
+		}
+		page := NewSlottedPage(blocksize)
+		if err := fm.Read(blk, page); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if v, _ := page.GetInt(100); v != 77 {
+			t.Errorf("Expected 77, got %d", v)
+		}
+		if err := fm.Flush("data.db"); err != nil {
+			t.Errorf("Flush failed: %v", err)
+		}
+	})
+}
+
+func TestSaveCompressionDictSyncs(t *testing.T) {
+	dir := t.TempDir()
+	fm, err := NewFileMgr(dir, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+
+	var syncs []string
+	fm.syncer = func(f *os.File) error {
+		syncs = append(syncs, filepath.Base(f.Name()))
+		return f.Sync()
+	}
+	if err := fm.SaveCompressionDict(NewCompressionDict([]byte("dict"))); err != nil {
+		t.Fatalf("SaveCompressionDict failed: %v", err)
+	}
+	// The dictionary is synced before the rename, and the directory after.
+	want := fmt.Sprint([]string{CompressionDictFile + ".tmp", filepath.Base(dir)})
+	if got := fmt.Sprint(syncs); got != want {
+		t.Errorf("Expected syncs %s, got %s", want, got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, CompressionDictFile+".tmp")); !os.IsNotExist(err) {
+		t.Errorf("Expected no temporary dictionary file left, got %v", err)
+	}
+}
+
+func TestWriteBlocks(t *testing.T) {
+	const blocksize = 400
+	fm, err := NewFileMgr(t.TempDir(), blocksize)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+
+	var writes, syncs []string
+	fm.writer = func(f *os.File, b []byte, off int64) (int, error) {
+		writes = append(writes, fmt.Sprintf("%s@%d+%d", filepath.Base(f.Name()), off/blocksize, len(b)/blocksize))
+		return f.WriteAt(b, off)
+	}
+	fm.syncer = func(f *os.File) error {
+		syncs = append(syncs, filepath.Base(f.Name()))
+		return f.Sync()
+	}
+	pageOf := func(fill byte) *SlottedPage {
+		p := NewSlottedPage(blocksize)
+		copy(p.Contents(), bytes.Repeat([]byte{fill}, blocksize))
+		return p
+	}
+
+	// Out of order, across two files, with block 1 of a.db given twice.
+	batch := []BlockWrite{
+		{NewBlockId("b.db", 0), pageOf('x')},
+		{NewBlockId("a.db", 5), pageOf('f')},
+		{NewBlockId("a.db", 1), pageOf('?')},
+		{NewBlockId("a.db", 0), pageOf('a')},
+		{NewBlockId("a.db", 2), pageOf('c')},
+		{NewBlockId("a.db", 1), pageOf('b')},
+	}
+	if err := fm.WriteBlocks(batch); err != nil {
+		t.Fatalf("WriteBlocks failed: %v", err)
+	}
+	if got := fmt.Sprint(writes); got != "[a.db@0+3 a.db@5+1 b.db@0+1]" {
+		t.Errorf("Expected adjacent blocks coalesced per file, got writes %s", got)
+	}
+	if got := fmt.Sprint(syncs); got != "[a.db b.db]" {
+		t.Errorf("Expected one sync per file, got %s", got)
+	}
+	if got := fm.BlocksWritten(); got != 5 {
+		t.Errorf("Expected 5 blocks written, got %d", got)
+	}
+	for _, want := range []struct {
+		blk  *BlockId
+		fill byte
+	}{
+		{NewBlockId("a.db", 0), 'a'},
+		{NewBlockId("a.db", 1), 'b'},
+		{NewBlockId("a.db", 2), 'c'},
+		{NewBlockId("a.db", 5), 'f'},
+		{NewBlockId("b.db", 0), 'x'},
+	} {
+		p := NewSlottedPage(blocksize)
+		if err := fm.Read(want.blk, p); err != nil {
+			t.Fatalf("Read of %v failed: %v", want.blk, err)
+		}
+		if !bytes.Equal(p.Contents(), pageOf(want.fill).Contents()) {
+			t.Errorf("Block %v does not hold the last page written to it", want.blk)
+		}
+	}
+
+	// A failure part way reports the blocks that made it.
+	failAt, err := fm.blockOffset(5)
+	if err != nil {
+		t.Fatalf("blockOffset failed: %v", err)
+	}
+	fm.writer = func(f *os.File, b []byte, off int64) (int, error) {
+		if off == failAt {
+			return 0, errors.New("disk full")
+		}
+		return f.WriteAt(b, off)
+	}
+	err = fm.WriteBlocks([]BlockWrite{
+		{NewBlockId("a.db", 5), pageOf('g')},
+		{NewBlockId("a.db", 3), pageOf('d')},
+		{NewBlockId("b.db", 1), pageOf('y')},
+	})
+	var batchErr *WriteBlocksError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("Expected a WriteBlocksError, got %v", err)
+	}
+	if p := batchErr.Persisted; len(p) != 1 || p[0].FileName() != "a.db" || p[0].Number() != 3 {
+		t.Errorf("Expected only block 3 of a.db persisted, got %v", p)
+	}
+}
+
+func TestBlockOffsetDoesNotWrap(t *testing.T) {
+	const blocksize = 4096
+	fm, err := NewFileMgr(t.TempDir(), blocksize)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+
+	// In int32 arithmetic this product wraps to -4096.
+	offset, err := fm.blockOffset(math.MaxInt32)
+	if err != nil {
+		t.Fatalf("blockOffset failed for the largest block number: %v", err)
+	}
+	if want := int64(math.MaxInt32) * blocksize; offset != want {
+		t.Errorf("Expected offset %d for block %d, got %d", want, int32(math.MaxInt32), offset)
+	}
+	if err := fm.EnsureFileSize(NewBlockId("big.db", 0), 1<<20); err != nil {
+		t.Fatalf("EnsureFileSize failed: %v", err)
+	}
+	if n, err := fm.Length("big.db"); err != nil || n != 1<<20 {
+		t.Errorf("Expected 1<<20 preallocated blocks, got %d (%v)", n, err)
+	}
+
+	// NewBlockId refuses negative numbers, but a literal can still carry one.
+	negative := &BlockId{Filename: "big.db", Blknum: -1}
+	page := NewSlottedPage(blocksize)
+	if err := fm.Read(negative, page); !errors.Is(err, ErrInvalidBlock) {
+		t.Errorf("Expected ErrInvalidBlock reading a negative block, got %v", err)
+	}
+	if err := fm.Write(negative, page); !errors.Is(err, ErrInvalidBlock) {
+		t.Errorf("Expected ErrInvalidBlock writing a negative block, got %v", err)
+	}
+
+	// Under a size limit, a block past it is rejected before any I/O.
+	fm.statsMu.Lock()
+	fm.metaData.SizeLimit = 10 * blocksize
+	fm.statsMu.Unlock()
+	if err := fm.Write(NewBlockId("limited.db", 9), page); err != nil {
+		t.Errorf("Write of the last block under the limit failed: %v", err)
+	}
+	err = fm.Write(NewBlockId("limited.db", math.MaxInt32), page)
+	if !errors.Is(err, ErrSizeLimitExceeded) {
+		t.Errorf("Expected ErrSizeLimitExceeded writing past the size limit, got %v", err)
+	}
+	if n, err := fm.Length("limited.db"); err != nil || n != 10 {
+		t.Errorf("Expected the rejected write to leave 10 blocks, got %d (%v)", n, err)
+	}
+}
+
+func TestSizeLimit(t *testing.T) {
+	const blocksize = 400
+	dir := t.TempDir()
+	fm, err := NewFileMgr(dir, blocksize)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	if err := fm.SetSizeLimit(5 * blocksize); err != nil {
+		t.Fatalf("SetSizeLimit failed: %v", err)
+	}
+
+	// Appends succeed up to the limit, then trip it and leave the file alone.
+	for i := 0; i < 5; i++ {
+		if _, err := fm.Append("limited.db"); err != nil {
+			t.Fatalf("Append %d under the limit failed: %v", i, err)
+		}
+	}
+	_, err = fm.Append("limited.db")
+	var limitErr *SizeLimitError
+	if !errors.As(err, &limitErr) || !errors.Is(err, ErrSizeLimitExceeded) {
+		t.Fatalf("Expected a *SizeLimitError, got %v", err)
+	}
+	if limitErr.Filename != "limited.db" || limitErr.Size != 6*blocksize || limitErr.Limit != 5*blocksize {
+		t.Errorf("Unexpected error details: %+v", limitErr)
+	}
+	if stat, err := os.Stat(filepath.Join(dir, "limited.db")); err != nil {
+		t.Fatalf("Failed to stat limited.db: %v", err)
+	} else if stat.Size() != 5*blocksize {
+		t.Errorf("Expected limited.db to be %d bytes, got %d", 5*blocksize, stat.Size())
+	}
+
+	// Preallocation is held to the same limit, directly or through
+	// EnsureFileSize.
+	if err := fm.PreallocateFile(NewBlockId("prealloc.db", 0), 6*blocksize); !errors.Is(err, ErrSizeLimitExceeded) {
+		t.Errorf("Expected ErrSizeLimitExceeded preallocating past the limit, got %v", err)
+	}
+	if err := fm.EnsureFileSize(NewBlockId("prealloc.db", 0), 6); !errors.Is(err, ErrSizeLimitExceeded) {
+		t.Errorf("Expected ErrSizeLimitExceeded from EnsureFileSize, got %v", err)
+	}
+	if err := fm.PreallocateFile(NewBlockId("prealloc.db", 0), 5*blocksize); err != nil {
+		t.Errorf("Preallocating up to the limit failed: %v", err)
+	}
+
+	// A write past the end of the file is held to the limit too, directly
+	// or in a batch, while rewriting a block inside the limit is not.
+	page := NewSlottedPage(blocksize)
+	if err := fm.Write(NewBlockId("limited.db", 5), page); !errors.Is(err, ErrSizeLimitExceeded) {
+		t.Errorf("Expected ErrSizeLimitExceeded writing past the limit, got %v", err)
+	}
+	batch := []BlockWrite{
+		{Blk: NewBlockId("limited.db", 4), Page: page},
+		{Blk: NewBlockId("limited.db", 6), Page: page},
+	}
+	if err := fm.WriteBlocks(batch); !errors.Is(err, ErrSizeLimitExceeded) {
+		t.Errorf("Expected ErrSizeLimitExceeded from WriteBlocks past the limit, got %v", err)
+	}
+	if err := fm.Write(NewBlockId("limited.db", 4), page); err != nil {
+		t.Errorf("Rewriting a block inside the limit failed: %v", err)
+	}
+	if stat, err := os.Stat(filepath.Join(dir, "limited.db")); err != nil {
+		t.Fatalf("Failed to stat limited.db: %v", err)
+	} else if stat.Size() != 5*blocksize {
+		t.Errorf("Expected limited.db to stay %d bytes, got %d", 5*blocksize, stat.Size())
+	}
+
+	// A file already past a lowered limit can still be read and rewritten,
+	// just not grown.
+	if err := fm.SetSizeLimit(2 * blocksize); err != nil {
+		t.Fatalf("SetSizeLimit failed: %v", err)
+	}
+	if err := fm.Read(NewBlockId("limited.db", 4), page); err != nil {
+		t.Errorf("Reading a block past a lowered limit failed: %v", err)
+	}
+	if err := fm.WriteBlocks(batch[:1]); err != nil {
+		t.Errorf("Rewriting a block past a lowered limit failed: %v", err)
+	}
+
+	// Concurrent appends never overshoot the limit together.
+	if err := fm.SetSizeLimit(20 * blocksize); err != nil {
+		t.Fatalf("SetSizeLimit failed: %v", err)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	appended := 0
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				_, err := fm.Append("race.db")
+				if errors.Is(err, ErrSizeLimitExceeded) {
+					continue
+				}
+				if err != nil {
+					t.Errorf("Append failed: %v", err)
+					return
+				}
+				mu.Lock()
+				appended++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if appended != 20 {
+		t.Errorf("Expected exactly 20 appends to succeed, got %d", appended)
+	}
+	if stat, err := os.Stat(filepath.Join(dir, "race.db")); err != nil {
+		t.Fatalf("Failed to stat race.db: %v", err)
+	} else if stat.Size() != 20*blocksize {
+		t.Errorf("Expected race.db to be %d bytes, got %d", 20*blocksize, stat.Size())
+	}
+
+	// Removing the limit lets the file grow again.
+	if err := fm.SetSizeLimit(0); err != nil {
+		t.Fatalf("SetSizeLimit failed: %v", err)
+	}
+	if _, err := fm.Append("limited.db"); err != nil {
+		t.Errorf("Append without a limit failed: %v", err)
+	}
+}
+
+func TestAppendDoesNotSaveMetadata(t *testing.T) {
+	const blocksize = 400
+	dir := t.TempDir()
+	fm, err := NewFileMgr(dir, blocksize, WithSyncPolicy(SyncEveryWrite))
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	var syncs []string
+	fm.syncer = func(f *os.File) error {
+		syncs = append(syncs, filepath.Base(f.Name()))
+		return f.Sync()
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := fm.Append("a.db"); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	if got := fmt.Sprint(syncs); got != "[a.db a.db a.db]" {
+		t.Errorf("Expected each Append to sync just a.db, got %s", got)
+	}
+
+	// Without a Close the metadata on disk is stale; reopening measures the
+	// files instead.
+	reopened, err := NewFileMgr(dir, blocksize)
+	if err != nil {
+		t.Fatalf("Failed to reopen FileMgr: %v", err)
+	}
+	defer reopened.Close()
+	if e, ok := reopened.Metadata().Files["a.db"]; !ok || e.BlockCount != 3 {
+		t.Errorf("Expected a.db to have 3 blocks after reopening, got %+v (present %v)", e, ok)
+	}
+}
+
+func TestMetadataSurvivesRestart(t *testing.T) {
+	const blocksize = 400
+	dir := t.TempDir()
+	fm, err := NewFileMgr(dir, blocksize)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	created := fm.Metadata().CreatedAt
+	for i := 0; i < 3; i++ {
+		if _, err := fm.Append("a.db"); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	if err := fm.Write(NewBlockId("b.db", 4), NewSlottedPage(blocksize)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := fm.PreallocateFile(NewBlockId("c.db", 0), 2*blocksize); err != nil {
+		t.Fatalf("PreallocateFile failed: %v", err)
+	}
+	if err := fm.Truncate("a.db", 2); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if err := fm.RenameFile(NewBlockId("c.db", 0), "d.db"); err != nil {
+		t.Fatalf("RenameFile failed: %v", err)
+	}
+	if _, err := fm.Append("gone.db"); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if err := fm.DeleteFile("gone.db"); err != nil {
+		t.Fatalf("DeleteFile failed: %v", err)
+	}
+	if err := fm.SetSizeLimit(100 * blocksize); err != nil {
+		t.Fatalf("SetSizeLimit failed: %v", err)
+	}
+	if err := fm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	reopened, err := NewFileMgr(dir, blocksize)
+	if err != nil {
+		t.Fatalf("Failed to reopen FileMgr: %v", err)
+	}
+	defer reopened.Close()
+	md := reopened.Metadata()
+	if !md.CreatedAt.Equal(created) {
+		t.Errorf("Expected CreatedAt %v to survive, got %v", created, md.CreatedAt)
+	}
+	if md.SizeLimit != 100*blocksize {
+		t.Errorf("Expected a size limit of %d, got %d", 100*blocksize, md.SizeLimit)
+	}
+	want := map[string]int32{"a.db": 2, "b.db": 5, "d.db": 2}
+	if len(md.Files) != len(want) {
+		t.Errorf("Expected entries for %v, got %v", want, md.Files)
+	}
+	for name, blocks := range want {
+		if e, ok := md.Files[name]; !ok || e.BlockCount != blocks {
+			t.Errorf("Expected %s to have %d blocks, got %+v (present %v)", name, blocks, e, ok)
+		}
+	}
+	if md.BlockCount != 9 || md.FileSize != 9*blocksize {
+		t.Errorf("Expected totals of 9 blocks and %d bytes, got %d and %d", 9*blocksize, md.BlockCount, md.FileSize)
+	}
+
+	// The metadata file is bookkeeping, not a database file.
+	files, err := reopened.ListFiles()
+	if err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+	for _, f := range files {
+		if f.Name == MetadataFile {
+			t.Errorf("Expected ListFiles to leave out %s", MetadataFile)
+		}
+	}
+
+	// A newer format is refused rather than misread.
+	data, err := os.ReadFile(filepath.Join(dir, MetadataFile))
+	if err != nil {
+		t.Fatalf("Failed to read metadata: %v", err)
+	}
+	data[len(metadataMagic)+1] = metadataVersion + 1
+	if _, err := decodeMetadata(data); err == nil {
+		t.Error("Expected an unknown metadata version to be rejected")
+	}
+}
+
+func TestBlockSizeMismatch(t *testing.T) {
+	dir := t.TempDir()
+	fm, err := NewFileMgr(dir, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	if _, err := fm.Append("data.db"); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if err := fm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	_, err = NewFileMgr(dir, 512)
+	if !errors.Is(err, ErrBlockSizeMismatch) {
+		t.Fatalf("Expected ErrBlockSizeMismatch, got %v", err)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "4096") || !strings.Contains(msg, "512") {
+		t.Errorf("Expected the error to name both block sizes, got %q", msg)
+	}
+	if _, err := NewFileMgr(dir, 512, WithReadOnly()); !errors.Is(err, ErrBlockSizeMismatch) {
+		t.Errorf("Expected a read-only open to be checked too, got %v", err)
+	}
+
+	// The override opens anyway and leaves the recorded size alone.
+	fm, err = NewFileMgr(dir, 512, WithBlockSizeOverride())
+	if err != nil {
+		t.Fatalf("Expected the override to open, got %v", err)
+	}
+	if bs := fm.Metadata().BlockSize; bs != 4096 {
+		t.Errorf("Expected the recorded block size to stay 4096, got %d", bs)
+	}
+	if err := fm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	fm, err = NewFileMgr(dir, 4096)
+	if err != nil {
+		t.Fatalf("Expected the matching block size to open, got %v", err)
+	}
+	fm.Close()
+
+	// Metadata saved before the block size was recorded adopts the one the
+	// directory is next opened with.
+	data, err := os.ReadFile(filepath.Join(dir, MetadataFile))
+	if err != nil {
+		t.Fatalf("Failed to read metadata: %v", err)
+	}
+	data = data[:len(data)-4]
+	binary.BigEndian.PutUint16(data[len(metadataMagic):], 2)
+	if err := os.WriteFile(filepath.Join(dir, MetadataFile), data, 0644); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+	fm, err = NewFileMgr(dir, 4096)
+	if err != nil {
+		t.Fatalf("Failed to open with old metadata: %v", err)
+	}
+	fm.Close()
+	if _, err := NewFileMgr(dir, 512); !errors.Is(err, ErrBlockSizeMismatch) {
+		t.Errorf("Expected the adopted block size to be checked, got %v", err)
+	}
+}
+
+func TestPerFileStats(t *testing.T) {
+	const blocksize = 400
+	fm, err := NewFileMgr(t.TempDir(), blocksize)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+
+	// Interleave I/O on a data file and a log file from several goroutines.
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			page := NewSlottedPage(blocksize)
+			for i := 0; i < 5; i++ {
+				if err := fm.Write(NewBlockId("data.db", int32(i)), page); err != nil {
+					t.Errorf("Write failed: %v", err)
+					return
+				}
+				if _, err := fm.Append("log.db"); err != nil {
+					t.Errorf("Append failed: %v", err)
+					return
+				}
+				if err := fm.Read(NewBlockId("data.db", int32(i)), page); err != nil {
+					t.Errorf("Read failed: %v", err)
+					return
+				}
+				if err := fm.Read(NewBlockId("data.db", int32(i)), page); err != nil {
+					t.Errorf("Read failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if _, err := fm.ReadBlocks("log.db", 0, 3); err != nil {
+		t.Fatalf("ReadBlocks failed: %v", err)
+	}
+
+	if got, want := fm.StatsFor("data.db"), (FileStats{BlocksRead: 40, BlocksWritten: 20}); got != want {
+		t.Errorf("Expected data.db stats %+v, got %+v", want, got)
+	}
+	if got, want := fm.StatsFor("log.db"), (FileStats{BlocksRead: 3, BlocksAppended: 20}); got != want {
+		t.Errorf("Expected log.db stats %+v, got %+v", want, got)
+	}
+	if got := fm.StatsFor("untouched.db"); got != (FileStats{}) {
+		t.Errorf("Expected no stats for an untouched file, got %+v", got)
+	}
+	if fm.BlocksRead() != 43 || fm.BlocksWritten() != 20 {
+		t.Errorf("Expected 43 reads and 20 writes in all, got %d and %d", fm.BlocksRead(), fm.BlocksWritten())
+	}
+
+	// The counts follow a renamed file.
+	if err := fm.RenameFile(NewBlockId("log.db", 0), "log.old"); err != nil {
+		t.Fatalf("RenameFile failed: %v", err)
+	}
+	all := fm.AllStats()
+	if _, ok := all["log.db"]; ok {
+		t.Error("Expected no stats left under the old name")
+	}
+	if got := all["log.old"]; got.BlocksAppended != 20 {
+		t.Errorf("Expected the renamed file to keep its 20 appends, got %+v", got)
+	}
+	all["data.db"] = FileStats{}
+	if fm.StatsFor("data.db").BlocksWritten != 20 {
+		t.Error("Expected AllStats to return a copy")
+	}
+
+	fm.ResetStats()
+	if got := fm.AllStats(); len(got) != 0 {
+		t.Errorf("Expected ResetStats to clear the per-file stats, got %v", got)
+	}
+}
+
+func TestLatencyStats(t *testing.T) {
+	const blocksize = 400
+	fm, err := NewFileMgr(t.TempDir(), blocksize)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+
+	page := NewSlottedPage(blocksize)
+	for i := 0; i < 10; i++ {
+		if err := fm.Write(NewBlockId("data.db", int32(i)), page); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	for i := 0; i < 25; i++ {
+		if err := fm.Read(NewBlockId("data.db", int32(i%10)), page); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := fm.Append("log.db"); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+
+	stats := fm.LatencyStats()
+	if got := stats.Read.Count(); got != 25 {
+		t.Errorf("Expected 25 reads in the histogram, got %d", got)
+	}
+	if got := stats.Write.Count(); got != 10 {
+		t.Errorf("Expected 10 writes in the histogram, got %d", got)
+	}
+	if got := stats.Append.Count(); got != 5 {
+		t.Errorf("Expected 5 appends in the histogram, got %d", got)
+	}
+	// Every write and append is synced under the default policy.
+	if got := stats.Sync.Count(); got < 15 {
+		t.Errorf("Expected at least 15 syncs in the histogram, got %d", got)
+	}
+	if len(stats.Write.Counts) != len(stats.Write.Bounds)+1 {
+		t.Errorf("Expected one bucket past the bounds, got %d counts for %d bounds", len(stats.Write.Counts), len(stats.Write.Bounds))
+	}
+	// The bounds are the caller's copy.
+	stats.Write.Bounds[0] = time.Hour
+	if got := fm.LatencyStats().Write.Bounds[0]; got == time.Hour {
+		t.Errorf("Expected changing a snapshot's bounds to leave the histogram alone")
+	}
+	if stats.Sync.Total <= 0 {
+		t.Errorf("Expected the syncs to take some time, got %v", stats.Sync.Total)
+	}
+	var logged time.Duration
+	for _, e := range fm.WriteLog() {
+		logged += e.Elapsed
+	}
+	if logged <= 0 {
+		t.Errorf("Expected the write log to record durations, got %v in all", logged)
+	}
+
+	fm.ResetStats()
+	stats = fm.LatencyStats()
+	if n := stats.Read.Count() + stats.Write.Count() + stats.Append.Count() + stats.Sync.Count(); n != 0 || stats.Write.Total != 0 {
+		t.Errorf("Expected ResetStats to clear the histograms, got %d operations", n)
+	}
+}
+
+func TestMmapReads(t *testing.T) {
+	const blocksize = 400
+	dir := t.TempDir()
+	plain, err := NewFileMgr(dir, blocksize)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer plain.Close()
+	mapped, err := NewFileMgr(dir, blocksize, EnableMmap())
+	if err != nil {
+		t.Fatalf("Failed to create mmap FileMgr: %v", err)
+	}
+	defer mapped.Close()
+
+	for i := 0; i < 4; i++ {
+		page := NewSlottedPage(blocksize)
+		if err := page.SetInt(100, 1000+i); err != nil {
+			t.Fatalf("SetInt failed: %v", err)
+		}
+		if err := plain.Write(NewBlockId("data.db", int32(i)), page); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	sameBytes := func(blk *BlockId) {
+		t.Helper()
+		want, got := NewSlottedPage(blocksize), NewSlottedPage(blocksize)
+		if err := plain.Read(blk, want); err != nil {
+			t.Fatalf("Read of %v failed: %v", blk, err)
+		}
+		if err := mapped.Read(blk, got); err != nil {
+			t.Fatalf("mmap Read of %v failed: %v", blk, err)
+		}
+		if !bytes.Equal(want.Contents(), got.Contents()) {
+			t.Errorf("Expected the mmap read of %v to match the syscall read", blk)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		sameBytes(NewBlockId("data.db", int32(i)))
+	}
+	mapped.mmapMu.Lock()
+	size := len(mapped.mmaps["data.db"])
+	mapped.mmapMu.Unlock()
+	if runtime.GOOS != "windows" && size != 4*blocksize {
+		t.Errorf("Expected data.db to be mapped whole, got a mapping of %d bytes", size)
+	}
+
+	// A block written past the mapping by another FileMgr is read with a
+	// syscall, and an overwrite through it shows through the mapping.
+	page := NewSlottedPage(blocksize)
+	if err := page.SetInt(100, 4000); err != nil {
+		t.Fatalf("SetInt failed: %v", err)
+	}
+	if err := plain.Write(NewBlockId("data.db", 4), page); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := plain.Write(NewBlockId("data.db", 0), page); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	sameBytes(NewBlockId("data.db", 4))
+	sameBytes(NewBlockId("data.db", 0))
+
+	// Appending through the mmap FileMgr remaps on the next read.
+	blk, err := mapped.Append("data.db")
+	if err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	sameBytes(blk)
+
+	// After a truncate the cut blocks are gone rather than faulting.
+	if err := mapped.Truncate("data.db", 2); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if err := mapped.Read(NewBlockId("data.db", 3), NewSlottedPage(blocksize)); err == nil {
+		t.Error("Expected reading a truncated block to fail")
+	}
+	sameBytes(NewBlockId("data.db", 1))
+}
+
+func TestMmapReadsDuringGrowth(t *testing.T) {
+	const blocksize = 400
+	fm, err := NewFileMgr(t.TempDir(), blocksize, EnableMmap())
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+
+	// A writer grows the file by appending and filling blocks while readers
+	// check every block that exists so far, remapping as it grows.
+	const blocks = 50
+	var (
+		wg      sync.WaitGroup
+		written atomic.Int32
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < blocks; i++ {
+			blk, err := fm.Append("grow.db")
+			if err != nil {
+				t.Errorf("Append failed: %v", err)
+				return
+			}
+			page := NewSlottedPage(blocksize)
+			if err := page.SetInt(100, 5000+i); err != nil {
+				t.Errorf("SetInt failed: %v", err)
+				return
+			}
+			if err := fm.Write(blk, page); err != nil {
+				t.Errorf("Write failed: %v", err)
+				return
+			}
+			written.Store(int32(i + 1))
+		}
+	}()
+	for r := 0; r < 3; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			page := NewSlottedPage(blocksize)
+			for n := int32(0); n < blocks; n = written.Load() {
+				for i := int32(0); i < n; i++ {
+					if err := fm.Read(NewBlockId("grow.db", i), page); err != nil {
+						t.Errorf("Read of block %d failed: %v", i, err)
+						return
+					}
+					if v, err := page.GetInt(100); err != nil || v != 5000+int(i) {
+						t.Errorf("Expected block %d to hold %d, got %d (%v)", i, 5000+i, v, err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestStartupValidation(t *testing.T) {
+	const blocksize = 400
+	dir := t.TempDir()
+	fm, err := NewFileMgr(dir, blocksize)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	for _, name := range []string{"good.db", "short.db", "long.db"} {
+		for i := 0; i < 2; i++ {
+			if _, err := fm.Append(name); err != nil {
+				t.Fatalf("Append failed: %v", err)
+			}
+		}
+	}
+	if err := fm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	// Cut one file short and leave a partial block on another.
+	if err := os.Truncate(filepath.Join(dir, "short.db"), blocksize+150); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if err := os.Truncate(filepath.Join(dir, "long.db"), 2*blocksize+1); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+
+	// Without the option nothing is checked.
+	fm, err = NewFileMgr(dir, blocksize)
+	if err != nil {
+		t.Fatalf("Failed to open without validation: %v", err)
+	}
+	if problems := fm.ValidationProblems(); len(problems) != 0 {
+		t.Errorf("Expected no validation without the option, got %v", problems)
+	}
+	fm.Close()
+
+	// Lenient validation opens and reports both files.
+	fm, err = NewFileMgr(dir, blocksize, WithStartupValidation(false))
+	if err != nil {
+		t.Fatalf("Failed to open with lenient validation: %v", err)
+	}
+	problems := fm.ValidationProblems()
+	fm.Close()
+	want := map[string]int64{"short.db": blocksize + 150, "long.db": 2*blocksize + 1}
+	if len(problems) != len(want) {
+		t.Fatalf("Expected problems with %v, got %v", want, problems)
+	}
+	for _, p := range problems {
+		if size, ok := want[p.Filename]; !ok || p.Size != size || p.BlockSize != blocksize || p.Err == nil {
+			t.Errorf("Unexpected problem %v", p)
+		}
+	}
+
+	// Strict validation refuses to open.
+	_, err = NewFileMgr(dir, blocksize, WithStartupValidation(true))
+	var verr *ValidationError
+	if !errors.As(err, &verr) || !errors.Is(err, ErrValidationFailed) {
+		t.Fatalf("Expected a *ValidationError, got %v", err)
+	}
+	if len(verr.Problems) != 2 {
+		t.Errorf("Expected 2 problems, got %v", verr.Problems)
+	}
+
+	// Once repaired, the directory opens; the metadata file, whose size is
+	// no multiple of the block size, is skipped.
+	for _, name := range []string{"short.db", "long.db"} {
+		if err := os.Truncate(filepath.Join(dir, name), blocksize); err != nil {
+			t.Fatalf("Truncate failed: %v", err)
+		}
+	}
+	fm, err = NewFileMgr(dir, blocksize, WithStartupValidation(true))
+	if err != nil {
+		t.Fatalf("Expected the repaired directory to open, got %v", err)
+	}
+	fm.Close()
+
+	// Superblocks are allowed for.
+	dbDir := t.TempDir()
+	db, err := OpenDatabase(dbDir, blocksize)
+	if err != nil {
+		t.Fatalf("OpenDatabase failed: %v", err)
+	}
+	if _, err := db.Append("data.db"); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	db.Close()
+	db, err = OpenDatabase(dbDir, blocksize, WithStartupValidation(true))
+	if err != nil {
+		t.Fatalf("Expected a database with superblocks to validate, got %v", err)
+	}
+	db.Close()
+}
+
+func TestReadBlocks(t *testing.T) {
+	const blocksize = 400
+	fm, err := NewFileMgr(t.TempDir(), blocksize)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+
+	for i := 0; i < 10; i++ {
+		page := NewSlottedPage(blocksize)
+		if err := page.SetInt(100, 1000+i); err != nil {
+			t.Fatalf("SetInt failed: %v", err)
+		}
+		if err := fm.Write(NewBlockId("scan.db", int32(i)), page); err != nil {
+			t.Fatalf("Write of block %d failed: %v", i, err)
+		}
+	}
+
+	before := fm.BlocksRead()
+	pages, err := fm.ReadBlocks("scan.db", 0, 10)
+	if err != nil {
+		t.Fatalf("ReadBlocks failed: %v", err)
+	}
+	if len(pages) != 10 {
+		t.Fatalf("Expected 10 pages, got %d", len(pages))
+	}
+	if got := fm.BlocksRead() - before; got != 10 {
+		t.Errorf("Expected 10 blocks counted as read, got %d", got)
+	}
+	for i, page := range pages {
+		single := NewSlottedPage(blocksize)
+		if err := fm.Read(NewBlockId("scan.db", int32(i)), single); err != nil {
+			t.Fatalf("Read of block %d failed: %v", i, err)
+		}
+		if !bytes.Equal(page.Contents(), single.Contents()) {
+			t.Errorf("Block %d from ReadBlocks differs from a single Read", i)
+		}
+	}
+
+	// Ranges running past the end return the blocks that exist.
+	for _, tc := range []struct{ start, count, want int }{{7, 5, 3}, {10, 3, 0}, {2, 0, 0}} {
+		pages, err := fm.ReadBlocks("scan.db", tc.start, tc.count)
+		if err != nil {
+			t.Fatalf("ReadBlocks(%d, %d) failed: %v", tc.start, tc.count, err)
+		}
+		if len(pages) != tc.want {
+			t.Errorf("ReadBlocks(%d, %d) returned %d pages, want %d", tc.start, tc.count, len(pages), tc.want)
+		}
+	}
+	if pages, _ := fm.ReadBlocks("scan.db", 7, 5); len(pages) > 0 {
+		if v, _ := pages[0].GetInt(100); v != 1007 {
+			t.Errorf("Expected block 7 to hold 1007, got %d", v)
+		}
+	}
+	if _, err := fm.ReadBlocks("scan.db", -1, 2); !errors.Is(err, ErrInvalidBlock) {
+		t.Errorf("Expected ErrInvalidBlock for a negative start, got %v", err)
+	}
+}
+
+func TestChecksumDetectsCorruptionOnDisk(t *testing.T) {
+	dir := t.TempDir()
+	const blocksize = 400
+	fm, err := NewFileMgr(dir, blocksize, WithChecksumVerification())
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	appended, err := fm.Append("crc.db")
+	if err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	written := NewBlockId("crc.db", 1)
+	page := NewSlottedPage(blocksize)
+	cell := NewKVCell([]byte("key"))
+	cell.SetValue("value")
+	if err := page.InsertCell(cell); err != nil {
+		t.Fatalf("InsertCell failed: %v", err)
+	}
+	if err := fm.Write(written, page); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	for _, blk := range []*BlockId{appended, written} {
+		if err := fm.Read(blk, NewSlottedPage(blocksize)); err != nil {
+			t.Fatalf("Read of intact block %v failed: %v", blk, err)
+		}
+	}
+	appendedOff, _ := fm.blockOffset(appended.Number())
+	writtenOff, _ := fm.blockOffset(written.Number())
+	if err := fm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Flip a header byte of the appended block and the last byte of the
+	// written block, which lies in its cell.
+	f, err := os.OpenFile(filepath.Join(dir, "crc.db"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Failed to open data file: %v", err)
+	}
+	for _, off := range []int64{appendedOff + 4, writtenOff + blocksize - 1} {
+		b := make([]byte, 1)
+		if _, err := f.ReadAt(b, off); err != nil {
+			t.Fatalf("ReadAt failed: %v", err)
+		}
+		b[0] ^= 0x01
+		if _, err := f.WriteAt(b, off); err != nil {
+			t.Fatalf("WriteAt failed: %v", err)
+		}
+	}
+	f.Close()
+
+	fm, err = NewFileMgr(dir, blocksize, WithChecksumVerification())
+	if err != nil {
+		t.Fatalf("Failed to reopen FileMgr: %v", err)
+	}
+	defer fm.Close()
+	for _, blk := range []*BlockId{appended, written} {
+		err := fm.Read(blk, NewSlottedPage(blocksize))
+		if !errors.Is(err, ErrChecksumMismatch) {
+			t.Fatalf("Expected ErrChecksumMismatch reading %v, got %v", blk, err)
+		}
+		var ce *ChecksumError
+		if !errors.As(err, &ce) || !ce.Blk.Equals(blk) {
+			t.Errorf("Expected a ChecksumError for %v, got %v", blk, err)
+		}
+	}
+	if _, err := fm.ReadBlocks("crc.db", 0, 2); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected ReadBlocks to report the corruption, got %v", err)
+	}
+}
+
+func TestMaxOpenFiles(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncEveryWrite, SyncOnClose} {
+		t.Run(policy.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			const blocksize, limit, files = 400, 2, 10
+			fm, err := NewFileMgr(dir, blocksize, WithMaxOpenFiles(limit), WithSyncPolicy(policy))
+			if err != nil {
+				t.Fatalf("Failed to create FileMgr: %v", err)
+			}
+			checkOpen := func() {
+				t.Helper()
+				fm.openFilesLock.Lock()
+				n := len(fm.openFiles)
+				fm.openFilesLock.Unlock()
+				if n > limit {
+					t.Fatalf("Expected at most %d open files, got %d", limit, n)
+				}
+			}
+
+			for round := 0; round < 3; round++ {
+				for i := 0; i < files; i++ {
+					page := NewSlottedPage(blocksize)
+					if err := page.SetInt(100, round*files+i); err != nil {
+						t.Fatalf("SetInt failed: %v", err)
+					}
+					blk := NewBlockId(fmt.Sprintf("file%d.db", i), int32(round))
+					if err := fm.Write(blk, page); err != nil {
+						t.Fatalf("Write of %v failed: %v", blk, err)
+					}
+					checkOpen()
+				}
+			}
+			for round := 0; round < 3; round++ {
+				for i := 0; i < files; i++ {
+					filename := fmt.Sprintf("file%d.db", i)
+					if n, err := fm.Length(filename); err != nil || n != 3 {
+						t.Fatalf("Expected %s to hold 3 blocks, got %d (%v)", filename, n, err)
+					}
+					page := NewSlottedPage(blocksize)
+					if err := fm.Read(NewBlockId(filename, int32(round)), page); err != nil {
+						t.Fatalf("Read failed: %v", err)
+					}
+					if v, _ := page.GetInt(100); v != round*files+i {
+						t.Errorf("Block %d of %s holds %d, want %d", round, filename, v, round*files+i)
+					}
+					checkOpen()
+				}
+			}
+			if err := fm.SyncAll(); err != nil {
+				t.Errorf("SyncAll failed: %v", err)
+			}
+			if err := fm.Close(); err != nil {
+				t.Errorf("Close failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestReadOnlyFileMgr(t *testing.T) {
+	dir := t.TempDir()
+	const blocksize = 400
+	fm, err := NewFileMgr(dir, blocksize)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	page := NewSlottedPage(blocksize)
+	if err := page.SetInt(100, 42); err != nil {
+		t.Fatalf("SetInt failed: %v", err)
+	}
+	blk := NewBlockId("data.db", 0)
+	if err := fm.Write(blk, page); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	fm.Close()
+	tmp := filepath.Join(dir, "leftover.tmp")
+	if err := os.WriteFile(tmp, []byte("keep"), 0644); err != nil {
+		t.Fatalf("Failed to create temporary file: %v", err)
+	}
+	before, err := os.ReadFile(filepath.Join(dir, "data.db"))
+	if err != nil {
+		t.Fatalf("Failed to read data file: %v", err)
+	}
+
+	ro, err := NewFileMgr(dir, blocksize, WithReadOnly())
+	if err != nil {
+		t.Fatalf("Failed to open FileMgr read-only: %v", err)
+	}
+	defer ro.Close()
+	if _, err := os.Stat(tmp); err != nil {
+		t.Errorf("Expected the temporary file to survive a read-only open, got %v", err)
+	}
+
+	got := NewSlottedPage(blocksize)
+	if err := ro.Read(blk, got); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if v, _ := got.GetInt(100); v != 42 {
+		t.Errorf("Expected to read back 42, got %d", v)
+	}
+	if n, err := ro.Length("data.db"); err != nil || n != 1 {
+		t.Errorf("Expected a length of 1, got %d (%v)", n, err)
+	}
+	if ro.BlocksRead() != 1 {
+		t.Errorf("Expected 1 block read, got %d", ro.BlocksRead())
+	}
+
+	mutations := map[string]func() error{
+		"Write":       func() error { return ro.Write(blk, got) },
+		"WriteBlocks": func() error { return ro.WriteBlocks([]BlockWrite{{Blk: blk, Page: got}}) },
+		"Append": func() error {
+			_, err := ro.Append("data.db")
+			return err
+		},
+		"AppendN": func() error {
+			_, err := ro.AppendN("data.db", 2)
+			return err
+		},
+		"Allocate": func() error {
+			_, err := ro.Allocate("data.db", 0)
+			return err
+		},
+		"PreallocateFile": func() error { return ro.PreallocateFile(blk, 4*blocksize) },
+		"RenameFile":      func() error { return ro.RenameFile(blk.Copy(), "renamed.db") },
+		"DeleteFile":      func() error { return ro.DeleteFile("data.db") },
+		"Truncate":        func() error { return ro.Truncate("data.db", 0) },
+		"CopyFile":        func() error { return ro.CopyFile("data.db", "copy.db") },
+		"SetSizeLimit":    func() error { return ro.SetSizeLimit(10 * blocksize) },
+		"FreeBlock":       func() error { return ro.FreeBlock(blk) },
+		"EnsureFileSize":  func() error { return ro.EnsureFileSize(blk, 8) },
+	}
+	for name, mutate := range mutations {
+		if err := mutate(); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("Expected %s to fail with ErrReadOnly, got %v", name, err)
+		}
+	}
+	if err := ro.Read(NewBlockId("missing.db", 0), got); err == nil {
+		t.Error("Expected reading a missing file not to create it")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing.db")); !os.IsNotExist(err) {
+		t.Errorf("Expected missing.db not to be created, got %v", err)
+	}
+	after, err := os.ReadFile(filepath.Join(dir, "data.db"))
+	if err != nil || !bytes.Equal(before, after) {
+		t.Errorf("Expected the data file to be unchanged (%v)", err)
+	}
+
+	if _, err := NewFileMgr(filepath.Join(dir, "absent"), blocksize, WithReadOnly()); err == nil {
+		t.Error("Expected opening a missing directory read-only to fail")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	const blocksize = 400
+	fm, err := NewFileMgr(t.TempDir(), blocksize)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	for i := 0; i < 5; i++ {
+		if _, err := fm.Append("data.db"); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	page := NewSlottedPage(blocksize)
+	if err := page.SetInt(100, 7); err != nil {
+		t.Fatalf("SetInt failed: %v", err)
+	}
+	if err := fm.Write(NewBlockId("data.db", 1), page); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	if err := fm.Truncate("data.db", 6); !errors.Is(err, ErrInvalidBlock) {
+		t.Errorf("Expected growing the file to fail with ErrInvalidBlock, got %v", err)
+	}
+	if err := fm.Truncate("data.db", 2); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if n, err := fm.Length("data.db"); err != nil || n != 2 {
+		t.Errorf("Expected a length of 2, got %d (%v)", n, err)
+	}
+	got := NewSlottedPage(blocksize)
+	if err := fm.Read(NewBlockId("data.db", 3), got); err == nil {
+		t.Error("Expected reading block 3 to fail after truncation")
+	}
+	if err := fm.Read(NewBlockId("data.db", 1), got); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if v, _ := got.GetInt(100); v != 7 {
+		t.Errorf("Expected block 1 to keep its contents, got %d", v)
+	}
+
+	if err := fm.Truncate("missing.db", 0); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected truncating a missing file to fail with os.ErrNotExist, got %v", err)
+	}
+
+	fl := fm.fileLock("data.db")
+	fl.RLock()
+	err = fm.Truncate("data.db", 1)
+	fl.RUnlock()
+	if !errors.Is(err, ErrFileBusy) {
+		t.Errorf("Expected truncating a file in use to fail with ErrFileBusy, got %v", err)
+	}
+	if n, _ := fm.Length("data.db"); n != 2 {
+		t.Errorf("Expected a busy file to keep a length of 2, got %d", n)
+	}
+}
+
+func TestListFiles(t *testing.T) {
+	dir := t.TempDir()
+	const blocksize = 400
+	fm, err := NewFileMgr(dir, blocksize)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	want := map[string]int32{"a.db": 1, "b.db": 3, "c.db": 2}
+	for name, n := range want {
+		for i := int32(0); i < n; i++ {
+			if _, err := fm.Append(name); err != nil {
+				t.Fatalf("Append failed: %v", err)
+			}
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "scratch.tmp"), []byte("x"), 0644); err != nil {
+		t.Fatalf("Failed to create temporary file: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatalf("Failed to create subdirectory: %v", err)
+	}
+
+	files, err := fm.ListFiles()
+	if err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+	if len(files) != len(want) {
+		t.Fatalf("Expected %d files, got %+v", len(want), files)
+	}
+	for i, f := range files {
+		if i > 0 && files[i-1].Name >= f.Name {
+			t.Errorf("Expected files sorted by name, got %s before %s", files[i-1].Name, f.Name)
+		}
+		if n, ok := want[f.Name]; !ok || f.Blocks != n {
+			t.Errorf("Expected %s to have %d blocks, got %d", f.Name, n, f.Blocks)
+		}
+		if f.ModTime.IsZero() {
+			t.Errorf("Expected %s to have a modification time", f.Name)
+		}
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	dir := t.TempDir()
+	const blocksize = 400
+	fm, err := NewFileMgr(dir, blocksize, WithSyncPolicy(SyncOnClose))
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		page := NewSlottedPage(blocksize)
+		if err := page.SetInt(100, 10*i); err != nil {
+			t.Fatalf("SetInt failed: %v", err)
+		}
+		if err := fm.Write(NewBlockId("data.db", int32(i)), page); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	if err := fm.CopyFile("data.db", "copy.db"); err != nil {
+		t.Fatalf("CopyFile failed: %v", err)
+	}
+	backupDir := t.TempDir()
+	if err := fm.CopyFile("data.db", filepath.Join(backupDir, "backup.db")); err != nil {
+		t.Fatalf("CopyFile to an absolute path failed: %v", err)
+	}
+	if err := fm.CopyFile("data.db", "copy.db"); !errors.Is(err, os.ErrExist) {
+		t.Errorf("Expected copying over an existing file to fail with os.ErrExist, got %v", err)
+	}
+	if err := fm.CopyFile("missing.db", "other.db"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected copying a missing file to fail with os.ErrNotExist, got %v", err)
+	}
+	fm.Close()
+
+	for _, c := range []struct{ dir, name string }{{dir, "copy.db"}, {backupDir, "backup.db"}} {
+		reader, err := NewFileMgr(c.dir, blocksize)
+		if err != nil {
+			t.Fatalf("Failed to create FileMgr: %v", err)
+		}
+		if n, err := reader.Length(c.name); err != nil || n != 3 {
+			t.Errorf("Expected %s to have 3 blocks, got %d (%v)", c.name, n, err)
+		}
+		for i := 0; i < 3; i++ {
+			page := NewSlottedPage(blocksize)
+			if err := reader.Read(NewBlockId(c.name, int32(i)), page); err != nil {
+				t.Fatalf("Read of %s failed: %v", c.name, err)
+			}
+			if v, _ := page.GetInt(100); v != 10*i {
+				t.Errorf("Expected block %d of %s to hold %d, got %d", i, c.name, 10*i, v)
+			}
+		}
+		reader.Close()
+	}
+}
@@ -0,0 +1,108 @@
+package kfile
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// WithMaxOpenFiles caps how many file handles the FileMgr keeps open at
+// once. When opening a file would exceed n, the least recently used idle
+// handles are closed, syncing any batched writes first, and reopened
+// lazily on their next access. A file is idle when no operation holds its
+// lock, so a handle in the middle of a read or write is never closed; the
+// cap is only exceeded while every other open file is in use. Zero, the
+// default, leaves the number of open files unbounded.
+func WithMaxOpenFiles(n int) FileMgrOption {
+	return func(fm *FileMgr) {
+		fm.maxOpenFiles = n
+	}
+}
+
+// cacheFileLocked records f as the open handle for filename and closes idle
+// handles beyond the WithMaxOpenFiles cap. The caller must hold
+// fm.openFilesLock.
+func (fm *FileMgr) cacheFileLocked(filename string, f *os.File) {
+	fm.openFiles[filename] = f
+	fm.touchFileLocked(filename)
+	fm.evictFilesLocked(filename)
+}
+
+// touchFileLocked marks filename as just used. The caller must hold
+// fm.openFilesLock.
+func (fm *FileMgr) touchFileLocked(filename string) {
+	if fm.maxOpenFiles <= 0 {
+		return
+	}
+	if fm.lastUsed == nil {
+		fm.lastUsed = make(map[string]uint64)
+	}
+	fm.useClock++
+	fm.lastUsed[filename] = fm.useClock
+}
+
+// evictFilesLocked closes the least recently used idle handles, other than
+// keep, until no more than fm.maxOpenFiles remain open. The caller must hold
+// fm.openFilesLock.
+func (fm *FileMgr) evictFilesLocked(keep string) {
+	if fm.maxOpenFiles <= 0 || len(fm.openFiles) <= fm.maxOpenFiles {
+		return
+	}
+	names := make([]string, 0, len(fm.openFiles))
+	for name := range fm.openFiles {
+		if name != keep {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return fm.lastUsed[names[i]] < fm.lastUsed[names[j]]
+	})
+	for _, name := range names {
+		if len(fm.openFiles) <= fm.maxOpenFiles {
+			return
+		}
+		// Operations hold the file's lock while they use its handle, so
+		// taking it without waiting proves the file is idle. Waiting here
+		// could deadlock against an operation that is itself opening a file.
+		fl := fm.fileLock(name)
+		if !fl.TryLock() {
+			continue
+		}
+		err := fm.closeIdleFileLocked(name)
+		fl.Unlock()
+		if err != nil {
+			// Nobody is waiting on the eviction, so report the error
+			// through SyncAll as the background flusher does.
+			fm.dirtyMu.Lock()
+			if fm.flushErr == nil {
+				fm.flushErr = err
+			}
+			fm.dirtyMu.Unlock()
+		}
+	}
+}
+
+// closeIdleFileLocked syncs filename if batched writes left it dirty, then
+// closes its handle. The caller must hold fm.openFilesLock and the file's
+// lock. A file that fails to sync stays open and dirty.
+func (fm *FileMgr) closeIdleFileLocked(filename string) error {
+	f := fm.openFiles[filename]
+	fm.dirtyMu.Lock()
+	_, dirty := fm.dirty[filename]
+	fm.dirtyMu.Unlock()
+	if dirty {
+		if err := fm.syncFile(f); err != nil {
+			return fmt.Errorf("failed to sync file %s: %w", filename, err)
+		}
+		fm.dirtyMu.Lock()
+		delete(fm.dirty, filename)
+		fm.dirtyMu.Unlock()
+	}
+	fm.dropMmapLocked(filename)
+	delete(fm.openFiles, filename)
+	delete(fm.lastUsed, filename)
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close file %s: %w", filename, err)
+	}
+	return nil
+}
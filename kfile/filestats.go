@@ -0,0 +1,81 @@
+package kfile
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// FileStats counts the block I/O done on one file.
+type FileStats struct {
+	BlocksRead     int64
+	BlocksWritten  int64
+	BlocksAppended int64
+}
+
+// fileCounters holds the live counters behind a FileStats. They are updated
+// atomically, so I/O on one file never waits on the counters of another.
+type fileCounters struct {
+	read, written, appended atomic.Int64
+}
+
+// fileStatsTable maps file names to their counters.
+type fileStatsTable struct {
+	mu    sync.Mutex
+	files map[string]*fileCounters
+}
+
+// counters returns the counters of filename, creating them on first use.
+func (t *fileStatsTable) counters(filename string) *fileCounters {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.files == nil {
+		t.files = make(map[string]*fileCounters)
+	}
+	c, ok := t.files[filename]
+	if !ok {
+		c = &fileCounters{}
+		t.files[filename] = c
+	}
+	return c
+}
+
+// rename carries the counters of oldName over to newName.
+func (t *fileStatsTable) rename(oldName, newName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c, ok := t.files[oldName]; ok {
+		delete(t.files, oldName)
+		t.files[newName] = c
+	}
+}
+
+func (c *fileCounters) snapshot() FileStats {
+	return FileStats{
+		BlocksRead:     c.read.Load(),
+		BlocksWritten:  c.written.Load(),
+		BlocksAppended: c.appended.Load(),
+	}
+}
+
+// StatsFor returns a copy of the I/O counts of filename. Counts follow a
+// file through RenameFile and are cleared by ResetStats.
+func (fm *FileMgr) StatsFor(filename string) FileStats {
+	fm.fileStats.mu.Lock()
+	defer fm.fileStats.mu.Unlock()
+	if c, ok := fm.fileStats.files[filename]; ok {
+		return c.snapshot()
+	}
+	return FileStats{}
+}
+
+// AllStats returns a copy of the I/O counts of every file that has seen any
+// since the FileMgr was opened or last reset.
+func (fm *FileMgr) AllStats() map[string]FileStats {
+	fm.fileStats.mu.Lock()
+	defer fm.fileStats.mu.Unlock()
+	out := make(map[string]FileStats, len(fm.fileStats.files))
+	for name, c := range fm.fileStats.files {
+		out[name] = c.snapshot()
+	}
+	return out
+}
@@ -0,0 +1,251 @@
+package kfile
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Superblock layout, at the start of every file opened through OpenDatabase.
+const (
+	SuperblockSize      = 512
+	superblockMagic     = "USQLSB01"
+	superblockIDOffset  = 8
+	superblockBlkOffset = 24
+)
+
+// ErrDatabaseIdentityMismatch is returned when the files in a database
+// directory do not all carry the same database identity.
+var ErrDatabaseIdentityMismatch = errors.New("database identity mismatch")
+
+// DatabaseID is the random identity stamped into every file of a database so
+// that data files and the log can be checked to belong together.
+type DatabaseID [16]byte
+
+// String formats the identity as a UUID.
+func (id DatabaseID) String() string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
+
+// newDatabaseID generates a random (version 4) UUID.
+func newDatabaseID() (DatabaseID, error) {
+	var id DatabaseID
+	if _, err := io.ReadFull(rand.Reader, id[:]); err != nil {
+		return id, fmt.Errorf("failed to generate database identity: %w", err)
+	}
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return id, nil
+}
+
+// OpenDatabase opens dbDirectory like NewFileMgr, but every file carries a
+// superblock stamped with the database identity. A new directory gets a fresh
+// identity; an existing one must have all its files stamped with the same
+// identity and block size, otherwise ErrDatabaseIdentityMismatch is returned
+// naming the offending files.
+func OpenDatabase(dbDirectory string, blocksize int, opts ...FileMgrOption) (*FileMgr, error) {
+	stamps, err := readStamps(dbDirectory)
+	if err != nil {
+		return nil, err
+	}
+	id, err := agreedIdentity(stamps, blocksize)
+	if err != nil {
+		return nil, err
+	}
+	// Set the superblock up ahead of the caller's options, so that all of
+	// NewFileMgr, startup validation included, sees it.
+	withSuperblock := func(fm *FileMgr) {
+		fm.headerSize = SuperblockSize
+		fm.dbID = id
+	}
+	return NewFileMgr(dbDirectory, blocksize, append([]FileMgrOption{withSuperblock}, opts...)...)
+}
+
+// ForceAdopt rewrites the identity of every file in dbDirectory to that of
+// the authority file (normally the log), for maintenance after files were
+// deliberately moved between databases. It first checks that every file has
+// an intact superblock for the given block size and a whole number of blocks,
+// and changes nothing if any does not.
+func ForceAdopt(dbDirectory string, blocksize int, authority string) error {
+	stamps, err := readStamps(dbDirectory)
+	if err != nil {
+		return err
+	}
+	var target *fileStamp
+	for i := range stamps {
+		s := &stamps[i]
+		if s.err != nil {
+			return fmt.Errorf("cannot adopt %s: %w", s.name, s.err)
+		}
+		if s.blocksize != blocksize {
+			return fmt.Errorf("cannot adopt %s: block size %d, expected %d", s.name, s.blocksize, blocksize)
+		}
+		if (s.size-SuperblockSize)%int64(blocksize) != 0 {
+			return fmt.Errorf("cannot adopt %s: size %d is not a whole number of blocks", s.name, s.size)
+		}
+		if s.name == authority {
+			target = s
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("authority file %s not found in %s", authority, dbDirectory)
+	}
+	for _, s := range stamps {
+		if s.id == target.id {
+			continue
+		}
+		if err := writeSuperblockAt(filepath.Join(dbDirectory, s.name), target.id, blocksize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileStamp is the superblock content read from one file.
+type fileStamp struct {
+	name      string
+	id        DatabaseID
+	blocksize int
+	size      int64
+	err       error
+}
+
+// readStamps reads the superblock of every database file in dbDirectory,
+// sorted by name. A missing directory has no stamps.
+func readStamps(dbDirectory string) ([]fileStamp, error) {
+	entries, err := os.ReadDir(dbDirectory)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list directory %s: %w", dbDirectory, err)
+	}
+	var stamps []fileStamp
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) == ".tmp" || strings.HasPrefix(e.Name(), ".") || e.Name() == CompressionDictFile {
+			continue
+		}
+		s := fileStamp{name: e.Name()}
+		s.id, s.blocksize, s.size, s.err = readSuperblockAt(filepath.Join(dbDirectory, e.Name()))
+		stamps = append(stamps, s)
+	}
+	sort.Slice(stamps, func(i, j int) bool { return stamps[i].name < stamps[j].name })
+	return stamps, nil
+}
+
+// agreedIdentity returns the identity shared by all stamps, or a new one if
+// there are none.
+func agreedIdentity(stamps []fileStamp, blocksize int) (DatabaseID, error) {
+	if len(stamps) == 0 {
+		return newDatabaseID()
+	}
+	byID := make(map[DatabaseID][]string)
+	var problems []string
+	for _, s := range stamps {
+		switch {
+		case s.err != nil:
+			problems = append(problems, fmt.Sprintf("%s (%v)", s.name, s.err))
+		case s.blocksize != blocksize:
+			problems = append(problems, fmt.Sprintf("%s (block size %d, expected %d)", s.name, s.blocksize, blocksize))
+		default:
+			byID[s.id] = append(byID[s.id], s.name)
+		}
+	}
+	if len(byID) > 1 {
+		for id, names := range byID {
+			problems = append(problems, fmt.Sprintf("%s belong to %s", strings.Join(names, ", "), id))
+		}
+		sort.Strings(problems)
+	}
+	if len(problems) > 0 {
+		return DatabaseID{}, fmt.Errorf("%w: %s", ErrDatabaseIdentityMismatch, strings.Join(problems, "; "))
+	}
+	return stamps[0].id, nil
+}
+
+// checkSuperblock stamps an empty file with the database identity, or
+// verifies the identity of a non-empty one.
+func (fm *FileMgr) checkSuperblock(f *os.File, filename string) error {
+	stat, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file %s: %w", filename, err)
+	}
+	if stat.Size() == 0 {
+		if fm.readOnly {
+			return nil
+		}
+		if _, err := fm.fileWriteAt(f, encodeSuperblock(fm.dbID, fm.blocksize), 0); err != nil {
+			return fmt.Errorf("failed to stamp superblock of %s: %w", filename, err)
+		}
+		return f.Sync()
+	}
+	id, blocksize, err := decodeSuperblock(fileReaderAt{fm, f})
+	if err != nil {
+		return fmt.Errorf("%w: %s (%v)", ErrDatabaseIdentityMismatch, filename, err)
+	}
+	if id != fm.dbID || blocksize != fm.blocksize {
+		return fmt.Errorf("%w: %s belongs to %s with block size %d, database is %s with block size %d",
+			ErrDatabaseIdentityMismatch, filename, id, blocksize, fm.dbID, fm.blocksize)
+	}
+	return nil
+}
+
+// DatabaseID returns the identity stamped into this database's files. It is
+// the zero value for a FileMgr created with NewFileMgr.
+func (fm *FileMgr) DatabaseID() DatabaseID {
+	return fm.dbID
+}
+
+func encodeSuperblock(id DatabaseID, blocksize int) []byte {
+	sb := make([]byte, SuperblockSize)
+	copy(sb, superblockMagic)
+	copy(sb[superblockIDOffset:], id[:])
+	binary.BigEndian.PutUint32(sb[superblockBlkOffset:], uint32(blocksize))
+	return sb
+}
+
+func decodeSuperblock(f io.ReaderAt) (DatabaseID, int, error) {
+	var id DatabaseID
+	sb := make([]byte, SuperblockSize)
+	if _, err := f.ReadAt(sb, 0); err != nil {
+		return id, 0, fmt.Errorf("no superblock: %w", err)
+	}
+	if !bytes.Equal(sb[:len(superblockMagic)], []byte(superblockMagic)) {
+		return id, 0, errors.New("no superblock")
+	}
+	copy(id[:], sb[superblockIDOffset:])
+	return id, int(binary.BigEndian.Uint32(sb[superblockBlkOffset:])), nil
+}
+
+func readSuperblockAt(path string) (DatabaseID, int, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return DatabaseID{}, 0, 0, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return DatabaseID{}, 0, 0, err
+	}
+	id, blocksize, err := decodeSuperblock(f)
+	return id, blocksize, stat.Size(), err
+}
+
+func writeSuperblockAt(path string, id DatabaseID, blocksize int) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(encodeSuperblock(id, blocksize), 0); err != nil {
+		return fmt.Errorf("failed to rewrite superblock of %s: %w", path, err)
+	}
+	return f.Sync()
+}
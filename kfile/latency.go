@@ -0,0 +1,106 @@
+package kfile
+
+import (
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBounds are the upper bounds of the latency histogram buckets; a
+// final bucket counts everything slower than the last bound.
+var latencyBounds = [...]time.Duration{
+	10 * time.Microsecond,
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// LatencyHistogram is a snapshot of the latencies of one kind of operation.
+// Counts[i] is the number of operations that took at most Bounds[i] (and
+// more than Bounds[i-1]); the last count, one past the bounds, is for those
+// slower than every bound.
+type LatencyHistogram struct {
+	Bounds []time.Duration
+	Counts []int64
+	Total  time.Duration // summed over all operations
+}
+
+// Count returns the number of operations in the histogram.
+func (h LatencyHistogram) Count() int64 {
+	var n int64
+	for _, c := range h.Counts {
+		n += c
+	}
+	return n
+}
+
+// LatencyStats holds a latency histogram per kind of block I/O. Write and
+// Append include the sync the sync policy asks for, which Sync also counts
+// on its own.
+type LatencyStats struct {
+	Read   LatencyHistogram
+	Write  LatencyHistogram
+	Append LatencyHistogram
+	Sync   LatencyHistogram
+}
+
+// latencyHistogram is the live form of a LatencyHistogram. Recording is a
+// couple of atomic adds, so it costs little next to the I/O it times.
+type latencyHistogram struct {
+	counts [len(latencyBounds) + 1]atomic.Int64
+	total  atomic.Int64 // nanoseconds
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBounds) && d > latencyBounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.total.Add(int64(d))
+}
+
+func (h *latencyHistogram) snapshot() LatencyHistogram {
+	out := LatencyHistogram{
+		Bounds: slices.Clone(latencyBounds[:]),
+		Counts: make([]int64, len(h.counts)),
+		Total:  time.Duration(h.total.Load()),
+	}
+	for i := range h.counts {
+		out.Counts[i] = h.counts[i].Load()
+	}
+	return out
+}
+
+func (h *latencyHistogram) reset() {
+	for i := range h.counts {
+		h.counts[i].Store(0)
+	}
+	h.total.Store(0)
+}
+
+// ioLatency holds the FileMgr's histograms.
+type ioLatency struct {
+	read, write, append, sync latencyHistogram
+}
+
+func (l *ioLatency) reset() {
+	l.read.reset()
+	l.write.reset()
+	l.append.reset()
+	l.sync.reset()
+}
+
+// LatencyStats returns a snapshot of the block I/O latency histograms,
+// which ResetStats clears. ReadBlocks and WriteBlocks count as one read or
+// write per call.
+func (fm *FileMgr) LatencyStats() LatencyStats {
+	return LatencyStats{
+		Read:   fm.latency.read.snapshot(),
+		Write:  fm.latency.write.snapshot(),
+		Append: fm.latency.append.snapshot(),
+		Sync:   fm.latency.sync.snapshot(),
+	}
+}
@@ -0,0 +1,76 @@
+package kfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileInfo describes one database file as listed by ListFiles.
+type FileInfo struct {
+	Name    string
+	Blocks  int32 // whole blocks in the file, as Length counts them
+	ModTime time.Time
+}
+
+// ListFiles returns the database files in the data directory, sorted by
+// name. Directories, temporary .tmp files and the FileMgr's own bookkeeping
+// files (the double-write area, the compression dictionary and the
+// metadata) are left out, as are log files kept in a separate
+// WithLogDirectory. Each file is measured under its lock, so a concurrent
+// Append is either counted whole or not at all.
+func (fm *FileMgr) ListFiles() ([]FileInfo, error) {
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+
+	if fm.closed {
+		return nil, ErrClosed
+	}
+	entries, err := os.ReadDir(fm.dbDirectory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list directory %s: %w", fm.dbDirectory, err)
+	}
+	var files []FileInfo
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !isDataFile(name) {
+			continue
+		}
+		info, err := fm.statFile(name)
+		if errors.Is(err, os.ErrNotExist) {
+			// Deleted since the directory was read.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, info)
+	}
+	return files, nil
+}
+
+// isDataFile reports whether name, a file in the data directory, may be a
+// database file rather than a temporary or bookkeeping file.
+func isDataFile(name string) bool {
+	return filepath.Ext(name) != ".tmp" && name != DoubleWriteFile && name != CompressionDictFile && name != MetadataFile
+}
+
+// statFile describes the data file filename, holding its lock so that no
+// write to it is in progress. The caller must hold fm.mutex.
+func (fm *FileMgr) statFile(filename string) (FileInfo, error) {
+	fl := fm.fileLock(filename)
+	fl.RLock()
+	defer fl.RUnlock()
+
+	stat, err := os.Stat(filepath.Join(fm.dbDirectory, filename))
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to stat file %s: %w", filename, err)
+	}
+	var blocks int32
+	if stat.Size() > int64(fm.headerSize) {
+		blocks = int32((stat.Size() - int64(fm.headerSize)) / int64(fm.blocksize))
+	}
+	return FileInfo{Name: filename, Blocks: blocks, ModTime: stat.ModTime()}, nil
+}
@@ -0,0 +1,458 @@
+package kfile
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+)
+
+// MetadataFile is the file in the database directory holding the FileMgr's
+// metadata across restarts. The leading dot keeps it out of identity checks,
+// which skip dotfiles.
+const MetadataFile = ".meta"
+
+// Metadata file layout: magic, version, then the version's fields. Newer
+// versions append fields, so a reader checks the version before decoding.
+//
+// Version 1: CreatedAt, ModifiedAt and SizeLimit as int64 (times in Unix
+// nanoseconds), a uint32 file count, then per file a uint16 name length,
+// the name, the block count as uint32 and ModifiedAt as int64.
+//
+// Version 2 adds the free lists: a uint32 count of files with free blocks,
+// then per file a uint16 name length, the name, a uint32 block count and
+// the block numbers as uint32, in the order they were freed.
+//
+// Version 3 adds the block size as a uint32.
+const (
+	metadataMagic   = "USQLMETA"
+	metadataVersion = 3
+)
+
+// ErrBlockSizeMismatch is returned by NewFileMgr for a directory whose
+// metadata records a block size other than the one asked for.
+var ErrBlockSizeMismatch = errors.New("block size mismatch")
+
+// WithBlockSizeOverride opens a directory whatever block size its metadata
+// records, for tooling that knows better, such as a converter between block
+// sizes. The recorded block size is left as it is.
+func WithBlockSizeOverride() FileMgrOption {
+	return func(fm *FileMgr) {
+		fm.ignoreBlockSize = true
+	}
+}
+
+// FileEntry is the metadata kept for one file.
+type FileEntry struct {
+	BlockCount int32
+	ModifiedAt time.Time
+}
+
+// Metadata returns a copy of the FileMgr's metadata. BlockCount and
+// FileSize are the totals over Files.
+func (fm *FileMgr) Metadata() FileMetadata {
+	fm.statsMu.Lock()
+	defer fm.statsMu.Unlock()
+	md := fm.metaData
+	md.Files = make(map[string]FileEntry, len(fm.metaData.Files))
+	md.FreeBlocks = make(map[string][]int32, len(fm.metaData.FreeBlocks))
+	for name, free := range fm.metaData.FreeBlocks {
+		md.FreeBlocks[name] = slices.Clone(free)
+	}
+	md.BlockCount, md.FileSize = 0, 0
+	for name, e := range fm.metaData.Files {
+		md.Files[name] = e
+		md.BlockCount += int(e.BlockCount)
+		md.FileSize += int64(fm.headerSize) + int64(e.BlockCount)*int64(fm.blocksize)
+	}
+	return md
+}
+
+// readMetadata reads MetadataFile, returning nil if there is none. It fails
+// with ErrBlockSizeMismatch if the directory records another block size;
+// NewFileMgr calls it before repairing anything, which has to be done with
+// the directory's own block size.
+func (fm *FileMgr) readMetadata() (*FileMetadata, error) {
+	data, err := os.ReadFile(filepath.Join(fm.dbDirectory, MetadataFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	md, err := decodeMetadata(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+	if md.BlockSize != 0 && md.BlockSize != fm.blocksize && !fm.ignoreBlockSize {
+		return nil, fmt.Errorf("%w: %s has %d-byte blocks, opened with %d",
+			ErrBlockSizeMismatch, fm.dbDirectory, md.BlockSize, fm.blocksize)
+	}
+	return &md, nil
+}
+
+// loadMetadata installs md, as read by readMetadata, with its file entries
+// refreshed from the files. Without one it starts new metadata and, unless
+// read-only, saves it as updateMetadata would, so that CreatedAt records
+// when the database was first opened.
+func (fm *FileMgr) loadMetadata(md *FileMetadata) error {
+	if md == nil {
+		fm.statsMu.Lock()
+		fm.metaData = NewMetaData(time.Now())
+		fm.metaData.BlockSize = fm.blocksize
+		data := fm.encodeMetadataLocked()
+		fm.statsMu.Unlock()
+		if fm.readOnly {
+			return nil
+		}
+		if fm.dirty != nil {
+			fm.metaPending = true
+			return nil
+		}
+		return fm.saveMetadata(data)
+	}
+	changed, err := fm.refreshFileMeta(md)
+	if err != nil {
+		return err
+	}
+	fm.statsMu.Lock()
+	fm.metaData = *md
+	fm.statsMu.Unlock()
+	fm.metaPending = changed && !fm.readOnly
+	fm.freeBlocks = make(map[string][]int32, len(md.FreeBlocks))
+	for name, free := range md.FreeBlocks {
+		fm.freeBlocks[name] = slices.Clone(free)
+	}
+	if md.BlockSize == 0 && !fm.readOnly {
+		// Metadata from before the block size was recorded.
+		return fm.updateMetadata(func(md *FileMetadata) bool {
+			md.BlockSize = fm.blocksize
+			return true
+		})
+	}
+	return nil
+}
+
+// setFileMeta records that filename has blocks blocks. The caller must hold
+// the file's lock.
+func (fm *FileMgr) setFileMeta(filename string, blocks int32) {
+	fm.noteMetadata(func(md *FileMetadata) bool {
+		if e, ok := md.Files[filename]; ok && e.BlockCount == blocks {
+			return false
+		}
+		md.Files[filename] = FileEntry{BlockCount: blocks, ModifiedAt: time.Now()}
+		return true
+	})
+}
+
+// growFileMetaLocked records that filename, just written, has at least
+// blocks blocks, measuring it if the metadata does not already say so. The
+// caller must hold the file's lock.
+func (fm *FileMgr) growFileMetaLocked(filename string, blocks int32) error {
+	fm.statsMu.Lock()
+	e, ok := fm.metaData.Files[filename]
+	fm.statsMu.Unlock()
+	if ok && e.BlockCount >= blocks {
+		return nil
+	}
+	n, err := fm.LengthLocked(filename)
+	if err != nil {
+		return fmt.Errorf("failed to determine length for file %s: %w", filename, err)
+	}
+	fm.setFileMeta(filename, n)
+	return nil
+}
+
+// setFreeBlocksMeta records free as the free list of filename.
+func (fm *FileMgr) setFreeBlocksMeta(filename string, free []int32) error {
+	return fm.updateMetadata(func(md *FileMetadata) bool {
+		if slices.Equal(md.FreeBlocks[filename], free) {
+			return false
+		}
+		if len(free) == 0 {
+			delete(md.FreeBlocks, filename)
+			return true
+		}
+		if md.FreeBlocks == nil {
+			md.FreeBlocks = make(map[string][]int32)
+		}
+		md.FreeBlocks[filename] = slices.Clone(free)
+		return true
+	})
+}
+
+// renameFileMeta moves the entry of oldName, if any, to newName.
+func (fm *FileMgr) renameFileMeta(oldName, newName string) {
+	fm.noteMetadata(func(md *FileMetadata) bool {
+		e, ok := md.Files[oldName]
+		if !ok {
+			return false
+		}
+		delete(md.Files, oldName)
+		md.Files[newName] = e
+		return true
+	})
+}
+
+// forgetFileMeta drops the entry of filename, if any.
+func (fm *FileMgr) forgetFileMeta(filename string) {
+	fm.noteMetadata(func(md *FileMetadata) bool {
+		if _, ok := md.Files[filename]; !ok {
+			return false
+		}
+		delete(md.Files, filename)
+		return true
+	})
+}
+
+// updateMetadata applies change to the metadata and, if it reports a
+// change, saves the result. Saves are serialised so that the file always
+// ends up holding the latest metadata. When the sync policy batches syncs,
+// the save is left to the next sync of the dirty files, see flushMetadata,
+// as the data it describes is not durable before then either.
+func (fm *FileMgr) updateMetadata(change func(md *FileMetadata) bool) error {
+	fm.metaMu.Lock()
+	defer fm.metaMu.Unlock()
+
+	fm.statsMu.Lock()
+	if fm.metaData.Files == nil {
+		fm.metaData.Files = make(map[string]FileEntry)
+	}
+	if !change(&fm.metaData) {
+		fm.statsMu.Unlock()
+		return nil
+	}
+	fm.metaData.ModifiedAt = time.Now()
+	data := fm.encodeMetadataLocked()
+	fm.statsMu.Unlock()
+	if fm.dirty != nil {
+		fm.metaPending = true
+		return nil
+	}
+	return fm.saveMetadata(data)
+}
+
+// noteMetadata applies change like updateMetadata, for the file entries,
+// which NewFileMgr rebuilds from the files themselves, see refreshFileMeta.
+// A change is saved with the next save of other metadata, the next sync of
+// the dirty files or Close, rather than rewriting MetadataFile on every
+// Append.
+func (fm *FileMgr) noteMetadata(change func(md *FileMetadata) bool) {
+	fm.metaMu.Lock()
+	defer fm.metaMu.Unlock()
+	fm.statsMu.Lock()
+	defer fm.statsMu.Unlock()
+
+	if fm.metaData.Files == nil {
+		fm.metaData.Files = make(map[string]FileEntry)
+	}
+	if change(&fm.metaData) {
+		fm.metaData.ModifiedAt = time.Now()
+		fm.metaPending = true
+	}
+}
+
+// refreshFileMeta brings the file entries of md up to date with the files
+// on disk, which noteMetadata may not have saved before a crash. Entries of
+// files that are gone are dropped, and data files without one are added.
+func (fm *FileMgr) refreshFileMeta(md *FileMetadata) (changed bool, err error) {
+	if md.Files == nil {
+		md.Files = make(map[string]FileEntry)
+	}
+	names := make(map[string]bool, len(md.Files))
+	for name := range md.Files {
+		names[name] = true
+	}
+	entries, err := os.ReadDir(fm.dbDirectory)
+	if err != nil {
+		return false, fmt.Errorf("failed to list directory %s: %w", fm.dbDirectory, err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && isDataFile(entry.Name()) {
+			names[entry.Name()] = true
+		}
+	}
+	for name := range names {
+		stat, err := os.Stat(filepath.Join(fm.dbDirectory, name))
+		if errors.Is(err, os.ErrNotExist) && fm.logDirectory != "" {
+			stat, err = os.Stat(filepath.Join(fm.logDirectory, name))
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			delete(md.Files, name)
+			changed = true
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to stat file %s: %w", name, err)
+		}
+		var blocks int32
+		if stat.Size() > int64(fm.headerSize) {
+			blocks = int32((stat.Size() - int64(fm.headerSize)) / int64(fm.blocksize))
+		}
+		if e, ok := md.Files[name]; !ok || e.BlockCount != blocks {
+			md.Files[name] = FileEntry{BlockCount: blocks, ModifiedAt: stat.ModTime()}
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// flushMetadata saves metadata changes that updateMetadata or noteMetadata
+// held back.
+func (fm *FileMgr) flushMetadata() error {
+	fm.metaMu.Lock()
+	defer fm.metaMu.Unlock()
+
+	if !fm.metaPending {
+		return nil
+	}
+	fm.statsMu.Lock()
+	data := fm.encodeMetadataLocked()
+	fm.statsMu.Unlock()
+	if err := fm.saveMetadata(data); err != nil {
+		return err
+	}
+	fm.metaPending = false
+	return nil
+}
+
+// saveMetadata replaces MetadataFile with data through replaceFile, so a
+// crash leaves either the old metadata or the new.
+func (fm *FileMgr) saveMetadata(data []byte) error {
+	if err := fm.replaceFile(filepath.Join(fm.dbDirectory, MetadataFile), data); err != nil {
+		return fmt.Errorf("failed to save metadata: %w", err)
+	}
+	return nil
+}
+
+// encodeMetadataLocked serialises the metadata in the current version; the
+// caller must hold fm.statsMu. Files are written in name order, so equal
+// metadata always encodes the same.
+func (fm *FileMgr) encodeMetadataLocked() []byte {
+	md := fm.metaData
+	names := make([]string, 0, len(md.Files))
+	for name := range md.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := make([]byte, 0, len(metadataMagic)+30+len(names)*32)
+	buf = append(buf, metadataMagic...)
+	buf = binary.BigEndian.AppendUint16(buf, metadataVersion)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(md.CreatedAt.UnixNano()))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(md.ModifiedAt.UnixNano()))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(md.SizeLimit))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(names)))
+	for _, name := range names {
+		e := md.Files[name]
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(name)))
+		buf = append(buf, name...)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(e.BlockCount))
+		buf = binary.BigEndian.AppendUint64(buf, uint64(e.ModifiedAt.UnixNano()))
+	}
+
+	names = names[:0]
+	for name := range md.FreeBlocks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(names)))
+	for _, name := range names {
+		free := md.FreeBlocks[name]
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(name)))
+		buf = append(buf, name...)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(free)))
+		for _, blk := range free {
+			buf = binary.BigEndian.AppendUint32(buf, uint32(blk))
+		}
+	}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(md.BlockSize))
+	return buf
+}
+
+// decodeMetadata parses the contents of MetadataFile.
+func decodeMetadata(data []byte) (FileMetadata, error) {
+	var md FileMetadata
+	if len(data) < len(metadataMagic)+2 || string(data[:len(metadataMagic)]) != metadataMagic {
+		return md, fmt.Errorf("not a metadata file")
+	}
+	data = data[len(metadataMagic):]
+	version := binary.BigEndian.Uint16(data)
+	if version < 1 || version > metadataVersion {
+		return md, fmt.Errorf("unsupported metadata version %d", version)
+	}
+	data = data[2:]
+
+	short := errors.New("truncated metadata")
+	if len(data) < 28 {
+		return md, short
+	}
+	md.CreatedAt = time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+	md.ModifiedAt = time.Unix(0, int64(binary.BigEndian.Uint64(data[8:])))
+	md.SizeLimit = int64(binary.BigEndian.Uint64(data[16:]))
+	n := int(binary.BigEndian.Uint32(data[24:]))
+	data = data[28:]
+	md.Files = make(map[string]FileEntry, n)
+	for i := 0; i < n; i++ {
+		if len(data) < 2 {
+			return md, short
+		}
+		nameLen := int(binary.BigEndian.Uint16(data))
+		data = data[2:]
+		if len(data) < nameLen+12 {
+			return md, short
+		}
+		name := string(data[:nameLen])
+		e := FileEntry{
+			BlockCount: int32(binary.BigEndian.Uint32(data[nameLen:])),
+			ModifiedAt: time.Unix(0, int64(binary.BigEndian.Uint64(data[nameLen+4:]))),
+		}
+		data = data[nameLen+12:]
+		md.Files[name] = e
+	}
+	if version < 2 {
+		return md, nil
+	}
+
+	if len(data) < 4 {
+		return md, short
+	}
+	n = int(binary.BigEndian.Uint32(data))
+	data = data[4:]
+	md.FreeBlocks = make(map[string][]int32, n)
+	for i := 0; i < n; i++ {
+		if len(data) < 2 {
+			return md, short
+		}
+		nameLen := int(binary.BigEndian.Uint16(data))
+		data = data[2:]
+		if len(data) < nameLen+4 {
+			return md, short
+		}
+		name := string(data[:nameLen])
+		count := int(binary.BigEndian.Uint32(data[nameLen:]))
+		data = data[nameLen+4:]
+		if len(data) < count*4 {
+			return md, short
+		}
+		free := make([]int32, count)
+		for j := range free {
+			free[j] = int32(binary.BigEndian.Uint32(data[j*4:]))
+		}
+		data = data[count*4:]
+		md.FreeBlocks[name] = free
+	}
+	if version < 3 {
+		return md, nil
+	}
+
+	if len(data) < 4 {
+		return md, short
+	}
+	md.BlockSize = int(binary.BigEndian.Uint32(data))
+	return md, nil
+}
@@ -0,0 +1,87 @@
+package kfile
+
+import (
+	"errors"
+	"os"
+)
+
+// errMmapUnsupported is returned by mmapFile where memory mapping is not
+// available.
+var errMmapUnsupported = errors.New("memory mapping not supported")
+
+// EnableMmap makes Read copy blocks out of a read-only memory mapping of
+// each file rather than issue a read syscall per block. A file is mapped
+// at its current size on its first Read. Blocks past the mapping, such as
+// ones another process appended, are read with a syscall as before, and an
+// operation that grows the file past its mapping, or shrinks it, drops the
+// mapping so that the next Read maps the file afresh. Where mapping is not
+// supported, or fails, Read keeps using syscalls.
+func EnableMmap() FileMgrOption {
+	return func(fm *FileMgr) {
+		fm.useMmap = true
+	}
+}
+
+// mappedBlock returns the mapped bytes of the block at offset in filename,
+// mapping the file first if need be, or nil if the block is not mapped. The
+// caller must hold the file's lock, shared or exclusive, for as long as it
+// uses the bytes.
+func (fm *FileMgr) mappedBlock(filename string, f *os.File, offset int64) []byte {
+	if !fm.useMmap {
+		return nil
+	}
+	fm.mmapMu.Lock()
+	defer fm.mmapMu.Unlock()
+	m, ok := fm.mmaps[filename]
+	if !ok {
+		if fm.mmaps == nil {
+			fm.mmaps = make(map[string][]byte)
+		}
+		// A failed mapping is remembered as nil, so reads do not retry it
+		// until the file changes size.
+		if stat, err := f.Stat(); err == nil && stat.Size() > 0 {
+			m, _ = mmapFile(f, stat.Size())
+		}
+		fm.mmaps[filename] = m
+	}
+	end := offset + int64(fm.blocksize)
+	if end > int64(len(m)) {
+		return nil
+	}
+	return m[offset:end]
+}
+
+// outgrowMmapLocked drops the mapping of filename if the file now reaches
+// size bytes, past its end. The caller must hold the file's lock
+// exclusively.
+func (fm *FileMgr) outgrowMmapLocked(filename string, size int64) {
+	if !fm.useMmap {
+		return
+	}
+	fm.mmapMu.Lock()
+	defer fm.mmapMu.Unlock()
+	if m, ok := fm.mmaps[filename]; ok && int64(len(m)) < size {
+		fm.unmapLocked(filename)
+	}
+}
+
+// dropMmapLocked drops the mapping of filename, if any. The caller must
+// hold the file's lock exclusively, or fm.mutex exclusively.
+func (fm *FileMgr) dropMmapLocked(filename string) {
+	if !fm.useMmap {
+		return
+	}
+	fm.mmapMu.Lock()
+	defer fm.mmapMu.Unlock()
+	fm.unmapLocked(filename)
+}
+
+// unmapLocked unmaps filename and forgets the mapping; the caller must hold
+// fm.mmapMu. Unmapping a mapping made by mmapFile cannot fail short of a
+// bug, so errors are ignored.
+func (fm *FileMgr) unmapLocked(filename string) {
+	if m := fm.mmaps[filename]; m != nil {
+		_ = munmapFile(m)
+	}
+	delete(fm.mmaps, filename)
+}
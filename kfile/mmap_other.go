@@ -0,0 +1,14 @@
+//go:build !unix
+
+package kfile
+
+import "os"
+
+// mmapFile is unsupported on this platform, so Read always uses syscalls.
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func munmapFile(m []byte) error {
+	return nil
+}
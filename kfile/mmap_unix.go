@@ -0,0 +1,19 @@
+//go:build unix
+
+package kfile
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmapFile maps the first size bytes of f read-only. The mapping is shared,
+// so it reflects later writes to the file through any handle.
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	return unix.Mmap(int(f.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+}
+
+func munmapFile(m []byte) error {
+	return unix.Munmap(m)
+}
@@ -0,0 +1,192 @@
+package kfile
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+)
+
+// overflowSuffix ends the names of the files OverflowFile returns.
+const overflowSuffix = ".overflow"
+
+// OverflowFile returns the file holding the overflow blocks of the cells of
+// filename. Keeping them apart means a scan of filename never meets a
+// fragment of some other cell's value.
+func OverflowFile(filename string) string {
+	return filename + overflowSuffix
+}
+
+// IsOverflowFile reports whether filename is named like a file returned by
+// OverflowFile.
+func IsOverflowFile(filename string) bool {
+	return strings.HasSuffix(filename, overflowSuffix)
+}
+
+// OverflowReader calls use with the page of block blk of an overflow file,
+// for the duration of the call.
+type OverflowReader func(blk int32, use func(*SlottedPage) error) error
+
+// SetOverflowReader makes GetCell, GetCellBySlot, FindCell and ScanRange
+// return an overflowing cell with its value in full, read back through read
+// from the overflow file of the page's own file, and without FlagOverflow.
+// The BufferMgr sets it on every page it pins. A nil read returns such cells
+// as stored.
+func (sp *SlottedPage) SetOverflowReader(read OverflowReader) {
+	sp.readOverflow = read
+}
+
+// resolveOverflow returns cell with its value read back in full, if it
+// overflows and the page has an overflow reader, and cell itself otherwise.
+func (sp *SlottedPage) resolveOverflow(cell *Cell) (*Cell, error) {
+	if sp.readOverflow == nil || !cell.HasOverflow() {
+		return cell, nil
+	}
+	value := slices.Clone(cell.value)
+	err := walkOverflow(cell, sp.readOverflow, func(_ int32, frag *Cell) {
+		value = append(value, frag.value...)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read overflow of cell %q: %w", cell.key, err)
+	}
+	cell.value = value
+	cell.valueSize = len(value)
+	cell.flags &^= FlagOverflow
+	cell.pageId = 0
+	return cell, nil
+}
+
+// OverflowSpill is a KV cell split by SpillCell: Inline goes into the page,
+// holding the start of the value, and each of Fragments into an overflow
+// block of its own, holding the rest in chain order.
+type OverflowSpill struct {
+	Inline    *Cell
+	Fragments []*Cell
+}
+
+// Chain points Inline at the first of blks and each fragment but the last at
+// the block after its own. blks holds one block of the overflow file per
+// fragment, in order.
+func (s *OverflowSpill) Chain(blks []int32) {
+	s.Inline.pageId = uint64(blks[0])
+	for i, frag := range s.Fragments[:len(s.Fragments)-1] {
+		frag.flags |= FlagOverflow
+		frag.pageId = uint64(blks[i+1])
+	}
+}
+
+// SpillCell splits cell, a KV cell that does not fit in the page, so that
+// its Inline part fills the page's free space and the rest of its value is
+// spread over Fragments, each as large as a block allows. A positive limit
+// further caps the encoded size of every piece, so that a caller can keep
+// the log record of each within a log page. The cell keeps its flags and
+// timestamps, so stamp it first. Nothing is written: the caller places the
+// fragments, links the pieces with Chain and inserts Inline with
+// RestoreCell, logging each step as it goes. Deleting the cell leaves its
+// fragments in place, since undoing the delete needs them. It fails with an
+// error wrapping ErrPageFull if not even the start of the value fits.
+func (sp *SlottedPage) SpillCell(cell *Cell, limit int) (*OverflowSpill, error) {
+	if cell.cellType != CellTypeKV {
+		return nil, fmt.Errorf("%w: only KV cells can overflow", ErrPageFull)
+	}
+	// Measure the cell without its value, but with the size field of the
+	// full value, which is at least as long as any fragment's.
+	inline := *cell
+	inline.flags |= FlagOverflow
+	inline.value = nil
+	room := sp.gap() - slotPointerSize - slotEntrySize - len(inline.ToBytes())
+	if limit > 0 {
+		room = min(room, limit-len(inline.ToBytes()))
+	}
+	if room < 0 || len(cell.value) == 0 {
+		return nil, fmt.Errorf("%w: cell %q does not fit even without its value", ErrPageFull, cell.key)
+	}
+	n := min(room, len(cell.value)-1)
+	inline.value = cell.value[:n]
+	inline.valueSize = n
+
+	probe := NewKVCell(cell.key)
+	probe.flags |= FlagOverflow
+	probe.valueSize = len(sp.data)
+	per := MaxCellSize(len(sp.data)) - len(probe.ToBytes())
+	if limit > 0 {
+		per = min(per, limit-len(probe.ToBytes()))
+	}
+	if per <= 0 {
+		return nil, fmt.Errorf("%w: key of %d bytes leaves no room for overflow", ErrPageFull, len(cell.key))
+	}
+	spill := &OverflowSpill{Inline: &inline}
+	for rest := cell.value[n:]; len(rest) > 0; rest = rest[min(per, len(rest)):] {
+		frag := NewKVCell(cell.key)
+		if err := frag.SetValue(slices.Clone(rest[:min(per, len(rest))])); err != nil {
+			return nil, err
+		}
+		spill.Fragments = append(spill.Fragments, frag)
+	}
+	return spill, nil
+}
+
+// FreeOverflow frees the overflow blocks of cell, a cell of filename as
+// stored, with FreeBlock. It reads the chain from disk, so use it once the
+// delete of the cell is committed and its blocks are out of the buffer
+// pool. A cell without overflow has none.
+func (fm *FileMgr) FreeOverflow(filename string, cell *Cell) error {
+	if !cell.HasOverflow() {
+		return nil
+	}
+	file := OverflowFile(filename)
+	length, err := fm.Length(file)
+	if err != nil {
+		return err
+	}
+	page := NewSlottedPage(fm.blocksize)
+	read := func(blk int32, use func(*SlottedPage) error) error {
+		if blk >= length {
+			return fmt.Errorf("corrupt overflow chain at block %d", blk)
+		}
+		if err := fm.Read(NewBlockId(file, blk), page); err != nil {
+			return err
+		}
+		return use(page)
+	}
+	var chain []int32
+	err = walkOverflow(cell, read, func(blk int32, _ *Cell) {
+		chain = append(chain, blk)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read overflow of cell %q: %w", cell.key, err)
+	}
+	for _, blk := range chain {
+		if err := fm.FreeBlock(NewBlockId(file, blk)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkOverflow reads the overflow chain of cell through read, passing each
+// block number and the fragment cell it holds to visit in order. A chain
+// that comes back to a block it has passed is reported as corrupt.
+func walkOverflow(cell *Cell, read OverflowReader, visit func(blk int32, frag *Cell)) error {
+	seen := make(map[uint64]bool)
+	for next := cell; next.HasOverflow(); {
+		if seen[next.pageId] || next.pageId > math.MaxInt32 {
+			return fmt.Errorf("corrupt overflow chain at block %d", next.pageId)
+		}
+		seen[next.pageId] = true
+		blk := int32(next.pageId)
+		err := read(blk, func(page *SlottedPage) error {
+			frag, err := page.StoredCellBySlot(0)
+			if err != nil {
+				return err
+			}
+			visit(blk, frag)
+			next = frag
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package kfile
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ReadBlocks reads count blocks of filename starting at block start with a
+// single ReadAt, and returns one page per block in order. A range running
+// past the end of the file is cut short, so fewer pages than requested, or
+// none, come back without error. As with Read, the pages hold the raw block
+// contents, and under WithChecksumVerification a block failing its checksum
+// fails the call with a *ChecksumError.
+func (fm *FileMgr) ReadBlocks(filename string, start, count int) ([]*SlottedPage, error) {
+	if start < 0 || count < 0 {
+		return nil, fmt.Errorf("%w: range of %d blocks from %d in %s", ErrInvalidBlock, count, start, filename)
+	}
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+	fl := fm.fileLock(filename)
+	fl.RLock()
+	defer fl.RUnlock()
+
+	if fm.closed {
+		return nil, ErrClosed
+	}
+	length, err := fm.LengthLocked(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine length for file %s: %w", filename, err)
+	}
+	count = min(count, int(length)-start)
+	if count <= 0 {
+		return nil, nil
+	}
+	f, err := fm.getFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file %s: %w", filename, err)
+	}
+	offset, err := fm.blockOffset(int32(start))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blocks of %s: %w", filename, err)
+	}
+
+	buf := fm.ioBuffer(count * fm.blocksize)
+	began := time.Now()
+	bytesRead, err := fm.fileReadAt(f, buf, offset)
+	elapsed := time.Since(began)
+	if err != nil && (bytesRead == 0 || !errors.Is(err, io.EOF)) {
+		return nil, fmt.Errorf("failed to read blocks %d-%d of %s: %w", start, start+count-1, filename, err)
+	}
+	// A file that shrank since its length was taken leaves a short read;
+	// keep only the whole blocks.
+	count = bytesRead / fm.blocksize
+
+	pages := make([]*SlottedPage, count)
+	for i := range pages {
+		p := NewSlottedPage(fm.blocksize)
+		copy(p.Contents(), buf[i*fm.blocksize:(i+1)*fm.blocksize])
+		if fm.checksums {
+			if err := verifyBlock(NewBlockId(filename, int32(start+i)), p); err != nil {
+				return nil, err
+			}
+		}
+		pages[i] = p
+	}
+
+	fm.fileStats.counters(filename).read.Add(int64(len(pages)))
+	fm.latency.read.observe(elapsed)
+	fm.statsMu.Lock()
+	defer fm.statsMu.Unlock()
+	for i := range pages {
+		fm.blocksRead++
+		fm.addToReadLog(ReadWriteLogEntry{
+			Timestamp:   time.Now(),
+			BlockId:     NewBlockId(filename, int32(start+i)),
+			BytesAmount: fm.blocksize,
+			Elapsed:     elapsed,
+		})
+	}
+	return pages, nil
+}
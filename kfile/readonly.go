@@ -0,0 +1,20 @@
+package kfile
+
+import "errors"
+
+// ErrReadOnly is returned by every operation that would modify a database
+// opened with WithReadOnly.
+var ErrReadOnly = errors.New("file manager is read-only")
+
+// WithReadOnly opens an existing database directory without any means of
+// changing it, for inspection and backup tools. Files are opened O_RDONLY,
+// and Write, WriteBlocks, Append, Allocate, PreallocateFile, RenameFile,
+// DeleteFile and SaveCompressionDict fail with ErrReadOnly. Leftover
+// temporary files are kept, an interrupted atomic write is left unrepaired,
+// and a missing directory or file is an error rather than being created.
+// Reads and statistics work as usual.
+func WithReadOnly() FileMgrOption {
+	return func(fm *FileMgr) {
+		fm.readOnly = true
+	}
+}
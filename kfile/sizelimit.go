@@ -0,0 +1,77 @@
+package kfile
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrSizeLimitExceeded is returned, wrapped in a *SizeLimitError, by an
+// operation that would grow a file past the size limit set by SetSizeLimit.
+var ErrSizeLimitExceeded = errors.New("size limit exceeded")
+
+// SizeLimitError reports a file that an operation would have grown to Size
+// bytes, past the size limit of Limit bytes. It unwraps to
+// ErrSizeLimitExceeded.
+type SizeLimitError struct {
+	Filename string
+	Size     int64
+	Limit    int64
+}
+
+func (e *SizeLimitError) Error() string {
+	return fmt.Sprintf("%v: %s would grow to %d bytes, past the limit of %d", ErrSizeLimitExceeded, e.Filename, e.Size, e.Limit)
+}
+
+func (e *SizeLimitError) Unwrap() error {
+	return ErrSizeLimitExceeded
+}
+
+// SetSizeLimit caps the size in bytes, superblock included, to which Append,
+// PreallocateFile and Write may grow any one file, and saves the limit with
+// the metadata. A limit of zero or less removes the cap. Files already past
+// a new limit are left as they are, but cannot grow further.
+func (fm *FileMgr) SetSizeLimit(bytes int64) error {
+	if fm.readOnly {
+		return ErrReadOnly
+	}
+	return fm.updateMetadata(func(md *FileMetadata) bool {
+		if md.SizeLimit == bytes {
+			return false
+		}
+		md.SizeLimit = bytes
+		return true
+	})
+}
+
+// checkSizeLimit fails with a *SizeLimitError if filename may not grow to
+// size bytes. The caller must hold the file's lock until the growth is done,
+// so that concurrent appends cannot each pass the check and together
+// overshoot the limit.
+func (fm *FileMgr) checkSizeLimit(filename string, size int64) error {
+	fm.statsMu.Lock()
+	limit := fm.metaData.SizeLimit
+	fm.statsMu.Unlock()
+	if limit > 0 && size > limit {
+		return &SizeLimitError{Filename: filename, Size: size, Limit: limit}
+	}
+	return nil
+}
+
+// checkWriteLimitLocked is checkSizeLimit for a write of the blocks of
+// filename up to last, which grows the file only if last is past its end;
+// rewriting blocks the file already has is allowed whatever the limit. The
+// caller must hold the file's lock.
+func (fm *FileMgr) checkWriteLimitLocked(filename string, last int32) error {
+	err := fm.checkSizeLimit(filename, int64(fm.headerSize)+(int64(last)+1)*int64(fm.blocksize))
+	if err == nil {
+		return nil
+	}
+	length, lerr := fm.LengthLocked(filename)
+	if lerr != nil {
+		return fmt.Errorf("failed to determine length for file %s: %w", filename, lerr)
+	}
+	if last < length {
+		return nil
+	}
+	return err
+}
@@ -2,7 +2,11 @@ package kfile
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"time"
 )
 
 // Header field offsets (in bytes)
@@ -11,18 +15,59 @@ const (
 	headerSizeOffset = 4  // Header size stored at offset 4
 	cellCountOffset  = 8  // Number of cells stored at offset 8
 	freeSpaceOffset  = 12 // Free space pointer stored at offset 12
+	checksumOffset   = 16 // CRC32 of the page stored at offset 16
+	pageFlagsOffset  = 20 // Page flags stored at offset 20
 	PageHeaderSize   = 24 // Fixed header size (may include additional metadata)
 	DefaultPageSize  = 8196
-	slotPointerSize  = 4 // Size reserved for a slot pointer (used in cell offset calculations)
+	slotPointerSize  = 4 // Size of the length prefix stored ahead of each cell
+	slotEntrySize    = 4 // Size of one slot directory entry
+
+	// pageFlagChecksummed marks a page whose checksum field is valid.
+	pageFlagChecksummed = 1
+	// pageFlagCastagnoli marks a checksum computed with CRC32C; pages
+	// checksummed before it was introduced use the IEEE polynomial.
+	pageFlagCastagnoli = 2
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	// ErrKeyNotFound is returned when a lookup finds no cell with the given key.
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrPageFull is returned when a cell does not fit in the page's free space.
+	ErrPageFull = errors.New("not enough space")
+	// ErrEmptyKey is returned when inserting a cell with a zero-length key.
+	// Keys order the slot directory, so every cell needs one; values, on the
+	// other hand, may be empty.
+	ErrEmptyKey = errors.New("empty key")
+	// ErrChecksumMismatch is returned when a page's contents do not match
+	// the checksum stored in its header.
+	ErrChecksumMismatch = errors.New("page checksum mismatch")
+	// ErrNotSorted is returned by BulkInsert when its cells are not in
+	// strictly increasing key order after the page's own.
+	ErrNotSorted = errors.New("cells not in key order")
 )
 
-// SlottedPage represents a page with a slotted structure
+// SlottedPage represents a page with a slotted structure. The page is
+// self-describing: the fixed header is followed by the slot directory, one
+// slotEntrySize offset per live cell in key order, and the cells are packed
+// down from the end of the page, each behind a length prefix. The header
+// size field covers the header and the directory, so the gap between it and
+// the free space pointer is the unused space. A page filled by FileMgr.Read
+// can therefore be searched at once, with no rebuild step.
+//
+// An all-zero page, as read from a freshly appended block, reads as an empty
+// page; its header is written by the first insertion.
 type SlottedPage struct {
-	*Page            // Embeds the underlying Page
-	headerSize int   // Fixed header size (including slot array)
-	cellCount  int   // Number of cells in the page
-	freeSpace  int   // Offset where free space begins
-	slots      []int // Array of offsets to cells (sorted by key)
+	*Page // Embeds the underlying Page
+
+	// now stamps inserted and updated cells; nil leaves them unstamped.
+	now func() time.Time
+	// onCompact receives the statistics of each Compact; nil ignores them.
+	onCompact func(CompactionStats)
+	// readOverflow reads overflow blocks for GetCell and FindCell; nil
+	// leaves overflowing cells as stored, see SetOverflowReader.
+	readOverflow OverflowReader
 }
 
 func NewSlottedPage(pageSize int) *SlottedPage {
@@ -30,87 +75,227 @@ func NewSlottedPage(pageSize int) *SlottedPage {
 		pageSize = DefaultPageSize
 	}
 
-	sp := &SlottedPage{
-		Page:       NewPage(pageSize),
-		headerSize: PageHeaderSize,
-		freeSpace:  pageSize,
-		slots:      make([]int, 0),
-	}
-
-	// Initialize header fields.
-	if err := sp.SetInt(pageSizeOffset, pageSize); err != nil {
+	sp := &SlottedPage{Page: NewPage(pageSize)}
+	if pageSize < PageHeaderSize {
 		return nil
 	}
-	if err := sp.SetInt(headerSizeOffset, PageHeaderSize); err != nil {
-		return nil
-	}
-	if err := sp.SetInt(cellCountOffset, 0); err != nil {
-		return nil
-	}
-	if err := sp.SetInt(freeSpaceOffset, pageSize); err != nil {
-		return nil
-	}
-
+	initHeader(sp.data)
 	return sp
 }
 
+// initHeader writes the header of an empty page over the start of data.
+func initHeader(data []byte) {
+	binary.BigEndian.PutUint32(data[pageSizeOffset:], uint32(len(data)))
+	binary.BigEndian.PutUint32(data[headerSizeOffset:], PageHeaderSize)
+	binary.BigEndian.PutUint32(data[cellCountOffset:], 0)
+	binary.BigEndian.PutUint32(data[freeSpaceOffset:], uint32(len(data)))
+}
+
+// isBlankLocked reports whether data has no header yet. The caller must
+// hold sp.mu.
+func (sp *SlottedPage) isBlankLocked() bool {
+	return binary.BigEndian.Uint32(sp.data[pageSizeOffset:]) == 0 &&
+		binary.BigEndian.Uint32(sp.data[freeSpaceOffset:]) == 0
+}
+
+// headerField reads the header field at offset.
+func (sp *SlottedPage) headerField(offset int) int {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	return int(binary.BigEndian.Uint32(sp.data[offset:]))
+}
+
+// numSlots returns the number of live cells, and so of directory entries.
+func (sp *SlottedPage) numSlots() int {
+	return sp.headerField(cellCountOffset)
+}
+
+// slot returns the offset of the cell in directory entry i.
+func (sp *SlottedPage) slot(i int) int {
+	return sp.headerField(PageHeaderSize + i*slotEntrySize)
+}
+
+// headerSize returns the size of the header and the slot directory.
+func (sp *SlottedPage) headerSize() int {
+	return PageHeaderSize + sp.numSlots()*slotEntrySize
+}
+
 // GetFreeSpace returns the current free space pointer.
 func (sp *SlottedPage) GetFreeSpace() int {
-	return sp.freeSpace
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	if sp.isBlankLocked() {
+		return len(sp.data)
+	}
+	return int(binary.BigEndian.Uint32(sp.data[freeSpaceOffset:]))
 }
 
+// gap returns the unused bytes between the slot directory and the cells.
+func (sp *SlottedPage) gap() int {
+	return sp.GetFreeSpace() - sp.headerSize()
+}
+
+// GetUsedSpace returns the bytes taken by the header, the slot directory
+// and the live cells, each with its length prefix. Space left behind by
+// deleted cells is not counted, since Compact gives it back.
+func (sp *SlottedPage) GetUsedSpace() int {
+	return sp.headerSize() + sp.cellsTotalSize()
+}
+
+// Available returns the bytes left for new cells, their length prefixes and
+// their slot directory entries.
+// It shadows Page.Available, whose call to GetUsedSpace would not reach the
+// SlottedPage method.
+func (sp *SlottedPage) Available() int {
+	return sp.Size() - sp.GetUsedSpace()
+}
+
+// MaxCellSize returns the most bytes a cell may encode to and still fit in
+// an empty slotted page of pageSize bytes.
+func MaxCellSize(pageSize int) int {
+	return pageSize - PageHeaderSize - slotEntrySize - slotPointerSize
+}
+
+// HasRoomFor reports whether cell can be inserted without compaction.
+func (sp *SlottedPage) HasRoomFor(cell *Cell) bool {
+	return sp.gap() >= len(cell.ToBytes())+slotPointerSize+slotEntrySize
+}
+
+// HasRoomAfterCompact reports whether cell can be inserted once Compact has
+// given back the space of deleted cells.
+func (sp *SlottedPage) HasRoomAfterCompact(cell *Cell) bool {
+	return sp.Available() >= len(cell.ToBytes())+slotPointerSize+slotEntrySize
+}
+
+// EnableTimestamps makes InsertCell and UpdateCell record created-at and
+// modified-at times on each cell, read from now. A nil now uses time.Now.
+// Cells inserted before the call, and pages read back without it, keep
+// whatever timestamps they already carry.
+func (sp *SlottedPage) EnableTimestamps(now func() time.Time) {
+	if now == nil {
+		now = time.Now
+	}
+	sp.now = now
+}
+
+// DisableTimestamps undoes EnableTimestamps: cells inserted and updated
+// afterwards are left unstamped.
+func (sp *SlottedPage) DisableTimestamps() {
+	sp.now = nil
+}
+
+// StampCell gives cell the created-at and modified-at times InsertCell
+// would, when timestamps are enabled, so that a caller logging the cell
+// before inserting it with RestoreCell logs it as it will be stored.
+func (sp *SlottedPage) StampCell(cell *Cell) {
+	if sp.now != nil {
+		t := sp.now()
+		cell.setTimestamps(t, t)
+	}
+}
+
+// InsertCell inserts cell in key order, stamping it when timestamps are
+// enabled. It fails with an error wrapping ErrPageFull if the cell does not
+// fit between the slot directory and the cells; space left behind by
+// deleted cells only becomes free again through Compact.
 func (sp *SlottedPage) InsertCell(cell *Cell) error {
+	sp.StampCell(cell)
+	return sp.insertCell(cell)
+}
+
+// RestoreCell inserts cell exactly as given, keeping its type, its flags and
+// any timestamps it carries, even when timestamps are enabled. Undo and redo
+// use it to put back a logged cell image, and inserts that log the cell
+// first use it after StampCell.
+func (sp *SlottedPage) RestoreCell(cell *Cell) error {
+	return sp.insertCell(cell)
+}
+
+// insertCell stores cell as is, without stamping it.
+func (sp *SlottedPage) insertCell(cell *Cell) error {
+	if len(cell.key) == 0 {
+		return ErrEmptyKey
+	}
 	cellBytes := cell.ToBytes()
 	cellSize := len(cellBytes)
+	// Each cell is stored behind a length prefix and needs a directory
+	// entry, neither of which may spill into the other.
+	needed := cellSize + slotPointerSize + slotEntrySize
 
-	// Ensure there is enough free space (header is reserved at the beginning).
-	usableSpace := sp.freeSpace - sp.headerSize
-	if usableSpace < cellSize {
-		return fmt.Errorf("not enough space: need %d bytes but only %d bytes available", cellSize, usableSpace)
+	// Space left behind by deleted cells is only reclaimed by Compact.
+	if usableSpace := sp.gap(); usableSpace < needed {
+		return fmt.Errorf("%w: need %d bytes but only %d bytes available", ErrPageFull, needed, usableSpace)
 	}
 
 	// Check if the cell itself fits within the available free space.
-	if !cell.FitsInPage(sp.freeSpace) {
+	freeSpace := sp.GetFreeSpace()
+	if !cell.FitsInPage(freeSpace) {
 		return fmt.Errorf("cell too large for remaining page space")
 	}
 
-	// Calculate the new cell offset.
-	// Reserve extra space (slotPointerSize bytes) for internal bookkeeping if needed.
-	newOffset := sp.freeSpace - cellSize - slotPointerSize
-
-	// Write the cell data to the underlying page.
+	// The cell goes just below the lowest one, behind its length prefix.
+	newOffset := freeSpace - cellSize - slotPointerSize
 	if err := sp.SetBytes(newOffset, cellBytes); err != nil {
 		return fmt.Errorf("failed to write cell bytes: %w", err)
 	}
 
-	// Find the insertion index for the cell in the sorted slot array.
+	// Open a directory entry at the cell's position in key order.
 	insertPos := sp.FindSlotPosition(cell.key)
+	count := sp.numSlots()
 
-	// AllocateBufferForBlock new cell offset into the slot array.
-	sp.slots = append(sp.slots, 0)                     // Grow slice by one.
-	copy(sp.slots[insertPos+1:], sp.slots[insertPos:]) // Shift slots to the right.
-	sp.slots[insertPos] = newOffset
-
-	// Update page header values.
-	sp.cellCount++
-	sp.freeSpace = newOffset
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.isBlankLocked() {
+		initHeader(sp.data)
+	}
+	entry := PageHeaderSize + insertPos*slotEntrySize
+	end := PageHeaderSize + count*slotEntrySize
+	copy(sp.data[entry+slotEntrySize:end+slotEntrySize], sp.data[entry:end])
+	binary.BigEndian.PutUint32(sp.data[entry:], uint32(newOffset))
+	sp.setCountLocked(count + 1)
+	binary.BigEndian.PutUint32(sp.data[freeSpaceOffset:], uint32(newOffset))
+	sp.setIsDirty(true)
+	return nil
+}
 
-	if err := sp.SetInt(cellCountOffset, sp.cellCount); err != nil {
-		return fmt.Errorf("failed to update cell count: %w", err)
+// reclaim compacts the page when fewer than needed bytes lie between the
+// slot directory and the cells but deleted cells have left space behind.
+func (sp *SlottedPage) reclaim(needed int) error {
+	if sp.gap() >= needed || sp.cellsTotalSize() >= sp.Size()-sp.GetFreeSpace() {
+		return nil
 	}
-	if err := sp.SetInt(freeSpaceOffset, sp.freeSpace); err != nil {
-		return fmt.Errorf("failed to update free space pointer: %w", err)
+	if err := sp.Compact(); err != nil {
+		return fmt.Errorf("failed to compact page: %w", err)
 	}
-
 	return nil
 }
 
+// setCountLocked records count live cells in the header, sizing the slot
+// directory to match. The caller must hold sp.mu.
+func (sp *SlottedPage) setCountLocked(count int) {
+	binary.BigEndian.PutUint32(sp.data[cellCountOffset:], uint32(count))
+	binary.BigEndian.PutUint32(sp.data[headerSizeOffset:], uint32(PageHeaderSize+count*slotEntrySize))
+}
+
+// cellsTotalSize returns the bytes occupied by live cells, including their
+// length prefixes.
+func (sp *SlottedPage) cellsTotalSize() int {
+	total := 0
+	for _, offset := range sp.GetAllSlots() {
+		if n, err := sp.GetInt(offset); err == nil {
+			total += n + slotPointerSize
+		}
+	}
+	return total
+}
+
 // FindSlotPosition returns the insertion index for a new cell (by key) using binary search.
 func (sp *SlottedPage) FindSlotPosition(key []byte) int {
-	low, high := 0, len(sp.slots)-1
+	sp.assertSorted()
+	low, high := 0, sp.numSlots()-1
 	for low <= high {
 		mid := (low + high) / 2
-		cell, err := sp.GetCell(sp.slots[mid])
+		cell, err := sp.getCell(sp.slot(mid))
 		if err != nil {
 			// In case of error reading the cell, default to inserting at the beginning.
 			return low
@@ -127,8 +312,20 @@ func (sp *SlottedPage) FindSlotPosition(key []byte) int {
 	return low
 }
 
-// GetCell retrieves the cell stored at the specified offset.
+// GetCell retrieves the cell stored at the specified offset. An overflowing
+// cell comes back with its value in full if the page has an overflow
+// reader.
 func (sp *SlottedPage) GetCell(offset int) (*Cell, error) {
+	cell, err := sp.getCell(offset)
+	if err != nil {
+		return nil, err
+	}
+	return sp.resolveOverflow(cell)
+}
+
+// getCell decodes the cell stored at offset as it is, without following an
+// overflow chain.
+func (sp *SlottedPage) getCell(offset int) (*Cell, error) {
 	cellBytes, err := sp.GetBytes(offset)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get cell bytes at offset %d: %w", offset, err)
@@ -138,41 +335,199 @@ func (sp *SlottedPage) GetCell(offset int) (*Cell, error) {
 
 // GetCellBySlot retrieves the cell at the given slot index.
 func (sp *SlottedPage) GetCellBySlot(slot int) (*Cell, error) {
-	if slot < 0 || slot >= len(sp.slots) {
+	if slot < 0 || slot >= sp.numSlots() {
 		return nil, fmt.Errorf("invalid slot index: %d", slot)
 	}
-	return sp.GetCell(sp.slots[slot])
+	return sp.GetCell(sp.slot(slot))
 }
 
-// DeleteCell marks the cell at the given slot as deleted and removes its slot entry.
+// StoredCellBySlot retrieves the cell at the given slot index as the page
+// stores it: an overflowing cell keeps FlagOverflow and only the start of
+// its value. Logging and undo, which deal in page images, use it.
+func (sp *SlottedPage) StoredCellBySlot(slot int) (*Cell, error) {
+	if slot < 0 || slot >= sp.numSlots() {
+		return nil, fmt.Errorf("invalid slot index: %d", slot)
+	}
+	return sp.getCell(sp.slot(slot))
+}
+
+// DeleteCell marks the cell at the given slot as deleted and removes its
+// directory entry.
 func (sp *SlottedPage) DeleteCell(slot int) error {
-	if slot < 0 || slot >= len(sp.slots) {
+	count := sp.numSlots()
+	if slot < 0 || slot >= count {
 		return fmt.Errorf("invalid slot index: %d", slot)
 	}
 
-	cell, err := sp.GetCell(sp.slots[slot])
+	cellOffset := sp.slot(slot)
+	cell, err := sp.getCell(cellOffset)
 	if err != nil {
 		return fmt.Errorf("failed to get cell for deletion: %w", err)
 	}
 	cell.MarkDeleted()
 
-	// Remove the slot from the sorted slot array.
-	sp.slots = append(sp.slots[:slot], sp.slots[slot+1:]...)
-	sp.cellCount--
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	// Persist the flag as well, so a scan of the cell region does not bring
+	// the cell back.
+	sp.data[cellOffset+slotPointerSize] |= FlagDeleted
+	entry := PageHeaderSize + slot*slotEntrySize
+	end := PageHeaderSize + count*slotEntrySize
+	copy(sp.data[entry:], sp.data[entry+slotEntrySize:end])
+	clear(sp.data[end-slotEntrySize : end])
+	sp.setCountLocked(count - 1)
+	sp.setIsDirty(true)
+	return nil
+}
+
+// UpdateCell replaces the value of the cell with the given key, as
+// UpdateCellBySlot does.
+func (sp *SlottedPage) UpdateCell(key []byte, val any) error {
+	_, slot, err := sp.FindStoredCell(key)
+	if err != nil {
+		return err
+	}
+	return sp.UpdateCellBySlot(slot, val)
+}
+
+// UpdateCellBySlot replaces the value of the cell at slot. When timestamps
+// are enabled the cell keeps its created-at time and its modified-at time is
+// advanced. An updated cell no larger than the stored one is overwritten
+// where it is, its stored length and slot unchanged, and any bytes it no
+// longer needs are zeroed until the page is next compacted; a larger one is
+// deleted and inserted again, which keeps the slots in key order since the
+// key does not change. If the larger cell does not fit, the old one is put
+// back and an error wrapping ErrPageFull is returned. The cell keeps its size
+// encoding; key cells, which hold no value, and cells whose value continues
+// in overflow blocks are refused.
+func (sp *SlottedPage) UpdateCellBySlot(slot int, val any) error {
+	old, err := sp.StoredCellBySlot(slot)
+	if err != nil {
+		return err
+	}
+	if old.cellType != CellTypeKV {
+		return fmt.Errorf("cannot update the value of key cell %q", old.key)
+	}
+	if old.HasOverflow() {
+		return fmt.Errorf("cannot update cell %q in place: its value continues in overflow blocks", old.key)
+	}
+
+	cell := NewKVCell(old.key)
+	if old.HasVarintSizes() {
+		cell.UseVarintSizes()
+	}
+	if err := cell.SetValue(val); err != nil {
+		return err
+	}
+	if sp.now != nil {
+		t := sp.now()
+		created := t
+		if old.HasTimestamps() {
+			created = old.CreatedAt()
+		}
+		cell.setTimestamps(created, t)
+	}
+
+	// A cell's bytes are read by its decoder, not by its stored length, so
+	// a shorter cell can sit in the space of the old one.
+	cellBytes := cell.ToBytes()
+	offset := sp.slot(slot)
+	stored, err := sp.GetInt(offset)
+	if err != nil {
+		return fmt.Errorf("failed to read stored cell length: %w", err)
+	}
+	if len(cellBytes) <= stored {
+		sp.mu.Lock()
+		defer sp.mu.Unlock()
+		start := offset + slotPointerSize
+		copy(sp.data[start:], cellBytes)
+		clear(sp.data[start+len(cellBytes) : start+stored])
+		sp.setIsDirty(true)
+		return nil
+	}
 
-	if err := sp.SetInt(cellCountOffset, sp.cellCount); err != nil {
-		return fmt.Errorf("failed to update cell count after deletion: %w", err)
+	if err := sp.DeleteCell(slot); err != nil {
+		return fmt.Errorf("failed to remove old cell: %w", err)
+	}
+	if err := sp.reclaim(len(cellBytes) + slotPointerSize + slotEntrySize); err != nil {
+		return err
+	}
+	if err := sp.insertCell(cell); err != nil {
+		if restoreErr := sp.insertCell(old); restoreErr != nil {
+			return fmt.Errorf("failed to insert updated cell: %w (and failed to restore old cell: %v)", err, restoreErr)
+		}
+		return fmt.Errorf("failed to insert updated cell: %w", err)
 	}
 	return nil
 }
 
+// ModifiedSince returns the cells, in key order, whose modified-at time is at
+// or after t. Cells without timestamps are never returned.
+func (sp *SlottedPage) ModifiedSince(t time.Time) []*Cell {
+	var cells []*Cell
+	for _, offset := range sp.GetAllSlots() {
+		cell, err := sp.GetCell(offset)
+		if err != nil || !cell.HasTimestamps() {
+			continue
+		}
+		if !cell.ModifiedAt().Before(t) {
+			cells = append(cells, cell)
+		}
+	}
+	return cells
+}
+
+// ApplyDelta overwrites len(newBytes) bytes of the value of the cell at slot,
+// starting offsetWithinCell bytes into the value, leaving the rest of the
+// cell untouched. It is meant for redo and undo of delta-encoded log records,
+// so the range must lie entirely within the existing value.
+func (sp *SlottedPage) ApplyDelta(slot int, offsetWithinCell int, newBytes []byte) error {
+	cell, err := sp.StoredCellBySlot(slot)
+	if err != nil {
+		return fmt.Errorf("failed to get cell for delta: %w", err)
+	}
+	if cell.cellType != CellTypeKV {
+		return fmt.Errorf("cannot apply delta to a key cell at slot %d", slot)
+	}
+	if offsetWithinCell < 0 || offsetWithinCell+len(newBytes) > cell.valueSize {
+		return fmt.Errorf("%s: delta [%d, %d) outside value of %d bytes",
+			ErrOutOfBounds, offsetWithinCell, offsetWithinCell+len(newBytes), cell.valueSize)
+	}
+
+	// Stored layout: length prefix, header byte, key size, value size,
+	// value type, optional timestamps, key, value.
+	valueStart := sp.slot(slot) + slotPointerSize + cell.keyOffset() + cell.keySize
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	copy(sp.data[valueStart+offsetWithinCell:], newBytes)
+	sp.setIsDirty(true)
+	return nil
+}
+
 // FindCell performs a binary search for a cell by key.
-// Returns the cell, its slot index, or an error if not found.
+// Returns the cell, its slot index, or an error if not found. Like GetCell it
+// returns an overflowing cell with its value in full if the page has an
+// overflow reader.
 func (sp *SlottedPage) FindCell(key []byte) (*Cell, int, error) {
-	low, high := 0, len(sp.slots)-1
+	cell, slot, err := sp.FindStoredCell(key)
+	if err != nil {
+		return nil, -1, err
+	}
+	if cell, err = sp.resolveOverflow(cell); err != nil {
+		return nil, -1, err
+	}
+	return cell, slot, nil
+}
+
+// FindStoredCell is FindCell returning the cell as the page stores it, like
+// StoredCellBySlot.
+func (sp *SlottedPage) FindStoredCell(key []byte) (*Cell, int, error) {
+	sp.assertSorted()
+	low, high := 0, sp.numSlots()-1
 	for low <= high {
 		mid := (low + high) / 2
-		cell, err := sp.GetCell(sp.slots[mid])
+		cell, err := sp.getCell(sp.slot(mid))
 		if err != nil {
 			return nil, -1, fmt.Errorf("failed to retrieve cell at slot %d: %w", mid, err)
 		}
@@ -185,10 +540,88 @@ func (sp *SlottedPage) FindCell(key []byte) (*Cell, int, error) {
 			low = mid + 1
 		}
 	}
-	return nil, -1, fmt.Errorf("key not found")
+	return nil, -1, ErrKeyNotFound
+}
+
+// Scan returns the live cells whose keys lie between low and high, both
+// included, in key order. It is ScanRange with inclusive bounds.
+func (sp *SlottedPage) Scan(low, high []byte) ([]*Cell, error) {
+	return sp.ScanRange(low, high, true, true)
+}
+
+// ScanRange returns the live cells whose keys lie between low and high in
+// key order, each bound included or excluded as includeLow and includeHigh
+// say. A nil bound leaves the range open on that side. The first slot is
+// found by binary search and the slots walked from there, so the cost is
+// that of the cells returned; a range with no keys in it returns none.
+func (sp *SlottedPage) ScanRange(low, high []byte, includeLow, includeHigh bool) ([]*Cell, error) {
+	start := 0
+	if low != nil {
+		start = sp.FindSlotPosition(low)
+	}
+	var cells []*Cell
+	for i, n := start, sp.numSlots(); i < n; i++ {
+		cell, err := sp.getCell(sp.slot(i))
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve cell at slot %d: %w", i, err)
+		}
+		if low != nil && !includeLow && bytes.Equal(cell.key, low) {
+			continue
+		}
+		if high != nil {
+			if c := bytes.Compare(cell.key, high); c > 0 || (c == 0 && !includeHigh) {
+				break
+			}
+		}
+		if !cell.IsDeleted() {
+			if cell, err = sp.resolveOverflow(cell); err != nil {
+				return nil, err
+			}
+			cells = append(cells, cell)
+		}
+	}
+	return cells, nil
+}
+
+// IsSorted reports whether the slot directory is in strictly increasing key
+// order, which FindCell and FindSlotPosition rely on. A page whose cells
+// cannot be read is reported as unsorted.
+func (sp *SlottedPage) IsSorted() bool {
+	var prev []byte
+	for i, offset := range sp.GetAllSlots() {
+		cell, err := sp.getCell(offset)
+		if err != nil {
+			return false
+		}
+		if i > 0 && bytes.Compare(prev, cell.key) >= 0 {
+			return false
+		}
+		prev = cell.key
+	}
+	return true
+}
+
+// RewriteSorted restores key order to the slot directory and rewrites the page
+// with its cells packed in that order.
+func (sp *SlottedPage) RewriteSorted() error {
+	// Compact re-inserts every live cell through the binary search of a
+	// fresh page, which puts the slots back in key order.
+	return sp.Compact()
+}
+
+// assertSorted panics if the slots are out of key order, in builds with the
+// slotdebug tag; see debugAssertSorted.
+func (sp *SlottedPage) assertSorted() {
+	if debugAssertSorted && !sp.IsSorted() {
+		panic("slotted page: slots are not in key order")
+	}
 }
 
 // Compact defragments the page by removing deleted cells and re-packing live cells.
+// Live cells are re-serialised unchanged, key cells with their child page
+// ids and stamped cells with their timestamps, and keep their key order; the
+// free space pointer then sits right below them, and the bytes it moved by
+// are reported to OnCompact as BytesReclaimed.
 func (sp *SlottedPage) Compact() error {
 	// Create a new slotted page with the same underlying size.
 	newPage := NewSlottedPage(len(sp.data))
@@ -197,28 +630,351 @@ func (sp *SlottedPage) Compact() error {
 	}
 
 	// Re-insert all non-deleted cells into the new page.
-	for _, offset := range sp.slots {
-		cell, err := sp.GetCell(offset)
+	for _, offset := range sp.GetAllSlots() {
+		cell, err := sp.getCell(offset)
 		if err != nil {
 			return fmt.Errorf("failed to retrieve cell during compaction: %w", err)
 		}
 		if !cell.IsDeleted() {
-			if err := newPage.InsertCell(cell); err != nil {
+			if err := newPage.insertCell(cell); err != nil {
 				return fmt.Errorf("failed to insert cell during compaction: %w", err)
 			}
 		}
 	}
 
-	// Replace the current page data and metadata with the compacted version.
-	sp.data = newPage.data
-	sp.slots = newPage.slots
-	sp.cellCount = newPage.cellCount
-	sp.freeSpace = newPage.freeSpace
+	// Copy the compacted bytes over the existing data slice rather than
+	// swapping slices, so that anyone holding Contents() (such as the owning
+	// buffer) sees, and flushes, the compacted page.
+	stored, oldFreeSpace := sp.storedCellCount(), sp.GetFreeSpace()
+	retained := newPage.numSlots()
+	sp.mu.Lock()
+	copy(sp.data, newPage.data)
+	sp.setIsDirty(true)
+	sp.mu.Unlock()
 
+	if sp.onCompact != nil {
+		sp.onCompact(CompactionStats{
+			CellsRetained:  retained,
+			CellsDropped:   stored - retained,
+			BytesReclaimed: newPage.GetFreeSpace() - oldFreeSpace,
+		})
+	}
 	return nil
 }
 
-// GetAllSlots returns the list of cell offsets (slots) in the page.
+// SetContents replaces the page's bytes with data. An all-zero data, as
+// read from a freshly appended block, becomes an empty page, and a page
+// written before the slot directory was kept on the page is converted as by
+// RebuildSlots. If data is not a well-formed slotted page an error is
+// returned and the page is left as it was.
+//
+// It shadows Page.SetContents, which replaces only the bytes.
+func (sp *SlottedPage) SetContents(data []byte) error {
+	if err := normalizePage(data); err != nil {
+		return err
+	}
+	sp.mu.Lock()
+	sp.data = data
+	sp.mu.Unlock()
+	return nil
+}
+
+// RebuildSlots checks the page's bytes and brings them into the current
+// layout. Pages carry their slot directory, so a page written by this
+// version needs no rebuild; this writes the header of an all-zero page and
+// rewrites a page from before the directory was kept on the page, deriving
+// the directory by scanning its cells. A page whose bytes do not parse, or
+// an old page too full to make room for its directory, is left untouched and
+// an error is returned.
+func (sp *SlottedPage) RebuildSlots() error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return normalizePage(sp.data)
+}
+
+// normalizePage validates data as a slotted page, initializing an all-zero
+// one and converting one without an on-page slot directory in place. On
+// error data is unchanged.
+func normalizePage(data []byte) error {
+	if len(data) < PageHeaderSize {
+		return fmt.Errorf("page of %d bytes is smaller than its header", len(data))
+	}
+	header := func(offset int) int {
+		return int(binary.BigEndian.Uint32(data[offset:]))
+	}
+	if header(pageSizeOffset) == 0 && header(freeSpaceOffset) == 0 {
+		initHeader(data)
+		return nil
+	}
+	if size := header(pageSizeOffset); size != len(data) {
+		return fmt.Errorf("page header records size %d but page has %d bytes", size, len(data))
+	}
+	freeSpace := header(freeSpaceOffset)
+	if freeSpace < PageHeaderSize || freeSpace > len(data) {
+		return fmt.Errorf("free space pointer %d outside page of %d bytes", freeSpace, len(data))
+	}
+	count := header(cellCountOffset)
+	if count > 0 && header(headerSizeOffset) == PageHeaderSize {
+		return convertPage(data, freeSpace, count)
+	}
+	if header(headerSizeOffset) != PageHeaderSize+count*slotEntrySize || header(headerSizeOffset) > freeSpace {
+		return fmt.Errorf("page header records %d cells but a header of %d bytes", count, header(headerSizeOffset))
+	}
+	var prev []byte
+	for i := 0; i < count; i++ {
+		offset := header(PageHeaderSize + i*slotEntrySize)
+		cell, _, err := parseStoredCell(data, offset, freeSpace)
+		if err != nil {
+			return fmt.Errorf("slot %d: %w", i, err)
+		}
+		if cell.IsDeleted() {
+			return fmt.Errorf("slot %d points at a deleted cell", i)
+		}
+		if i > 0 && bytes.Compare(prev, cell.key) >= 0 {
+			return fmt.Errorf("slot %d is out of key order", i)
+		}
+		prev = cell.key
+	}
+	return nil
+}
+
+// parseStoredCell decodes the length-prefixed cell at offset, which must lie
+// in the cell region starting at freeSpace, and returns it with the offset
+// just past it.
+func parseStoredCell(data []byte, offset, freeSpace int) (*Cell, int, error) {
+	if offset < freeSpace || offset+slotPointerSize > len(data) {
+		return nil, 0, fmt.Errorf("%s: cell offset %d outside the cell region", ErrOutOfBounds, offset)
+	}
+	end := offset + slotPointerSize + int(binary.BigEndian.Uint32(data[offset:]))
+	if end > len(data) || end <= offset+slotPointerSize {
+		return nil, 0, fmt.Errorf("%s: bad cell length at offset %d", ErrOutOfBounds, offset)
+	}
+	cell, err := CellFromBytes(data[offset+slotPointerSize : end])
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to parse cell at offset %d: %w", offset, err)
+	}
+	return cell, end, nil
+}
+
+// convertPage rewrites a page laid out before the slot directory was kept
+// on the page, whose header records count cells but no directory. Its cells
+// are found by scanning the cell region and packed into a fresh page, which
+// drops deleted cells and makes room for the directory.
+func convertPage(data []byte, freeSpace, count int) error {
+	var live []*Cell
+	for offset := freeSpace; offset < len(data); {
+		cell, end, err := parseStoredCell(data, offset, freeSpace)
+		if err != nil {
+			return err
+		}
+		if !cell.IsDeleted() {
+			live = append(live, cell)
+		}
+		offset = end
+	}
+	if count != len(live) {
+		return fmt.Errorf("page header records %d cells but %d were found", count, len(live))
+	}
+	converted := NewSlottedPage(len(data))
+	for _, cell := range live {
+		if err := converted.insertCell(cell); err != nil {
+			return fmt.Errorf("failed to convert page: %w", err)
+		}
+	}
+	// Keep the page flags; the checksum is stale either way until the page
+	// is next written.
+	copy(converted.data[checksumOffset:PageHeaderSize], data[checksumOffset:PageHeaderSize])
+	copy(data, converted.data)
+	return nil
+}
+
+// ExportCells returns copies of the page's live cells in key order. The
+// copies share no memory with the page, so they stay valid after the page
+// changes and can be imported into a page of any size. It fails if a cell
+// cannot be decoded, rather than leave it out of the export. Overflowing
+// cells are exported as stored, still pointing at their overflow blocks.
+func (sp *SlottedPage) ExportCells() ([]*Cell, error) {
+	n := sp.numSlots()
+	cells := make([]*Cell, 0, n)
+	for i := 0; i < n; i++ {
+		// getCell decodes into freshly allocated key and value slices.
+		cell, err := sp.getCell(sp.slot(i))
+		if err != nil {
+			return nil, fmt.Errorf("failed to export cell in slot %d: %w", i, err)
+		}
+		cells = append(cells, cell)
+	}
+	return cells, nil
+}
+
+// ImportCells inserts cells, as returned by ExportCells, keeping any
+// timestamps they carry. If they do not all fit it returns an error wrapping
+// ErrPageFull, and if any insert fails the page is put back as it was, so
+// either every cell is imported or none is.
+func (sp *SlottedPage) ImportCells(cells []*Cell) error {
+	needed := 0
+	for _, cell := range cells {
+		if len(cell.key) == 0 {
+			return ErrEmptyKey
+		}
+		needed += len(cell.ToBytes()) + slotPointerSize + slotEntrySize
+	}
+	if available := sp.Available(); needed > available {
+		return fmt.Errorf("%w: importing %d cells needs %d bytes but only %d bytes available",
+			ErrPageFull, len(cells), needed, available)
+	}
+	saved := bytes.Clone(sp.Contents())
+	restore := func() {
+		sp.mu.Lock()
+		defer sp.mu.Unlock()
+		copy(sp.data, saved)
+	}
+	if err := sp.reclaim(needed); err != nil {
+		restore()
+		return err
+	}
+	for _, cell := range cells {
+		if err := sp.insertCell(cell); err != nil {
+			restore()
+			return fmt.Errorf("failed to import cell %s: %w", cell.key, err)
+		}
+	}
+	return nil
+}
+
+// BulkInsert inserts cells, which must be in strictly increasing key order
+// and sort after every cell already on the page, as one pass: their slots
+// are appended to the directory in order and their bytes packed down from
+// the free space pointer, with no search or shifting per cell. Unless the
+// page has to be compacted first, it ends up byte for byte as repeated
+// InsertCell calls would leave it, stamps included. If the
+// cells are out of order it returns ErrNotSorted, and if they do not all fit
+// an error wrapping ErrPageFull; either way none of them is inserted.
+func (sp *SlottedPage) BulkInsert(cells []*Cell) error {
+	if len(cells) == 0 {
+		return nil
+	}
+	var prev []byte
+	if n := sp.numSlots(); n > 0 {
+		last, err := sp.getCell(sp.slot(n - 1))
+		if err != nil {
+			return fmt.Errorf("failed to read last cell: %w", err)
+		}
+		prev = last.key
+	}
+	for i, cell := range cells {
+		if len(cell.key) == 0 {
+			return ErrEmptyKey
+		}
+		if prev != nil && bytes.Compare(prev, cell.key) >= 0 {
+			return fmt.Errorf("%w: cell %d has key %q after %q", ErrNotSorted, i, cell.key, prev)
+		}
+		prev = cell.key
+	}
+
+	if sp.now != nil {
+		t := sp.now()
+		for _, cell := range cells {
+			cell.setTimestamps(t, t)
+		}
+	}
+	encoded := make([][]byte, len(cells))
+	needed := 0
+	for i, cell := range cells {
+		encoded[i] = cell.ToBytes()
+		needed += len(encoded[i]) + slotPointerSize + slotEntrySize
+	}
+	if err := sp.reclaim(needed); err != nil {
+		return err
+	}
+	if usableSpace := sp.gap(); usableSpace < needed {
+		return fmt.Errorf("%w: inserting %d cells needs %d bytes but only %d bytes available",
+			ErrPageFull, len(cells), needed, usableSpace)
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.isBlankLocked() {
+		initHeader(sp.data)
+	}
+	count := int(binary.BigEndian.Uint32(sp.data[cellCountOffset:]))
+	free := int(binary.BigEndian.Uint32(sp.data[freeSpaceOffset:]))
+	for i, b := range encoded {
+		free -= len(b) + slotPointerSize
+		binary.BigEndian.PutUint32(sp.data[free:], uint32(len(b)))
+		copy(sp.data[free+slotPointerSize:], b)
+		binary.BigEndian.PutUint32(sp.data[PageHeaderSize+(count+i)*slotEntrySize:], uint32(free))
+	}
+	sp.setCountLocked(count + len(encoded))
+	binary.BigEndian.PutUint32(sp.data[freeSpaceOffset:], uint32(free))
+	sp.setIsDirty(true)
+	return nil
+}
+
+// GetAllSlots returns the cell offsets held in the slot directory, in key
+// order.
 func (sp *SlottedPage) GetAllSlots() []int {
-	return sp.slots
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	if sp.isBlankLocked() {
+		return []int{}
+	}
+	count := int(binary.BigEndian.Uint32(sp.data[cellCountOffset:]))
+	slots := make([]int, count)
+	for i := range slots {
+		slots[i] = int(binary.BigEndian.Uint32(sp.data[PageHeaderSize+i*slotEntrySize:]))
+	}
+	return slots
+}
+
+// UpdateChecksum stores a CRC32C of the page in its header. The buffer layer
+// calls it just before the page is written out, so the checksum covers every
+// change however it was made.
+func (sp *SlottedPage) UpdateChecksum() {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	flags := binary.BigEndian.Uint32(sp.data[pageFlagsOffset:])
+	binary.BigEndian.PutUint32(sp.data[pageFlagsOffset:], flags|pageFlagChecksummed|pageFlagCastagnoli)
+	binary.BigEndian.PutUint32(sp.data[checksumOffset:], sp.checksumLocked(castagnoliTable))
+}
+
+// VerifyChecksum checks the page against the checksum stored by
+// UpdateChecksum and returns an error wrapping ErrChecksumMismatch if they
+// differ. Pages that were never checksummed, such as freshly appended
+// blocks, always pass.
+func (sp *SlottedPage) VerifyChecksum() error {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	flags := binary.BigEndian.Uint32(sp.data[pageFlagsOffset:])
+	if flags&pageFlagChecksummed == 0 {
+		return nil
+	}
+	table := crc32.IEEETable
+	if flags&pageFlagCastagnoli != 0 {
+		table = castagnoliTable
+	}
+	stored := binary.BigEndian.Uint32(sp.data[checksumOffset:])
+	if actual := sp.checksumLocked(table); actual != stored {
+		return fmt.Errorf("%w: stored %08x, computed %08x", ErrChecksumMismatch, stored, actual)
+	}
+	return nil
+}
+
+// checksumLocked computes a CRC32 with table over the header fields ahead
+// of the checksum, the slot directory and the cell region, which starts at
+// the free space pointer recorded in the header. The unused gap between
+// the directory and the cells is not covered, nor are the page flags, which
+// record the polynomial in use.
+func (sp *SlottedPage) checksumLocked(table *crc32.Table) uint32 {
+	freeSpace := int(binary.BigEndian.Uint32(sp.data[freeSpaceOffset:]))
+	if freeSpace < PageHeaderSize || freeSpace > len(sp.data) {
+		freeSpace = PageHeaderSize
+	}
+	headerEnd := int(binary.BigEndian.Uint32(sp.data[headerSizeOffset:]))
+	if headerEnd < PageHeaderSize || headerEnd > freeSpace {
+		headerEnd = PageHeaderSize
+	}
+	crc := crc32.Checksum(sp.data[:checksumOffset], table)
+	crc = crc32.Update(crc, table, sp.data[PageHeaderSize:headerEnd])
+	return crc32.Update(crc, table, sp.data[freeSpace:])
 }
@@ -0,0 +1,7 @@
+//go:build !slotdebug
+
+package kfile
+
+// debugAssertSorted is off outside slotdebug builds, so that the check in
+// assertSorted compiles away.
+const debugAssertSorted = false
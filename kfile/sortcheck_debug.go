@@ -0,0 +1,8 @@
+//go:build slotdebug
+
+package kfile
+
+// debugAssertSorted makes every binary search over the slot directory first
+// check that the slots are in key order and panic if they are not. The check
+// costs a full scan per search, so only builds with the slotdebug tag make it.
+const debugAssertSorted = true
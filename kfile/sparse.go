@@ -0,0 +1,36 @@
+package kfile
+
+import (
+	"fmt"
+	"os"
+)
+
+// AllocatedSize returns the bytes of storage filename takes up on disk. A
+// file grown by PreallocateFile is sparse: Length counts every block of its
+// logical size, but blocks never written are holes that take no storage
+// and read back as zeros, so AllocatedSize may be far below Length times the
+// block size. Where the platform does not report storage use, it returns the
+// logical size. A missing file is an error wrapping os.ErrNotExist rather
+// than being created.
+func (fm *FileMgr) AllocatedSize(filename string) (int64, error) {
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+	fl := fm.fileLock(filename)
+	fl.RLock()
+	defer fl.RUnlock()
+
+	if fm.closed {
+		return 0, ErrClosed
+	}
+	fm.openFilesLock.Lock()
+	path := fm.pathLocked(filename)
+	fm.openFilesLock.Unlock()
+	stat, err := os.Stat(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat file %s: %w", filename, err)
+	}
+	if n, ok := allocatedBytes(stat); ok {
+		return n, nil
+	}
+	return stat.Size(), nil
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package kfile
+
+import "os"
+
+// allocatedBytes is unsupported on this platform, so AllocatedSize reports
+// the logical size.
+func allocatedBytes(fi os.FileInfo) (int64, bool) {
+	return 0, false
+}
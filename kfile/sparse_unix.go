@@ -0,0 +1,18 @@
+//go:build unix
+
+package kfile
+
+import (
+	"os"
+	"syscall"
+)
+
+// allocatedBytes returns the storage behind fi, which stat counts in
+// 512-byte units whatever the file system's block size.
+func allocatedBytes(fi os.FileInfo) (int64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int64(st.Blocks) * 512, true
+}
@@ -0,0 +1,269 @@
+package kfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SyncPolicy decides when data files written by Write and Append are synced
+// to stable storage. Log files, see FileMgr.SetLogFile, are synced on every
+// write under any policy.
+type SyncPolicy int
+
+const (
+	// SyncEveryWrite syncs the file before each Write or Append returns.
+	SyncEveryWrite SyncPolicy = iota
+	// SyncOnInterval leaves written files dirty for a background flusher
+	// that syncs them at a fixed interval.
+	SyncOnInterval
+	// SyncOnClose leaves written files dirty until Sync, SyncAll or Close.
+	// A crash can lose every write since the last of those.
+	SyncOnClose
+)
+
+// defaultSyncInterval is the flusher interval for SyncOnInterval when
+// WithSyncInterval does not set one.
+const defaultSyncInterval = 100 * time.Millisecond
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncEveryWrite:
+		return "every-write"
+	case SyncOnInterval:
+		return "interval"
+	case SyncOnClose:
+		return "on-close"
+	}
+	return fmt.Sprintf("SyncPolicy(%d)", int(p))
+}
+
+// WithSyncPolicy sets when written data files are synced; the default is
+// SyncEveryWrite. Under the other policies Sync and SyncAll make writes
+// durable on demand, and Close always syncs whatever is still dirty. Atomic
+// writes keep syncing every write, since the double-write protocol depends
+// on it.
+func WithSyncPolicy(policy SyncPolicy) FileMgrOption {
+	return func(fm *FileMgr) {
+		fm.syncPolicy = policy
+	}
+}
+
+// WithSyncInterval selects SyncOnInterval with the given interval, so a
+// crash can lose at most about one interval of writes that were not
+// otherwise synced. A non-positive interval keeps SyncEveryWrite.
+func WithSyncInterval(interval time.Duration) FileMgrOption {
+	return func(fm *FileMgr) {
+		if interval <= 0 {
+			fm.syncPolicy = SyncEveryWrite
+			return
+		}
+		fm.syncPolicy = SyncOnInterval
+		fm.syncInterval = interval
+	}
+}
+
+// syncFile syncs f to stable storage, timing the sync for LatencyStats.
+func (fm *FileMgr) syncFile(f *os.File) error {
+	start := time.Now()
+	defer func() { fm.latency.sync.observe(time.Since(start)) }()
+	if fm.syncer != nil {
+		return fm.syncer(f)
+	}
+	return f.Sync()
+}
+
+// replaceFile replaces the file at path with data. It writes a temporary
+// file, syncs it, renames it into place and syncs the directory, so a crash
+// leaves either the old contents or the new, and the temporary file is
+// removed on the next open.
+func (fm *FileMgr) replaceFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := fm.syncFile(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return fm.syncDir(filepath.Dir(path))
+}
+
+// syncDir syncs the directory entries of dir, so that files created or
+// renamed in it survive a crash.
+func (fm *FileMgr) syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return fm.syncFile(d)
+}
+
+// batchingSyncs reports whether Write and Append leave files dirty rather
+// than syncing them.
+func (fm *FileMgr) batchingSyncs() bool {
+	return fm.syncPolicy != SyncEveryWrite && !fm.atomicWrites
+}
+
+// syncWrittenLocked makes a write to f durable as the sync policy asks,
+// either at once or by marking the file dirty. Log files are always synced
+// at once. The caller must hold the file's lock.
+func (fm *FileMgr) syncWrittenLocked(filename string, f *os.File) error {
+	if fm.batchingSyncs() && !fm.isLogFile(filename) {
+		fm.markDirty(filename, f)
+		return nil
+	}
+	if err := fm.syncFile(f); err != nil {
+		return fmt.Errorf("failed to sync file %s: %w", filename, err)
+	}
+	return nil
+}
+
+// markDirty records that f has writes the flusher has yet to sync.
+func (fm *FileMgr) markDirty(filename string, f *os.File) {
+	fm.dirtyMu.Lock()
+	defer fm.dirtyMu.Unlock()
+	fm.dirty[filename] = f
+}
+
+// startFlusher launches the goroutine that syncs dirty files every
+// fm.syncInterval until Close.
+func (fm *FileMgr) startFlusher() {
+	if fm.syncInterval <= 0 {
+		fm.syncInterval = defaultSyncInterval
+	}
+	fm.stopFlush = make(chan struct{})
+	fm.flushDone = make(chan struct{})
+	go func() {
+		defer close(fm.flushDone)
+		ticker := time.NewTicker(fm.syncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-fm.stopFlush:
+				return
+			case <-ticker.C:
+				fm.mutex.RLock()
+				if !fm.closed {
+					if err := fm.syncDirty(); err != nil {
+						fm.dirtyMu.Lock()
+						if fm.flushErr == nil {
+							fm.flushErr = err
+						}
+						fm.dirtyMu.Unlock()
+					}
+				}
+				fm.mutex.RUnlock()
+			}
+		}
+	}()
+}
+
+// stopFlusher stops the background flusher, if any, and waits for it.
+func (fm *FileMgr) stopFlusher() {
+	if fm.stopFlush == nil {
+		return
+	}
+	fm.stopOnce.Do(func() {
+		close(fm.stopFlush)
+		<-fm.flushDone
+	})
+}
+
+// Sync makes every write to filename so far durable, syncing the file if
+// the sync policy left it dirty. Under SyncEveryWrite it is a no-op.
+func (fm *FileMgr) Sync(filename string) error {
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+
+	if fm.closed {
+		return ErrClosed
+	}
+	if fm.dirty == nil {
+		return nil
+	}
+	return fm.syncDirtyFile(filename)
+}
+
+// SyncAll makes every write so far durable, syncing each file the sync
+// policy left dirty. It also reports any error the background flusher met
+// since the last call. Under SyncEveryWrite it is a no-op.
+func (fm *FileMgr) SyncAll() error {
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+
+	if fm.closed {
+		return ErrClosed
+	}
+	if fm.dirty == nil {
+		return nil
+	}
+	err := fm.syncDirty()
+	fm.dirtyMu.Lock()
+	if err == nil {
+		err = fm.flushErr
+	}
+	fm.flushErr = nil
+	fm.dirtyMu.Unlock()
+	return err
+}
+
+// syncDirty syncs every dirty file, then saves the metadata if it changed.
+// The caller must hold fm.mutex.
+func (fm *FileMgr) syncDirty() error {
+	fm.dirtyMu.Lock()
+	names := make([]string, 0, len(fm.dirty))
+	for name := range fm.dirty {
+		names = append(names, name)
+	}
+	fm.dirtyMu.Unlock()
+
+	var firstErr error
+	for _, name := range names {
+		if err := fm.syncDirtyFile(name); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := fm.flushMetadata(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// syncDirtyFile syncs filename if it is still dirty. Holding the file's lock
+// keeps DeleteFile and RenameFile from closing the handle underneath it.
+func (fm *FileMgr) syncDirtyFile(filename string) error {
+	fl := fm.fileLock(filename)
+	fl.RLock()
+	defer fl.RUnlock()
+	return fm.syncDirtyFileLocked(filename)
+}
+
+// syncDirtyFileLocked syncs filename if it is dirty; the caller must hold
+// the file's lock.
+func (fm *FileMgr) syncDirtyFileLocked(filename string) error {
+	fm.dirtyMu.Lock()
+	f, ok := fm.dirty[filename]
+	delete(fm.dirty, filename)
+	fm.dirtyMu.Unlock()
+	if !ok {
+		return nil
+	}
+	if err := fm.syncFile(f); err != nil {
+		return fmt.Errorf("failed to sync file %s: %w", filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package kfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ErrFileBusy is returned by Truncate when another operation is using the
+// file.
+var ErrFileBusy = errors.New("file is in use")
+
+// Truncate shrinks filename to its first numBlocks blocks and syncs it.
+// numBlocks may not exceed the current length. Rather than wait, it fails
+// with ErrFileBusy while another goroutine holds the file's lock, since a
+// reader or writer of the file may still be using a block being cut off.
+// Free blocks cut off leave the file's free list.
+func (fm *FileMgr) Truncate(filename string, numBlocks int) error {
+	if fm.readOnly {
+		return ErrReadOnly
+	}
+	if numBlocks < 0 {
+		return fmt.Errorf("%w: cannot truncate %s to %d blocks", ErrInvalidBlock, filename, numBlocks)
+	}
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+	fl := fm.fileLock(filename)
+	if !fl.TryLock() {
+		return fmt.Errorf("failed to truncate %s: %w", filename, ErrFileBusy)
+	}
+	defer fl.Unlock()
+
+	if fm.closed {
+		return ErrClosed
+	}
+	// getFile would create a missing file, so check for it first.
+	fm.openFilesLock.Lock()
+	path := fm.pathLocked(filename)
+	fm.openFilesLock.Unlock()
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("failed to truncate %s: %w", filename, err)
+	}
+	length, err := fm.LengthLocked(filename)
+	if err != nil {
+		return fmt.Errorf("failed to determine length for file %s: %w", filename, err)
+	}
+	if numBlocks > int(length) {
+		return fmt.Errorf("%w: cannot truncate %s of %d blocks to %d", ErrInvalidBlock, filename, length, numBlocks)
+	}
+
+	f, err := fm.getFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to get file for truncate: %w", err)
+	}
+	// Reading a mapped page past the new end of file would fault.
+	fm.dropMmapLocked(filename)
+	if err := f.Truncate(int64(fm.headerSize) + int64(numBlocks)*int64(fm.blocksize)); err != nil {
+		return fmt.Errorf("failed to truncate %s: %w", filename, err)
+	}
+	// The sync also covers any writes the sync policy left pending.
+	if err := fm.syncFile(f); err != nil {
+		return fmt.Errorf("failed to sync file %s: %w", filename, err)
+	}
+	fm.dirtyMu.Lock()
+	delete(fm.dirty, filename)
+	fm.dirtyMu.Unlock()
+	fm.setFileMeta(filename, int32(numBlocks))
+	if err := fm.trimFreeBlocks(filename, int32(numBlocks)); err != nil {
+		return err
+	}
+
+	fm.statsMu.Lock()
+	metadata := fm.metaData
+	metadata.ModifiedAt = time.Now()
+	metadata.LastAccessed = time.Now()
+	fm.addMetaData(metadata)
+	fm.statsMu.Unlock()
+	return nil
+}
@@ -0,0 +1,86 @@
+package kfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrValidationFailed is returned, wrapped in a *ValidationError, by
+// NewFileMgr when strict startup validation finds a bad data file.
+var ErrValidationFailed = errors.New("data files failed validation")
+
+// FileProblem describes a data file that failed startup validation.
+type FileProblem struct {
+	Filename  string
+	Size      int64 // bytes in the file when it was checked
+	BlockSize int   // the size, past any superblock, should be a multiple of it
+	Err       error // what ValidateFile reported
+}
+
+func (p FileProblem) String() string {
+	return fmt.Sprintf("%s (%d bytes, block size %d): %v", p.Filename, p.Size, p.BlockSize, p.Err)
+}
+
+// ValidationError reports every data file that failed strict startup
+// validation. It unwraps to ErrValidationFailed.
+type ValidationError struct {
+	Problems []FileProblem
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		msgs[i] = p.String()
+	}
+	return fmt.Sprintf("%v: %s", ErrValidationFailed, strings.Join(msgs, "; "))
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrValidationFailed
+}
+
+// WithStartupValidation makes NewFileMgr run ValidateFile on every data file
+// in the data directory once it is open, so that a file cut short, whose
+// size is not a whole number of blocks, is found at startup rather than in
+// the middle of a transaction. Temporary and bookkeeping files are skipped,
+// as by ListFiles. The problems found are kept for ValidationProblems; with
+// strict set, NewFileMgr instead refuses to open and returns them in a
+// *ValidationError.
+func WithStartupValidation(strict bool) FileMgrOption {
+	return func(fm *FileMgr) {
+		fm.validateOnOpen = true
+		fm.strictValidation = strict
+	}
+}
+
+// ValidationProblems returns the problems startup validation found, if
+// WithStartupValidation was given.
+func (fm *FileMgr) ValidationProblems() []FileProblem {
+	return append([]FileProblem(nil), fm.validationProblems...)
+}
+
+// validateDirectory runs ValidateFile on every data file in the data
+// directory and returns the problems found.
+func (fm *FileMgr) validateDirectory() ([]FileProblem, error) {
+	entries, err := os.ReadDir(fm.dbDirectory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list directory %s: %w", fm.dbDirectory, err)
+	}
+	var problems []FileProblem
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !isDataFile(name) {
+			continue
+		}
+		if err := fm.ValidateFile(name); err != nil {
+			p := FileProblem{Filename: name, BlockSize: fm.blocksize, Err: err}
+			if info, err := entry.Info(); err == nil {
+				p.Size = info.Size()
+			}
+			problems = append(problems, p)
+		}
+	}
+	return problems, nil
+}
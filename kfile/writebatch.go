@@ -0,0 +1,185 @@
+package kfile
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// BlockWrite pairs a block with the page to be written to it.
+type BlockWrite struct {
+	Blk  *BlockId
+	Page *SlottedPage
+}
+
+// WriteBlocksError reports a WriteBlocks call that failed part way. The
+// blocks in Persisted were written and synced as the sync policy asks;
+// every other block of the batch may or may not have reached the file.
+type WriteBlocksError struct {
+	Persisted []BlockId
+	Err       error
+}
+
+func (e *WriteBlocksError) Error() string {
+	return fmt.Sprintf("batch write failed after %d blocks persisted: %v", len(e.Persisted), e.Err)
+}
+
+func (e *WriteBlocksError) Unwrap() error {
+	return e.Err
+}
+
+// WriteBlocks writes a batch of blocks, possibly spread over several files.
+// Entries are grouped by file and sorted by block number, runs of adjacent
+// blocks go out in a single WriteAt, and each file is synced once at the
+// end rather than after every block. If a block appears more than once the
+// last entry wins. On failure the error is a *WriteBlocksError listing the
+// blocks that were persisted. With atomic writes each block still goes
+// through the double-write area on its own. As with Write, pages are
+// checksummed under WithChecksumVerification.
+func (fm *FileMgr) WriteBlocks(entries []BlockWrite) error {
+	if fm.readOnly {
+		return ErrReadOnly
+	}
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+
+	if fm.closed {
+		return ErrClosed
+	}
+	if fm.checksums {
+		for _, e := range entries {
+			e.Page.UpdateChecksum()
+		}
+	}
+	byFile := make(map[string][]BlockWrite)
+	for _, e := range entries {
+		// Reject bad block numbers before anything is written.
+		if _, err := fm.blockOffset(e.Blk.Number()); err != nil {
+			return fmt.Errorf("failed to write block %v: %w", e.Blk, err)
+		}
+		byFile[e.Blk.FileName()] = append(byFile[e.Blk.FileName()], e)
+	}
+	filenames := make([]string, 0, len(byFile))
+	for filename := range byFile {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	var persisted []BlockId
+	for _, filename := range filenames {
+		written, err := fm.writeFileBlocks(filename, byFile[filename])
+		persisted = append(persisted, written...)
+		if err != nil {
+			return &WriteBlocksError{Persisted: persisted, Err: err}
+		}
+	}
+	return nil
+}
+
+// writeFileBlocks writes the entries for one file and syncs it, returning
+// the blocks that were persisted. The caller must hold fm.mutex.
+func (fm *FileMgr) writeFileBlocks(filename string, entries []BlockWrite) ([]BlockId, error) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Blk.Number() < entries[j].Blk.Number()
+	})
+	// Keep the last entry for each block.
+	unique := entries[:0]
+	for i, e := range entries {
+		if i+1 < len(entries) && entries[i+1].Blk.Number() == e.Blk.Number() {
+			continue
+		}
+		unique = append(unique, e)
+	}
+	entries = unique
+
+	fl := fm.fileLock(filename)
+	fl.Lock()
+	defer fl.Unlock()
+
+	// Entries are sorted, so the last one decides whether the file grows.
+	if err := fm.checkWriteLimitLocked(filename, entries[len(entries)-1].Blk.Number()); err != nil {
+		return nil, fmt.Errorf("failed to write blocks of %s: %w", filename, err)
+	}
+	f, err := fm.getFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file %s: %w", filename, err)
+	}
+
+	start := time.Now()
+	written := 0
+	var writeErr error
+	if fm.atomicWrites {
+		for _, e := range entries {
+			offset, err := fm.blockOffset(e.Blk.Number())
+			if err == nil {
+				_, err = fm.writeBlockLocked(f, filename, offset, e.Page.Contents())
+			}
+			if err != nil {
+				writeErr = fmt.Errorf("failed to write block %v: %w", e.Blk, err)
+				break
+			}
+			written++
+		}
+	} else {
+		for start := 0; start < len(entries); {
+			end := start + 1
+			for end < len(entries) && entries[end].Blk.Number() == entries[end-1].Blk.Number()+1 {
+				end++
+			}
+			run := fm.ioBuffer((end - start) * fm.blocksize)[:0]
+			for _, e := range entries[start:end] {
+				run = append(run, e.Page.Contents()...)
+			}
+			offset, err := fm.blockOffset(entries[start].Blk.Number())
+			if err == nil {
+				var n int
+				n, err = fm.writeAt(f, run, offset)
+				if err == nil && n != len(run) {
+					err = fmt.Errorf("incomplete write: expected %d bytes, wrote %d", len(run), n)
+				}
+			}
+			if err != nil {
+				writeErr = fmt.Errorf("failed to write blocks %d-%d of %s: %w",
+					entries[start].Blk.Number(), entries[end-1].Blk.Number(), filename, err)
+				break
+			}
+			written = end
+			start = end
+		}
+		// Sync whatever runs made it out, even after a failed write, so the
+		// caller knows exactly which blocks are safe.
+		if written > 0 {
+			if err := fm.syncWrittenLocked(filename, f); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if written > 0 {
+		if err := fm.growFileMetaLocked(filename, entries[written-1].Blk.Number()+1); err != nil && writeErr == nil {
+			writeErr = err
+		}
+	}
+
+	elapsed := time.Since(start)
+	if written > 0 {
+		fm.latency.write.observe(elapsed)
+		end := int64(fm.headerSize) + int64(entries[written-1].Blk.Number()+1)*int64(fm.blocksize)
+		fm.outgrowMmapLocked(filename, end)
+	}
+	persisted := make([]BlockId, written)
+	fm.fileStats.counters(filename).written.Add(int64(written))
+	fm.statsMu.Lock()
+	for i, e := range entries[:written] {
+		persisted[i] = *e.Blk
+		fm.blocksWritten++
+		fm.addToWriteLog(ReadWriteLogEntry{
+			Timestamp:   time.Now(),
+			BlockId:     e.Blk,
+			BytesAmount: fm.blocksize,
+			Elapsed:     elapsed,
+		})
+	}
+	fm.statsMu.Unlock()
+	return persisted, writeErr
+}
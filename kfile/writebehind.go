@@ -0,0 +1,157 @@
+package kfile
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// Defaults for WithWriteBehind.
+const (
+	defaultWriteBehindWorkers = 4
+	defaultWriteBehindDepth   = 64
+)
+
+// asyncWrite is a request on a write-behind queue: a block write, or with a
+// nil blk a barrier that Flush waits on.
+type asyncWrite struct {
+	blk  *BlockId
+	page *SlottedPage
+	done chan error
+}
+
+// WithWriteBehind starts a pool of workers that carry out the writes given
+// to WriteAsync, so that the caller does not wait on the disk. Each worker
+// has a queue of depth requests, and WriteAsync blocks while the queue it
+// needs is full. A non-positive workers or depth takes a default of 4
+// workers with 64 requests each. Close drains the queues before closing the
+// files.
+func WithWriteBehind(workers, depth int) FileMgrOption {
+	return func(fm *FileMgr) {
+		if workers <= 0 {
+			workers = defaultWriteBehindWorkers
+		}
+		if depth <= 0 {
+			depth = defaultWriteBehindDepth
+		}
+		fm.wbWorkers = workers
+		fm.wbDepth = depth
+	}
+}
+
+// startWriteBehind launches the write-behind workers, if WithWriteBehind
+// asked for them.
+func (fm *FileMgr) startWriteBehind() {
+	if fm.wbWorkers == 0 || fm.readOnly {
+		return
+	}
+	fm.wbErrs = make(map[string]error)
+	fm.wbQueues = make([]chan asyncWrite, fm.wbWorkers)
+	for i := range fm.wbQueues {
+		queue := make(chan asyncWrite, fm.wbDepth)
+		fm.wbQueues[i] = queue
+		fm.wbDone.Add(1)
+		go func() {
+			defer fm.wbDone.Done()
+			for req := range queue {
+				if req.blk == nil {
+					close(req.done)
+					continue
+				}
+				err := fm.Write(req.blk, req.page)
+				if err != nil {
+					fm.wbErrMu.Lock()
+					if fm.wbErrs[req.blk.FileName()] == nil {
+						fm.wbErrs[req.blk.FileName()] = err
+					}
+					fm.wbErrMu.Unlock()
+				}
+				req.done <- err
+				close(req.done)
+			}
+		}()
+	}
+}
+
+// stopWriteBehind refuses further WriteAsync calls and waits for the
+// workers to finish every write already queued.
+func (fm *FileMgr) stopWriteBehind() {
+	fm.wbMu.Lock()
+	if fm.wbQueues == nil || fm.wbClosed {
+		fm.wbMu.Unlock()
+		return
+	}
+	fm.wbClosed = true
+	for _, queue := range fm.wbQueues {
+		close(queue)
+	}
+	fm.wbMu.Unlock()
+	fm.wbDone.Wait()
+}
+
+// WriteAsync queues a write of p to blk and returns a channel that delivers
+// its outcome, once the block is written and synced as by Write. The page
+// is copied, so the caller may change or reuse it at once, but Read may see
+// the block's previous contents until the channel delivers. Writes to one
+// block are carried out in the order they were queued. Without
+// WithWriteBehind the write is made before WriteAsync returns.
+func (fm *FileMgr) WriteAsync(blk *BlockId, p *SlottedPage) <-chan error {
+	done := make(chan error, 1)
+	if fm.wbQueues == nil {
+		done <- fm.Write(blk, p)
+		close(done)
+		return done
+	}
+	page := NewSlottedPage(fm.blocksize)
+	copy(page.Contents(), p.Contents())
+
+	fm.wbMu.RLock()
+	defer fm.wbMu.RUnlock()
+	if fm.wbClosed {
+		done <- ErrClosed
+		close(done)
+		return done
+	}
+	fm.wbQueues[fm.writeBehindQueue(blk)] <- asyncWrite{blk: blk.Copy(), page: page, done: done}
+	return done
+}
+
+// writeBehindQueue returns the queue that takes every write to blk, which
+// keeps them in order.
+func (fm *FileMgr) writeBehindQueue(blk *BlockId) int {
+	h := fnv.New32a()
+	h.Write([]byte(blk.FileName()))
+	return int((h.Sum32() ^ uint32(blk.Number())) % uint32(len(fm.wbQueues)))
+}
+
+// Flush waits for every write queued by WriteAsync before the call, then
+// makes the writes to filename durable as Sync does. It returns the first
+// error met by an asynchronous write to filename since the last Flush of
+// it, even if its channel was never read. Without WithWriteBehind it is
+// Sync.
+func (fm *FileMgr) Flush(filename string) error {
+	if fm.wbQueues != nil {
+		fm.wbMu.RLock()
+		if fm.wbClosed {
+			fm.wbMu.RUnlock()
+			return ErrClosed
+		}
+		barriers := make([]chan error, len(fm.wbQueues))
+		for i, queue := range fm.wbQueues {
+			barriers[i] = make(chan error)
+			queue <- asyncWrite{done: barriers[i]}
+		}
+		fm.wbMu.RUnlock()
+		for _, b := range barriers {
+			<-b
+		}
+
+		fm.wbErrMu.Lock()
+		err := fm.wbErrs[filename]
+		delete(fm.wbErrs, filename)
+		fm.wbErrMu.Unlock()
+		if err != nil {
+			return fmt.Errorf("asynchronous write to %s failed: %w", filename, err)
+		}
+	}
+	return fm.Sync(filename)
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 	"ultraSQL/buffer"
@@ -122,7 +123,7 @@ func TestFlush(t *testing.T) {
 	}
 
 	// Read the block to confirm data was written
-	buff, _ := bm.Policy.Get(*logMgr.currentBlock)
+	buff, _ := bm.Policy().Get(*logMgr.currentBlock)
 	page := buff.Contents()
 	if err != nil {
 		t.Fatalf("Failed to read block after flush: %v", err)
@@ -264,3 +265,321 @@ func createLogRecord(s string, n int) []byte {
 	//fmt.Printf("Serialized record [%s, %d]: npos=%d, recordLen=%d\n", s, n, npos, len(record))
 	return record
 }
+
+func TestLogMgrClose(t *testing.T) {
+	tempDir := t.TempDir()
+	fm, err := kfile.NewFileMgr(tempDir, 400)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	policy := buffer.InitLRU(3, fm)
+	bm := buffer.NewBufferMgr(fm, 3, policy)
+	logMgr, err := NewLogMgr(fm, bm, "close_test.db")
+	if err != nil {
+		t.Fatalf("Failed to initialize LogMgr: %v", err)
+	}
+	if _, _, err := logMgr.Append([]byte("before close")); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+
+	// Close in dependency order: log, then buffers, then files.
+	if err := logMgr.Close(); err != nil {
+		t.Fatalf("LogMgr Close failed: %v", err)
+	}
+	if err := logMgr.Close(); err != nil {
+		t.Errorf("Expected double Close to return nil, got %v", err)
+	}
+	if err := bm.Close(); err != nil {
+		t.Fatalf("BufferMgr Close failed: %v", err)
+	}
+	if err := fm.Close(); err != nil {
+		t.Fatalf("FileMgr Close failed: %v", err)
+	}
+
+	if _, _, err := logMgr.Append([]byte("after close")); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Append, got %v", err)
+	}
+	if err := logMgr.Flush(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Flush, got %v", err)
+	}
+	if err := logMgr.Checkpoint(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Checkpoint, got %v", err)
+	}
+	if _, err := logMgr.Iterator(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Iterator, got %v", err)
+	}
+}
+
+func TestAppendRollsOverToNewBlock(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 400)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	policy := buffer.InitLRU(3, fm)
+	bm := buffer.NewBufferMgr(fm, 3, policy)
+	logMgr, err := NewLogMgr(fm, bm, "rollover_test.db")
+	if err != nil {
+		t.Fatalf("Failed to initialize LogMgr: %v", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		if _, _, err := logMgr.Append(make([]byte, 50)); err != nil {
+			t.Fatalf("Append %d failed: %v", i, err)
+		}
+	}
+	if logMgr.currentBlock.Number() == 0 {
+		t.Errorf("Expected appends to roll over past block 0")
+	}
+}
+
+func TestForwardIterator(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 400)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	policy := buffer.InitLRU(3, fm)
+	bm := buffer.NewBufferMgr(fm, 3, policy)
+	logMgr, err := NewLogMgr(fm, bm, "forward_test.db")
+	if err != nil {
+		t.Fatalf("Failed to initialize LogMgr: %v", err)
+	}
+
+	// Records large enough that the five span several blocks.
+	var want []string
+	for i := 0; i < 5; i++ {
+		rec := fmt.Sprintf("record %d %s", i, strings.Repeat("x", 120))
+		if _, _, err := logMgr.Append([]byte(rec)); err != nil {
+			t.Fatalf("Append %d failed: %v", i, err)
+		}
+		want = append(want, rec)
+	}
+	if logMgr.currentBlock.Number() == 0 {
+		t.Fatal("Expected the records to span more than one block")
+	}
+
+	iter, err := logMgr.ForwardIterator()
+	if err != nil {
+		t.Fatalf("ForwardIterator failed: %v", err)
+	}
+	defer iter.(*utils.ForwardLogIterator).Close()
+	var got []string
+	for iter.HasNext() {
+		rec, err := iter.Next()
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		got = append(got, string(rec))
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Expected records oldest first:\n%q\ngot:\n%q", want, got)
+	}
+
+	// Starting from where a backward scan found record 2 yields the rest.
+	back, err := logMgr.Iterator()
+	if err != nil {
+		t.Fatalf("Iterator failed: %v", err)
+	}
+	for i := 4; i >= 2; i-- {
+		if _, err := back.Next(); err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+	}
+	blk, slot := back.(*utils.LogIterator).Position()
+	back.(*utils.LogIterator).Close()
+	from, err := logMgr.ForwardIteratorFrom(blk, slot)
+	if err != nil {
+		t.Fatalf("ForwardIteratorFrom failed: %v", err)
+	}
+	defer from.(*utils.ForwardLogIterator).Close()
+	got = nil
+	for from.HasNext() {
+		rec, err := from.Next()
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		got = append(got, string(rec))
+	}
+	if strings.Join(got, "|") != strings.Join(want[2:], "|") {
+		t.Errorf("Expected records 2 to 4:\n%q\ngot:\n%q", want[2:], got)
+	}
+}
+
+func TestAppendRejectsEmptyRecord(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 400)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	bm := buffer.NewBufferMgr(fm, 3, buffer.InitLRU(3, fm))
+	logMgr, err := NewLogMgr(fm, bm, "empty_test.db")
+	if err != nil {
+		t.Fatalf("Failed to initialize LogMgr: %v", err)
+	}
+
+	for _, rec := range [][]byte{nil, {}} {
+		if _, _, err := logMgr.Append(rec); !errors.Is(err, ErrEmptyRecord) {
+			t.Errorf("Expected ErrEmptyRecord for %#v, got %v", rec, err)
+		}
+	}
+	// A one-byte record is the smallest accepted.
+	if _, _, err := logMgr.Append([]byte{0}); err != nil {
+		t.Errorf("Expected a one-byte record to be accepted, got %v", err)
+	}
+}
+
+func TestLogDirectory(t *testing.T) {
+	dataDir, logDir := t.TempDir(), filepath.Join(t.TempDir(), "wal")
+	fm, err := kfile.NewFileMgr(dataDir, 400, kfile.WithLogDirectory(logDir))
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	bm := buffer.NewBufferMgr(fm, 3, buffer.InitLRU(3, fm))
+	lm, err := NewLogMgr(fm, bm, "wal.log")
+	if err != nil {
+		t.Fatalf("Failed to initialize LogMgr: %v", err)
+	}
+	if _, err := fm.Append("data.db"); err != nil {
+		t.Fatalf("Failed to append data block: %v", err)
+	}
+	createRecords(t, lm, 1, 20)
+	if err := lm.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	for _, tc := range []struct{ dir, present, absent string }{
+		{logDir, "wal.log", "data.db"},
+		{dataDir, "data.db", "wal.log"},
+	} {
+		if _, err := os.Stat(filepath.Join(tc.dir, tc.present)); err != nil {
+			t.Errorf("Expected %s in %s: %v", tc.present, tc.dir, err)
+		}
+		if _, err := os.Stat(filepath.Join(tc.dir, tc.absent)); !os.IsNotExist(err) {
+			t.Errorf("Expected no %s in %s, got %v", tc.absent, tc.dir, err)
+		}
+	}
+
+	iter, err := lm.Iterator()
+	if err != nil {
+		t.Fatalf("Iterator failed: %v", err)
+	}
+	n := 0
+	for iter.HasNext() {
+		if _, err := iter.Next(); err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		n++
+	}
+	if n != 20 {
+		t.Errorf("Expected to iterate 20 records from the log directory, got %d", n)
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 4096)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	policy := buffer.InitLRU(3, fm)
+	bm := buffer.NewBufferMgr(fm, 3, policy)
+	logMgr, err := NewLogMgr(fm, bm, "group_commit.db")
+	if err != nil {
+		t.Fatalf("Failed to initialize LogMgr: %v", err)
+	}
+
+	// Each commit appends its record, then waits for it to be durable. The
+	// appends all land before any commit flushes, as they would while a
+	// slow sync holds the flushes up, so the commits find each other.
+	const commits = 100
+	before := fm.BlocksWritten()
+	var appended, wg sync.WaitGroup
+	appended.Add(commits)
+	for i := 0; i < commits; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			lsn, _, err := logMgr.Append([]byte(fmt.Sprintf("commit %d", i)))
+			appended.Done()
+			if err != nil {
+				t.Errorf("Append %d failed: %v", i, err)
+				return
+			}
+			appended.Wait()
+			if err := logMgr.FlushUpTo(lsn); err != nil {
+				t.Errorf("FlushUpTo(%d) failed: %v", lsn, err)
+				return
+			}
+			if saved := logMgr.SavedLSN(); saved < lsn {
+				t.Errorf("FlushUpTo(%d) returned with only LSN %d saved", lsn, saved)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	writes := fm.BlocksWritten() - before
+	t.Logf("%d commits took %d log writes", commits, writes)
+	if writes >= commits/2 {
+		t.Errorf("Expected far fewer log writes than %d commits, got %d", commits, writes)
+	}
+
+	// Every commit is on disk: a fresh LogMgr over the file sees them all.
+	if err := logMgr.Close(); err != nil {
+		t.Fatalf("LogMgr Close failed: %v", err)
+	}
+	it, err := utils.NewLogIterator(fm, bm, kfile.NewBlockId("group_commit.db", fm.NewLength("group_commit.db")-1))
+	if err != nil {
+		t.Fatalf("Failed to create iterator: %v", err)
+	}
+	n := 0
+	for it.HasNext() {
+		if _, err := it.Next(); err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		n++
+	}
+	if n != commits {
+		t.Errorf("Expected %d records on disk, got %d", commits, n)
+	}
+}
+
+func TestFlushSyncsLogUnderBatchedSyncPolicy(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 400, kfile.WithSyncPolicy(kfile.SyncOnClose))
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	bm := buffer.NewBufferMgr(fm, 3, buffer.InitLRU(3, fm))
+	lm, err := NewLogMgr(fm, bm, "wal.log")
+	if err != nil {
+		t.Fatalf("Failed to initialize LogMgr: %v", err)
+	}
+
+	// Data files wait for Close, but a commit is durable only once its log
+	// record is synced, so every log write is synced before it returns.
+	if _, err := fm.Append("data.db"); err != nil {
+		t.Fatalf("Failed to append data block: %v", err)
+	}
+	syncs := func() int64 { return fm.LatencyStats().Sync.Count() }
+	before := syncs()
+	lsn, _, err := lm.Append([]byte("commit"))
+	if err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if err := lm.FlushLSN(lsn); err != nil {
+		t.Fatalf("FlushLSN failed: %v", err)
+	}
+	if got := syncs() - before; got != 1 {
+		t.Errorf("Expected the log flush to sync once, got %d syncs", got)
+	}
+	before = syncs()
+	if err := lm.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if got := syncs() - before; got != 1 {
+		t.Errorf("Expected Flush to sync the log, got %d syncs", got)
+	}
+}
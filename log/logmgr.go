@@ -16,6 +16,12 @@ import (
 // This value should ideally be defined in the kfile package.
 var ErrCellTooLarge = errors.New("cell too large full")
 
+// ErrClosed is returned by LogMgr operations attempted after Close.
+var ErrClosed = errors.New("log manager is closed")
+
+// ErrEmptyRecord is returned by Append for a zero-length log record.
+var ErrEmptyRecord = errors.New("empty log record")
+
 // Error wraps an underlying error with an operation context.
 type Error struct {
 	Op  string
@@ -41,6 +47,14 @@ type LogMgr struct {
 	latestLSN      int
 	latestSavedLSN int
 	logSize        int32
+	closed         bool
+	// Group commit, see FlushUpTo: set while a leader writes the log page
+	// without holding mu, and broadcast on flushDone when it is done.
+	flushing  bool
+	flushDone *sync.Cond
+	// switching is set while Append moves the log to a new block, see
+	// switchBlock.
+	switching bool
 }
 
 // NewLogMgr creates a new LogMgr using the provided file and buffer managers.
@@ -54,7 +68,11 @@ func NewLogMgr(fm *kfile.FileMgr, bm *buffer.BufferMgr, logFile string) (*LogMgr
 		bm:      bm,
 		logFile: logFile,
 	}
+	lm.flushDone = sync.NewCond(&lm.mu)
 
+	if err := fm.SetLogFile(logFile); err != nil {
+		return nil, &Error{Op: "new", Err: err}
+	}
 	var err error
 	if lm.logSize, err = fm.Length(logFile); err != nil {
 		return nil, &Error{Op: "new", Err: fmt.Errorf("failed to get log file length: %w", err)}
@@ -68,26 +86,32 @@ func NewLogMgr(fm *kfile.FileMgr, bm *buffer.BufferMgr, logFile string) (*LogMgr
 		if err != nil || lm.currentBlock == nil {
 			return nil, &Error{Op: "new", Err: fmt.Errorf("failed to append initial block: %w", err)}
 		}
-		// Inform the buffer manager that this block is in use.
-		lm.bm.Policy().AllocateBufferForBlock(*lm.currentBlock)
 	} else {
 		// Otherwise, set the current block as the last block.
 		lm.currentBlock = kfile.NewBlockId(logFile, lm.logSize-1)
 	}
 
-	// Pin the current block.
+	// Pin the current block; it stays pinned while the log appends to it.
 	buff, err := bm.Pin(lm.currentBlock)
 	if err != nil {
 		return nil, &Error{Op: "new", Err: fmt.Errorf("failed to pin initial block: %w", err)}
 	}
-	// Initialize the log page's contents.
-	buff.SetContents(logPage)
+	if lm.logSize == 0 {
+		// Initialize the log page's contents.
+		buff.SetContents(logPage)
+	} else {
+		// Continue an existing log: keep the records already in its last
+		// block and number new ones after them, so they sort last.
+		lm.latestLSN = lastLSN(buff.Contents())
+		lm.latestSavedLSN = lm.latestLSN
+	}
 	lm.logBuffer = buff
 
 	// Flush the initial block.
 	if err := lm.logBuffer.Flush(); err != nil {
 		return nil, &Error{Op: "new", Err: fmt.Errorf("failed to flush initial block: %w", err)}
 	}
+	bm.SetLogFlusher(lm.FlushLSN)
 
 	return lm, nil
 }
@@ -111,18 +135,106 @@ func (lm *LogMgr) Iterator() (utils.Iterator[[]byte], error) {
 	return utils.NewLogIterator(lm.fm, lm.bm, lm.currentBlock)
 }
 
+// ForwardIterator returns an iterator over the log records, oldest first.
+// Like Iterator, it first flushes the log to disk.
+func (lm *LogMgr) ForwardIterator() (utils.Iterator[[]byte], error) {
+	if err := lm.Flush(); err != nil {
+		return nil, &Error{Op: "iterator", Err: err}
+	}
+	return utils.NewForwardLogIterator(lm.fm, lm.bm, lm.currentBlock)
+}
+
+// ForwardIteratorFrom is ForwardIterator starting with the record at slot
+// of blk rather than with the oldest one.
+func (lm *LogMgr) ForwardIteratorFrom(blk kfile.BlockId, slot int) (utils.Iterator[[]byte], error) {
+	if err := lm.Flush(); err != nil {
+		return nil, &Error{Op: "iterator", Err: err}
+	}
+	return utils.NewForwardLogIteratorFrom(lm.fm, lm.bm, blk, slot, lm.currentBlock)
+}
+
 // Flush writes the contents of the log buffer to disk and updates the saved LSN.
 func (lm *LogMgr) Flush() error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	return lm.flushLocked()
+}
+
+// flushLocked performs the flush, after any group flush in progress; the
+// caller must hold lm.mu.
+func (lm *LogMgr) flushLocked() error {
+	for lm.flushing {
+		lm.flushDone.Wait()
+	}
+	if lm.closed {
+		return ErrClosed
+	}
 	// Flush the log buffer.
 	if err := lm.logBuffer.LogFlush(lm.currentBlock); err != nil {
 		return err
 	}
-	// Unpin the buffer if needed.
-	lm.bm.Unpin(lm.logBuffer)
 	lm.latestSavedLSN = lm.latestLSN
 	return nil
 }
 
+// FlushLSN makes the log durable up to and including the record with the
+// given LSN. It writes the log buffer only if that record is not on disk yet,
+// sharing the write with concurrent callers as FlushUpTo does.
+func (lm *LogMgr) FlushLSN(lsn int) error {
+	return lm.FlushUpTo(lsn)
+}
+
+// FlushUpTo returns once the log is durable at least through lsn. Concurrent
+// callers commit as a group: one of them, the leader, writes the log page as
+// it stands, covering every record appended so far, while the others wait
+// for that write and return if it covered their record. Appends go on while
+// the leader writes, so the next leader's write covers all the commits that
+// queued up behind the last one, and a burst of commits costs a few writes
+// and syncs rather than one each.
+func (lm *LogMgr) FlushUpTo(lsn int) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	for lm.flushing && lsn > lm.latestSavedLSN {
+		lm.flushDone.Wait()
+	}
+	if lsn <= lm.latestSavedLSN {
+		return nil
+	}
+	if lm.closed {
+		return ErrClosed
+	}
+
+	// Write a copy of the page, so that Append can go on changing the page
+	// itself meanwhile. Anything that moves the log to a new block waits for
+	// this write first, in flushLocked.
+	blk, lastLSN := lm.currentBlock, lm.latestLSN
+	page := lm.logBuffer.Contents()
+	page.UpdateChecksum()
+	snapshot := kfile.NewSlottedPage(lm.fm.BlockSize())
+	if err := snapshot.SetContents(bytes.Clone(page.Contents())); err != nil {
+		return &Error{Op: "flush", Err: err}
+	}
+	lm.flushing = true
+	lm.mu.Unlock()
+	err := lm.fm.Write(blk, snapshot)
+	lm.mu.Lock()
+	lm.flushing = false
+	lm.flushDone.Broadcast()
+	if err != nil {
+		return &Error{Op: "flush", Err: err}
+	}
+	lm.latestSavedLSN = max(lm.latestSavedLSN, lastLSN)
+	return nil
+}
+
+// SavedLSN returns the LSN of the newest log record known to be on disk.
+func (lm *LogMgr) SavedLSN() int {
+	lm.mu.RLock()
+	defer lm.mu.RUnlock()
+	return lm.latestSavedLSN
+}
+
 // appendNewBlock appends a new block to the log file.
 func (lm *LogMgr) appendNewBlock() (*kfile.BlockId, error) {
 	blkNum, err := lm.fm.LengthLocked(lm.logFile)
@@ -136,36 +248,50 @@ func (lm *LogMgr) appendNewBlock() (*kfile.BlockId, error) {
 // Append adds a new log record to the log and returns the LSN and key.
 func (lm *LogMgr) Append(logrec []byte) (int, []byte, error) {
 	if len(logrec) == 0 {
-		return 0, nil, &Error{Op: "append", Err: fmt.Errorf("empty log record")}
+		return 0, nil, &Error{Op: "append", Err: ErrEmptyRecord}
 	}
 
 	lm.mu.Lock()
 	defer lm.mu.Unlock()
 
-	// Generate a unique key for the log record.
-	cellKey := lm.GenerateKey()
-	// Create a new key-value cell with the generated key.
-	cell := kfile.NewKVCell(cellKey)
-	if err := cell.SetValue(logrec); err != nil {
-		return 0, nil, &Error{Op: "append", Err: fmt.Errorf("failed to set log record value: %w", err)}
+	for lm.switching {
+		lm.flushDone.Wait()
+	}
+	if lm.closed {
+		return 0, nil, &Error{Op: "append", Err: ErrClosed}
 	}
 
+	cellKey, cell, err := lm.newCell(logrec)
+	if err != nil {
+		return 0, nil, &Error{Op: "append", Err: err}
+	}
 	// Retrieve the current log page.
 	logPage := lm.logBuffer.Contents()
-	err := logPage.InsertCell(cell)
+	err = logPage.InsertCell(cell)
+	// Moving on to a new block has to wait for a group flush of the current
+	// one, see FlushUpTo, and other appends may go in meanwhile; try again
+	// once it is done.
+	for pageFull(err) && lm.flushing {
+		lm.flushDone.Wait()
+		if lm.closed {
+			return 0, nil, &Error{Op: "append", Err: ErrClosed}
+		}
+		if cellKey, cell, err = lm.newCell(logrec); err != nil {
+			return 0, nil, &Error{Op: "append", Err: err}
+		}
+		logPage = lm.logBuffer.Contents()
+		err = logPage.InsertCell(cell)
+	}
 	if err != nil {
 		// If the cell does not fit in the current page, flush the current block and start a new one.
-		if errors.Is(err, ErrCellTooLarge) {
-			if flushErr := lm.Flush(); flushErr != nil {
+		if pageFull(err) {
+			if flushErr := lm.flushLocked(); flushErr != nil {
 				return 0, nil, &Error{Op: "append", Err: fmt.Errorf("failed to flush current block: %w", flushErr)}
 			}
-			lm.currentBlock, err = lm.appendNewBlock()
-			if err != nil || lm.currentBlock == nil {
-				return 0, nil, &Error{Op: "append", Err: fmt.Errorf("failed to append new block: %w", err)}
+			if err := lm.switchBlock(); err != nil {
+				return 0, nil, &Error{Op: "append", Err: err}
 			}
-			// You may want to inform the buffer manager about the new block.
-			lm.bm.Policy().AllocateBufferForBlock(*lm.currentBlock)
-			// Try inserting again into the new log page.
+			// Try inserting again into the empty page of the new block.
 			logPage = lm.logBuffer.Contents()
 			if err = logPage.InsertCell(cell); err != nil {
 				return 0, nil, &Error{Op: "append", Err: fmt.Errorf("failed to insert cell after appending new block: %w", err)}
@@ -175,25 +301,115 @@ func (lm *LogMgr) Append(logrec []byte) (int, []byte, error) {
 		}
 	}
 
-	// Update the log buffer with the modified log page.
-	lm.logBuffer.SetContents(logPage)
+	// The record went into the log buffer's own page, which iterators
+	// pinning the block read as it is.
 	lm.latestLSN++
 	// Mark the buffer as modified with the new LSN.
 	lm.logBuffer.MarkModified(-1, lm.latestLSN)
 	return lm.latestLSN, cellKey, nil
 }
 
+// switchBlock moves the log buffer to a new block at the end of the log, as
+// NewLogMgr does for the initial one, so that iterators pinning it see the
+// new records. The caller must hold lm.mu and have flushed the current block.
+//
+// Pinning the new block may evict a dirty page, whose flush waits for the
+// log through the page's LSN, see buffer.BufferMgr.SetLogFlusher; so lm.mu is
+// released meanwhile. Every record is on disk by then, so such a wait
+// returns at once, and appends wait for the switch to finish.
+func (lm *LogMgr) switchBlock() error {
+	blk, err := lm.appendNewBlock()
+	if err != nil {
+		return fmt.Errorf("failed to append new block: %w", err)
+	}
+	lm.switching, lm.flushing = true, true
+	lm.mu.Unlock()
+	buff, pinErr := lm.bm.Pin(blk)
+	if pinErr == nil {
+		lm.bm.Unpin(lm.logBuffer)
+	}
+	lm.mu.Lock()
+	lm.switching, lm.flushing = false, false
+	lm.flushDone.Broadcast()
+	if pinErr != nil {
+		return fmt.Errorf("failed to pin new block: %w", pinErr)
+	}
+	lm.currentBlock, lm.logBuffer = blk, buff
+	if lm.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// MaxRecordSize returns the size of the largest record Append takes, one
+// that fills a log page on its own.
+func (lm *LogMgr) MaxRecordSize() int {
+	cell := kfile.NewKVCell(make([]byte, len("log_")+8))
+	_ = cell.SetValue([]byte{})
+	return kfile.MaxCellSize(lm.fm.BlockSize()) - len(cell.ToBytes())
+}
+
+// newCell builds the cell for logrec, keyed by the LSN it will get; the
+// caller must hold lm.mu.
+func (lm *LogMgr) newCell(logrec []byte) ([]byte, *kfile.Cell, error) {
+	// Generate a unique key for the log record.
+	cellKey := lm.GenerateKey()
+	// Create a new key-value cell with the generated key.
+	cell := kfile.NewKVCell(cellKey)
+	if err := cell.SetValue(logrec); err != nil {
+		return nil, nil, fmt.Errorf("failed to set log record value: %w", err)
+	}
+	return cellKey, cell, nil
+}
+
+// pageFull reports whether err says a cell did not fit in the log page.
+func pageFull(err error) bool {
+	return errors.Is(err, ErrCellTooLarge) || errors.Is(err, kfile.ErrPageFull)
+}
+
 // Checkpoint forces a flush of the log.
 func (lm *LogMgr) Checkpoint() error {
 	lm.mu.Lock()
 	defer lm.mu.Unlock()
 
-	if err := lm.Flush(); err != nil {
+	if err := lm.flushLocked(); err != nil {
 		return &Error{Op: "checkpoint", Err: err}
 	}
 	return nil
 }
 
+// Close flushes any buffered log records and marks the LogMgr as closed.
+// It must be called before the BufferMgr and FileMgr are closed; calling it
+// twice is a no-op.
+func (lm *LogMgr) Close() error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	if lm.closed {
+		return nil
+	}
+	if err := lm.flushLocked(); err != nil {
+		return &Error{Op: "close", Err: err}
+	}
+	lm.closed = true
+	lm.bm.Unpin(lm.logBuffer)
+	return nil
+}
+
+// lastLSN returns the LSN encoded in the largest key of a log page, or 0 if
+// the page holds no records.
+func lastLSN(p *kfile.SlottedPage) int {
+	slots := p.GetAllSlots()
+	if len(slots) == 0 {
+		return 0
+	}
+	cell, err := p.GetCellBySlot(len(slots) - 1)
+	if err != nil || len(cell.GetKey()) != len("log_")+8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(cell.GetKey()[len("log_"):]))
+}
+
 // GenerateKey creates a unique key for a new log record.
 func (lm *LogMgr) GenerateKey() []byte {
 	const prefix = "log_"
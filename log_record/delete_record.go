@@ -0,0 +1,109 @@
+package log_record
+
+import (
+	"errors"
+	"fmt"
+	syslog "log"
+	"ultraSQL/kfile"
+	"ultraSQL/log"
+	"ultraSQL/txinterface"
+)
+
+// DeleteCellRecord logs the removal of a cell, keeping the complete cell
+// image so that undo can put it back.
+type DeleteCellRecord struct {
+	txnum     int64
+	blk       kfile.BlockId
+	key       []byte
+	cellBytes []byte
+}
+
+// NewDeleteCellRecord creates a record for deleting the serialized cell from blk.
+func NewDeleteCellRecord(txnum int64, blk kfile.BlockId, key []byte, cellBytes []byte) *DeleteCellRecord {
+	return &DeleteCellRecord{
+		txnum:     txnum,
+		blk:       blk,
+		key:       key,
+		cellBytes: cellBytes,
+	}
+}
+
+// FromBytesDeleteCell creates a DeleteCellRecord from raw bytes
+func FromBytesDeleteCell(data []byte) (*DeleteCellRecord, error) {
+	txnum, blk, key, cellBytes, err := parseCellRecord(data)
+	if err != nil {
+		return nil, err
+	}
+	return NewDeleteCellRecord(txnum, blk, key, cellBytes), nil
+}
+
+func (r *DeleteCellRecord) Op() int32 {
+	return DELETECELL
+}
+
+func (r *DeleteCellRecord) TxNumber() int64 {
+	return r.txnum
+}
+
+func (r *DeleteCellRecord) Block() kfile.BlockId {
+	return r.blk
+}
+
+func (r *DeleteCellRecord) Key() []byte {
+	return r.key
+}
+
+// Undo re-inserts the deleted cell unless it is already present.
+func (r *DeleteCellRecord) Undo(tx txinterface.TxInterface) error {
+	if err := tx.Pin(r.blk); err != nil {
+		return fmt.Errorf("failed to pin block during undo: %w", err)
+	}
+	defer func() {
+		if err := tx.UnPin(r.blk); err != nil {
+			syslog.Printf("failed to unpin block during undo: %v", err)
+		}
+	}()
+
+	if err := putCell(tx, r.blk, r.key, r.cellBytes); err != nil {
+		return fmt.Errorf("failed to restore deleted cell during undo: %w", err)
+	}
+	return nil
+}
+
+// Redo removes the cell again. A cell that is already gone is treated as
+// already redone.
+func (r *DeleteCellRecord) Redo(tx txinterface.TxInterface) error {
+	if err := tx.Pin(r.blk); err != nil {
+		return fmt.Errorf("failed to pin block during redo: %w", err)
+	}
+	defer func() {
+		if err := tx.UnPin(r.blk); err != nil {
+			syslog.Printf("failed to unpin block during redo: %v", err)
+		}
+	}()
+
+	if err := tx.DeleteCell(r.blk, r.key, false); err != nil && !errors.Is(err, kfile.ErrKeyNotFound) {
+		return fmt.Errorf("failed to delete cell during redo: %w", err)
+	}
+	return nil
+}
+
+func (r *DeleteCellRecord) String() string {
+	return fmt.Sprintf("DELETECELL txnum=%d, blk=%s, key=%s, cellBytes=%v",
+		r.txnum, r.blk.String(), r.key, r.cellBytes)
+}
+
+// ToBytes serializes a delete cell record
+func (r *DeleteCellRecord) ToBytes() []byte {
+	return cellRecordBytes(DELETECELL, r.txnum, r.blk, r.key, r.cellBytes)
+}
+
+// DeleteCellRecordWriteToLog writes a delete cell record to the log and returns its LSN.
+func DeleteCellRecordWriteToLog(lm *log.LogMgr, txnum int64, blk kfile.BlockId, key []byte, cellBytes []byte) (int, error) {
+	record := NewDeleteCellRecord(txnum, blk, key, cellBytes)
+	lsn, _, err := lm.Append(record.ToBytes())
+	if err != nil {
+		return -1, fmt.Errorf("failed to write delete cell record to log: %w", err)
+	}
+	return lsn, nil
+}
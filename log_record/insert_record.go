@@ -0,0 +1,200 @@
+package log_record
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	syslog "log"
+	"ultraSQL/kfile"
+	"ultraSQL/log"
+	"ultraSQL/txinterface"
+)
+
+// InsertCellRecord logs the insertion of a complete cell (key and value) so
+// that recovery can undo or redo it in a single step.
+type InsertCellRecord struct {
+	txnum     int64
+	blk       kfile.BlockId
+	key       []byte
+	cellBytes []byte
+}
+
+// NewInsertCellRecord creates a record for inserting the serialized cell into blk.
+func NewInsertCellRecord(txnum int64, blk kfile.BlockId, key []byte, cellBytes []byte) *InsertCellRecord {
+	return &InsertCellRecord{
+		txnum:     txnum,
+		blk:       blk,
+		key:       key,
+		cellBytes: cellBytes,
+	}
+}
+
+// FromBytesInsertCell creates an InsertCellRecord from raw bytes
+func FromBytesInsertCell(data []byte) (*InsertCellRecord, error) {
+	txnum, blk, key, cellBytes, err := parseCellRecord(data)
+	if err != nil {
+		return nil, err
+	}
+	return NewInsertCellRecord(txnum, blk, key, cellBytes), nil
+}
+
+// parseCellRecord decodes the layout shared by cell insert and delete
+// records: type, txnum, filename, block number, key and serialized cell.
+func parseCellRecord(data []byte) (int64, kfile.BlockId, []byte, []byte, error) {
+	buf := bytes.NewBuffer(data)
+
+	// Skip past the record type
+	if err := binary.Read(buf, binary.BigEndian, new(int32)); err != nil {
+		return 0, kfile.BlockId{}, nil, nil, fmt.Errorf("failed to read record type: %w", err)
+	}
+
+	var txnum int64
+	if err := binary.Read(buf, binary.BigEndian, &txnum); err != nil {
+		return 0, kfile.BlockId{}, nil, nil, fmt.Errorf("failed to read transaction number: %w", err)
+	}
+
+	filename, err := readLengthPrefixed(buf)
+	if err != nil {
+		return 0, kfile.BlockId{}, nil, nil, fmt.Errorf("failed to read filename: %w", err)
+	}
+
+	var blkNum int32
+	if err := binary.Read(buf, binary.BigEndian, &blkNum); err != nil {
+		return 0, kfile.BlockId{}, nil, nil, fmt.Errorf("failed to read block number: %w", err)
+	}
+	if blkNum < 0 {
+		return 0, kfile.BlockId{}, nil, nil, fmt.Errorf("negative block number %d", blkNum)
+	}
+
+	key, err := readLengthPrefixed(buf)
+	if err != nil {
+		return 0, kfile.BlockId{}, nil, nil, fmt.Errorf("failed to read key: %w", err)
+	}
+
+	cellBytes, err := readLengthPrefixed(buf)
+	if err != nil {
+		return 0, kfile.BlockId{}, nil, nil, fmt.Errorf("failed to read cell bytes: %w", err)
+	}
+
+	return txnum, *kfile.NewBlockId(string(filename), blkNum), key, cellBytes, nil
+}
+
+// readLengthPrefixed reads a uint32 length followed by that many bytes.
+func readLengthPrefixed(buf *bytes.Buffer) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(buf, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	if int(n) > buf.Len() {
+		return nil, fmt.Errorf("length %d exceeds remaining %d bytes", n, buf.Len())
+	}
+	out := make([]byte, n)
+	copy(out, buf.Next(int(n)))
+	return out, nil
+}
+
+func (r *InsertCellRecord) Op() int32 {
+	return INSERTCELL
+}
+
+func (r *InsertCellRecord) TxNumber() int64 {
+	return r.txnum
+}
+
+func (r *InsertCellRecord) Block() kfile.BlockId {
+	return r.blk
+}
+
+func (r *InsertCellRecord) Key() []byte {
+	return r.key
+}
+
+// Undo removes the inserted cell. A cell that never reached the page (a crash
+// between logging and the page write) is treated as already undone.
+func (r *InsertCellRecord) Undo(tx txinterface.TxInterface) error {
+	if err := tx.Pin(r.blk); err != nil {
+		return fmt.Errorf("failed to pin block during undo: %w", err)
+	}
+	defer func() {
+		if err := tx.UnPin(r.blk); err != nil {
+			syslog.Printf("failed to unpin block during undo: %v", err)
+		}
+	}()
+
+	if err := tx.DeleteCell(r.blk, r.key, false); err != nil && !errors.Is(err, kfile.ErrKeyNotFound) {
+		return fmt.Errorf("failed to remove inserted cell during undo: %w", err)
+	}
+	return nil
+}
+
+// Redo re-inserts the logged cell unless it is already present.
+func (r *InsertCellRecord) Redo(tx txinterface.TxInterface) error {
+	if err := tx.Pin(r.blk); err != nil {
+		return fmt.Errorf("failed to pin block during redo: %w", err)
+	}
+	defer func() {
+		if err := tx.UnPin(r.blk); err != nil {
+			syslog.Printf("failed to unpin block during redo: %v", err)
+		}
+	}()
+
+	if err := putCell(tx, r.blk, r.key, r.cellBytes); err != nil {
+		return fmt.Errorf("failed to redo inserted cell: %w", err)
+	}
+	return nil
+}
+
+func (r *InsertCellRecord) String() string {
+	return fmt.Sprintf("INSERTCELL txnum=%d, blk=%s, key=%s, cellBytes=%v",
+		r.txnum, r.blk.String(), r.key, r.cellBytes)
+}
+
+// ToBytes serializes an insert cell record
+func (r *InsertCellRecord) ToBytes() []byte {
+	return cellRecordBytes(INSERTCELL, r.txnum, r.blk, r.key, r.cellBytes)
+}
+
+// cellRecordBytes encodes the layout read back by parseCellRecord.
+func cellRecordBytes(op int32, txnum int64, blk kfile.BlockId, key []byte, cellBytes []byte) []byte {
+	var buf bytes.Buffer
+
+	if err := binary.Write(&buf, binary.BigEndian, op); err != nil {
+		return nil
+	}
+	if err := binary.Write(&buf, binary.BigEndian, txnum); err != nil {
+		return nil
+	}
+
+	filenameBytes := []byte(blk.FileName())
+	if err := binary.Write(&buf, binary.BigEndian, uint32(len(filenameBytes))); err != nil {
+		return nil
+	}
+	buf.Write(filenameBytes)
+
+	if err := binary.Write(&buf, binary.BigEndian, blk.Number()); err != nil {
+		return nil
+	}
+
+	if err := binary.Write(&buf, binary.BigEndian, uint32(len(key))); err != nil {
+		return nil
+	}
+	buf.Write(key)
+
+	if err := binary.Write(&buf, binary.BigEndian, uint32(len(cellBytes))); err != nil {
+		return nil
+	}
+	buf.Write(cellBytes)
+
+	return buf.Bytes()
+}
+
+// InsertCellRecordWriteToLog writes an insert cell record to the log and returns its LSN.
+func InsertCellRecordWriteToLog(lm *log.LogMgr, txnum int64, blk kfile.BlockId, key []byte, cellBytes []byte) (int, error) {
+	record := NewInsertCellRecord(txnum, blk, key, cellBytes)
+	lsn, _, err := lm.Append(record.ToBytes())
+	if err != nil {
+		return -1, fmt.Errorf("failed to write insert cell record to log: %w", err)
+	}
+	return lsn, nil
+}
@@ -3,6 +3,7 @@ package log_record
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	syslog "log"
 	"ultraSQL/kfile"
@@ -12,6 +13,8 @@ import (
 
 const (
 	UNIFIEDUPDATE = 5 // Add this with other log record type constants
+	INSERTCELL    = 6
+	DELETECELL    = 7
 )
 
 type UnifiedUpdateRecord struct {
@@ -54,6 +57,9 @@ func FromBytesUnifiedUpdate(data []byte) (*UnifiedUpdateRecord, error) {
 	if err := binary.Read(buf, binary.BigEndian, &blkNum); err != nil {
 		return nil, fmt.Errorf("failed to read block number: %w", err)
 	}
+	if blkNum < 0 {
+		return nil, fmt.Errorf("negative block number %d", blkNum)
+	}
 
 	// Read key length
 	var keyLen uint32
@@ -120,55 +126,60 @@ func (r *UnifiedUpdateRecord) TxNumber() int64 {
 	return r.txnum
 }
 
-// Recovery methods
+// Undo puts the cell back as it was before the update.
 func (r *UnifiedUpdateRecord) Undo(tx txinterface.TxInterface) error {
-	// Pin the block
 	if err := tx.Pin(r.blk); err != nil {
 		return fmt.Errorf("failed to pin block during undo: %w", err)
 	}
-
-	// Ensure block is unpinned after we're done
 	defer func() {
 		if err := tx.UnPin(r.blk); err != nil {
-			// Log the error since we can't return it from the defer
 			syslog.Printf("failed to unpin block during undo: %v", err)
 		}
 	}()
 
-	// Insert the old value back
-	if err := tx.InsertCell(r.blk, r.key, r.oldBytes, false); err != nil {
-		syslog.Printf("This is old value %s this is new value %s", r.oldBytes, r.newBytes)
-		return fmt.Errorf("failed to insert old value during undo: %w", err)
+	if err := putCell(tx, r.blk, r.key, r.oldBytes); err != nil {
+		return fmt.Errorf("failed to restore old value during undo: %w", err)
 	}
-
 	return nil
 }
 
+// Redo puts the cell back as it was after the update.
 func (r *UnifiedUpdateRecord) Redo(tx txinterface.TxInterface) error {
-	// Pin the block
 	if err := tx.Pin(r.blk); err != nil {
 		return fmt.Errorf("failed to pin block during redo: %w", err)
 	}
-
-	// Ensure block is unpinned after we're done
 	defer func() {
 		if err := tx.UnPin(r.blk); err != nil {
-			// Log the error since we can't return it from the defer
 			syslog.Printf("failed to unpin block during redo: %v", err)
 		}
 	}()
 
-	// Insert the new value
-	if err := tx.InsertCell(r.blk, r.key, r.newBytes, false); err != nil {
-		return fmt.Errorf("failed to insert new value during redo: %w", err)
+	if err := putCell(tx, r.blk, r.key, r.newBytes); err != nil {
+		return fmt.Errorf("failed to apply new value during redo: %w", err)
 	}
+	return nil
+}
 
+// putCell replaces the cell stored under key in blk, if any, with the
+// serialized cell logged in cellBytes. The logged cell goes back as it was,
+// with its type, flags and timestamps. The caller must have pinned blk.
+func putCell(tx txinterface.TxInterface, blk kfile.BlockId, key []byte, cellBytes []byte) error {
+	cell, err := kfile.CellFromBytes(cellBytes)
+	if err != nil {
+		return fmt.Errorf("failed to decode logged cell: %w", err)
+	}
+	if err := tx.DeleteCell(blk, key, false); err != nil && !errors.Is(err, kfile.ErrKeyNotFound) {
+		return fmt.Errorf("failed to clear cell: %w", err)
+	}
+	if err := tx.RestoreCell(blk, cell); err != nil {
+		return fmt.Errorf("failed to insert cell: %w", err)
+	}
 	return nil
 }
 
 func (r *UnifiedUpdateRecord) String() string {
 	return fmt.Sprintf("UNIFIEDUPDATE txnum=%d, blk=%s, key=%s, oldBytes=%v, newBytes=%v",
-		r.txnum, r.blk, r.key, r.oldBytes, r.newBytes)
+		r.txnum, r.blk.String(), r.key, r.oldBytes, r.newBytes)
 }
 
 // ToBytes serializes a unified update record
@@ -245,44 +256,50 @@ func WriteToLog(lm *log.LogMgr, txnum int64, blk kfile.BlockId, key []byte, oldB
 	return lsn
 }
 
+// CreateLogRecord parses a log record, returning nil if it cannot be
+// parsed. Use ParseLogRecord to learn why.
 func CreateLogRecord(data []byte) Ilog_record {
+	rec, err := ParseLogRecord(data)
+	if err != nil {
+		return nil
+	}
+	return rec
+}
+
+// ErrMalformedRecord is returned by ParseLogRecord for bytes that do not
+// hold a known, complete log record.
+var ErrMalformedRecord = errors.New("malformed log record")
+
+// ParseLogRecord parses a log record, returning an error wrapping
+// ErrMalformedRecord if the op code is unknown or the record is truncated.
+func ParseLogRecord(data []byte) (Ilog_record, error) {
 	// Peek at op code
 	if len(data) < 4 {
-		return nil
+		return nil, fmt.Errorf("%w: %d bytes is too short for an op code", ErrMalformedRecord, len(data))
 	}
 	op := int32(binary.BigEndian.Uint32(data[0:4]))
+	var rec Ilog_record
+	var err error
 	switch op {
 	case CHECKPOINT:
-		rec, err := NewCheckpointRecordFromBytes(data)
-		if err != nil {
-			return nil
-		}
-		return rec
+		rec, err = NewCheckpointRecordFromBytes(data)
 	case START:
-		rec, err := NewStartRecordFromBytes(data)
-		if err != nil {
-			return nil
-		}
-		return rec
+		rec, err = NewStartRecordFromBytes(data)
 	case COMMIT:
-		rec, err := NewCommitRecordFromBytes(data)
-		if err != nil {
-			return nil
-		}
-		return rec
+		rec, err = NewCommitRecordFromBytes(data)
 	case ROLLBACK:
-		rec, err := NewRollbackRecordFromBytes(data)
-		if err != nil {
-			return nil
-		}
-		return rec
+		rec, err = NewRollbackRecordFromBytes(data)
 	case UNIFIEDUPDATE:
-		rec, err := FromBytesUnifiedUpdate(data)
-		if err != nil {
-			return nil
-		}
-		return rec
+		rec, err = FromBytesUnifiedUpdate(data)
+	case INSERTCELL:
+		rec, err = FromBytesInsertCell(data)
+	case DELETECELL:
+		rec, err = FromBytesDeleteCell(data)
 	default:
-		return nil
+		return nil, fmt.Errorf("%w: unknown op code %d", ErrMalformedRecord, op)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: op %d: %w", ErrMalformedRecord, op, err)
 	}
+	return rec, nil
 }
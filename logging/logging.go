@@ -0,0 +1,22 @@
+// Package logging provides the default logger for the storage engine's
+// diagnostic output. Components log through a *slog.Logger that discards
+// everything unless the application installs its own.
+package logging
+
+import (
+	"context"
+	"log/slog"
+)
+
+// discardHandler drops every record.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// Discard returns a logger that produces no output.
+func Discard() *slog.Logger {
+	return slog.New(discardHandler{})
+}
@@ -0,0 +1,7 @@
+package recovery
+
+// DoRecover exposes doRecover to the external test package.
+func (r *Mgr) DoRecover() int {
+	peak, _ := r.doRecover()
+	return peak
+}
@@ -1,19 +1,69 @@
 package recovery
 
 import (
+	"errors"
 	"fmt"
 	"ultraSQL/buffer"
+	"ultraSQL/kfile"
 	"ultraSQL/log"
 	"ultraSQL/log_record"
 	"ultraSQL/txinterface"
+	"ultraSQL/utils"
 )
 
+// ErrCorruptLog is returned by Recover and Rollback when a log record older
+// than the newest one cannot be parsed. Skipping it could skip an undo, so
+// the scan stops instead; EnableLogRepair lets it quarantine the record.
+var ErrCorruptLog = errors.New("corrupt log record")
+
+// QuarantinedRecord is a log record that failed to parse and was removed
+// from the log by a scan with log repair enabled.
+type QuarantinedRecord struct {
+	Block kfile.BlockId // log block that held the record
+	Slot  int           // slot of the record within the block
+	Data  []byte        // the raw record
+	Err   error         // why it failed to parse
+}
+
+// CommitMode selects when Commit forces the commit record to disk.
+type CommitMode int
+
+const (
+	// SyncCommit flushes the log through the commit record before Commit
+	// returns. It is the default.
+	SyncCommit CommitMode = iota
+	// DelayedCommit only appends the commit record. It becomes durable with
+	// the next log flush, such as a later synchronous commit, a checkpoint
+	// or LogMgr.FlushLSN, and is lost if the system crashes first. The
+	// transaction's pages are not flushed either: they must not reach disk
+	// before the log does, so the caller flushes them after the log.
+	DelayedCommit
+)
+
+// CommitResult reports where a commit record landed in the log and whether
+// it was already on disk when Commit returned. A caller holding a
+// non-durable result can wait for durability with LogMgr.FlushLSN(LSN).
+type CommitResult struct {
+	LSN     int
+	Durable bool
+}
+
 // Mgr manages the logging and recovery for a given transaction.
 type Mgr struct {
-	lm    *log.LogMgr
-	bm    *buffer.BufferMgr
-	tx    txinterface.TxInterface
-	txNum int64
+	lm         *log.LogMgr
+	bm         *buffer.BufferMgr
+	tx         txinterface.TxInterface
+	txNum      int64
+	commitMode CommitMode
+
+	repairLog   bool
+	quarantined []QuarantinedRecord
+	redo        bool
+}
+
+// redoer is implemented by the log records that can be replayed.
+type redoer interface {
+	Redo(tx txinterface.TxInterface) error
 }
 
 func NewRecoveryMgr(tx txinterface.TxInterface, txNum int64, lm *log.LogMgr, bm *buffer.BufferMgr) *Mgr {
@@ -31,28 +81,59 @@ func NewRecoveryMgr(tx txinterface.TxInterface, txNum int64, lm *log.LogMgr, bm
 	return rm
 }
 
-func (r *Mgr) Commit() error {
+// SetCommitMode selects how later calls to Commit treat durability.
+func (r *Mgr) SetCommitMode(mode CommitMode) {
+	r.commitMode = mode
+}
 
-	r.bm.Policy().FlushAll(r.txNum)
+// EnableLogRepair makes later scans of the log remove corrupt records other
+// than the newest, instead of stopping with ErrCorruptLog. Each removed
+// record is reported by Quarantined so it can be examined or kept aside.
+// Only use it once the loss of whatever the records described is accepted.
+func (r *Mgr) EnableLogRepair() {
+	r.repairLog = true
+}
+
+// EnableRedo makes later calls to Recover also replay the updates of
+// committed transactions, oldest first, once the undo pass is done. Without
+// it recovery only undoes, relying on commits having flushed their pages.
+func (r *Mgr) EnableRedo() {
+	r.redo = true
+}
+
+// Quarantined returns the records removed from the log under
+// EnableLogRepair, oldest removal first.
+func (r *Mgr) Quarantined() []QuarantinedRecord {
+	return append([]QuarantinedRecord(nil), r.quarantined...)
+}
+
+func (r *Mgr) Commit() (CommitResult, error) {
+	if r.commitMode == SyncCommit {
+		r.bm.Policy().FlushAll(r.txNum)
+	}
 	lsn, err := log_record.CommitRecordWriteToLog(r.lm, r.txNum)
 	if err != nil {
-		return fmt.Errorf("error occurred during commit: %v\n", err)
+		return CommitResult{LSN: -1}, fmt.Errorf("error occurred during commit: %v\n", err)
 	}
-	flushErr := r.lm.Buffer().FlushLSN(lsn)
-	if flushErr != nil {
-		return fmt.Errorf("error occurred during commit flush: %v\n", flushErr)
+	if r.commitMode == SyncCommit {
+		flushErr := r.lm.FlushLSN(lsn)
+		if flushErr != nil {
+			return CommitResult{LSN: lsn}, fmt.Errorf("error occurred during commit flush: %v\n", flushErr)
+		}
 	}
-	return nil
+	return CommitResult{LSN: lsn, Durable: lsn <= r.lm.SavedLSN()}, nil
 }
 
 func (r *Mgr) Rollback() error {
-	r.doRollback()
+	if err := r.doRollback(); err != nil {
+		return fmt.Errorf("error occurred during rollback: %w", err)
+	}
 	r.bm.Policy().FlushAll(r.txNum)
 	lsn, err := log_record.RollbackRecordWriteToLog(r.lm, r.txNum)
 	if err != nil {
 		return fmt.Errorf("error occurred during rollback: %v\n", err)
 	}
-	flushErr := r.lm.Buffer().FlushLSN(lsn)
+	flushErr := r.lm.FlushLSN(lsn)
 	if flushErr != nil {
 		return fmt.Errorf("error occurred during rollback flush: %v\n", flushErr)
 	}
@@ -60,21 +141,23 @@ func (r *Mgr) Rollback() error {
 }
 
 func (r *Mgr) Recover() error {
-	r.doRecover()
+	if _, err := r.doRecover(); err != nil {
+		return fmt.Errorf("error occurred during recovery: %w", err)
+	}
 	r.bm.Policy().FlushAll(r.txNum)
 	lsn, err := log_record.CheckpointRecordWriteToLog(r.lm)
 	if err != nil {
 		return fmt.Errorf("error occurred during recovery checkpoint: %v\n", err)
 	}
-	flushErr := r.lm.Buffer().FlushLSN(lsn)
+	flushErr := r.lm.FlushLSN(lsn)
 	if flushErr != nil {
 		return fmt.Errorf("error occurred during recovery flush: %v\n", flushErr)
 	}
 	return nil
 }
 
-// SetCellValue updates the cell in a slotted page, then writes a unified log record
-// that stores the old/new serialized cell bytes for undo/redo.
+// SetCellValue writes a unified log record that stores the old/new serialized
+// cell bytes for undo/redo, then updates the cell in the slotted page.
 func (r *Mgr) SetCellValue(buff *buffer.Buffer, key []byte, newVal any) (int, error) {
 	// 1. Get the slotted page from the buffer.
 	sp := buff.Contents()
@@ -100,71 +183,209 @@ func (r *Mgr) SetCellValue(buff *buffer.Buffer, key []byte, newVal any) (int, er
 	blk := buff.Block() // or any *BlockId if your Buffer returns it
 	lsn := log_record.WriteToLog(r.lm, r.txNum, *blk, key, oldBytes, newBytes)
 
-	// 7. Return the LSN so the caller can handle further flush or keep track of it.
+	// 7. Apply the update to the page now that it is logged.
+	if err := sp.UpdateCell(key, newVal); err != nil {
+		return -1, fmt.Errorf("failed to update cell %s: %w", key, err)
+	}
+	buff.MarkModified(r.txNum, lsn)
+
+	// 8. Return the LSN so the caller can handle further flush or keep track of it.
 	return lsn, nil
 }
 
+// LogInsertCell writes a single log record capturing the complete cell (key
+// and value) about to be inserted into the buffer's block. Callers must log
+// before modifying the page so that recovery never sees a half-inserted cell.
+func (r *Mgr) LogInsertCell(buff *buffer.Buffer, cell *kfile.Cell) (int, error) {
+	blk := buff.Block()
+	if blk == nil {
+		return -1, fmt.Errorf("buffer is not assigned to a block")
+	}
+	return log_record.InsertCellRecordWriteToLog(r.lm, r.txNum, *blk, cell.GetKey(), cell.ToBytes())
+}
+
+// LogDeleteCell writes a single log record capturing the complete cell about
+// to be removed from the buffer's block, so that undo can restore it.
+func (r *Mgr) LogDeleteCell(buff *buffer.Buffer, cell *kfile.Cell) (int, error) {
+	blk := buff.Block()
+	if blk == nil {
+		return -1, fmt.Errorf("buffer is not assigned to a block")
+	}
+	return log_record.DeleteCellRecordWriteToLog(r.lm, r.txNum, *blk, cell.GetKey(), cell.ToBytes())
+}
+
+// nextRecord reads and parses the next record of a backward log scan. A
+// record that fails to parse is skipped with a warning if it is the newest
+// one, first in the scan, since a crash can tear the tail of the log. Any
+// older one stops the scan with ErrCorruptLog, or is quarantined when log
+// repair is enabled. Skipped records come back as nil with no error.
+func (r *Mgr) nextRecord(iter utils.Iterator[[]byte], first bool) (log_record.Ilog_record, error) {
+	data, err := iter.Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read next log record: %w", err)
+	}
+	rec, parseErr := log_record.ParseLogRecord(data)
+	if parseErr == nil {
+		return rec, nil
+	}
+	var blk kfile.BlockId
+	slot := -1
+	logIter, positioned := iter.(*utils.LogIterator)
+	if positioned {
+		blk, slot = logIter.Position()
+	}
+	switch {
+	case first:
+		r.bm.Logger().Warn("skipping torn record at the tail of the log", "block", blk.String(), "slot", slot, "err", parseErr)
+		return nil, nil
+	case r.repairLog && positioned:
+		if err := logIter.Remove(); err != nil {
+			return nil, fmt.Errorf("failed to quarantine log record at block %v slot %d: %w", &blk, slot, err)
+		}
+		r.quarantined = append(r.quarantined, QuarantinedRecord{Block: blk, Slot: slot, Data: data, Err: parseErr})
+		r.bm.Logger().Warn("quarantined corrupt log record", "block", blk.String(), "slot", slot, "err", parseErr)
+		return nil, nil
+	}
+	return nil, fmt.Errorf("%w at block %v slot %d: %w", ErrCorruptLog, &blk, slot, parseErr)
+}
+
 // doRollback performs a backward scan of the log to undo any record belonging to this transaction.
-func (r *Mgr) doRollback() {
+func (r *Mgr) doRollback() error {
 	iter, err := r.lm.Iterator()
 	if err != nil {
-		fmt.Printf("error occurred creating log iterator: %v\n", err)
-		return
+		return fmt.Errorf("failed to create log iterator: %w", err)
 	}
-	for iter.HasNext() {
-		data, err := iter.Next()
+	if closer, ok := iter.(interface{ Close() }); ok {
+		defer closer.Close()
+	}
+	for first := true; iter.HasNext(); first = false {
+		rec, err := r.nextRecord(iter, first)
 		if err != nil {
-			fmt.Printf("error occurred reading next log record: %v\n", err)
-			return
+			return err
 		}
-		rec := log_record.CreateLogRecord(data) // e.g. UnifiedUpdateRecord or other record
 		if rec == nil {
 			continue
 		}
 		if rec.TxNumber() == r.txNum {
 			if rec.Op() == log_record.START {
 				// Once we reach the START record for our transaction, we stop
-				return
+				return nil
 			}
-			err := rec.Undo(r.tx)
-			if err != nil {
-				return
+			if err := rec.Undo(r.tx); err != nil {
+				return fmt.Errorf("undo of %v: %w", rec, err)
 			}
 		}
 	}
+	return nil
 }
 
-// doRecover replays the log from the end, undoing updates for transactions that never committed.
-func (r *Mgr) doRecover() {
+// doRecover replays the log from the end, undoing updates for transactions
+// that never committed, and returns the largest number of finished
+// transactions it had to remember at once. Under EnableRedo it then redoes
+// the committed transactions with doRedo, from the checkpoint the scan
+// stopped at. It fails on a corrupt log record, see nextRecord, and on a
+// failed undo or redo; Recover then writes no checkpoint, so the next
+// recovery scans the same records again.
+//
+// Checkpoints are only written while no transaction is active, so the scan
+// stops at the last one. Before that, a finished transaction is forgotten as
+// soon as its START record is reached, since no older record can belong to
+// it. Memory is therefore bounded by the number of transactions that
+// overlap at any point of the scanned log, not by the length of the log.
+func (r *Mgr) doRecover() (int, error) {
 	finishedTxs := make(map[int64]bool)
+	committed := make(map[int64]bool)
+	peak := 0
+	var checkpoint *kfile.BlockId
+	checkpointSlot := 0
 
 	iter, err := r.lm.Iterator()
 	if err != nil {
-		fmt.Printf("error occurred creating log iterator: %v\n", err)
-		return
+		return peak, fmt.Errorf("failed to create log iterator: %w", err)
 	}
-	for iter.HasNext() {
-		data, err := iter.Next()
+	if closer, ok := iter.(interface{ Close() }); ok {
+		defer closer.Close()
+	}
+scan:
+	for first := true; iter.HasNext(); first = false {
+		rec, err := r.nextRecord(iter, first)
 		if err != nil {
-			fmt.Printf("error occurred reading next log record: %v\n", err)
-			return
+			return peak, err
 		}
-		rec := log_record.CreateLogRecord(data)
 		if rec == nil {
 			continue
 		}
 		switch rec.Op() {
 		case log_record.CHECKPOINT:
-			return
+			if logIter, ok := iter.(*utils.LogIterator); ok {
+				blk, slot := logIter.Position()
+				checkpoint, checkpointSlot = &blk, slot
+			}
+			break scan
+		case log_record.START:
+			delete(finishedTxs, rec.TxNumber())
 		case log_record.COMMIT, log_record.ROLLBACK:
 			finishedTxs[rec.TxNumber()] = true
+			peak = max(peak, len(finishedTxs))
+			if r.redo && rec.Op() == log_record.COMMIT {
+				committed[rec.TxNumber()] = true
+			}
 		default:
 			if !finishedTxs[rec.TxNumber()] {
-				err := rec.Undo(r.tx)
-				if err != nil {
-					return
+				if err := rec.Undo(r.tx); err != nil {
+					return peak, fmt.Errorf("undo of %v: %w", rec, err)
 				}
 			}
 		}
 	}
+	if r.redo {
+		// Release the backward scan's log page before the forward one pins.
+		if closer, ok := iter.(interface{ Close() }); ok {
+			closer.Close()
+		}
+		return peak, r.doRedo(committed, checkpoint, checkpointSlot)
+	}
+	return peak, nil
+}
+
+// doRedo replays the log oldest first, redoing the updates of the
+// transactions in committed. It starts at slot of checkpoint, or at the
+// start of the log if there was none: every page change logged before a
+// checkpoint is already on disk, and older records may carry the numbers of
+// transactions in committed from an earlier run. Records that fail to parse
+// are skipped: the backward scan of doRecover has already refused or
+// quarantined every corrupt record other than a torn tail.
+func (r *Mgr) doRedo(committed map[int64]bool, checkpoint *kfile.BlockId, slot int) error {
+	if len(committed) == 0 {
+		return nil
+	}
+	var iter utils.Iterator[[]byte]
+	var err error
+	if checkpoint != nil {
+		iter, err = r.lm.ForwardIteratorFrom(*checkpoint, slot)
+	} else {
+		iter, err = r.lm.ForwardIterator()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create forward log iterator: %w", err)
+	}
+	if closer, ok := iter.(interface{ Close() }); ok {
+		defer closer.Close()
+	}
+	for iter.HasNext() {
+		data, err := iter.Next()
+		if err != nil {
+			return fmt.Errorf("failed to read next log record: %w", err)
+		}
+		rec, err := log_record.ParseLogRecord(data)
+		if err != nil || !committed[rec.TxNumber()] {
+			continue
+		}
+		if rr, ok := rec.(redoer); ok {
+			if err := rr.Redo(r.tx); err != nil {
+				return fmt.Errorf("failed to redo %v: %w", rec, err)
+			}
+		}
+	}
+	return nil
 }
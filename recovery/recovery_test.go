@@ -1,8 +1,11 @@
 package recovery_test
 
 import (
+	"bytes"
+	"errors"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 	"ultraSQL/transaction"
@@ -51,7 +54,8 @@ func TestRecoveryMgrLifecycle(t *testing.T) {
 		t.Fatalf("Failed to create LogMgr: %v", err)
 	}
 	// Create the transaction manager.
-	txMgr := transaction.NewTransaction(fm, lm, bm)
+	txm := transaction.NewTxMgr(fm, lm, bm)
+	txMgr := txm.NewTransaction()
 	if txMgr == nil {
 		t.Fatal("Transaction manager is nil")
 	}
@@ -65,7 +69,7 @@ func TestRecoveryMgrLifecycle(t *testing.T) {
 	// Start record should have been written. We'll verify it shortly.
 
 	// 4) Test Commit
-	if err := rm.Commit(); err != nil {
+	if _, err := rm.Commit(); err != nil {
 		t.Errorf("Commit returned error: %v", err)
 	}
 
@@ -121,3 +125,516 @@ func TestRecoveryMgrLifecycle(t *testing.T) {
 		t.Errorf("Expected fourth log record to be START, got %v", ops[3])
 	}
 }
+
+func TestRecoverTracksBoundedTransactions(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 4096)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	bm := buffer.NewBufferMgr(fm, 8, buffer.InitLRU(8, fm))
+	lm, err := log.NewLogMgr(fm, bm, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to create LogMgr: %v", err)
+	}
+	write := func(_ int, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("Failed to write log record: %v", err)
+		}
+	}
+
+	// A long history of finished transactions, some of them overlapping.
+	for txnum := int64(1000); txnum < 1400; txnum += 2 {
+		write(log_record.StartRecordWriteToLog(lm, txnum))
+		write(log_record.StartRecordWriteToLog(lm, txnum+1))
+		write(log_record.CommitRecordWriteToLog(lm, txnum))
+		write(log_record.RollbackRecordWriteToLog(lm, txnum+1))
+	}
+	txm := transaction.NewTxMgr(fm, lm, bm)
+	tx := txm.NewTransaction()
+	rm := recovery.NewRecoveryMgr(tx, 5000, lm, bm)
+	if peak := rm.DoRecover(); peak > 2 {
+		t.Errorf("Expected at most the 2 overlapping transactions to be tracked, got %d", peak)
+	}
+
+	// After a checkpoint only the transactions that follow it are scanned.
+	write(log_record.CheckpointRecordWriteToLog(lm))
+	for txnum := int64(2000); txnum < 2003; txnum++ {
+		write(log_record.StartRecordWriteToLog(lm, txnum))
+	}
+	for txnum := int64(2000); txnum < 2003; txnum++ {
+		write(log_record.CommitRecordWriteToLog(lm, txnum))
+	}
+	if peak := rm.DoRecover(); peak != 3 {
+		t.Errorf("Expected the 3 post-checkpoint transactions to be tracked, got %d", peak)
+	}
+}
+
+func TestCommitReportsDurability(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 4096)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	bm := buffer.NewBufferMgr(fm, 8, buffer.InitLRU(8, fm))
+	lm, err := log.NewLogMgr(fm, bm, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to create LogMgr: %v", err)
+	}
+	txm := transaction.NewTxMgr(fm, lm, bm)
+	tx := txm.NewTransaction()
+
+	delayed := recovery.NewRecoveryMgr(tx, 1, lm, bm)
+	delayed.SetCommitMode(recovery.DelayedCommit)
+	res, err := delayed.Commit()
+	if err != nil {
+		t.Fatalf("Delayed commit failed: %v", err)
+	}
+	if res.Durable || lm.SavedLSN() >= res.LSN {
+		t.Errorf("Expected delayed commit at LSN %d to be buffered, got %+v with saved LSN %d", res.LSN, res, lm.SavedLSN())
+	}
+
+	// A synchronous commit is durable, and so is everything logged before it.
+	synced, err := recovery.NewRecoveryMgr(tx, 2, lm, bm).Commit()
+	if err != nil {
+		t.Fatalf("Sync commit failed: %v", err)
+	}
+	if !synced.Durable || synced.LSN <= res.LSN {
+		t.Errorf("Expected a durable commit after LSN %d, got %+v", res.LSN, synced)
+	}
+	if lm.SavedLSN() < res.LSN {
+		t.Errorf("Expected the earlier delayed commit to be on disk, saved LSN %d", lm.SavedLSN())
+	}
+
+	// A delayed commit can be made durable explicitly.
+	delayed = recovery.NewRecoveryMgr(tx, 3, lm, bm)
+	delayed.SetCommitMode(recovery.DelayedCommit)
+	if res, err = delayed.Commit(); err != nil || res.Durable {
+		t.Fatalf("Expected a buffered delayed commit, got %+v, %v", res, err)
+	}
+	if err := lm.FlushLSN(res.LSN); err != nil {
+		t.Fatalf("FlushLSN failed: %v", err)
+	}
+	if lm.SavedLSN() < res.LSN {
+		t.Errorf("Expected FlushLSN to make LSN %d durable, saved LSN %d", res.LSN, lm.SavedLSN())
+	}
+}
+
+func TestRecoverRefusesCorruptMiddleRecord(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 4096)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	bm := buffer.NewBufferMgr(fm, 8, buffer.InitLRU(8, fm))
+	lm, err := log.NewLogMgr(fm, bm, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to create LogMgr: %v", err)
+	}
+	write := func(_ int, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("Failed to write log record: %v", err)
+		}
+	}
+	// An insert record cut short after its transaction number.
+	corrupt := []byte{0, 0, 0, log_record.INSERTCELL, 0, 0, 0, 0, 0, 0, 0, 7}
+
+	// A torn record at the tail of the log is skipped.
+	txm := transaction.NewTxMgr(fm, lm, bm)
+	tx := txm.NewTransaction()
+	rm := recovery.NewRecoveryMgr(tx, 5000, lm, bm)
+	write(log_record.StartRecordWriteToLog(lm, 7))
+	write(log_record.CommitRecordWriteToLog(lm, 7))
+	if _, _, err := lm.Append(corrupt); err != nil {
+		t.Fatalf("Failed to append corrupt record: %v", err)
+	}
+	if err := rm.Recover(); err != nil {
+		t.Fatalf("Expected recovery to skip a torn tail record, got %v", err)
+	}
+
+	// The same record in the middle of the log, past the checkpoint Recover
+	// just wrote, stops recovery with its position.
+	write(log_record.StartRecordWriteToLog(lm, 8))
+	if _, _, err := lm.Append(corrupt); err != nil {
+		t.Fatalf("Failed to append corrupt record: %v", err)
+	}
+	write(log_record.CommitRecordWriteToLog(lm, 8))
+	err = rm.Recover()
+	if !errors.Is(err, recovery.ErrCorruptLog) {
+		t.Fatalf("Expected ErrCorruptLog for a corrupt middle record, got %v", err)
+	}
+	if !errors.Is(err, log_record.ErrMalformedRecord) || !strings.Contains(err.Error(), "log_test.db") {
+		t.Errorf("Expected the error to explain the record and name its log block, got %v", err)
+	}
+	if err := rm.Rollback(); !errors.Is(err, recovery.ErrCorruptLog) {
+		t.Errorf("Expected rollback to stop at the corrupt record too, got %v", err)
+	}
+
+	// With repair enabled the record is quarantined and recovery completes;
+	// afterwards the log is clean even without repair.
+	repairing := recovery.NewRecoveryMgr(tx, 5001, lm, bm)
+	repairing.EnableLogRepair()
+	if err := repairing.Recover(); err != nil {
+		t.Fatalf("Expected recovery with repair to succeed, got %v", err)
+	}
+	quarantined := repairing.Quarantined()
+	if len(quarantined) != 1 || !bytes.Equal(quarantined[0].Data, corrupt) {
+		t.Fatalf("Expected the corrupt record to be quarantined, got %+v", quarantined)
+	}
+	if quarantined[0].Block.FileName() != "log_test.db" {
+		t.Errorf("Expected the quarantined record to come from the log, got block %v", &quarantined[0].Block)
+	}
+	write(log_record.StartRecordWriteToLog(lm, 9))
+	if err := recovery.NewRecoveryMgr(tx, 5002, lm, bm).Recover(); err != nil {
+		t.Errorf("Expected recovery after repair to succeed, got %v", err)
+	}
+}
+
+func TestRecoverRedoesCommittedUpdates(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 4096)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	bm := buffer.NewBufferMgr(fm, 8, buffer.InitLRU(8, fm))
+	lm, err := log.NewLogMgr(fm, bm, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to create LogMgr: %v", err)
+	}
+	blk, err := fm.Append("data.db")
+	if err != nil {
+		t.Fatalf("Failed to append block: %v", err)
+	}
+	write := func(_ int, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("Failed to write log record: %v", err)
+		}
+	}
+	logInsert := func(txnum int64, key, val string) {
+		t.Helper()
+		cell := kfile.NewKVCell([]byte(key))
+		if err := cell.SetValue(val); err != nil {
+			t.Fatalf("SetValue failed: %v", err)
+		}
+		write(log_record.InsertCellRecordWriteToLog(lm, txnum, *blk, cell.GetKey(), cell.ToBytes()))
+	}
+
+	// Inserts that were logged but whose page never reached disk: one
+	// committed, one still in flight at the crash.
+	txm := transaction.NewTxMgr(fm, lm, bm)
+	tx := txm.NewTransaction()
+	rm := recovery.NewRecoveryMgr(tx, 5000, lm, bm)
+	write(log_record.StartRecordWriteToLog(lm, 7))
+	write(log_record.StartRecordWriteToLog(lm, 8))
+	logInsert(7, "committed", "kept")
+	logInsert(8, "uncommitted", "lost")
+	write(log_record.CommitRecordWriteToLog(lm, 7))
+
+	rm.EnableRedo()
+	if err := rm.Recover(); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+	cell, err := tx.FindCell(*blk, []byte("committed"))
+	if err != nil {
+		t.Fatalf("Expected the committed insert to be redone: %v", err)
+	}
+	if v, err := cell.GetValue(); err != nil || v != "kept" {
+		t.Errorf("Expected the redone cell to hold %q, got %v (%v)", "kept", v, err)
+	}
+	if _, err := tx.FindCell(*blk, []byte("uncommitted")); !errors.Is(err, kfile.ErrKeyNotFound) {
+		t.Errorf("Expected the uncommitted insert not to be redone, got %v", err)
+	}
+}
+
+func TestRecoverReportsFailedUndo(t *testing.T) {
+	dir := t.TempDir()
+	fm, lm, _ := openCrashed(t, dir)
+	blk, err := fm.Append("data.db")
+	if err != nil {
+		t.Fatalf("Failed to append block: %v", err)
+	}
+	cell := kfile.NewKVCell([]byte("k"))
+	if err := cell.SetValue("v"); err != nil {
+		t.Fatalf("SetValue failed: %v", err)
+	}
+	page := kfile.NewSlottedPage(fm.BlockSize())
+	if err := page.InsertCell(cell); err != nil {
+		t.Fatalf("InsertCell failed: %v", err)
+	}
+	page.UpdateChecksum()
+	if err := fm.Write(blk, page); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	// An uncommitted insert whose page is then damaged on disk, so that
+	// undoing it cannot pin the block.
+	if _, err := log_record.StartRecordWriteToLog(lm, 8); err != nil {
+		t.Fatalf("Failed to write log record: %v", err)
+	}
+	lsn, err := log_record.InsertCellRecordWriteToLog(lm, 8, *blk, cell.GetKey(), cell.ToBytes())
+	if err != nil {
+		t.Fatalf("Failed to write log record: %v", err)
+	}
+	if err := lm.FlushLSN(lsn); err != nil {
+		t.Fatalf("FlushLSN failed: %v", err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "data.db"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Failed to open data file: %v", err)
+	}
+	if _, err := f.WriteAt([]byte{0xff}, int64(fm.BlockSize()-1)); err != nil {
+		t.Fatalf("Failed to damage data file: %v", err)
+	}
+	f.Close()
+
+	fm2, lm2, bm2 := openCrashed(t, dir)
+	tx := transaction.NewTxMgr(fm2, lm2, bm2).NewTransaction()
+	rm := recovery.NewRecoveryMgr(tx, tx.GetTxNum(), lm2, bm2)
+	err = rm.Recover()
+	if !errors.Is(err, kfile.ErrChecksumMismatch) || !strings.Contains(err.Error(), "undo of") {
+		t.Fatalf("Expected Recover to report the failed undo, got %v", err)
+	}
+
+	// No checkpoint follows a failed recovery, so the next one retries.
+	iter, err := lm2.Iterator()
+	if err != nil {
+		t.Fatalf("Iterator failed: %v", err)
+	}
+	for iter.HasNext() {
+		data, err := iter.Next()
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		rec, err := log_record.ParseLogRecord(data)
+		if err != nil {
+			t.Fatalf("ParseLogRecord failed: %v", err)
+		}
+		if rec.Op() == log_record.CHECKPOINT {
+			t.Fatal("Expected no checkpoint after a failed recovery")
+		}
+	}
+}
+
+// openCrashed opens the database in dir as a restart after a crash would:
+// whatever the previous managers had not written is lost.
+func openCrashed(t *testing.T, dir string) (*kfile.FileMgr, *log.LogMgr, *buffer.BufferMgr) {
+	t.Helper()
+	fm, err := kfile.NewFileMgr(dir, 4096)
+	if err != nil {
+		t.Fatalf("Failed to open FileMgr: %v", err)
+	}
+	t.Cleanup(func() { fm.Close() })
+	bm := buffer.NewBufferMgr(fm, 8, buffer.InitLRU(8, fm))
+	lm, err := log.NewLogMgr(fm, bm, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to open LogMgr: %v", err)
+	}
+	return fm, lm, bm
+}
+
+// recoverWithRedo reopens the database in dir after a crash, runs recovery
+// with redo in a fresh transaction and returns it for checking the result.
+func recoverWithRedo(t *testing.T, dir string) *transaction.Mgr {
+	t.Helper()
+	fm, lm, bm := openCrashed(t, dir)
+	tx := transaction.NewTxMgr(fm, lm, bm).NewTransaction()
+	rm := recovery.NewRecoveryMgr(tx, tx.GetTxNum(), lm, bm)
+	rm.EnableRedo()
+	if err := rm.Recover(); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+	return tx
+}
+
+func TestRecoverRedoesRealTransactions(t *testing.T) {
+	dir := t.TempDir()
+	fm, lm, bm := openCrashed(t, dir)
+	var blks []*kfile.BlockId
+	for i := 0; i < 2; i++ {
+		blk, err := fm.Append("data.db")
+		if err != nil {
+			t.Fatalf("Failed to append block: %v", err)
+		}
+		blks = append(blks, blk)
+	}
+
+	txm := transaction.NewTxMgr(fm, lm, bm)
+	// A commits with its log on disk but not its page.
+	txA := txm.NewTransaction()
+	txA.SetCommitMode(recovery.DelayedCommit)
+	if err := txA.InsertCell(*blks[0], []byte("a"), "kept", true); err != nil {
+		t.Fatalf("InsertCell failed: %v", err)
+	}
+	result, err := txA.CommitWithResult()
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if err := lm.FlushLSN(result.LSN); err != nil {
+		t.Fatalf("FlushLSN failed: %v", err)
+	}
+	// B rolls back.
+	txB := txm.NewTransaction()
+	if txB.GetTxNum() == txA.GetTxNum() {
+		t.Fatalf("Expected distinct transaction numbers, both are %d", txA.GetTxNum())
+	}
+	if err := txB.InsertCell(*blks[1], []byte("b"), "lost", true); err != nil {
+		t.Fatalf("InsertCell failed: %v", err)
+	}
+	if err := txB.Rollback(); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+
+	tx := recoverWithRedo(t, dir)
+	if _, err := tx.FindCell(*blks[0], []byte("a")); err != nil {
+		t.Errorf("Expected A's committed insert to be redone: %v", err)
+	}
+	if _, err := tx.FindCell(*blks[1], []byte("b")); !errors.Is(err, kfile.ErrKeyNotFound) {
+		t.Errorf("Expected B's rolled back insert not to be redone, got %v", err)
+	}
+}
+
+func TestRedoStartsAtCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	fm, lm, bm := openCrashed(t, dir)
+	var blks []*kfile.BlockId
+	for i := 0; i < 2; i++ {
+		blk, err := fm.Append("data.db")
+		if err != nil {
+			t.Fatalf("Failed to append block: %v", err)
+		}
+		blks = append(blks, blk)
+	}
+	commit := func(tx *transaction.Mgr) {
+		t.Helper()
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+	}
+
+	// First run: transaction 2 inserts x and transaction 3 deletes it.
+	txm := transaction.NewTxMgr(fm, lm, bm)
+	commit(txm.NewTransaction())
+	tx2 := txm.NewTransaction()
+	if err := tx2.InsertCell(*blks[0], []byte("x"), "old", true); err != nil {
+		t.Fatalf("InsertCell failed: %v", err)
+	}
+	commit(tx2)
+	tx3 := txm.NewTransaction()
+	if err := tx3.DeleteCell(*blks[0], []byte("x"), true); err != nil {
+		t.Fatalf("DeleteCell failed: %v", err)
+	}
+	commit(tx3)
+
+	// Second run: recovery checkpoints the log, then a new transaction 2
+	// commits without its page reaching disk.
+	fm, lm, bm = openCrashed(t, dir)
+	txm = transaction.NewTxMgr(fm, lm, bm)
+	if err := txm.NewTransaction().Recover(); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+	tx2 = txm.NewTransaction()
+	tx2.SetCommitMode(recovery.DelayedCommit)
+	if err := tx2.InsertCell(*blks[1], []byte("y"), "new", true); err != nil {
+		t.Fatalf("InsertCell failed: %v", err)
+	}
+	result, err := tx2.CommitWithResult()
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if err := lm.FlushLSN(result.LSN); err != nil {
+		t.Fatalf("FlushLSN failed: %v", err)
+	}
+
+	// Redoing the second run's transaction 2 must not replay the first's.
+	tx := recoverWithRedo(t, dir)
+	if _, err := tx.FindCell(*blks[1], []byte("y")); err != nil {
+		t.Errorf("Expected the committed insert of y to be redone: %v", err)
+	}
+	if _, err := tx.FindCell(*blks[0], []byte("x")); !errors.Is(err, kfile.ErrKeyNotFound) {
+		t.Errorf("Expected x, deleted before the checkpoint, to stay deleted, got %v", err)
+	}
+}
+
+func TestUnifiedUpdateUndoRestoresOldValue(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 4096)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	bm := buffer.NewBufferMgr(fm, 8, buffer.InitLRU(8, fm))
+	lm, err := log.NewLogMgr(fm, bm, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to create LogMgr: %v", err)
+	}
+	blk, err := fm.Append("data.db")
+	if err != nil {
+		t.Fatalf("Failed to append block: %v", err)
+	}
+	txm := transaction.NewTxMgr(fm, lm, bm)
+	tx := txm.NewTransaction()
+	if err := tx.InsertCell(*blk, []byte("k"), "old", false); err != nil {
+		t.Fatalf("InsertCell failed: %v", err)
+	}
+
+	// SetCellValue logs the old and new cell images of the update and
+	// applies it to the page.
+	rm := recovery.NewRecoveryMgr(tx, 1, lm, bm)
+	buff, err := bm.Pin(blk)
+	if err != nil {
+		t.Fatalf("Pin failed: %v", err)
+	}
+	if _, err := rm.SetCellValue(buff, []byte("k"), "new"); err != nil {
+		t.Fatalf("SetCellValue failed: %v", err)
+	}
+	if cell, _, err := buff.Contents().FindCell([]byte("k")); err != nil {
+		t.Fatalf("FindCell failed: %v", err)
+	} else if v, _ := cell.GetValue(); v != "new" {
+		t.Errorf("Expected SetCellValue to store %q in the page, got %v", "new", v)
+	}
+	if err := buff.Unpin(); err != nil {
+		t.Fatalf("Unpin failed: %v", err)
+	}
+	iter, err := lm.Iterator()
+	if err != nil {
+		t.Fatalf("Iterator failed: %v", err)
+	}
+	data, err := iter.Next()
+	if err != nil {
+		t.Fatalf("Next failed: %v", err)
+	}
+	parsed, err := log_record.ParseLogRecord(data)
+	if err != nil {
+		t.Fatalf("ParseLogRecord failed: %v", err)
+	}
+	rec, ok := parsed.(*log_record.UnifiedUpdateRecord)
+	if !ok {
+		t.Fatalf("Expected a UnifiedUpdateRecord, got %T", parsed)
+	}
+
+	value := func() any {
+		t.Helper()
+		cell, err := tx.FindCell(*blk, []byte("k"))
+		if err != nil {
+			t.Fatalf("Expected the cell to be present: %v", err)
+		}
+		v, err := cell.GetValue()
+		if err != nil {
+			t.Fatalf("GetValue failed: %v", err)
+		}
+		return v
+	}
+	if err := rec.Redo(tx); err != nil {
+		t.Fatalf("Redo failed: %v", err)
+	}
+	if v := value(); v != "new" {
+		t.Errorf("Expected redo to apply %q, got %v", "new", v)
+	}
+	if err := rec.Undo(tx); err != nil {
+		t.Fatalf("Undo failed: %v", err)
+	}
+	if v := value(); v != "old" {
+		t.Errorf("Expected undo to restore %q, got %v", "old", v)
+	}
+}
@@ -0,0 +1,416 @@
+package shadow
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sync"
+
+	"ultraSQL/kfile"
+)
+
+// Store implements copy-on-write shadow paging on top of a single file
+// managed by a FileMgr. It is an alternative to write-ahead logging for
+// small, rarely written databases: modified logical blocks are written to
+// fresh physical blocks, and Commit publishes them by writing a new mapping
+// table and then flipping one of two root blocks. Recovery is simply reading
+// the newest valid root, so a crash before the flip leaves the previous
+// state intact.
+//
+// Physical layout: blocks 0 and 1 hold alternating roots; every other block
+// is either a data page or part of a mapping table. Roots and mapping blocks
+// leave the first kfile.PageHeaderSize bytes alone, since a FileMgr with
+// checksum verification stamps its checksum there on every write.
+type Store struct {
+	mu       sync.Mutex
+	fm       *kfile.FileMgr
+	filename string
+
+	generation int
+	rootSlot   int32
+	mapping    []int32 // logical block -> physical block (0 means never written)
+	mapBlocks  []int32 // physical blocks holding the committed mapping table
+	pending    map[int32]int32
+	free       []int32 // physical blocks unused by the committed or staged version
+
+	// beforeFlip is a fault-injection hook invoked after the new mapping is
+	// durable but before the root is rewritten.
+	beforeFlip func() error
+}
+
+const (
+	rootMagic   = 0x53484457 // "SHDW"
+	rootVersion = 2
+
+	magicOffset       = kfile.PageHeaderSize
+	versionOffset     = magicOffset + 4
+	generationOffset  = magicOffset + 8
+	logicalLenOffset  = magicOffset + 12
+	mapCountOffset    = magicOffset + 16
+	mapChecksumOffset = magicOffset + 20
+	rootChecksumOff   = magicOffset + 24
+	mapListOffset     = magicOffset + 28
+
+	// mapEntriesOffset is where the mapping entries start in a mapping block.
+	mapEntriesOffset = kfile.PageHeaderSize
+
+	rootSlots = 2
+)
+
+var (
+	// ErrNoValidRoot is returned when a non-empty file holds no readable root.
+	ErrNoValidRoot = errors.New("shadow: no valid root block")
+	// ErrMappingTooLarge is returned when the mapping table no longer fits the root.
+	ErrMappingTooLarge = errors.New("shadow: mapping table too large for root block")
+)
+
+// NewStore opens the shadow-paged file, initializing it when it is empty,
+// and loads the newest valid root.
+func NewStore(fm *kfile.FileMgr, filename string) (*Store, error) {
+	if fm == nil {
+		return nil, fmt.Errorf("shadow: file manager cannot be nil")
+	}
+	s := &Store{
+		fm:       fm,
+		filename: filename,
+		pending:  make(map[int32]int32),
+	}
+
+	length, err := fm.Length(filename)
+	if err != nil {
+		return nil, fmt.Errorf("shadow: failed to get length of %s: %w", filename, err)
+	}
+	if length == 0 {
+		if err := s.initialize(); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	if err := s.loadRoot(length); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// initialize writes both root slots for an empty database.
+func (s *Store) initialize() error {
+	for i := 0; i < rootSlots; i++ {
+		if _, err := s.fm.Append(s.filename); err != nil {
+			return fmt.Errorf("shadow: failed to allocate root slot %d: %w", i, err)
+		}
+	}
+	// writeRoot targets the slot that is not live, so pretend slot 1 is live
+	// to place the initial root in slot 0.
+	s.rootSlot = 1
+	if err := s.writeRoot(0, 0, nil, nil); err != nil {
+		return err
+	}
+	s.rootSlot = 0
+	return s.rebuildFreeList()
+}
+
+// loadRoot reads both root slots and adopts the valid one with the highest generation.
+func (s *Store) loadRoot(length int32) error {
+	found := false
+	for slot := int32(0); slot < rootSlots && slot < length; slot++ {
+		gen, mapping, mapBlocks, err := s.readRoot(slot)
+		if err != nil {
+			continue
+		}
+		if !found || gen > s.generation {
+			found = true
+			s.generation = gen
+			s.rootSlot = slot
+			s.mapping = mapping
+			s.mapBlocks = mapBlocks
+		}
+	}
+	if !found {
+		return fmt.Errorf("%w in %s", ErrNoValidRoot, s.filename)
+	}
+	return s.rebuildFreeList()
+}
+
+// readRoot parses and validates the root in the given slot together with the
+// mapping table it references.
+func (s *Store) readRoot(slot int32) (int, []int32, []int32, error) {
+	page := kfile.NewSlottedPage(s.fm.BlockSize())
+	if err := s.fm.Read(kfile.NewBlockId(s.filename, slot), page); err != nil {
+		return 0, nil, nil, err
+	}
+	data := page.Contents()
+	if binary.BigEndian.Uint32(data[magicOffset:]) != rootMagic ||
+		binary.BigEndian.Uint32(data[versionOffset:]) != rootVersion {
+		return 0, nil, nil, fmt.Errorf("shadow: slot %d has no root", slot)
+	}
+	mapCount := int(binary.BigEndian.Uint32(data[mapCountOffset:]))
+	end := mapListOffset + 4*mapCount
+	if end > len(data) {
+		return 0, nil, nil, fmt.Errorf("shadow: slot %d has a corrupt root", slot)
+	}
+	stored := binary.BigEndian.Uint32(data[rootChecksumOff:])
+	if stored != rootChecksum(data, end) {
+		return 0, nil, nil, fmt.Errorf("shadow: slot %d failed checksum", slot)
+	}
+
+	gen := int(binary.BigEndian.Uint32(data[generationOffset:]))
+	logicalLen := int(binary.BigEndian.Uint32(data[logicalLenOffset:]))
+	mapBlocks := make([]int32, mapCount)
+	for i := range mapBlocks {
+		mapBlocks[i] = int32(binary.BigEndian.Uint32(data[mapListOffset+4*i:]))
+	}
+
+	raw := make([]byte, 0, mapCount*(s.fm.BlockSize()-mapEntriesOffset))
+	for _, phys := range mapBlocks {
+		mp := kfile.NewSlottedPage(s.fm.BlockSize())
+		if err := s.fm.Read(kfile.NewBlockId(s.filename, phys), mp); err != nil {
+			return 0, nil, nil, fmt.Errorf("shadow: failed to read mapping block %d: %w", phys, err)
+		}
+		raw = append(raw, mp.Contents()[mapEntriesOffset:]...)
+	}
+	if 4*logicalLen > len(raw) {
+		return 0, nil, nil, fmt.Errorf("shadow: slot %d mapping is truncated", slot)
+	}
+	raw = raw[:4*logicalLen]
+	if crc32.ChecksumIEEE(raw) != binary.BigEndian.Uint32(data[mapChecksumOffset:]) {
+		return 0, nil, nil, fmt.Errorf("shadow: slot %d mapping failed checksum", slot)
+	}
+	mapping := make([]int32, logicalLen)
+	for i := range mapping {
+		mapping[i] = int32(binary.BigEndian.Uint32(raw[4*i:]))
+	}
+	return gen, mapping, mapBlocks, nil
+}
+
+// rootChecksum covers the root header and mapping block list, excluding the
+// checksum field itself.
+func rootChecksum(data []byte, end int) uint32 {
+	h := crc32.NewIEEE()
+	h.Write(data[magicOffset:rootChecksumOff])
+	h.Write(data[mapListOffset:end])
+	return h.Sum32()
+}
+
+// rebuildFreeList recomputes which physical blocks neither the committed
+// version nor the staged writes reference; only those may be handed out
+// before the next commit.
+func (s *Store) rebuildFreeList() error {
+	length, err := s.fm.Length(s.filename)
+	if err != nil {
+		return fmt.Errorf("shadow: failed to get length of %s: %w", s.filename, err)
+	}
+	used := make(map[int32]bool, len(s.mapping)+len(s.mapBlocks))
+	for _, phys := range s.mapping {
+		used[phys] = true
+	}
+	for _, phys := range s.mapBlocks {
+		used[phys] = true
+	}
+	for _, phys := range s.pending {
+		used[phys] = true
+	}
+	s.free = s.free[:0]
+	for phys := int32(rootSlots); phys < length; phys++ {
+		if !used[phys] {
+			s.free = append(s.free, phys)
+		}
+	}
+	return nil
+}
+
+// allocate returns a physical block that is not part of the committed version.
+func (s *Store) allocate() (int32, error) {
+	if len(s.free) > 0 {
+		phys := s.free[0]
+		s.free = s.free[1:]
+		return phys, nil
+	}
+	blk, err := s.fm.Append(s.filename)
+	if err != nil {
+		return 0, fmt.Errorf("shadow: failed to grow %s: %w", s.filename, err)
+	}
+	return blk.Number(), nil
+}
+
+// resolve returns the physical block for a logical block, preferring
+// uncommitted writes, or 0 if the block was never written.
+func (s *Store) resolve(logical int32) int32 {
+	if phys, ok := s.pending[logical]; ok {
+		return phys
+	}
+	if int(logical) < len(s.mapping) {
+		return s.mapping[logical]
+	}
+	return 0
+}
+
+// Read fills p with the current contents of logical block blk. Blocks that
+// were never written read back as zeros.
+func (s *Store) Read(blk *kfile.BlockId, p *kfile.SlottedPage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	phys := s.resolve(blk.Number())
+	if phys == 0 {
+		clear(p.Contents())
+		return nil
+	}
+	return s.fm.Read(kfile.NewBlockId(s.filename, phys), p)
+}
+
+// Write stages the contents of logical block blk in a fresh physical block.
+// The change becomes visible after a crash only once Commit succeeds.
+func (s *Store) Write(blk *kfile.BlockId, p *kfile.SlottedPage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	logical := blk.Number()
+	phys, ok := s.pending[logical]
+	if !ok {
+		var err error
+		if phys, err = s.allocate(); err != nil {
+			return err
+		}
+		s.pending[logical] = phys
+	}
+	if err := s.fm.Write(kfile.NewBlockId(s.filename, phys), p); err != nil {
+		return fmt.Errorf("shadow: failed to write logical block %d: %w", logical, err)
+	}
+	return nil
+}
+
+// BlockSize returns the block size of the underlying file manager.
+func (s *Store) BlockSize() int {
+	return s.fm.BlockSize()
+}
+
+// Length returns the number of logical blocks, including uncommitted ones.
+func (s *Store) Length() int32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := int32(len(s.mapping))
+	for logical := range s.pending {
+		if logical+1 > n {
+			n = logical + 1
+		}
+	}
+	return n
+}
+
+// Generation returns the generation number of the committed root.
+func (s *Store) Generation() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.generation
+}
+
+// Commit makes all staged writes durable. Pages and the new mapping table
+// are synced before the alternate root slot is overwritten, and the root is
+// synced before Commit returns, whatever the FileMgr's sync policy, so a
+// crash at any point leaves either the old or the new state.
+func (s *Store) Commit() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.pending) == 0 {
+		return nil
+	}
+	defer func() {
+		// Reclaim mapping blocks written by an interrupted commit.
+		if err != nil {
+			_ = s.rebuildFreeList()
+		}
+	}()
+
+	mapping := make([]int32, len(s.mapping))
+	copy(mapping, s.mapping)
+	for logical, phys := range s.pending {
+		for int(logical) >= len(mapping) {
+			mapping = append(mapping, 0)
+		}
+		mapping[logical] = phys
+	}
+
+	raw := make([]byte, 4*len(mapping))
+	for i, phys := range mapping {
+		binary.BigEndian.PutUint32(raw[4*i:], uint32(phys))
+	}
+	blockSize := s.fm.BlockSize()
+	perBlock := blockSize - mapEntriesOffset
+	mapBlocks := make([]int32, 0, (len(raw)+perBlock-1)/perBlock)
+	for start := 0; start < len(raw); start += perBlock {
+		phys, err := s.allocate()
+		if err != nil {
+			return err
+		}
+		page := kfile.NewSlottedPage(blockSize)
+		clear(page.Contents())
+		copy(page.Contents()[mapEntriesOffset:], raw[start:min(start+perBlock, len(raw))])
+		if err := s.fm.Write(kfile.NewBlockId(s.filename, phys), page); err != nil {
+			return fmt.Errorf("shadow: failed to write mapping block: %w", err)
+		}
+		mapBlocks = append(mapBlocks, phys)
+	}
+
+	if err := s.fm.Sync(s.filename); err != nil {
+		return fmt.Errorf("shadow: failed to sync pages before root flip: %w", err)
+	}
+	if s.beforeFlip != nil {
+		if err := s.beforeFlip(); err != nil {
+			return fmt.Errorf("shadow: commit interrupted before root flip: %w", err)
+		}
+	}
+	if err := s.writeRoot(s.generation+1, len(mapping), raw, mapBlocks); err != nil {
+		return err
+	}
+	if err := s.fm.Sync(s.filename); err != nil {
+		return fmt.Errorf("shadow: failed to sync root: %w", err)
+	}
+
+	s.generation++
+	s.rootSlot = (s.rootSlot + 1) % rootSlots
+	s.mapping = mapping
+	s.mapBlocks = mapBlocks
+	s.pending = make(map[int32]int32)
+	return s.rebuildFreeList()
+}
+
+// Abort discards all staged writes, returning their physical blocks to the free list.
+func (s *Store) Abort() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pending = make(map[int32]int32)
+	return s.rebuildFreeList()
+}
+
+// writeRoot writes a root describing the given mapping into the slot that is
+// not currently live.
+func (s *Store) writeRoot(generation, logicalLen int, raw []byte, mapBlocks []int32) error {
+	blockSize := s.fm.BlockSize()
+	end := mapListOffset + 4*len(mapBlocks)
+	if end > blockSize {
+		return ErrMappingTooLarge
+	}
+	page := kfile.NewSlottedPage(blockSize)
+	data := page.Contents()
+	clear(data)
+	binary.BigEndian.PutUint32(data[magicOffset:], rootMagic)
+	binary.BigEndian.PutUint32(data[versionOffset:], rootVersion)
+	binary.BigEndian.PutUint32(data[generationOffset:], uint32(generation))
+	binary.BigEndian.PutUint32(data[logicalLenOffset:], uint32(logicalLen))
+	binary.BigEndian.PutUint32(data[mapCountOffset:], uint32(len(mapBlocks)))
+	binary.BigEndian.PutUint32(data[mapChecksumOffset:], crc32.ChecksumIEEE(raw))
+	for i, phys := range mapBlocks {
+		binary.BigEndian.PutUint32(data[mapListOffset+4*i:], uint32(phys))
+	}
+	binary.BigEndian.PutUint32(data[rootChecksumOff:], rootChecksum(data, end))
+
+	slot := (s.rootSlot + 1) % rootSlots
+	if err := s.fm.Write(kfile.NewBlockId(s.filename, slot), page); err != nil {
+		return fmt.Errorf("shadow: failed to write root slot %d: %w", slot, err)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package shadow
+
+import (
+	"errors"
+	"testing"
+
+	"ultraSQL/buffer"
+	"ultraSQL/kfile"
+)
+
+const testFile = "shadow.db"
+
+func openStore(t *testing.T, dir string, opts ...kfile.FileMgrOption) (*kfile.FileMgr, *Store) {
+	t.Helper()
+	fm, err := kfile.NewFileMgr(dir, 512, opts...)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	s, err := NewStore(fm, testFile)
+	if err != nil {
+		fm.Close()
+		t.Fatalf("Failed to open shadow store: %v", err)
+	}
+	return fm, s
+}
+
+func writeInt(t *testing.T, s *Store, blknum int32, val int) {
+	t.Helper()
+	page := kfile.NewSlottedPage(s.BlockSize())
+	if err := page.SetInt(100, val); err != nil {
+		t.Fatalf("SetInt failed: %v", err)
+	}
+	if err := s.Write(kfile.NewBlockId(testFile, blknum), page); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+}
+
+func readInt(t *testing.T, s *Store, blknum int32) int {
+	t.Helper()
+	page := kfile.NewSlottedPage(s.BlockSize())
+	if err := s.Read(kfile.NewBlockId(testFile, blknum), page); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	val, err := page.GetInt(100)
+	if err != nil {
+		t.Fatalf("GetInt failed: %v", err)
+	}
+	return val
+}
+
+func TestShadowStoreCrashBeforeRootFlip(t *testing.T) {
+	dir := t.TempDir()
+	fm, s := openStore(t, dir)
+
+	writeInt(t, s, 0, 10)
+	writeInt(t, s, 1, 11)
+	if err := s.Commit(); err != nil {
+		t.Fatalf("Initial commit failed: %v", err)
+	}
+
+	// Overwrite both blocks, then crash between the mapping write and the flip.
+	writeInt(t, s, 0, 20)
+	writeInt(t, s, 1, 21)
+	writeInt(t, s, 2, 22)
+	errCrash := errors.New("simulated crash")
+	s.beforeFlip = func() error { return errCrash }
+	if err := s.Commit(); !errors.Is(err, errCrash) {
+		t.Fatalf("Expected commit to fail with the injected crash, got %v", err)
+	}
+	fm.Close()
+
+	fm, s = openStore(t, dir)
+	defer fm.Close()
+	if got := readInt(t, s, 0); got != 10 {
+		t.Errorf("Block 0: expected old value 10 after crash, got %d", got)
+	}
+	if got := readInt(t, s, 1); got != 11 {
+		t.Errorf("Block 1: expected old value 11 after crash, got %d", got)
+	}
+	if got := s.Length(); got != 2 {
+		t.Errorf("Expected 2 logical blocks after crash, got %d", got)
+	}
+}
+
+func TestShadowStoreCommitVisibleAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	fm, s := openStore(t, dir)
+
+	writeInt(t, s, 0, 1)
+	if err := s.Commit(); err != nil {
+		t.Fatalf("First commit failed: %v", err)
+	}
+	writeInt(t, s, 0, 2)
+	writeInt(t, s, 3, 4)
+	if err := s.Commit(); err != nil {
+		t.Fatalf("Second commit failed: %v", err)
+	}
+	gen := s.Generation()
+	fm.Close()
+
+	fm, s = openStore(t, dir)
+	defer fm.Close()
+	if s.Generation() != gen {
+		t.Errorf("Expected generation %d after reopen, got %d", gen, s.Generation())
+	}
+	if got := readInt(t, s, 0); got != 2 {
+		t.Errorf("Block 0: expected 2, got %d", got)
+	}
+	if got := readInt(t, s, 3); got != 4 {
+		t.Errorf("Block 3: expected 4, got %d", got)
+	}
+	if got := readInt(t, s, 2); got != 0 {
+		t.Errorf("Block 2 was never written and should read as zero, got %d", got)
+	}
+}
+
+func TestShadowStoreUnderChecksumVerification(t *testing.T) {
+	dir := t.TempDir()
+	fm, s := openStore(t, dir, kfile.WithChecksumVerification())
+
+	// Block 200 takes the mapping table past one block.
+	for _, blknum := range []int32{0, 1, 200} {
+		writeInt(t, s, blknum, int(blknum)+7)
+	}
+	if err := s.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	writeInt(t, s, 1, 42)
+	if err := s.Commit(); err != nil {
+		t.Fatalf("Second commit failed: %v", err)
+	}
+	gen := s.Generation()
+	fm.Close()
+
+	fm, s = openStore(t, dir, kfile.WithChecksumVerification())
+	defer fm.Close()
+	if s.Generation() != gen {
+		t.Errorf("Expected generation %d after reopen, got %d", gen, s.Generation())
+	}
+	for blknum, want := range map[int32]int{0: 7, 1: 42, 200: 207} {
+		if got := readInt(t, s, blknum); got != want {
+			t.Errorf("Block %d: expected %d, got %d", blknum, want, got)
+		}
+	}
+}
+
+func TestShadowStoreCommitSyncsUnderBatchedPolicy(t *testing.T) {
+	fm, s := openStore(t, t.TempDir(), kfile.WithSyncPolicy(kfile.SyncOnClose))
+	defer fm.Close()
+
+	syncs := func() int64 { return fm.LatencyStats().Sync.Count() }
+	writeInt(t, s, 0, 7)
+	before := syncs()
+	var atFlip int64
+	s.beforeFlip = func() error {
+		atFlip = syncs()
+		return nil
+	}
+	if err := s.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if atFlip <= before {
+		t.Errorf("Expected the pages to be synced before the root flip")
+	}
+	if syncs() <= atFlip {
+		t.Errorf("Expected the root to be synced before Commit returned")
+	}
+}
+
+func TestShadowStoreAbort(t *testing.T) {
+	fm, s := openStore(t, t.TempDir())
+	defer fm.Close()
+
+	writeInt(t, s, 0, 5)
+	if err := s.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	writeInt(t, s, 0, 6)
+	if got := readInt(t, s, 0); got != 6 {
+		t.Errorf("Expected staged value 6 before abort, got %d", got)
+	}
+	if err := s.Abort(); err != nil {
+		t.Fatalf("Abort failed: %v", err)
+	}
+	if got := readInt(t, s, 0); got != 5 {
+		t.Errorf("Expected committed value 5 after abort, got %d", got)
+	}
+}
+
+func TestShadowStoreThroughBufferMgr(t *testing.T) {
+	dir := t.TempDir()
+	fm, s := openStore(t, dir)
+
+	bm := buffer.NewBufferMgr(fm, 2, buffer.InitClock(2, s))
+	blk := kfile.NewBlockId(testFile, 0)
+	buff, err := bm.Pin(blk)
+	if err != nil {
+		t.Fatalf("Pin failed: %v", err)
+	}
+	if err := buff.Contents().SetInt(100, 42); err != nil {
+		t.Fatalf("SetInt failed: %v", err)
+	}
+	buff.MarkModified(1, 1)
+	if err := buff.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	bm.Unpin(buff)
+	if err := s.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	fm.Close()
+
+	fm, s = openStore(t, dir)
+	defer fm.Close()
+	if got := readInt(t, s, 0); got != 42 {
+		t.Errorf("Expected 42 through the buffer layer, got %d", got)
+	}
+}
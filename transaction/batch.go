@@ -0,0 +1,79 @@
+package transaction
+
+import (
+	"fmt"
+	"ultraSQL/recovery"
+)
+
+// Batch runs a stream of small auto-commit transactions with write
+// combining. Each transaction commits with recovery.DelayedCommit, so its
+// START, change and COMMIT records share log pages with its neighbours', and
+// every size transactions the batch makes them durable together: one log
+// flush, then the data pages they modified. A page the pool evicts earlier
+// forces the log out through the page's LSN first, as any eviction does, so
+// each transaction stays atomic on recovery: one whose commit record reached
+// disk is redone, and any other undone. Recover after a crash with a
+// transaction on which EnableRedo was called.
+type Batch struct {
+	txm     *TxMgr
+	size    int
+	pending int            // transactions committed since the last flush
+	txnums  map[int64]bool // their transaction numbers
+	lastLSN int
+}
+
+// NewBatch returns a Batch that runs its transactions in txm and flushes
+// after every size of them.
+func NewBatch(txm *TxMgr, size int) *Batch {
+	if size < 1 {
+		size = 1
+	}
+	return &Batch{
+		txm:    txm,
+		size:   size,
+		txnums: make(map[int64]bool),
+	}
+}
+
+// Run executes fn in a new transaction and commits it, or rolls it back and
+// returns fn's error if fn fails. The commit is durable only once Run has
+// flushed the batch it belongs to, or after Flush.
+func (b *Batch) Run(fn func(tx *Mgr) error) error {
+	tx := b.txm.NewTransaction()
+	tx.SetCommitMode(recovery.DelayedCommit)
+	if err := fn(tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("%w (rollback failed: %v)", err, rbErr)
+		}
+		return err
+	}
+	result, err := tx.CommitWithResult()
+	if err != nil {
+		return err
+	}
+	b.pending++
+	b.txnums[tx.txNum] = true
+	b.lastLSN = result.LSN
+	if b.pending >= b.size {
+		return b.Flush()
+	}
+	return nil
+}
+
+// Flush makes every transaction committed through the batch durable: it
+// writes the log through the last commit record, then the pages those
+// transactions modified.
+func (b *Batch) Flush() error {
+	if b.pending == 0 {
+		return nil
+	}
+	if err := b.txm.lm.FlushLSN(b.lastLSN); err != nil {
+		return fmt.Errorf("failed to flush batch log: %w", err)
+	}
+	for txnum := range b.txnums {
+		b.txm.bm.Policy().FlushAll(txnum)
+		delete(b.txnums, txnum)
+	}
+	b.pending = 0
+	return nil
+}
@@ -0,0 +1,176 @@
+package transaction
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"ultraSQL/kfile"
+)
+
+// IndexKeyFunc extracts the indexed column value from the value of a base cell.
+type IndexKeyFunc func(val any) ([]byte, error)
+
+// secondaryIndex keeps indexFile in sync with the cells of the base file it
+// is registered on. Each entry is keyed by the indexed value followed by the
+// base cell's primary key, and holds that primary key as its value.
+type secondaryIndex struct {
+	indexFile string
+	keyFn     IndexKeyFunc
+}
+
+// RegisterIndex maintains a secondary index in indexFile for every logged
+// InsertCell and DeleteCell on baseFile, in every transaction m starts. Index
+// changes are logged like any other cell change, so they are undone together
+// with the base change. Register indexes before the transactions that should
+// maintain them start writing to baseFile.
+func (m *TxMgr) RegisterIndex(baseFile, indexFile string, keyFn IndexKeyFunc) error {
+	if baseFile == indexFile {
+		return fmt.Errorf("index file %s cannot be its own base file", indexFile)
+	}
+	if keyFn == nil {
+		return fmt.Errorf("index %s needs a key function", indexFile)
+	}
+	m.indexMu.Lock()
+	defer m.indexMu.Unlock()
+	m.indexes[baseFile] = append(m.indexes[baseFile], secondaryIndex{indexFile: indexFile, keyFn: keyFn})
+	return nil
+}
+
+// indexesOn returns the indexes registered on baseFile.
+func (m *TxMgr) indexesOn(baseFile string) []secondaryIndex {
+	m.indexMu.RLock()
+	defer m.indexMu.RUnlock()
+	return slices.Clone(m.indexes[baseFile])
+}
+
+// LookupIndex returns the primary keys of the base cells whose indexed value
+// equals value.
+func (t *Mgr) LookupIndex(indexFile string, value []byte) ([][]byte, error) {
+	if err := t.checkActive(); err != nil {
+		return nil, err
+	}
+	prefix := indexEntryPrefix(value)
+	var pks [][]byte
+	err := t.scanBlocks(indexFile, func(blk kfile.BlockId, p *kfile.SlottedPage) (bool, error) {
+		slots := p.GetAllSlots()
+		for slot := p.FindSlotPosition(prefix); slot < len(slots); slot++ {
+			cell, err := p.GetCellBySlot(slot)
+			if err != nil {
+				return false, fmt.Errorf("failed to read index entry in block %v: %w", blk, err)
+			}
+			if !bytes.HasPrefix(cell.GetKey(), prefix) {
+				break
+			}
+			pk, err := cell.GetValue()
+			if err != nil {
+				return false, fmt.Errorf("failed to decode index entry in block %v: %w", blk, err)
+			}
+			b, ok := pk.([]byte)
+			if !ok {
+				return false, fmt.Errorf("index entry in block %v holds %T, not a primary key", blk, pk)
+			}
+			pks = append(pks, b)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pks, nil
+}
+
+func (t *Mgr) addIndexEntries(baseFile string, pk []byte, val any) error {
+	for _, idx := range t.txm.indexesOn(baseFile) {
+		value, err := idx.keyFn(val)
+		if err != nil {
+			return fmt.Errorf("failed to compute key for index %s: %w", idx.indexFile, err)
+		}
+		key := indexEntryKey(value, pk)
+		blk, err := t.Insert(idx.indexFile, key, pk, true)
+		if err != nil {
+			return fmt.Errorf("failed to add entry to index %s: %w", idx.indexFile, err)
+		}
+		t.txm.noteKey(blk, key)
+	}
+	return nil
+}
+
+func (t *Mgr) removeIndexEntries(baseFile string, pk []byte, cell *kfile.Cell) error {
+	indexes := t.txm.indexesOn(baseFile)
+	if len(indexes) == 0 {
+		return nil
+	}
+	val, err := cell.GetValue()
+	if err != nil {
+		return fmt.Errorf("failed to decode deleted cell %s: %w", pk, err)
+	}
+	for _, idx := range indexes {
+		value, err := idx.keyFn(val)
+		if err != nil {
+			return fmt.Errorf("failed to compute key for index %s: %w", idx.indexFile, err)
+		}
+		key := indexEntryKey(value, pk)
+		found, _, err := t.locate(idx.indexFile, key)
+		if err != nil {
+			return err
+		}
+		if found == nil {
+			return fmt.Errorf("index %s has no entry for key %s: %w", idx.indexFile, pk, kfile.ErrKeyNotFound)
+		}
+		if err := t.DeleteCell(*found, key, true); err != nil {
+			return fmt.Errorf("failed to remove entry from index %s: %w", idx.indexFile, err)
+		}
+	}
+	return nil
+}
+
+// scanBlocks calls visit with the page of each block of filename in order
+// until visit reports it is done, see visitBlock.
+func (t *Mgr) scanBlocks(filename string, visit func(blk kfile.BlockId, p *kfile.SlottedPage) (bool, error)) error {
+	size, err := t.Size(filename)
+	if err != nil {
+		return err
+	}
+	for n := int32(0); n < size; n++ {
+		done, err := t.visitBlock(*kfile.NewBlockId(filename, n), visit)
+		if err != nil || done {
+			return err
+		}
+	}
+	return nil
+}
+
+// visitBlock calls visit with the page of blk and returns what it reports.
+// The block is read locked as the transaction's isolation level asks and,
+// if the transaction had not pinned it before, unpinned again afterwards.
+func (t *Mgr) visitBlock(blk kfile.BlockId, visit func(blk kfile.BlockId, p *kfile.SlottedPage) (bool, error)) (bool, error) {
+	unlock, err := t.readLock(blk, RepeatableRead)
+	if err != nil {
+		return false, fmt.Errorf("failed to lock block %v: %w", blk, err)
+	}
+	defer unlock()
+	held := t.bufferList.Buffer(blk) != nil
+	if err := t.Pin(blk); err != nil {
+		return false, err
+	}
+	done, err := visit(blk, t.bufferList.Buffer(blk).Contents())
+	if !held {
+		if unpinErr := t.UnPin(blk); unpinErr != nil && err == nil {
+			err = unpinErr
+		}
+	}
+	return done, err
+}
+
+// indexEntryPrefix encodes value with a length prefix so that entries for
+// one value never share a prefix with entries for a longer value.
+func indexEntryPrefix(value []byte) []byte {
+	prefix := make([]byte, 4, 4+len(value))
+	binary.BigEndian.PutUint32(prefix, uint32(len(value)))
+	return append(prefix, value...)
+}
+
+func indexEntryKey(value, pk []byte) []byte {
+	return append(indexEntryPrefix(value), pk...)
+}
@@ -0,0 +1,66 @@
+package transaction
+
+import (
+	"ultraSQL/kfile"
+)
+
+// IsolationLevel is one of the SQL standard isolation levels. Each is the
+// locking protocol that defines it in Berenson et al., "A Critique of ANSI
+// SQL Isolation Levels":
+//
+//   - ReadUncommitted reads without locks;
+//   - ReadCommitted holds a shared lock only for the duration of a read;
+//   - RepeatableRead holds shared locks on what it read until commit;
+//   - Serializable also holds the end of every file whose size it read, and
+//     the key range of every Scan, until commit.
+//
+// Writes take exclusive locks held until commit at every level.
+type IsolationLevel int
+
+const (
+	ReadUncommitted IsolationLevel = iota
+	ReadCommitted
+	RepeatableRead
+	Serializable
+)
+
+func (l IsolationLevel) String() string {
+	switch l {
+	case ReadUncommitted:
+		return "read uncommitted"
+	case ReadCommitted:
+		return "read committed"
+	case RepeatableRead:
+		return "repeatable read"
+	case Serializable:
+		return "serializable"
+	}
+	return "unknown isolation level"
+}
+
+// SetIsolationLevel sets the isolation level of the transaction's later
+// reads; a new transaction is Serializable. Locks already held are kept.
+func (t *Mgr) SetIsolationLevel(level IsolationLevel) {
+	t.isolation = level
+}
+
+// readLock takes the shared lock the transaction's isolation level asks for
+// before reading blk, and returns the function that ends the read. The lock
+// lasts until commit from level holdFrom up, and only for the read below
+// it; a lock the transaction already held is left alone.
+func (t *Mgr) readLock(blk kfile.BlockId, holdFrom IsolationLevel) (func(), error) {
+	if t.isolation == ReadUncommitted {
+		return func() {}, nil
+	}
+	if t.isolation >= holdFrom {
+		return func() {}, t.cm.SLock(blk)
+	}
+	if _, held := t.cm.GetLockType(blk); held {
+		return func() {}, nil
+	}
+	if err := t.cm.SLock(blk); err != nil {
+		return nil, err
+	}
+	// ReleaseLock only fails for a lock that is not held.
+	return func() { _ = t.cm.ReleaseLock(blk) }, nil
+}
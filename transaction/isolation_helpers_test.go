@@ -0,0 +1,362 @@
+package transaction
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+	"ultraSQL/buffer"
+	"ultraSQL/kfile"
+	"ultraSQL/log"
+)
+
+var isolationLevels = []IsolationLevel{ReadUncommitted, ReadCommitted, RepeatableRead, Serializable}
+
+// anomaly is an interleaving effect that an isolation level may permit.
+type anomaly int
+
+const (
+	dirtyRead anomaly = iota
+	nonRepeatableRead
+	phantom
+	lostUpdate
+)
+
+var anomalies = []anomaly{dirtyRead, nonRepeatableRead, phantom, lostUpdate}
+
+func (a anomaly) String() string {
+	return [...]string{"dirty read", "non-repeatable read", "phantom", "lost update"}[a]
+}
+
+// permits reports whether level l allows anomaly a. Dirty reads,
+// non-repeatable reads and phantoms follow the SQL standard; the standard
+// does not name lost updates, which Berenson et al. show repeatable read
+// prevents.
+func permits(l IsolationLevel, a anomaly) bool {
+	switch a {
+	case dirtyRead:
+		return l == ReadUncommitted
+	case nonRepeatableRead, lostUpdate:
+		return l <= ReadCommitted
+	default:
+		return l < Serializable
+	}
+}
+
+// isoOp is the operation of one step of a schedule.
+type isoOp int
+
+const (
+	opRead      isoOp = iota // read item key
+	opWrite                  // write val to item key
+	opIncrement              // write one more than this transaction last read of key
+	opScan                   // list the rows with keys in [key, hi)
+	opInsert                 // insert row key, holding val, into a new block
+	opCommit
+)
+
+// isoStep is one step of a schedule, run by transaction tx.
+type isoStep struct {
+	tx  int
+	op  isoOp
+	key string
+	hi  string
+	val string
+}
+
+// isoResult records what a step did. seq orders the completion of the
+// steps of a schedule, which may differ from their order in the schedule
+// when a step waits for a lock.
+type isoResult struct {
+	seq  int
+	val  string   // value read
+	keys []string // rows found by a scan
+	err  error
+}
+
+// errIsoAborted is the result of every step of a transaction after one of
+// its steps failed.
+var errIsoAborted = errors.New("transaction aborted earlier in the schedule")
+
+const (
+	isoItemsFile = "iso_items.db"
+	isoRowsFile  = "iso_rows.db"
+)
+
+// isoHarness runs scripted interleavings of transactions over a fresh
+// database holding one item, x, initially "0", in its own block of
+// isoItemsFile, and the rows "a", "b" and "y" in block 0 of isoRowsFile.
+type isoHarness struct {
+	t     *testing.T
+	fm    *kfile.FileMgr
+	lm    *log.LogMgr
+	bm    *buffer.BufferMgr
+	txm   *TxMgr
+	items map[string]kfile.BlockId
+
+	mu  sync.Mutex
+	seq int
+	// waiting holds the lock owners seen waiting for a lock since their
+	// transaction's current step was issued; wake is signalled whenever
+	// one is added.
+	waiting map[uint64]bool
+	wake    chan struct{}
+}
+
+func newIsoHarness(t *testing.T) *isoHarness {
+	t.Helper()
+	fm, err := kfile.NewFileMgr(t.TempDir(), 400)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	t.Cleanup(func() { fm.Close() })
+	bm := buffer.NewBufferMgr(fm, 32, buffer.InitLRU(32, fm))
+	lm, err := log.NewLogMgr(fm, bm, "iso_log.db")
+	if err != nil {
+		t.Fatalf("Failed to create LogMgr: %v", err)
+	}
+	h := &isoHarness{
+		t:       t,
+		fm:      fm,
+		lm:      lm,
+		bm:      bm,
+		txm:     NewTxMgr(fm, lm, bm),
+		items:   make(map[string]kfile.BlockId),
+		waiting: make(map[uint64]bool),
+		wake:    make(chan struct{}, 1),
+	}
+	h.txm.locks.SetWaitHook(h.lockWait)
+
+	setup := h.txm.NewTransaction()
+	itemBlk, err := fm.Append(isoItemsFile)
+	if err != nil {
+		t.Fatalf("Failed to append block: %v", err)
+	}
+	h.items["x"] = *itemBlk
+	rowBlk, err := fm.Append(isoRowsFile)
+	if err != nil {
+		t.Fatalf("Failed to append block: %v", err)
+	}
+	if err := setup.InsertCell(*itemBlk, []byte("x"), "0", true); err != nil {
+		t.Fatalf("Failed to insert item: %v", err)
+	}
+	for _, key := range []string{"a", "b", "y"} {
+		if err := setup.InsertCell(*rowBlk, []byte(key), "row", true); err != nil {
+			t.Fatalf("Failed to insert row: %v", err)
+		}
+	}
+	if err := setup.Commit(); err != nil {
+		t.Fatalf("Failed to commit setup: %v", err)
+	}
+	return h
+}
+
+// lockWait is the wait hook of the harness's lock table. It runs with the
+// table locked, so it only records owner and never blocks.
+func (h *isoHarness) lockWait(owner uint64) {
+	h.mu.Lock()
+	h.waiting[owner] = true
+	h.mu.Unlock()
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// issue hands step i to tx and reports whether the step finished, or false
+// once tx is waiting for a lock instead.
+func (h *isoHarness) issue(tx *isoTx, i int, done chan struct{}) bool {
+	owner := tx.tx.cm.Owner()
+	h.mu.Lock()
+	delete(h.waiting, owner)
+	h.mu.Unlock()
+	tx.queue <- i
+	for {
+		select {
+		case <-done:
+			return true
+		case <-h.wake:
+			h.mu.Lock()
+			blocked := h.waiting[owner]
+			h.mu.Unlock()
+			if blocked {
+				return false
+			}
+		}
+	}
+}
+
+// run drives txCount transactions of the harness's TxMgr at level through
+// steps, one goroutine per transaction, and returns the result of each
+// step. Steps are issued in order; a step that waits for a lock leaves its
+// transaction blocked, and that transaction's later steps queue behind it
+// while the schedule carries on with the others. A failed step rolls its
+// transaction back.
+func (h *isoHarness) run(level IsolationLevel, txCount int, steps []isoStep) []isoResult {
+	h.t.Helper()
+	results := make([]isoResult, len(steps))
+	done := make([]chan struct{}, len(steps))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	txs := make([]*isoTx, txCount)
+	for i := range txs {
+		txs[i] = &isoTx{
+			h:        h,
+			tx:       h.txm.NewTransaction(),
+			lastRead: make(map[string]string),
+			queue:    make(chan int, len(steps)),
+		}
+		txs[i].tx.SetIsolationLevel(level)
+		go func(tx *isoTx) {
+			for i := range tx.queue {
+				results[i] = tx.exec(steps[i])
+				close(done[i])
+			}
+		}(txs[i])
+	}
+	defer func() {
+		for _, tx := range txs {
+			close(tx.queue)
+		}
+	}()
+
+	blocked := make(map[int]int) // transaction -> step it is blocked on
+	for i, step := range steps {
+		if b, ok := blocked[step.tx]; ok {
+			select {
+			case <-done[b]:
+				delete(blocked, step.tx)
+			default:
+				txs[step.tx].queue <- i
+				continue
+			}
+		}
+		if !h.issue(txs[step.tx], i, done[i]) {
+			blocked[step.tx] = i
+		}
+	}
+	deadline := time.After(5 * time.Second)
+	for i := range steps {
+		select {
+		case <-done[i]:
+		case <-deadline:
+			h.t.Fatalf("%v: step %d %+v never finished", level, i, steps[i])
+		}
+	}
+	return results
+}
+
+// value returns the committed value of item key once every transaction of
+// the schedule has finished.
+func (h *isoHarness) value(key string) string {
+	h.t.Helper()
+	tx := h.txm.NewTransaction()
+	defer tx.Commit()
+	cell, err := tx.FindCell(h.items[key], []byte(key))
+	if err != nil {
+		h.t.Fatalf("Item %s not found: %v", key, err)
+	}
+	val, err := cell.GetValue()
+	if err != nil {
+		h.t.Fatalf("Failed to decode item %s: %v", key, err)
+	}
+	return fmt.Sprint(val)
+}
+
+func (h *isoHarness) nextSeq() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	return h.seq
+}
+
+// isoTx is one transaction of a schedule.
+type isoTx struct {
+	h        *isoHarness
+	tx       *Mgr
+	lastRead map[string]string
+	aborted  bool
+	queue    chan int
+}
+
+func (x *isoTx) exec(step isoStep) isoResult {
+	if x.aborted {
+		return isoResult{seq: x.h.nextSeq(), err: errIsoAborted}
+	}
+	var res isoResult
+	switch step.op {
+	case opRead:
+		res.val, res.err = x.read(step.key)
+	case opWrite:
+		res.err = x.write(step.key, step.val)
+	case opIncrement:
+		n, err := strconv.Atoi(x.lastRead[step.key])
+		if err != nil {
+			res.err = fmt.Errorf("increment of %s before reading it: %w", step.key, err)
+			break
+		}
+		res.err = x.write(step.key, strconv.Itoa(n+1))
+	case opScan:
+		res.keys, res.err = x.scan(step.key, step.hi)
+	case opInsert:
+		res.err = x.insert(step.key, step.val)
+	case opCommit:
+		res.err = x.tx.Commit()
+	}
+	if res.err != nil {
+		x.aborted = true
+		if step.op != opCommit {
+			if err := x.tx.Rollback(); err != nil {
+				res.err = errors.Join(res.err, err)
+			}
+		}
+	}
+	res.seq = x.h.nextSeq()
+	return res
+}
+
+func (x *isoTx) read(key string) (string, error) {
+	cell, err := x.tx.FindCell(x.h.items[key], []byte(key))
+	if err != nil {
+		return "", err
+	}
+	val, err := cell.GetValue()
+	if err != nil {
+		return "", err
+	}
+	x.lastRead[key] = fmt.Sprint(val)
+	return x.lastRead[key], nil
+}
+
+func (x *isoTx) write(key, val string) error {
+	blk := x.h.items[key]
+	if err := x.tx.DeleteCell(blk, []byte(key), true); err != nil {
+		return err
+	}
+	return x.tx.InsertCell(blk, []byte(key), val, true)
+}
+
+func (x *isoTx) scan(lo, hi string) ([]string, error) {
+	cells, err := x.tx.Scan(isoRowsFile, []byte(lo), []byte(hi))
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, cell := range cells {
+		keys = append(keys, string(cell.GetKey()))
+	}
+	return keys, nil
+}
+
+// insert puts row key into a block of its own, so that only the end of
+// file and key-range locks of a scan can hold it up.
+func (x *isoTx) insert(key, val string) error {
+	blk, err := x.tx.append(isoRowsFile)
+	if err != nil {
+		return err
+	}
+	return x.tx.InsertCell(*blk, []byte(key), val, true)
+}
@@ -0,0 +1,95 @@
+package transaction
+
+import (
+	"slices"
+	"testing"
+)
+
+// observeAnomaly runs the schedule that exhibits a at level on a fresh
+// database and reports whether the anomaly occurred.
+func observeAnomaly(t *testing.T, level IsolationLevel, a anomaly) bool {
+	h := newIsoHarness(t)
+	switch a {
+	case dirtyRead:
+		// T2 reads x while T1's write of it is uncommitted.
+		res := h.run(level, 2, []isoStep{
+			{tx: 0, op: opWrite, key: "x", val: "10"},
+			{tx: 1, op: opRead, key: "x"},
+			{tx: 0, op: opCommit},
+			{tx: 1, op: opCommit},
+		})
+		read, commit := res[1], res[2]
+		return read.err == nil && read.val == "10" && read.seq < commit.seq
+	case nonRepeatableRead:
+		// T2 commits a write of x between T1's two reads of it.
+		res := h.run(level, 2, []isoStep{
+			{tx: 0, op: opRead, key: "x"},
+			{tx: 1, op: opWrite, key: "x", val: "10"},
+			{tx: 1, op: opCommit},
+			{tx: 0, op: opRead, key: "x"},
+			{tx: 0, op: opCommit},
+		})
+		first, second := res[0], res[3]
+		return first.err == nil && second.err == nil && first.val != second.val
+	case phantom:
+		// T2 commits a row matching T1's scan between its two runs.
+		res := h.run(level, 2, []isoStep{
+			{tx: 0, op: opScan, key: "a", hi: "m"},
+			{tx: 1, op: opInsert, key: "c", val: "row"},
+			{tx: 1, op: opCommit},
+			{tx: 0, op: opScan, key: "a", hi: "m"},
+			{tx: 0, op: opCommit},
+		})
+		first, second := res[0], res[3]
+		return first.err == nil && second.err == nil && !slices.Equal(first.keys, second.keys)
+	case lostUpdate:
+		// Both transactions increment the x they read; one increment is lost
+		// if both commit and x ends up 1.
+		res := h.run(level, 2, []isoStep{
+			{tx: 0, op: opRead, key: "x"},
+			{tx: 1, op: opRead, key: "x"},
+			{tx: 0, op: opIncrement, key: "x"},
+			{tx: 1, op: opIncrement, key: "x"},
+			{tx: 0, op: opCommit},
+			{tx: 1, op: opCommit},
+		})
+		return res[4].err == nil && res[5].err == nil && h.value("x") == "1"
+	}
+	t.Fatalf("unknown anomaly %v", a)
+	return false
+}
+
+func TestIsolationAnomalies(t *testing.T) {
+	for _, level := range isolationLevels {
+		for _, a := range anomalies {
+			t.Run(level.String()+"/"+a.String(), func(t *testing.T) {
+				want := permits(level, a)
+				if got := observeAnomaly(t, level, a); got != want {
+					t.Errorf("%v: %v observed = %v, want %v", level, a, got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestIsolationLevelPermits(t *testing.T) {
+	// Each level permits strictly fewer anomalies than the one below it.
+	for i := 1; i < len(isolationLevels); i++ {
+		lower, higher := isolationLevels[i-1], isolationLevels[i]
+		fewer := false
+		for _, a := range anomalies {
+			if permits(higher, a) && !permits(lower, a) {
+				t.Errorf("%v permits %v but %v does not", higher, a, lower)
+			}
+			if permits(lower, a) && !permits(higher, a) {
+				fewer = true
+			}
+		}
+		if !fewer {
+			t.Errorf("%v permits no fewer anomalies than %v", higher, lower)
+		}
+	}
+	if permits(Serializable, phantom) || permits(Serializable, dirtyRead) {
+		t.Error("serializable permits an anomaly")
+	}
+}
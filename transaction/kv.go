@@ -0,0 +1,132 @@
+package transaction
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"ultraSQL/kfile"
+)
+
+// Put stores val under key in filename, replacing any existing value. The
+// key may live in any block of the file, see locate; a new key is placed
+// like Insert places it. The change is logged and locked like InsertCell and
+// DeleteCell.
+func (t *Mgr) Put(filename string, key []byte, val any) error {
+	if err := t.checkActive(); err != nil {
+		return err
+	}
+	blk, _, err := t.locate(filename, key)
+	if err != nil {
+		return err
+	}
+	if blk != nil {
+		if err := t.DeleteCell(*blk, key, true); err != nil {
+			return fmt.Errorf("failed to replace key %s in %s: %w", key, filename, err)
+		}
+	}
+	placed, err := t.Insert(filename, key, val, true)
+	if err != nil {
+		return err
+	}
+	t.txm.noteKey(placed, key)
+	return nil
+}
+
+// Get returns the decoded value stored under key in filename, or an error
+// wrapping kfile.ErrKeyNotFound if there is none.
+func (t *Mgr) Get(filename string, key []byte) (any, error) {
+	if err := t.checkActive(); err != nil {
+		return nil, err
+	}
+	blk, cell, err := t.locate(filename, key)
+	if err != nil {
+		return nil, err
+	}
+	if blk == nil {
+		return nil, fmt.Errorf("key %s in %s: %w", key, filename, kfile.ErrKeyNotFound)
+	}
+	val, err := cell.GetValue()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode key %s in %s: %w", key, filename, err)
+	}
+	return val, nil
+}
+
+// Delete removes key from filename. It returns an error wrapping
+// kfile.ErrKeyNotFound if there is no such key.
+func (t *Mgr) Delete(filename string, key []byte) error {
+	if err := t.checkActive(); err != nil {
+		return err
+	}
+	blk, _, err := t.locate(filename, key)
+	if err != nil {
+		return err
+	}
+	if blk == nil {
+		return fmt.Errorf("key %s in %s: %w", key, filename, kfile.ErrKeyNotFound)
+	}
+	return t.DeleteCell(*blk, key, true)
+}
+
+// Scan returns the live cells of filename with keys from lo up to but
+// excluding hi, in key order; a nil lo or hi leaves the range open on that
+// side. A Serializable transaction locks the range against inserts by
+// other transactions until commit, so running it again returns the same
+// cells even if another transaction meanwhile tries to add a matching key
+// in a block of its own.
+func (t *Mgr) Scan(filename string, lo, hi []byte) ([]*kfile.Cell, error) {
+	if err := t.checkActive(); err != nil {
+		return nil, err
+	}
+	if t.isolation == Serializable {
+		if err := t.cm.RangeSLock(filename, lo, hi); err != nil {
+			return nil, fmt.Errorf("failed to lock keys of %s: %w", filename, err)
+		}
+	}
+	var cells []*kfile.Cell
+	err := t.scanBlocks(filename, func(blk kfile.BlockId, p *kfile.SlottedPage) (bool, error) {
+		found, err := p.ScanRange(lo, hi, true, false)
+		if err != nil {
+			return false, fmt.Errorf("failed to scan block %v: %w", blk, err)
+		}
+		cells = append(cells, found...)
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(cells, func(a, b *kfile.Cell) int {
+		return bytes.Compare(a.GetKey(), b.GetKey())
+	})
+	return cells, nil
+}
+
+// locate returns the block and cell of filename holding key, or a nil block
+// if no block does. It first tries the block TxMgr last saw key in, see
+// noteKey; when that misses, it scans the file from the first block to the
+// first that holds key. A key that is absent, as for each Put of a new key,
+// so costs a pin and a read lock of every block of the file.
+func (t *Mgr) locate(filename string, key []byte) (*kfile.BlockId, *kfile.Cell, error) {
+	var found *kfile.BlockId
+	var cell *kfile.Cell
+	find := func(blk kfile.BlockId, p *kfile.SlottedPage) (bool, error) {
+		c, _, err := p.FindCell(key)
+		if err != nil {
+			return false, nil
+		}
+		found, cell = &blk, c
+		return true, nil
+	}
+	if n, ok := t.txm.keyBlock(filename, key); ok {
+		if done, err := t.visitBlock(*kfile.NewBlockId(filename, n), find); err != nil || done {
+			return found, cell, err
+		}
+	}
+	if err := t.scanBlocks(filename, find); err != nil {
+		return nil, nil, err
+	}
+	if found != nil {
+		t.txm.noteKey(*found, key)
+	}
+	return found, cell, nil
+}
@@ -0,0 +1,73 @@
+package transaction
+
+import (
+	"slices"
+	"ultraSQL/kfile"
+)
+
+// placementProbes caps the blocks chooseBlock pins looking for room before
+// it appends a new one.
+const placementProbes = 4
+
+// freeSpace holds, for the blocks of one file TxMgr has seen, the bytes each
+// had free once compacted when last inserted into, deleted from or probed.
+// It is only a hint: other transactions change the pages after they are
+// noted, and a rolled back insert leaves its block noted fuller than it is,
+// so a block is checked before a cell is placed in it.
+type freeSpace map[int32]int
+
+// noteSpace records that blk has avail bytes free once compacted.
+func (m *TxMgr) noteSpace(blk kfile.BlockId, avail int) {
+	m.hintMu.Lock()
+	defer m.hintMu.Unlock()
+	space := m.space[blk.FileName()]
+	if space == nil {
+		space = make(freeSpace)
+		m.space[blk.FileName()] = space
+	}
+	space[blk.Number()] = avail
+}
+
+// roomyBlocks returns up to n of the first size blocks of filename worth
+// probing for a cell of need bytes: the last block when it has not been
+// noted, as after a restart, then those noted with at least need bytes
+// free, highest first.
+func (m *TxMgr) roomyBlocks(filename string, need int, size int32, n int) []int32 {
+	m.hintMu.Lock()
+	defer m.hintMu.Unlock()
+	space := m.space[filename]
+	var blks []int32
+	for blk, avail := range space {
+		if blk < size && avail >= need {
+			blks = append(blks, blk)
+		}
+	}
+	slices.SortFunc(blks, func(a, b int32) int { return int(b - a) })
+	if _, seen := space[size-1]; size > 0 && !seen {
+		blks = append([]int32{size - 1}, blks...)
+	}
+	return blks[:min(len(blks), n)]
+}
+
+// noteKey records that key was last seen in blk. Like the free space, it is
+// a hint, filled in lazily as Put, locate and index maintenance come across
+// keys: the cell may since have moved or gone, so locate checks the block
+// before trusting it.
+func (m *TxMgr) noteKey(blk kfile.BlockId, key []byte) {
+	m.hintMu.Lock()
+	defer m.hintMu.Unlock()
+	keys := m.keys[blk.FileName()]
+	if keys == nil {
+		keys = make(map[string]int32)
+		m.keys[blk.FileName()] = keys
+	}
+	keys[string(key)] = blk.Number()
+}
+
+// keyBlock returns the block of filename key was last seen in, if any.
+func (m *TxMgr) keyBlock(filename string, key []byte) (int32, bool) {
+	m.hintMu.Lock()
+	defer m.hintMu.Unlock()
+	n, ok := m.keys[filename][string(key)]
+	return n, ok
+}
@@ -0,0 +1,254 @@
+package transaction
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"ultraSQL/buffer"
+	"ultraSQL/concurrency"
+	"ultraSQL/kfile"
+	"ultraSQL/log"
+)
+
+const simFile = "sim.db"
+
+// simulation is one run of random transactions against a database that is
+// crashed part way through. committed is the expected committed state of
+// the table: the value of every key.
+type simulation struct {
+	t       *testing.T
+	seed    int64
+	txm     *TxMgr
+	crashAt int64
+	started atomic.Int64
+
+	// mu guards committed and crashed. Commits take it, so that they reach
+	// committed in the order they reached the log.
+	mu        sync.Mutex
+	committed map[string]string
+	crashed   bool
+}
+
+// runSimulation runs up to txCount random transactions, spread over workers
+// goroutines running side by side, against a fresh database, and crashes
+// it when a randomly chosen transaction starts: the transactions still
+// running are abandoned and the database is reopened from its directory
+// without flushing anything. Recovery must then leave exactly the
+// committed transactions behind. Every random choice comes from generators
+// seeded with seed, so with a single worker a seed replays the same run.
+func runSimulation(t *testing.T, seed int64, workers, txCount int) {
+	t.Helper()
+	dir := t.TempDir()
+	s := &simulation{
+		t:         t,
+		seed:      seed,
+		txm:       openSimDB(t, seed, dir),
+		crashAt:   rand.New(rand.NewSource(seed)).Int63n(int64(txCount)) + 1,
+		committed: make(map[string]string),
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(rng *rand.Rand) {
+			defer wg.Done()
+			s.work(rng, int64(txCount))
+		}(rand.New(rand.NewSource(seed + int64(w) + 1)))
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	tx := openSimDB(t, seed, dir).NewTransaction()
+	if err := tx.Recover(); err != nil {
+		t.Fatalf("seed %d: recovery after crash at tx %d failed: %v", seed, s.crashAt, err)
+	}
+	cells, err := tx.Scan(simFile, nil, nil)
+	if err != nil {
+		t.Fatalf("seed %d: scan after recovery failed: %v", seed, err)
+	}
+	got := make(map[string]string, len(cells))
+	for _, cell := range cells {
+		val, err := cell.GetValue()
+		if err != nil {
+			t.Fatalf("seed %d: value of %s after recovery: %v", seed, cell.GetKey(), err)
+		}
+		got[string(cell.GetKey())] = fmt.Sprint(val)
+	}
+	if !maps.Equal(got, s.committed) {
+		t.Errorf("seed %d: after crash at tx %d recovered %v, want the committed %v", seed, s.crashAt, got, s.committed)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Errorf("seed %d: commit after recovery failed: %v", seed, err)
+	}
+}
+
+// openSimDB opens the database in dir. The FileMgr is closed when the test
+// ends, not at a crash, since a crash leaves its files behind as they are.
+func openSimDB(t *testing.T, seed int64, dir string) *TxMgr {
+	t.Helper()
+	fm, err := kfile.NewFileMgr(dir, 1024)
+	if err != nil {
+		t.Fatalf("seed %d: failed to create FileMgr: %v", seed, err)
+	}
+	t.Cleanup(func() { fm.Close() })
+	bm := buffer.NewBufferMgr(fm, 64, buffer.InitLRU(64, fm))
+	lm, err := log.NewLogMgr(fm, bm, "sim_log.db")
+	if err != nil {
+		t.Fatalf("seed %d: failed to create LogMgr: %v", seed, err)
+	}
+	return NewTxMgr(fm, lm, bm)
+}
+
+// work runs transactions until txCount have started or the database has
+// crashed.
+func (s *simulation) work(rng *rand.Rand, txCount int64) {
+	for !s.t.Failed() {
+		n := s.started.Add(1)
+		if n > txCount {
+			return
+		}
+		if n == s.crashAt {
+			s.mu.Lock()
+			s.crashed = true
+			s.mu.Unlock()
+		}
+		if s.isCrashed() {
+			return
+		}
+		s.runTransaction(n, rng)
+	}
+}
+
+func (s *simulation) isCrashed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.crashed
+}
+
+// view returns the value of key as transaction writes sees it: its own
+// write if it made one, the committed value otherwise. A nil write is a
+// delete.
+func (s *simulation) view(key string, writes map[string]*string) (string, bool) {
+	if w, ok := writes[key]; ok {
+		if w == nil {
+			return "", false
+		}
+		return *w, true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, ok := s.committed[key]
+	return val, ok
+}
+
+// runTransaction runs transaction n, a few random puts, gets and deletes
+// followed by a commit or a rollback. Every read is checked against the
+// committed state: the transaction keeps its locks until it ends, so no
+// other one can commit a change to what it read in the meantime. A
+// transaction chosen to break a deadlock rolls back. At a crash it stops
+// where it is, giving up its locks but nothing else. Those locks no longer
+// guard the uncommitted writes left behind, so once the database has
+// crashed a mismatch is expected and not reported.
+func (s *simulation) runTransaction(n int64, rng *rand.Rand) {
+	tx := s.txm.NewTransaction()
+	fail := func(format string, args ...any) {
+		if s.isCrashed() {
+			tx.cm.Release()
+			return
+		}
+		s.t.Errorf("seed %d, tx %d: %s", s.seed, n, fmt.Sprintf(format, args...))
+		// Let the other workers see the failure rather than wait for locks.
+		tx.cm.Release()
+	}
+	writes := make(map[string]*string)
+	for op := rng.Intn(8) + 1; op > 0; op-- {
+		if s.isCrashed() {
+			tx.cm.Release()
+			return
+		}
+		key := fmt.Sprintf("k%03d", rng.Intn(60))
+		var err error
+		switch choice := rng.Intn(10); {
+		case choice < 5: // put
+			val := fmt.Sprintf("v%d-%0*d", n, rng.Intn(40), 0)
+			if err = tx.Put(simFile, []byte(key), val); err == nil {
+				writes[key] = &val
+			}
+		case choice < 8: // get
+			var got any
+			got, err = tx.Get(simFile, []byte(key))
+			want, ok := s.view(key, writes)
+			switch {
+			case errors.Is(err, kfile.ErrKeyNotFound):
+				if ok {
+					fail("key %s: expected %q, got none", key, want)
+					return
+				}
+				err = nil
+			case err == nil && (!ok || got != want):
+				fail("key %s: expected %q (present %v), got %q", key, want, ok, got)
+				return
+			}
+		default: // delete
+			err = tx.Delete(simFile, []byte(key))
+			_, ok := s.view(key, writes)
+			switch {
+			case errors.Is(err, kfile.ErrKeyNotFound):
+				if ok {
+					fail("delete of %s found no key", key)
+					return
+				}
+				err = nil
+			case err == nil:
+				writes[key] = nil
+			}
+		}
+		if isLockConflict(err) {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				fail("rollback after %v: %v", err, rollbackErr)
+			}
+			return
+		}
+		if err != nil {
+			fail("operation on %s: %v", key, err)
+			return
+		}
+	}
+
+	if rng.Intn(10) >= 7 {
+		if err := tx.Rollback(); err != nil {
+			fail("rollback: %v", err)
+		}
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.crashed {
+		tx.cm.Release()
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		fail("commit: %v", err)
+		return
+	}
+	for key, w := range writes {
+		if w == nil {
+			delete(s.committed, key)
+		} else {
+			s.committed[key] = *w
+		}
+	}
+}
+
+// isLockConflict reports whether err is a lock request refused to break a
+// deadlock or that gave up waiting.
+func isLockConflict(err error) bool {
+	return errors.Is(err, concurrency.ErrDeadlock) ||
+		errors.Is(err, concurrency.ErrUpgradeConflict) ||
+		errors.Is(err, concurrency.ErrLockTimeout)
+}
@@ -0,0 +1,37 @@
+//go:build slow
+
+package transaction
+
+import (
+	"flag"
+	"testing"
+	"time"
+)
+
+var (
+	simSeed     = flag.Int64("sim.seed", 0, "seed for TestSimulation; 0 picks one from the clock")
+	simDuration = flag.Duration("sim.duration", 30*time.Second, "how long TestSimulation runs")
+	simWorkers  = flag.Int("sim.workers", 4, "number of goroutines driving TestSimulation")
+)
+
+// TestSimulation drives random transactions from sim.workers goroutines
+// against the storage stack for sim.duration, crashing the database once in
+// every round, and checks that recovery keeps exactly what was committed.
+// Run with: go test -tags slow -run TestSimulation ./transaction
+// A failing run prints its seed; rerun with -sim.seed, and -sim.workers=1
+// if it failed with one worker, to replay it.
+func TestSimulation(t *testing.T) {
+	seed := *simSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	t.Logf("simulation seed %d (replay with -sim.seed=%d)", seed, seed)
+
+	deadline := time.Now().Add(*simDuration)
+	for round := int64(0); time.Now().Before(deadline); round++ {
+		runSimulation(t, seed+round, *simWorkers, 200)
+		if t.Failed() {
+			t.Fatalf("simulation failed on seed %d", seed+round)
+		}
+	}
+}
@@ -1,52 +1,64 @@
 package transaction
 
 import (
+	"errors"
 	"fmt"
-	"sync/atomic"
 	"ultraSQL/buffer"
 	"ultraSQL/concurrency"
 	"ultraSQL/kfile"
-	"ultraSQL/log"
+	"ultraSQL/log_record"
 	"ultraSQL/recovery"
 )
 
+// ErrTxAborted is returned by every operation on a transaction after Abort.
+// The error also wraps the reason passed to Abort.
+var ErrTxAborted = errors.New("transaction aborted")
+
 type Mgr struct {
-	nextTxNum  int64
-	EndOfFile  int32
+	txm        *TxMgr
 	rm         *recovery.Mgr
 	cm         *concurrency.Mgr
 	bm         *buffer.BufferMgr
 	fm         *kfile.FileMgr
 	txNum      int64
 	bufferList *BufferList
+	abortErr   error
+	lastLSN    int // LSN of the newest logged change, -1 before any
+	isolation  IsolationLevel
 }
 
-func NewTransaction(fm *kfile.FileMgr, lm *log.LogMgr, bm *buffer.BufferMgr) *Mgr {
-	tx := &Mgr{
-		fm: fm,
-		bm: bm,
-	}
-	tx.nextTxNum = tx.nextTxNumber()
-	tx.rm = recovery.NewRecoveryMgr(tx, tx.txNum, lm, bm)
-	tx.cm = concurrency.NewConcurrencyMgr()
-	tx.bufferList = NewBufferList(bm)
-	return tx
+func (t *Mgr) Commit() error {
+	_, err := t.CommitWithResult()
+	return err
 }
 
-func (t *Mgr) Commit() error {
-	err := t.rm.Commit()
+// CommitWithResult commits like Commit and reports the commit record's LSN
+// and whether it was durable when the call returned.
+func (t *Mgr) CommitWithResult() (recovery.CommitResult, error) {
+	if err := t.checkActive(); err != nil {
+		return recovery.CommitResult{LSN: -1}, err
+	}
+	result, err := t.rm.Commit()
 	if err != nil {
-		return err
+		return result, err
 	}
 	err = t.cm.Release()
 	if err != nil {
-		return err
+		return result, err
 	}
 	t.bufferList.UnpinAll()
-	return nil
+	return result, nil
+}
+
+// SetCommitMode selects whether Commit waits for the log to reach disk.
+func (t *Mgr) SetCommitMode(mode recovery.CommitMode) {
+	t.rm.SetCommitMode(mode)
 }
 
 func (t *Mgr) Rollback() error {
+	if err := t.checkActive(); err != nil {
+		return err
+	}
 	err := t.rm.Rollback()
 	if err != nil {
 		return err
@@ -59,6 +71,39 @@ func (t *Mgr) Rollback() error {
 	return nil
 }
 
+// Abort ends the transaction because of an error outside its normal flow,
+// such as a deadlock or timeout. Like Rollback it undoes the transaction's
+// changes, releases its locks and unpins its buffers; in addition every later
+// call on the transaction fails with an error wrapping ErrTxAborted and
+// reason. Aborting an aborted transaction returns that error again.
+func (t *Mgr) Abort(reason error) error {
+	if err := t.checkActive(); err != nil {
+		return err
+	}
+	if reason == nil {
+		reason = errors.New("no reason given")
+	}
+	rollbackErr := t.rm.Rollback()
+	releaseErr := t.cm.Release()
+	t.bufferList.UnpinAll()
+	t.abortErr = fmt.Errorf("%w: %w", ErrTxAborted, reason)
+	if rollbackErr != nil {
+		return fmt.Errorf("failed to undo aborted transaction: %w", rollbackErr)
+	}
+	return releaseErr
+}
+
+// checkActive returns the abort error once the transaction has been aborted.
+func (t *Mgr) checkActive() error {
+	return t.abortErr
+}
+
+// EnableRedo makes Recover also redo the committed transactions whose pages
+// may not have reached disk, as after a crash during a Batch.
+func (t *Mgr) EnableRedo() {
+	t.rm.EnableRedo()
+}
+
 func (t *Mgr) Recover() error {
 	t.bm.Policy().FlushAll(t.txNum)
 	err := t.rm.Recover()
@@ -69,6 +114,9 @@ func (t *Mgr) Recover() error {
 }
 
 func (t *Mgr) Pin(blk kfile.BlockId) error {
+	if err := t.checkActive(); err != nil {
+		return err
+	}
 	err := t.bufferList.Pin(blk)
 	if err != nil {
 		return fmt.Errorf("failed to pin block %v: %w", blk, err)
@@ -76,6 +124,9 @@ func (t *Mgr) Pin(blk kfile.BlockId) error {
 	return nil
 }
 func (t *Mgr) UnPin(blk kfile.BlockId) error {
+	if err := t.checkActive(); err != nil {
+		return err
+	}
 	err := t.bufferList.Unpin(blk)
 	if err != nil {
 		return fmt.Errorf("failed to pin block %v: %w", blk, err)
@@ -83,12 +134,17 @@ func (t *Mgr) UnPin(blk kfile.BlockId) error {
 	return nil
 }
 
+// Size returns the number of blocks of filename. A Serializable
+// transaction sees no block appended by another one until it finishes.
 func (t *Mgr) Size(filename string) (int32, error) {
-	dummyblk := kfile.NewBlockId(filename, t.EndOfFile)
-	err := t.cm.SLock(*dummyblk)
+	if err := t.checkActive(); err != nil {
+		return 0, err
+	}
+	unlock, err := t.readLock(endOfFile(filename), Serializable)
 	if err != nil {
-		return 0, fmt.Errorf("an error occured when acquiring lock %s", err)
+		return 0, fmt.Errorf("failed to lock the end of %s: %w", filename, err)
 	}
+	defer unlock()
 	fileLength, err := t.fm.LengthLocked(filename)
 	if err != nil {
 		return 0, fmt.Errorf("an error occured when acquiring file length %s", err)
@@ -96,15 +152,26 @@ func (t *Mgr) Size(filename string) (int32, error) {
 	return fileLength, nil
 }
 
-func (t *Mgr) append(filename string) *kfile.BlockId {
-	dummyblk := kfile.NewBlockId(filename, t.EndOfFile)
-	t.cm.XLock(*dummyblk)
+func (t *Mgr) append(filename string) (*kfile.BlockId, error) {
+	if err := t.cm.XLock(endOfFile(filename)); err != nil {
+		return nil, fmt.Errorf("failed to lock the end of %s: %w", filename, err)
+	}
 	blk, err := t.fm.Append(filename)
 	if err != nil {
-		return nil
+		return nil, fmt.Errorf("failed to append block to %s: %w", filename, err)
 	}
-	return blk
+	return blk, nil
 }
+
+// endOfFile returns the block whose lock stands for the end of filename:
+// Size locks it shared and append exclusively, so that a Serializable
+// transaction that read the file's size sees no block appended before it
+// finishes. Its
+// number is one no real block has.
+func endOfFile(filename string) kfile.BlockId {
+	return kfile.BlockId{Filename: filename, Blknum: -1}
+}
+
 func (t *Mgr) blockSize() int {
 	return t.fm.BlockSize()
 }
@@ -112,48 +179,311 @@ func (t *Mgr) AvailableBuffs() int {
 	return t.bm.Available()
 }
 
-func (t *Mgr) nextTxNumber() int64 {
-	return atomic.AddInt64(&t.nextTxNum, 1)
-}
-
-func (t *Mgr) FindCell(blk kfile.BlockId, key []byte) *kfile.Cell {
-	t.cm.SLock(blk)
+// FindCell returns the cell with the given key in blk, after taking the
+// shared lock on blk that the transaction's isolation level asks for. It fails with the lock error, such as
+// concurrency.ErrDeadlock, if the lock cannot be granted, and with an error
+// wrapping kfile.ErrKeyNotFound if blk has no such cell.
+func (t *Mgr) FindCell(blk kfile.BlockId, key []byte) (*kfile.Cell, error) {
+	if err := t.checkActive(); err != nil {
+		return nil, err
+	}
+	unlock, err := t.readLock(blk, RepeatableRead)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock block %v: %w", blk, err)
+	}
+	defer unlock()
+	if err := t.Pin(blk); err != nil {
+		return nil, err
+	}
 	buff := t.bufferList.Buffer(blk)
 	cell, _, err := buff.Contents().FindCell(key)
 	if err != nil {
-		return nil
+		return nil, fmt.Errorf("failed to find cell %s in block %v: %w", key, blk, err)
 	}
-	return cell
+	return cell, nil
 }
 
+// InsertCell inserts a cell holding key and val into blk. When okToLog is
+// set, the key is locked against the range locks of scans in other
+// transactions, see Scan, the complete cell is logged before the page is
+// modified, so recovery can always undo or redo the insert as one step, and
+// entries are added to any secondary index registered on blk's file. A value
+// too big for the page spills into blocks of the file's overflow file, see
+// kfile.SpillCell, each written and logged like an insert of its own. A lock
+// error, such as concurrency.ErrDeadlock, is returned before anything is
+// changed.
 func (t *Mgr) InsertCell(blk kfile.BlockId, key []byte, val any, okToLog bool) error {
-	t.cm.XLock(blk)
-	var err error
-	err = t.Pin(blk)
+	if err := t.checkActive(); err != nil {
+		return err
+	}
+	// Reject an empty key before it is logged, not when the page refuses it.
+	if len(key) == 0 {
+		return fmt.Errorf("failed to insert into block %v: %w", blk, kfile.ErrEmptyKey)
+	}
+	if okToLog {
+		if err := t.cm.KeyXLock(blk.FileName(), key); err != nil {
+			return fmt.Errorf("failed to lock key %s in %s: %w", key, blk.FileName(), err)
+		}
+	}
+	if err := t.cm.XLock(blk); err != nil {
+		return fmt.Errorf("failed to lock block %v: %w", blk, err)
+	}
+	err := t.Pin(blk)
 	if err != nil {
 		return err
 	}
 	buff := t.bufferList.Buffer(blk)
-	lsn := -1
-	cellKey := key
-	cell := kfile.NewKVCell(cellKey)
+	cell := kfile.NewKVCell(key)
+	if err := cell.SetValue(val); err != nil {
+		return fmt.Errorf("failed to set value for key %s: %w", key, err)
+	}
 	p := buff.Contents()
-	err = p.InsertCell(cell)
+	// Log the cell with the timestamps the page gives it, so that redo
+	// restores them too.
+	p.StampCell(cell)
+	if err := makeRoom(p, cell); err != nil {
+		return fmt.Errorf("failed to make room in block %v: %w", blk, err)
+	}
+	// Each piece of a spilled value is logged on its own, so the fragments'
+	// records, which name the longer overflow file, set the limit.
+	limit := t.cellLogLimit(kfile.OverflowFile(blk.FileName()), key)
+	if !p.HasRoomFor(cell) || len(cell.ToBytes()) > limit {
+		spill, err := p.SpillCell(cell, limit)
+		if err != nil {
+			return fmt.Errorf("failed to insert cell into block %v: %w", blk, err)
+		}
+		if err := t.writeOverflow(blk.FileName(), spill, okToLog); err != nil {
+			return fmt.Errorf("failed to spill value of key %s: %w", key, err)
+		}
+		cell = spill.Inline
+	}
+	lsn := -1
+	if okToLog {
+		lsn, err = t.rm.LogInsertCell(buff, cell)
+		if err != nil {
+			return err
+		}
+		t.lastLSN = lsn
+	}
+	err = p.RestoreCell(cell)
 	if err != nil {
-		return fmt.Errorf("failed to pin block %v: %w", blk, err)
+		return fmt.Errorf("failed to insert cell into block %v: %w", blk, err)
 	}
 	buff.MarkModified(t.txNum, lsn)
+	t.txm.noteSpace(blk, p.Available())
 	if okToLog {
-		lsn, err = t.rm.SetCellValue(buff, key, val)
+		return t.addIndexEntries(blk.FileName(), key, val)
+	}
+	return nil
+}
+
+// RestoreCell puts cell into blk exactly as given, keeping its type, flags
+// and timestamps, without logging it. Undo and redo use it to restore a
+// logged cell image. Like InsertCell it takes an exclusive lock on blk first.
+func (t *Mgr) RestoreCell(blk kfile.BlockId, cell *kfile.Cell) error {
+	if err := t.checkActive(); err != nil {
+		return err
+	}
+	if err := t.cm.XLock(blk); err != nil {
+		return fmt.Errorf("failed to lock block %v: %w", blk, err)
+	}
+	if err := t.Pin(blk); err != nil {
+		return err
+	}
+	buff := t.bufferList.Buffer(blk)
+	if err := makeRoom(buff.Contents(), cell); err != nil {
+		return fmt.Errorf("failed to make room in block %v: %w", blk, err)
+	}
+	if err := buff.Contents().RestoreCell(cell); err != nil {
+		return fmt.Errorf("failed to restore cell %s in block %v: %w", cell.GetKey(), blk, err)
+	}
+	buff.MarkModified(t.txNum, -1)
+	return nil
+}
+
+// cellLogLimit returns the most bytes a cell with key in a block of
+// filename may encode to for its insert record to fit in a log page.
+func (t *Mgr) cellLogLimit(filename string, key []byte) int {
+	rec := log_record.NewInsertCellRecord(t.txNum, *kfile.NewBlockId(filename, 0), key, nil)
+	return t.txm.lm.MaxRecordSize() - len(rec.ToBytes())
+}
+
+// writeOverflow places the fragments of spill in new blocks of the overflow
+// file of filename, each locked, logged and inserted like a cell of its
+// own, and chains spill's pieces through them. The blocks are unpinned once
+// written, however long the chain.
+func (t *Mgr) writeOverflow(filename string, spill *kfile.OverflowSpill, okToLog bool) error {
+	file := kfile.OverflowFile(filename)
+	blks := make([]int32, len(spill.Fragments))
+	for i := range blks {
+		blk, err := t.append(file)
 		if err != nil {
 			return err
 		}
+		blks[i] = blk.Number()
+	}
+	spill.Chain(blks)
+	for i, frag := range spill.Fragments {
+		blk := kfile.NewBlockId(file, blks[i])
+		if err := t.cm.XLock(*blk); err != nil {
+			return fmt.Errorf("failed to lock block %v: %w", blk, err)
+		}
+		if err := t.Pin(*blk); err != nil {
+			return err
+		}
+		buff := t.bufferList.Buffer(*blk)
+		lsn := -1
+		if okToLog {
+			var err error
+			if lsn, err = t.rm.LogInsertCell(buff, frag); err != nil {
+				return err
+			}
+			t.lastLSN = lsn
+		}
+		if err := buff.Contents().RestoreCell(frag); err != nil {
+			return fmt.Errorf("failed to insert overflow into block %v: %w", blk, err)
+		}
+		buff.MarkModified(t.txNum, lsn)
+		if err := t.UnPin(*blk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// makeRoom compacts p if cell does not fit in its free space, giving back
+// the space of deleted cells. Compaction keeps every live cell as it is, so
+// it needs no log record of its own.
+func makeRoom(p *kfile.SlottedPage, cell *kfile.Cell) error {
+	if p.HasRoomFor(cell) {
+		return nil
+	}
+	return p.Compact()
+}
+
+// Insert places a cell holding key and val in some block of filename that has
+// room for it, see chooseBlock, appending a new block when none is found, and
+// returns the block the cell landed in. If the chosen block fills up before the insert reaches it,
+// placement is retried once.
+func (t *Mgr) Insert(filename string, key []byte, val any, okToLog bool) (kfile.BlockId, error) {
+	if err := t.checkActive(); err != nil {
+		return kfile.BlockId{}, err
+	}
+	if len(key) == 0 {
+		return kfile.BlockId{}, fmt.Errorf("failed to insert into %s: %w", filename, kfile.ErrEmptyKey)
+	}
+	cell := kfile.NewKVCell(key)
+	if err := cell.SetValue(val); err != nil {
+		return kfile.BlockId{}, fmt.Errorf("failed to set value for key %s: %w", key, err)
+	}
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var blk *kfile.BlockId
+		blk, err = t.chooseBlock(filename, cell)
+		if err != nil {
+			return kfile.BlockId{}, err
+		}
+		err = t.InsertCell(*blk, key, val, okToLog)
+		if err == nil {
+			return *blk, nil
+		}
+		if !errors.Is(err, kfile.ErrPageFull) {
+			return kfile.BlockId{}, err
+		}
 	}
+	return kfile.BlockId{}, fmt.Errorf("failed to place key %s in %s: %w", key, filename, err)
+}
 
+// chooseBlock returns a block of filename with room for cell, counting the
+// space of deleted cells, which InsertCell compacts away. Rather than pin
+// every block, it probes at most placementProbes of them: the last block if
+// TxMgr has not noted its free space, then those noted with room, highest
+// first. If none has room a new block is appended.
+func (t *Mgr) chooseBlock(filename string, cell *kfile.Cell) (*kfile.BlockId, error) {
+	size, err := t.Size(filename)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range t.txm.roomyBlocks(filename, len(cell.ToBytes()), size, placementProbes) {
+		blk := kfile.NewBlockId(filename, n)
+		held := t.bufferList.Buffer(*blk) != nil
+		if err := t.Pin(*blk); err != nil {
+			return nil, err
+		}
+		p := t.bufferList.Buffer(*blk).Contents()
+		fits := p.HasRoomAfterCompact(cell)
+		t.txm.noteSpace(*blk, p.Available())
+		if !held {
+			if err := t.UnPin(*blk); err != nil {
+				return nil, err
+			}
+		}
+		if fits {
+			return blk, nil
+		}
+	}
+	return t.append(filename)
+}
+
+// DeleteCell removes the cell with the given key from blk. It returns an
+// error wrapping kfile.ErrKeyNotFound if no such cell exists. When okToLog is
+// set, the removed cell is logged first and matching secondary index entries
+// are removed as well; recovery invokes it with okToLog false. A lock error,
+// such as concurrency.ErrDeadlock, is returned before anything is changed.
+func (t *Mgr) DeleteCell(blk kfile.BlockId, key []byte, okToLog bool) error {
+	if err := t.checkActive(); err != nil {
+		return err
+	}
+	if err := t.cm.XLock(blk); err != nil {
+		return fmt.Errorf("failed to lock block %v: %w", blk, err)
+	}
+	if err := t.Pin(blk); err != nil {
+		return err
+	}
+	buff := t.bufferList.Buffer(blk)
+	p := buff.Contents()
+	// Undo puts back the cell as stored, pointing at its overflow blocks,
+	// which the delete leaves in place. Recovery may find those blocks
+	// unwritten, so only secondary indexes, keyed on the whole value, read
+	// them.
+	stored, slot, err := p.FindStoredCell(key)
+	if err != nil {
+		return fmt.Errorf("failed to find cell %s in block %v: %w", key, blk, err)
+	}
+	cell := stored
+	if okToLog {
+		if cell, err = p.GetCellBySlot(slot); err != nil {
+			return fmt.Errorf("failed to read cell %s in block %v: %w", key, blk, err)
+		}
+	}
+	lsn := -1
+	if okToLog {
+		lsn, err = t.rm.LogDeleteCell(buff, stored)
+		if err != nil {
+			return err
+		}
+		t.lastLSN = lsn
+	}
+	if err := p.DeleteCell(slot); err != nil {
+		return fmt.Errorf("failed to delete cell %s from block %v: %w", key, blk, err)
+	}
+	buff.MarkModified(t.txNum, lsn)
+	t.txm.noteSpace(blk, p.Available())
+	if okToLog {
+		return t.removeIndexEntries(blk.FileName(), key, cell)
+	}
 	return nil
 }
 
-// GetTxNum is required by the TxInterface.
+// LastLSN returns the LSN of the transaction's most recent logged change,
+// or -1 if it has logged none. Passing it to log.LogMgr.FlushLSN waits for
+// that change to be durable without committing.
+func (t *Mgr) LastLSN() int {
+	return t.lastLSN
+}
+
+// GetTxNum returns the transaction's number, which is unique among the
+// transactions of its TxMgr. It is required by the TxInterface.
 func (t *Mgr) GetTxNum() int64 {
-	return t.nextTxNum
+	return t.txNum
 }
@@ -1,11 +1,18 @@
 package transaction
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 	"ultraSQL/buffer"
+	"ultraSQL/concurrency"
 	"ultraSQL/kfile"
 	"ultraSQL/log"
 	"ultraSQL/log_record"
@@ -152,7 +159,8 @@ func TestTransactionManagerLifecycle(t *testing.T) {
 	}
 
 	// Create the transaction manager.
-	txMgr := NewTransaction(fm, lm, bm)
+	txm := NewTxMgr(fm, lm, bm)
+	txMgr := txm.NewTransaction()
 	if txMgr == nil {
 		t.Fatal("Transaction manager is nil")
 	}
@@ -188,12 +196,1173 @@ func TestTransactionManagerLifecycle(t *testing.T) {
 	}
 
 	// Optionally, test finding the cell.
-	cell := txMgr.FindCell(*blk, key)
-	if cell == nil {
-		t.Errorf("Failed to find cell with key %s in block %v", key, blk)
+	if _, err := txMgr.FindCell(*blk, key); err != nil {
+		t.Errorf("Failed to find cell with key %s in block %v: %v", key, blk, err)
 	} else {
 		t.Logf("Found cell with key %s in block %v", key, blk)
 	}
 
 	// Additional tests (Recover, Pin/Unpin, etc.) can be added here.
 }
+
+func TestInsertCellRecoveryIsAtomic(t *testing.T) {
+	tempDir := t.TempDir()
+	fm, err := kfile.NewFileMgr(tempDir, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	policy := buffer.InitLRU(8, fm)
+	bm := buffer.NewBufferMgr(fm, 8, policy)
+	lm, err := log.NewLogMgr(fm, bm, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to create LogMgr: %v", err)
+	}
+
+	blk := kfile.NewBlockId("atomic.db", 0)
+	if _, err := fm.Append(blk.FileName()); err != nil {
+		t.Fatalf("Failed to append block: %v", err)
+	}
+
+	txm := NewTxMgr(fm, lm, bm)
+	tx := txm.NewTransaction()
+	if err := tx.InsertCell(*blk, []byte("complete"), "value", true); err != nil {
+		t.Fatalf("InsertCell failed: %v", err)
+	}
+	cell, err := tx.FindCell(*blk, []byte("complete"))
+	if err != nil {
+		t.Fatalf("Expected inserted cell to be present: %v", err)
+	}
+	if val, err := cell.GetValue(); err != nil || val != "value" {
+		t.Errorf("Expected inserted cell to carry its value, got %v (err %v)", val, err)
+	}
+
+	// Crash after logging a second insert but before the page was modified.
+	torn := kfile.NewKVCell([]byte("torn"))
+	if err := torn.SetValue("lost"); err != nil {
+		t.Fatalf("SetValue failed: %v", err)
+	}
+	if _, err := log_record.InsertCellRecordWriteToLog(lm, tx.txNum, *blk, torn.GetKey(), torn.ToBytes()); err != nil {
+		t.Fatalf("Failed to log insert: %v", err)
+	}
+	// The first insert's page image reaches disk before the crash.
+	bm.Policy().FlushAll(tx.txNum)
+
+	// Recovery runs after a restart, in a TxMgr holding none of tx's locks.
+	recoveryTx := NewTxMgr(fm, lm, bm).NewTransaction()
+	if err := recoveryTx.Recover(); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+	for _, key := range []string{"complete", "torn"} {
+		if _, err := recoveryTx.FindCell(*blk, []byte(key)); !errors.Is(err, kfile.ErrKeyNotFound) {
+			t.Errorf("Expected uncommitted cell %q to be fully absent after recovery, got %v", key, err)
+		}
+	}
+}
+
+func TestInsertPlacesCellsAcrossBlocks(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 512)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	policy := buffer.InitLRU(32, fm)
+	bm := buffer.NewBufferMgr(fm, 32, policy)
+	lm, err := log.NewLogMgr(fm, bm, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to create LogMgr: %v", err)
+	}
+
+	txm := NewTxMgr(fm, lm, bm)
+	tx := txm.NewTransaction()
+	placed := make(map[string]kfile.BlockId)
+	for i := 0; i < 40; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		val := strings.Repeat("v", 10+(i*7)%60)
+		blk, err := tx.Insert("heap.db", []byte(key), val, true)
+		if err != nil {
+			t.Fatalf("Insert of %s failed: %v", key, err)
+		}
+		placed[key] = blk
+	}
+
+	size, err := tx.Size("heap.db")
+	if err != nil {
+		t.Fatalf("Size failed: %v", err)
+	}
+	if size < 3 {
+		t.Errorf("Expected inserts to spill over several blocks, got %d", size)
+	}
+	for key, blk := range placed {
+		if _, err := tx.FindCell(blk, []byte(key)); err != nil {
+			t.Errorf("Key %s not found in returned block %v: %v", key, blk, err)
+		}
+	}
+}
+
+func TestInsertReusesFreedBlockWithoutScanning(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	policy := buffer.InitLRU(32, fm)
+	bm := buffer.NewBufferMgr(fm, 32, policy)
+	lm, err := log.NewLogMgr(fm, bm, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to create LogMgr: %v", err)
+	}
+
+	txm := NewTxMgr(fm, lm, bm)
+	tx := txm.NewTransaction()
+	placed := make(map[string]kfile.BlockId)
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		blk, err := tx.Insert("heap.db", []byte(key), strings.Repeat("v", 300), true)
+		if err != nil {
+			t.Fatalf("Insert of %s failed: %v", key, err)
+		}
+		placed[key] = blk
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	// Empty the block the first key went to; only it has room for a cell
+	// bigger than a block holding a single row could take.
+	freed := placed["key000"]
+	tx = txm.NewTransaction()
+	for key, blk := range placed {
+		if blk == freed {
+			if err := tx.DeleteCell(blk, []byte(key), true); err != nil {
+				t.Fatalf("DeleteCell of %s failed: %v", key, err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	tx = txm.NewTransaction()
+	size, err := tx.Size("heap.db")
+	if err != nil {
+		t.Fatalf("Size failed: %v", err)
+	}
+	if size < 2*placementProbes {
+		t.Fatalf("Expected at least %d blocks to probe past, got %d", 2*placementProbes, size)
+	}
+	bm.ResetStats()
+	blk, err := tx.Insert("heap.db", []byte("big"), strings.Repeat("b", 720), true)
+	if err != nil {
+		t.Fatalf("Insert of big failed: %v", err)
+	}
+	if blk != freed {
+		t.Errorf("Expected the big cell in freed block %v, got %v", freed, blk)
+	}
+	stats := bm.Stats()
+	if pins := stats.Hits + stats.Misses; pins > placementProbes+2 {
+		t.Errorf("Expected at most %d pins to place a cell, got %d over %d blocks", placementProbes+2, pins, size)
+	}
+	if after, err := tx.Size("heap.db"); err != nil || after != size {
+		t.Errorf("Expected the file to stay at %d blocks, got %d (%v)", size, after, err)
+	}
+}
+
+func TestSecondaryIndexMaintenance(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 4096)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	policy := buffer.InitLRU(16, fm)
+	bm := buffer.NewBufferMgr(fm, 16, policy)
+	lm, err := log.NewLogMgr(fm, bm, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to create LogMgr: %v", err)
+	}
+
+	txm := NewTxMgr(fm, lm, bm)
+	tx := txm.NewTransaction()
+	// Rows are "name|city"; the index is on city.
+	byCity := func(val any) ([]byte, error) {
+		row, ok := val.(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected row type %T", val)
+		}
+		return []byte(row[strings.Index(row, "|")+1:]), nil
+	}
+	if err := txm.RegisterIndex("people.db", "people_city.idx", byCity); err != nil {
+		t.Fatalf("RegisterIndex failed: %v", err)
+	}
+
+	rows := map[string]string{
+		"p1": "ada|london",
+		"p2": "alan|london",
+		"p3": "grace|new york",
+	}
+	placed := make(map[string]kfile.BlockId)
+	for pk, row := range rows {
+		blk, err := tx.Insert("people.db", []byte(pk), row, true)
+		if err != nil {
+			t.Fatalf("Insert of %s failed: %v", pk, err)
+		}
+		placed[pk] = blk
+	}
+
+	lookup := func(city string) []string {
+		t.Helper()
+		pks, err := tx.LookupIndex("people_city.idx", []byte(city))
+		if err != nil {
+			t.Fatalf("LookupIndex failed: %v", err)
+		}
+		var out []string
+		for _, pk := range pks {
+			out = append(out, string(pk))
+		}
+		return out
+	}
+	if got := lookup("london"); len(got) != 2 || got[0] != "p1" || got[1] != "p2" {
+		t.Errorf("Expected [p1 p2] for london, got %v", got)
+	}
+	if got := lookup("new york"); len(got) != 1 || got[0] != "p3" {
+		t.Errorf("Expected [p3] for new york, got %v", got)
+	}
+
+	if err := tx.DeleteCell(placed["p1"], []byte("p1"), true); err != nil {
+		t.Fatalf("DeleteCell failed: %v", err)
+	}
+	if got := lookup("london"); len(got) != 1 || got[0] != "p2" {
+		t.Errorf("Expected [p2] for london after delete, got %v", got)
+	}
+
+	// Rolling back undoes the index changes along with the base changes.
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	if got := lookup("london"); len(got) != 0 {
+		t.Errorf("Expected no london entries after rollback, got %v", got)
+	}
+}
+
+// TestSimulationRegressions replays seeds on which TestSimulation (run with
+// -tags slow) once failed.
+func TestSimulationRegressions(t *testing.T) {
+	for _, seed := range []int64{
+		1792177339487009287, // log roll-over left iterators reading a stale page
+		1792177387921316357, // undoing a delete found the page full of dead cells
+	} {
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			runSimulation(t, seed, 1, 200)
+		})
+	}
+}
+
+func TestTransactionsShareLocks(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 512)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	policy := buffer.InitLRU(8, fm)
+	bm := buffer.NewBufferMgr(fm, 8, policy)
+	lm, err := log.NewLogMgr(fm, bm, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to create LogMgr: %v", err)
+	}
+
+	txm := NewTxMgr(fm, lm, bm)
+	tx1, tx2 := txm.NewTransaction(), txm.NewTransaction()
+	blk := kfile.NewBlockId("shared.db", 0)
+	for _, tx := range []*Mgr{tx1, tx2} {
+		if err := tx.cm.SLock(*blk); err != nil {
+			t.Fatalf("SLock failed: %v", err)
+		}
+	}
+
+	// Both readers now upgrade: only one of them may get the block.
+	errs := make(chan error, 2)
+	var wg sync.WaitGroup
+	for _, tx := range []*Mgr{tx1, tx2} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := tx.cm.XLock(*blk)
+			if err != nil {
+				// The loser gives up its locks so the winner can proceed.
+				tx.cm.Release()
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	var conflicts, granted int
+	for err := range errs {
+		switch {
+		case err == nil:
+			granted++
+		case errors.Is(err, concurrency.ErrUpgradeConflict):
+			conflicts++
+		default:
+			t.Errorf("Unexpected lock error: %v", err)
+		}
+	}
+	if conflicts != 1 || granted != 1 {
+		t.Errorf("Expected one upgrade conflict and one grant, got %d and %d", conflicts, granted)
+	}
+	for _, tx := range []*Mgr{tx1, tx2} {
+		if err := tx.Commit(); err != nil {
+			t.Errorf("Commit failed: %v", err)
+		}
+	}
+}
+
+func TestDeadlockVictimGetsErrDeadlock(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 512)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	policy := buffer.InitLRU(8, fm)
+	bm := buffer.NewBufferMgr(fm, 8, policy)
+	lm, err := log.NewLogMgr(fm, bm, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to create LogMgr: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := fm.Append("deadlock.db"); err != nil {
+			t.Fatalf("Failed to append block: %v", err)
+		}
+	}
+
+	txm := NewTxMgr(fm, lm, bm)
+	tx1, tx2 := txm.NewTransaction(), txm.NewTransaction()
+	a, b := kfile.NewBlockId("deadlock.db", 0), kfile.NewBlockId("deadlock.db", 1)
+	if err := tx1.InsertCell(*a, []byte("a1"), "v", true); err != nil {
+		t.Fatalf("tx1 insert into a failed: %v", err)
+	}
+	if err := tx2.InsertCell(*b, []byte("b2"), "v", true); err != nil {
+		t.Fatalf("tx2 insert into b failed: %v", err)
+	}
+
+	// Each now writes the block the other holds.
+	errs := make(chan error, 2)
+	var wg sync.WaitGroup
+	for _, req := range []struct {
+		tx  *Mgr
+		blk *kfile.BlockId
+	}{{tx1, b}, {tx2, a}} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := req.tx.InsertCell(*req.blk, []byte(fmt.Sprintf("x%d", req.tx.txNum)), "v", true)
+			if err != nil {
+				// The victim aborts so the other can proceed.
+				req.tx.Abort(err)
+				errs <- err
+				return
+			}
+			errs <- req.tx.Commit()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	var deadlocks, committed int
+	for err := range errs {
+		switch {
+		case err == nil:
+			committed++
+		case errors.Is(err, concurrency.ErrDeadlock):
+			deadlocks++
+		default:
+			t.Errorf("Unexpected error: %v", err)
+		}
+	}
+	if deadlocks != 1 || committed != 1 {
+		t.Errorf("Expected one deadlock victim and one commit, got %d and %d", deadlocks, committed)
+	}
+}
+
+func TestAbortUndoesWorkAndFailsLaterCalls(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 4096)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	policy := buffer.InitLRU(8, fm)
+	bm := buffer.NewBufferMgr(fm, 8, policy)
+	lm, err := log.NewLogMgr(fm, bm, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to create LogMgr: %v", err)
+	}
+
+	txm := NewTxMgr(fm, lm, bm)
+	tx := txm.NewTransaction()
+	var placed []kfile.BlockId
+	for _, key := range []string{"a", "b"} {
+		blk, err := tx.Insert("abort.db", []byte(key), "value", true)
+		if err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+		placed = append(placed, blk)
+	}
+
+	reason := errors.New("chosen as deadlock victim")
+	if err := tx.Abort(reason); err != nil {
+		t.Fatalf("Abort failed: %v", err)
+	}
+
+	check := txm.NewTransaction()
+	for i, key := range []string{"a", "b"} {
+		if _, err := check.FindCell(placed[i], []byte(key)); !errors.Is(err, kfile.ErrKeyNotFound) {
+			t.Errorf("Expected aborted insert of %q to be undone, got %v", key, err)
+		}
+	}
+
+	calls := map[string]error{
+		"InsertCell": tx.InsertCell(placed[0], []byte("c"), "value", true),
+		"DeleteCell": tx.DeleteCell(placed[0], []byte("a"), true),
+		"Pin":        tx.Pin(placed[0]),
+		"Commit":     tx.Commit(),
+		"Rollback":   tx.Rollback(),
+		"Abort":      tx.Abort(errors.New("again")),
+	}
+	for name, err := range calls {
+		if !errors.Is(err, ErrTxAborted) || !errors.Is(err, reason) {
+			t.Errorf("%s: expected ErrTxAborted wrapping the reason, got %v", name, err)
+		}
+	}
+	if _, err := tx.FindCell(placed[0], []byte("a")); !errors.Is(err, ErrTxAborted) {
+		t.Errorf("FindCell: expected ErrTxAborted, got %v", err)
+	}
+	if _, err := tx.LookupIndex("abort_idx.db", []byte("value")); !errors.Is(err, ErrTxAborted) || !errors.Is(err, reason) {
+		t.Errorf("LookupIndex: expected ErrTxAborted wrapping the reason, got %v", err)
+	}
+}
+
+func TestPutGetDelete(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 512)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	policy := buffer.InitLRU(32, fm)
+	bm := buffer.NewBufferMgr(fm, 32, policy)
+	lm, err := log.NewLogMgr(fm, bm, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to create LogMgr: %v", err)
+	}
+
+	txm := NewTxMgr(fm, lm, bm)
+	tx := txm.NewTransaction()
+	want := make(map[string]any)
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		var val any = strings.Repeat("v", 20+i)
+		if i%3 == 0 {
+			val = i
+		}
+		if err := tx.Put("kv.db", []byte(key), val); err != nil {
+			t.Fatalf("Put of %s failed: %v", key, err)
+		}
+		want[key] = val
+	}
+	if size, _ := tx.Size("kv.db"); size < 2 {
+		t.Fatalf("Expected keys to span several blocks, got %d", size)
+	}
+
+	// Overwrite with a value of a different size and type, and delete a few.
+	for _, key := range []string{"key001", "key015", "key029"} {
+		if err := tx.Put("kv.db", []byte(key), strings.Repeat("w", 50)); err != nil {
+			t.Fatalf("Overwrite of %s failed: %v", key, err)
+		}
+		want[key] = strings.Repeat("w", 50)
+	}
+	for _, key := range []string{"key000", "key014"} {
+		if err := tx.Delete("kv.db", []byte(key)); err != nil {
+			t.Fatalf("Delete of %s failed: %v", key, err)
+		}
+		delete(want, key)
+	}
+
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		got, err := tx.Get("kv.db", []byte(key))
+		expected, ok := want[key]
+		if !ok {
+			if !errors.Is(err, kfile.ErrKeyNotFound) {
+				t.Errorf("Expected deleted key %s to be missing, got %v, %v", key, got, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Get of %s failed: %v", key, err)
+		} else if got != expected {
+			t.Errorf("Key %s: expected %v, got %v", key, expected, got)
+		}
+	}
+	if err := tx.Delete("kv.db", []byte("key000")); !errors.Is(err, kfile.ErrKeyNotFound) {
+		t.Errorf("Expected deleting a missing key to fail with ErrKeyNotFound, got %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+}
+
+func TestGetFindsKeysWithoutScanning(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	policy := buffer.InitLRU(32, fm)
+	bm := buffer.NewBufferMgr(fm, 32, policy)
+	lm, err := log.NewLogMgr(fm, bm, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to create LogMgr: %v", err)
+	}
+
+	txm := NewTxMgr(fm, lm, bm)
+	tx := txm.NewTransaction()
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		if err := tx.Put("kv.db", []byte(key), strings.Repeat("v", 300)); err != nil {
+			t.Fatalf("Put of %s failed: %v", key, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	tx = txm.NewTransaction()
+	size, err := tx.Size("kv.db")
+	if err != nil {
+		t.Fatalf("Size failed: %v", err)
+	}
+	if size < 4 {
+		t.Fatalf("Expected keys to span several blocks, got %d", size)
+	}
+	bm.ResetStats()
+	if _, err := tx.Get("kv.db", []byte("key029")); err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if stats := bm.Stats(); stats.Hits+stats.Misses != 1 {
+		t.Errorf("Expected Get of a key Put placed to pin one block, got %d pins over %d blocks",
+			stats.Hits+stats.Misses, size)
+	}
+
+	// Move the key behind the hint's back; Get must still find it.
+	blk := kfile.NewBlockId("kv.db", size-1)
+	if err := tx.DeleteCell(*blk, []byte("key029"), true); err != nil {
+		t.Fatalf("DeleteCell failed: %v", err)
+	}
+	moved, err := tx.append("kv.db")
+	if err != nil {
+		t.Fatalf("append failed: %v", err)
+	}
+	if err := tx.InsertCell(*moved, []byte("key029"), "moved", true); err != nil {
+		t.Fatalf("InsertCell failed: %v", err)
+	}
+	if got, err := tx.Get("kv.db", []byte("key029")); err != nil || got != "moved" {
+		t.Errorf("Expected the moved value, got %v, %v", got, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+}
+
+func TestEmptyKeysAndValues(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 512)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	policy := buffer.InitLRU(16, fm)
+	bm := buffer.NewBufferMgr(fm, 16, policy)
+	lm, err := log.NewLogMgr(fm, bm, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to create LogMgr: %v", err)
+	}
+
+	txm := NewTxMgr(fm, lm, bm)
+	tx := txm.NewTransaction()
+	if err := tx.Put("kv.db", nil, "v"); !errors.Is(err, kfile.ErrEmptyKey) {
+		t.Errorf("Expected Put with an empty key to fail with ErrEmptyKey, got %v", err)
+	}
+	blk := kfile.NewBlockId("kv.db", 0)
+	if err := tx.InsertCell(*blk, []byte{}, "v", true); !errors.Is(err, kfile.ErrEmptyKey) {
+		t.Errorf("Expected InsertCell with an empty key to fail with ErrEmptyKey, got %v", err)
+	}
+
+	if err := tx.Put("kv.db", []byte("blank"), ""); err != nil {
+		t.Fatalf("Put of an empty value failed: %v", err)
+	}
+	if got, err := tx.Get("kv.db", []byte("blank")); err != nil || got != "" {
+		t.Errorf("Expected an empty string back, got %q, %v", got, err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+}
+
+func TestBatchKeepsTransactionsAtomicAcrossCrash(t *testing.T) {
+	dir := t.TempDir()
+	fm, err := kfile.NewFileMgr(dir, 1024)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	bm := buffer.NewBufferMgr(fm, 32, buffer.InitLRU(32, fm))
+	lm, err := log.NewLogMgr(fm, bm, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to create LogMgr: %v", err)
+	}
+
+	// Ten two-key transactions in batches of four; the third one fails, so
+	// the last one is still waiting for its batch to fill at the crash.
+	errFail := errors.New("failed on purpose")
+	batch := NewBatch(NewTxMgr(fm, lm, bm), 4)
+	for i := 0; i < 10; i++ {
+		err := batch.Run(func(tx *Mgr) error {
+			if _, err := tx.Insert("batch.db", []byte(fmt.Sprintf("t%02d-a", i)), i, true); err != nil {
+				return err
+			}
+			if i == 2 {
+				return errFail
+			}
+			_, err := tx.Insert("batch.db", []byte(fmt.Sprintf("t%02d-b", i)), i, true)
+			return err
+		})
+		if i == 2 {
+			if !errors.Is(err, errFail) {
+				t.Fatalf("Expected transaction 2 to fail, got %v", err)
+			}
+		} else if err != nil {
+			t.Fatalf("Transaction %d failed: %v", i, err)
+		}
+	}
+
+	// Crash: abandon the managers without flushing and reopen the directory.
+	fm2, err := kfile.NewFileMgr(dir, 1024)
+	if err != nil {
+		t.Fatalf("Failed to reopen FileMgr: %v", err)
+	}
+	defer fm2.Close()
+	bm2 := buffer.NewBufferMgr(fm2, 32, buffer.InitLRU(32, fm2))
+	lm2, err := log.NewLogMgr(fm2, bm2, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to reopen LogMgr: %v", err)
+	}
+	txm := NewTxMgr(fm2, lm2, bm2)
+	tx := txm.NewTransaction()
+	if err := tx.Recover(); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		var present []bool
+		for _, suffix := range []string{"a", "b"} {
+			_, err := tx.Get("batch.db", []byte(fmt.Sprintf("t%02d-%s", i, suffix)))
+			if err != nil && !errors.Is(err, kfile.ErrKeyNotFound) {
+				t.Fatalf("Get failed: %v", err)
+			}
+			present = append(present, err == nil)
+		}
+		want := i != 2 && i < 9
+		if present[0] != want || present[1] != want {
+			t.Errorf("Transaction %d: expected both keys present=%v, got %v", i, want, present)
+		}
+	}
+}
+
+func TestBatchRecoversAfterCrashWithSmallPool(t *testing.T) {
+	dir := t.TempDir()
+	fm, err := kfile.NewFileMgr(dir, 1024)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	// Three frames: the log page and two data pages, so the third file a
+	// batch touches evicts a dirty page of an earlier transaction.
+	bm := buffer.NewBufferMgr(fm, 3, buffer.InitLRU(3, fm))
+	lm, err := log.NewLogMgr(fm, bm, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to create LogMgr: %v", err)
+	}
+
+	// Nothing is flushed by the batch itself: the first transaction's page of
+	// a.db is evicted by the second one, and the crash follows.
+	txFiles := [][]string{{"a.db", "b.db"}, {"c.db"}}
+	batch := NewBatch(NewTxMgr(fm, lm, bm), 8)
+	for i, files := range txFiles {
+		err := batch.Run(func(tx *Mgr) error {
+			for _, file := range files {
+				if _, err := tx.Insert(file, []byte(fmt.Sprintf("t%d", i)), i, true); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Transaction %d failed: %v", i, err)
+		}
+	}
+	if bm.Stats().Evictions == 0 {
+		t.Fatal("Expected the batch to evict a dirty page")
+	}
+
+	fm2, err := kfile.NewFileMgr(dir, 1024)
+	if err != nil {
+		t.Fatalf("Failed to reopen FileMgr: %v", err)
+	}
+	defer fm2.Close()
+	bm2 := buffer.NewBufferMgr(fm2, 3, buffer.InitLRU(3, fm2))
+	lm2, err := log.NewLogMgr(fm2, bm2, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to reopen LogMgr: %v", err)
+	}
+	tx := NewTxMgr(fm2, lm2, bm2).NewTransaction()
+	tx.EnableRedo()
+	if err := tx.Recover(); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+
+	for i, files := range txFiles {
+		var present []bool
+		for _, file := range files {
+			_, err := tx.Get(file, []byte(fmt.Sprintf("t%d", i)))
+			if err != nil && !errors.Is(err, kfile.ErrKeyNotFound) {
+				t.Fatalf("Get failed: %v", err)
+			}
+			present = append(present, err == nil)
+		}
+		if slices.Contains(present, true) && slices.Contains(present, false) {
+			t.Errorf("Transaction %d: recovered only part of it: %v", i, present)
+		}
+	}
+}
+
+func TestLastLSN(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 512)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	policy := buffer.InitLRU(8, fm)
+	bm := buffer.NewBufferMgr(fm, 8, policy)
+	lm, err := log.NewLogMgr(fm, bm, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to create LogMgr: %v", err)
+	}
+
+	txm := NewTxMgr(fm, lm, bm)
+	tx := txm.NewTransaction()
+	if lsn := tx.LastLSN(); lsn != -1 {
+		t.Errorf("Expected LastLSN -1 before any change, got %d", lsn)
+	}
+	blk, err := tx.Insert("lsn.db", []byte("alpha"), "one", true)
+	if err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	first := tx.LastLSN()
+	if first <= 0 {
+		t.Fatalf("Expected a positive LSN after an insert, got %d", first)
+	}
+	if err := tx.DeleteCell(blk, []byte("alpha"), true); err != nil {
+		t.Fatalf("DeleteCell failed: %v", err)
+	}
+	second := tx.LastLSN()
+	if second <= first {
+		t.Errorf("Expected LastLSN to increase past %d, got %d", first, second)
+	}
+
+	// Waiting on LastLSN makes the delete durable: it is the newest record.
+	if err := lm.FlushLSN(second); err != nil {
+		t.Fatalf("FlushLSN failed: %v", err)
+	}
+	if saved := lm.SavedLSN(); saved != second {
+		t.Errorf("Expected the log to be saved up to %d, got %d", second, saved)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+}
+
+func TestRollbackRestoresDeletedCellsExactly(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 512)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	policy := buffer.InitLRU(8, fm)
+	bm := buffer.NewBufferMgr(fm, 8, policy)
+	lm, err := log.NewLogMgr(fm, bm, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to create LogMgr: %v", err)
+	}
+
+	// A key cell pointing at a child page and a cell stamped a while ago.
+	stamped := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	page := kfile.NewSlottedPage(fm.BlockSize())
+	if err := page.InsertCell(kfile.NewKeyCell([]byte("child"), 42)); err != nil {
+		t.Fatalf("InsertCell failed: %v", err)
+	}
+	page.EnableTimestamps(func() time.Time { return stamped })
+	kv := kfile.NewKVCell([]byte("row"))
+	if err := kv.SetValue("value"); err != nil {
+		t.Fatalf("SetValue failed: %v", err)
+	}
+	if err := page.InsertCell(kv); err != nil {
+		t.Fatalf("InsertCell failed: %v", err)
+	}
+	blk := kfile.NewBlockId("cells.db", 0)
+	if err := fm.Write(blk, page); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	txm := NewTxMgr(fm, lm, bm)
+	tx := txm.NewTransaction()
+	for _, key := range []string{"child", "row"} {
+		if err := tx.DeleteCell(*blk, []byte(key), true); err != nil {
+			t.Fatalf("DeleteCell of %s failed: %v", key, err)
+		}
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+
+	check := txm.NewTransaction()
+	child, err := check.FindCell(*blk, []byte("child"))
+	if err != nil {
+		t.Fatalf("Expected the key cell back after rollback: %v", err)
+	}
+	if child.GetType() != kfile.CellTypeKey || child.GetPageId() != 42 {
+		t.Errorf("Expected a key cell pointing at page 42, got type %d page %d", child.GetType(), child.GetPageId())
+	}
+	row, err := check.FindCell(*blk, []byte("row"))
+	if err != nil {
+		t.Fatalf("Expected the stamped cell back after rollback: %v", err)
+	}
+	if !row.HasTimestamps() || !row.CreatedAt().Equal(stamped) || !row.ModifiedAt().Equal(stamped) {
+		t.Errorf("Expected the cell to keep its timestamps, got %v/%v", row.CreatedAt(), row.ModifiedAt())
+	}
+	if val, err := row.GetValue(); err != nil || val != "value" {
+		t.Errorf("Expected value %q, got %v (err %v)", "value", val, err)
+	}
+	if err := check.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+}
+
+func TestCellTimestampsSurviveRedo(t *testing.T) {
+	dir := t.TempDir()
+	fm, err := kfile.NewFileMgr(dir, 512)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	bm := buffer.NewBufferMgr(fm, 8, buffer.InitLRU(8, fm))
+	stamped := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	bm.EnableCellTimestamps("stamped.db", func() time.Time { return stamped })
+	lm, err := log.NewLogMgr(fm, bm, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to create LogMgr: %v", err)
+	}
+
+	tx := NewTxMgr(fm, lm, bm).NewTransaction()
+	blk, err := tx.Insert("stamped.db", []byte("row"), "value", true)
+	if err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	// Lose the committed page, leaving only the log to bring the cell back.
+	if err := fm.Write(&blk, kfile.NewSlottedPage(fm.BlockSize())); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	fm2, err := kfile.NewFileMgr(dir, 512)
+	if err != nil {
+		t.Fatalf("Failed to reopen FileMgr: %v", err)
+	}
+	defer fm2.Close()
+	bm2 := buffer.NewBufferMgr(fm2, 8, buffer.InitLRU(8, fm2))
+	lm2, err := log.NewLogMgr(fm2, bm2, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to reopen LogMgr: %v", err)
+	}
+	recoveryTx := NewTxMgr(fm2, lm2, bm2).NewTransaction()
+	recoveryTx.EnableRedo()
+	if err := recoveryTx.Recover(); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+	row, err := recoveryTx.FindCell(blk, []byte("row"))
+	if err != nil {
+		t.Fatalf("Expected redo to bring the cell back: %v", err)
+	}
+	if !row.HasTimestamps() || !row.CreatedAt().Equal(stamped) || !row.ModifiedAt().Equal(stamped) {
+		t.Errorf("Expected the cell to keep its timestamps, got %v/%v", row.CreatedAt(), row.ModifiedAt())
+	}
+}
+
+func TestOverflowValuesAreLogged(t *testing.T) {
+	dir := t.TempDir()
+	fm, err := kfile.NewFileMgr(dir, 512)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	bm := buffer.NewBufferMgr(fm, 8, buffer.InitLRU(8, fm))
+	lm, err := log.NewLogMgr(fm, bm, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to create LogMgr: %v", err)
+	}
+	txm := NewTxMgr(fm, lm, bm)
+	big := bytes.Repeat([]byte("0123456789abcdef"), 2*512/16)
+
+	// An uncommitted value reads back whole from the pool, and rolls back.
+	tx := txm.NewTransaction()
+	if err := tx.Put("big.db", []byte("row"), big); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if val, err := tx.Get("big.db", []byte("row")); err != nil || !bytes.Equal(val.([]byte), big) {
+		t.Fatalf("Expected the value to read back whole before commit (err %v)", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	tx = txm.NewTransaction()
+	if _, err := tx.Get("big.db", []byte("row")); !errors.Is(err, kfile.ErrKeyNotFound) {
+		t.Fatalf("Expected the rolled back value to be gone, got %v", err)
+	}
+	if err := tx.Put("big.db", []byte("row"), big); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	overflow := kfile.OverflowFile("big.db")
+	n, err := fm.Length(overflow)
+	if err != nil || n < 2 {
+		t.Fatalf("Expected the value to spill into overflow blocks, %s has %d (%v)", overflow, n, err)
+	}
+
+	// Lose every page, leaving only the log to bring the value back.
+	for _, file := range []string{"big.db", overflow} {
+		n, err := fm.Length(file)
+		if err != nil {
+			t.Fatalf("Length failed: %v", err)
+		}
+		for i := int32(0); i < n; i++ {
+			if err := fm.Write(kfile.NewBlockId(file, i), kfile.NewSlottedPage(fm.BlockSize())); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+	}
+	fm2, err := kfile.NewFileMgr(dir, 512)
+	if err != nil {
+		t.Fatalf("Failed to reopen FileMgr: %v", err)
+	}
+	defer fm2.Close()
+	bm2 := buffer.NewBufferMgr(fm2, 8, buffer.InitLRU(8, fm2))
+	lm2, err := log.NewLogMgr(fm2, bm2, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to reopen LogMgr: %v", err)
+	}
+	recoveryTx := NewTxMgr(fm2, lm2, bm2).NewTransaction()
+	recoveryTx.EnableRedo()
+	if err := recoveryTx.Recover(); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+	if val, err := recoveryTx.Get("big.db", []byte("row")); err != nil || !bytes.Equal(val.([]byte), big) {
+		t.Errorf("Expected redo to bring the value back whole (err %v)", err)
+	}
+}
+
+func TestSecondaryIndexSharedAcrossTransactions(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 4096)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	policy := buffer.InitLRU(16, fm)
+	bm := buffer.NewBufferMgr(fm, 16, policy)
+	lm, err := log.NewLogMgr(fm, bm, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to create LogMgr: %v", err)
+	}
+
+	txm := NewTxMgr(fm, lm, bm)
+	byValue := func(val any) ([]byte, error) {
+		return []byte(fmt.Sprint(val)), nil
+	}
+	if err := txm.RegisterIndex("base.db", "base_value.idx", byValue); err != nil {
+		t.Fatalf("RegisterIndex failed: %v", err)
+	}
+
+	// Every transaction of the TxMgr maintains the index.
+	for _, pk := range []string{"k1", "k2"} {
+		tx := txm.NewTransaction()
+		if _, err := tx.Insert("base.db", []byte(pk), "red", true); err != nil {
+			t.Fatalf("Insert of %s failed: %v", pk, err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+	}
+	tx := txm.NewTransaction()
+	pks, err := tx.LookupIndex("base_value.idx", []byte("red"))
+	if err != nil {
+		t.Fatalf("LookupIndex failed: %v", err)
+	}
+	if len(pks) != 2 || string(pks[0]) != "k1" || string(pks[1]) != "k2" {
+		t.Errorf("Expected [k1 k2] for red, got %q", pks)
+	}
+
+	// An index entry that does not hold a primary key is reported, not a panic.
+	if _, err := tx.Insert("base_value.idx", indexEntryKey([]byte("blue"), []byte("k3")), 7, false); err != nil {
+		t.Fatalf("Insert of a bad index entry failed: %v", err)
+	}
+	if _, err := tx.LookupIndex("base_value.idx", []byte("blue")); err == nil {
+		t.Errorf("Expected LookupIndex to fail on an entry holding an int")
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+}
+
+func TestTxMgrNumbersCarryOnAcrossRestarts(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *TxMgr {
+		t.Helper()
+		fm, err := kfile.NewFileMgr(dir, 1024)
+		if err != nil {
+			t.Fatalf("Failed to open FileMgr: %v", err)
+		}
+		t.Cleanup(func() { fm.Close() })
+		bm := buffer.NewBufferMgr(fm, 8, buffer.InitLRU(8, fm))
+		lm, err := log.NewLogMgr(fm, bm, "log_test.db")
+		if err != nil {
+			t.Fatalf("Failed to open LogMgr: %v", err)
+		}
+		return NewTxMgr(fm, lm, bm)
+	}
+
+	txm := open()
+	var last int64
+	for i := 0; i < 3; i++ {
+		tx := txm.NewTransaction()
+		if _, err := tx.Insert("data.db", []byte(fmt.Sprintf("k%d", i)), i, true); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+		last = tx.GetTxNum()
+	}
+
+	// After a restart, and again after the checkpoint Recover writes, new
+	// transactions are numbered after every one already in the log.
+	for restart := 0; restart < 2; restart++ {
+		tx := open().NewTransaction()
+		if tx.GetTxNum() <= last {
+			t.Fatalf("Restart %d: expected a number above %d, got %d", restart, last, tx.GetTxNum())
+		}
+		if err := tx.Recover(); err != nil {
+			t.Fatalf("Recover failed: %v", err)
+		}
+		last = tx.GetTxNum()
+	}
+}
+
+func TestScanLocksOutPhantomInserts(t *testing.T) {
+	fm, err := kfile.NewFileMgr(t.TempDir(), 512)
+	if err != nil {
+		t.Fatalf("Failed to create FileMgr: %v", err)
+	}
+	defer fm.Close()
+	policy := buffer.InitLRU(16, fm)
+	bm := buffer.NewBufferMgr(fm, 16, policy)
+	lm, err := log.NewLogMgr(fm, bm, "log_test.db")
+	if err != nil {
+		t.Fatalf("Failed to create LogMgr: %v", err)
+	}
+
+	txm := NewTxMgr(fm, lm, bm)
+	setup := txm.NewTransaction()
+	for _, key := range []string{"a", "b", "y"} {
+		if _, err := setup.Insert("rows.db", []byte(key), "row", true); err != nil {
+			t.Fatalf("Insert of %s failed: %v", key, err)
+		}
+	}
+	if err := setup.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	tx1, tx2 := txm.NewTransaction(), txm.NewTransaction()
+	waiting := make(chan struct{}, 1)
+	txm.locks.SetWaitHook(func(owner uint64) {
+		if owner == tx2.cm.Owner() {
+			select {
+			case waiting <- struct{}{}:
+			default:
+			}
+		}
+	})
+	scanKeys := func() []string {
+		t.Helper()
+		cells, err := tx1.Scan("rows.db", []byte("a"), []byte("m"))
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		var keys []string
+		for _, c := range cells {
+			keys = append(keys, string(c.GetKey()))
+		}
+		return keys
+	}
+	first := scanKeys()
+	if !slices.Equal(first, []string{"a", "b"}) {
+		t.Fatalf("Expected [a b], got %q", first)
+	}
+
+	// tx2 inserts c into a block of its own, which no block lock of tx1
+	// covers; only the range lock of the scan holds it up.
+	blk, err := fm.Append("rows.db")
+	if err != nil {
+		t.Fatalf("Failed to append block: %v", err)
+	}
+	inserted := make(chan error, 1)
+	go func() { inserted <- tx2.InsertCell(*blk, []byte("c"), "row", true) }()
+	select {
+	case <-waiting:
+	case err := <-inserted:
+		t.Fatalf("Expected tx2's insert into the scanned range to wait, got %v", err)
+	}
+
+	if second := scanKeys(); !slices.Equal(first, second) {
+		t.Errorf("Scan changed from %q to %q within tx1", first, second)
+	}
+	if err := tx1.Commit(); err != nil {
+		t.Fatalf("tx1 commit failed: %v", err)
+	}
+	if err := <-inserted; err != nil {
+		t.Fatalf("tx2's insert failed after tx1 committed: %v", err)
+	}
+	if err := tx2.Commit(); err != nil {
+		t.Fatalf("tx2 commit failed: %v", err)
+	}
+
+	tx3 := txm.NewTransaction()
+	defer tx3.Commit()
+	cells, err := tx3.Scan("rows.db", nil, nil)
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if len(cells) != 4 || string(cells[2].GetKey()) != "c" {
+		t.Errorf("Expected c among the 4 committed rows in key order, got %d cells", len(cells))
+	}
+}
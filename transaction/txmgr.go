@@ -0,0 +1,103 @@
+package transaction
+
+import (
+	"sync"
+	"sync/atomic"
+	"ultraSQL/buffer"
+	"ultraSQL/concurrency"
+	"ultraSQL/kfile"
+	"ultraSQL/log"
+	"ultraSQL/log_record"
+	"ultraSQL/recovery"
+)
+
+// TxMgr holds what the transactions of one database share. Their locks go
+// into a single lock table, so that two transactions touching the same
+// block conflict, and each gets its own number, under which the log tells
+// its records apart from the others'. Create one TxMgr per database, next
+// to its FileMgr, LogMgr and BufferMgr, and start every transaction with
+// its NewTransaction.
+//
+// Numbers carry on from the highest one in the log, so no two transactions
+// of the database share one across restarts. After a restart, run Recover
+// in the first transaction, before any other starts.
+type TxMgr struct {
+	fm        *kfile.FileMgr
+	lm        *log.LogMgr
+	bm        *buffer.BufferMgr
+	locks     *concurrency.LockTable
+	nextTxNum atomic.Int64
+	indexMu   sync.RWMutex
+	indexes   map[string][]secondaryIndex // by base file, see RegisterIndex
+	hintMu    sync.Mutex
+	space     map[string]freeSpace        // by file, see noteSpace
+	keys      map[string]map[string]int32 // block by key by file, see noteKey
+}
+
+// NewTxMgr returns a TxMgr for the database behind fm, lm and bm. It reads
+// the log back to its last checkpoint to find where numbering left off.
+func NewTxMgr(fm *kfile.FileMgr, lm *log.LogMgr, bm *buffer.BufferMgr) *TxMgr {
+	m := &TxMgr{
+		fm:      fm,
+		lm:      lm,
+		bm:      bm,
+		locks:   concurrency.NewLockTable(),
+		indexes: make(map[string][]secondaryIndex),
+		space:   make(map[string]freeSpace),
+		keys:    make(map[string]map[string]int32),
+	}
+	last, err := lastTxNum(lm)
+	if err != nil {
+		bm.Logger().Warn("failed to read transaction numbers from the log", "err", err)
+	}
+	m.nextTxNum.Store(last)
+	return m
+}
+
+// lastTxNum returns the highest transaction number in the log, or 0 if it
+// has none. Every transaction that wrote before a checkpoint had started
+// before it, and so has a lower number than those that wrote after, so the
+// scan stops at the newest checkpoint that follows some numbered record.
+// Records that fail to parse are left for recovery to deal with.
+func lastTxNum(lm *log.LogMgr) (int64, error) {
+	iter, err := lm.Iterator()
+	if err != nil {
+		return 0, err
+	}
+	if closer, ok := iter.(interface{ Close() }); ok {
+		defer closer.Close()
+	}
+	var last int64
+	for iter.HasNext() {
+		data, err := iter.Next()
+		if err != nil {
+			return last, err
+		}
+		rec, err := log_record.ParseLogRecord(data)
+		if err != nil {
+			continue
+		}
+		if rec.Op() == log_record.CHECKPOINT && last > 0 {
+			break
+		}
+		last = max(last, rec.TxNumber())
+	}
+	return last, nil
+}
+
+// NewTransaction starts a transaction with the next number that takes its
+// locks in m's lock table.
+func (m *TxMgr) NewTransaction() *Mgr {
+	tx := &Mgr{
+		txm:       m,
+		fm:        m.fm,
+		bm:        m.bm,
+		txNum:     m.nextTxNum.Add(1),
+		lastLSN:   -1,
+		isolation: Serializable,
+	}
+	tx.rm = recovery.NewRecoveryMgr(tx, tx.txNum, m.lm, m.bm)
+	tx.cm = concurrency.NewConcurrencyMgrWithTable(m.locks)
+	tx.bufferList = NewBufferList(m.bm)
+	return tx
+}
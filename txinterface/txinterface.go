@@ -7,4 +7,6 @@ type TxInterface interface {
 	Pin(blk kfile.BlockId) error
 	UnPin(blk kfile.BlockId) error
 	InsertCell(blk kfile.BlockId, key []byte, val any, okToLog bool) error
+	DeleteCell(blk kfile.BlockId, key []byte, okToLog bool) error
+	RestoreCell(blk kfile.BlockId, cell *kfile.Cell) error
 }
@@ -1,6 +1,9 @@
 package utils
 
+// Iterator walks a sequence of values. Next returns an error when the next
+// value cannot be read, as when a log block fails to pin, so callers must
+// check it as well as HasNext.
 type Iterator[T any] interface {
 	HasNext() bool
-	Next() ([]byte, error)
+	Next() (T, error)
 }
@@ -67,13 +67,32 @@ func (it *LogIterator) Next() ([]byte, error) {
 	return rec, nil
 }
 
+// Position returns the block and slot of the record most recently returned
+// by Next.
+func (it *LogIterator) Position() (kfile.BlockId, int) {
+	return *it.blk, it.currentPos + 1
+}
+
+// Remove deletes the record most recently returned by Next from the log and
+// writes its block back to disk. Later calls to Next are unaffected.
+func (it *LogIterator) Remove() error {
+	slot := it.currentPos + 1
+	if err := it.buff.Contents().DeleteCell(slot); err != nil {
+		return fmt.Errorf("failed to remove log record at slot %d of block %v: %w", slot, it.blk, err)
+	}
+	it.buff.MarkModified(-1, -1)
+	if err := it.buff.Flush(); err != nil {
+		return fmt.Errorf("failed to write block %v after removing a record: %w", it.blk, err)
+	}
+	return nil
+}
+
 // moveToBlock pins the new block and updates the current slot to the last slot in that block.
 func (it *LogIterator) moveToBlock(blk *kfile.BlockId) error {
 	// If we already have a buffer pinned, unpin it first
 	if it.buff != nil {
-		if err := it.buff.Unpin(); err != nil {
-			return fmt.Errorf("moveToBlock: unpin error: %w", err)
-		}
+		// Through the BufferMgr, so that the frame counts as available again.
+		it.bm.Unpin(it.buff)
 	}
 	b, err := it.bm.Pin(blk)
 	if err != nil {
@@ -90,10 +109,7 @@ func (it *LogIterator) moveToBlock(blk *kfile.BlockId) error {
 // Close unpins the current buffer (if any).
 func (it *LogIterator) Close() {
 	if it.buff != nil {
-		if err := it.buff.Unpin(); err != nil {
-			// Normally you'd log or handle the error, but you might not want to panic.
-			fmt.Printf("warning: error unpinning buffer in Close: %v\n", err)
-		}
+		it.bm.Unpin(it.buff)
 		it.buff = nil
 	}
 }
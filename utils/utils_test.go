@@ -123,3 +123,11 @@ func TestMoveToBlock(t *testing.T) {
 		t.Errorf("Expected currentPos to be 0, got %d", iter.currentPos)
 	}
 }
+
+// Both log iterators are returned by LogMgr as an Iterator[[]byte], and a
+// slotted page's cells are walked as an Iterator[*kfile.Cell].
+var (
+	_ Iterator[[]byte]      = (*LogIterator)(nil)
+	_ Iterator[[]byte]      = (*ForwardLogIterator)(nil)
+	_ Iterator[*kfile.Cell] = (*kfile.CellIterator)(nil)
+)